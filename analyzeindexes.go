@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/httpclient"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/plugin"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// analyzeIndexes prints the query service's index advice for each of the plugin's queries, along with the indexes on
+// the span keyspace that none of them use, and then returns. Nothing is created or dropped.
+func analyzeIndexes(opts options.Options, args []string, store plugin.Store, conn string, client httpclient.Client, logger hclog.Logger) error {
+	flags := flag.NewFlagSet("analyze-indexes", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	err = plugin.VerifyCollections(opts, client, conn, store, logger)
+	if err != nil {
+		return err
+	}
+
+	err = plugin.OpenBucket(store, opts.BucketName, logger)
+	if err != nil {
+		return err
+	}
+
+	report, err := plugin.AdviseIndexes(store, opts.StorageModel == "trace")
+	if err != nil {
+		return err
+	}
+
+	for _, advice := range report.Advice {
+		fmt.Printf("%s\n", advice.Query)
+		printStatements("uses", advice.CurrentIndexes)
+		printStatements("recommended", advice.RecommendedIndexes)
+		printStatements("covering", advice.CoveringIndexes)
+		if len(advice.RecommendedIndexes) == 0 && len(advice.CoveringIndexes) == 0 {
+			fmt.Printf("  no recommendations\n")
+		}
+		fmt.Println()
+	}
+
+	if len(report.UnusedIndexes) == 0 {
+		fmt.Printf("every index on %s is used by the plugin's queries\n", store.Keyspace())
+		return nil
+	}
+	fmt.Printf("indexes on %s unused by the plugin's queries\n", store.Keyspace())
+	for _, name := range report.UnusedIndexes {
+		fmt.Printf("  %s\n", name)
+	}
+
+	return nil
+}
+
+func printStatements(label string, statements []string) {
+	for _, statement := range statements {
+		fmt.Printf("  %s: %s\n", label, statement)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/httpclient"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/plugin"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/traceio"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/pkg/errors"
+)
+
+// exportTraces writes the traces matching a query, or a list of trace IDs, to a file with one trace per line.
+func exportTraces(opts options.Options, args []string, store plugin.Store, conn string, client httpclient.Client, logger hclog.Logger) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", traceio.JaegerFormat, "The format of the file, jaeger or otlp")
+	output := flags.String("output", "-", "A path to the file to write, - writes to stdout")
+	tenant := flags.String("tenant", "", "The tenant whose traces are exported, when tenancy is enabled")
+	traceIDs := flags.String("trace-ids", "", "A comma separated list of the traces to export, instead of a query")
+	service := flags.String("service", "", "The service whose traces are exported")
+	operation := flags.String("operation", "", "The operation whose traces are exported")
+	start := flags.String("start", "", "Exports traces that started after this time, in RFC3339 format, defaults to a day before end")
+	end := flags.String("end", "", "Exports traces that started before this time, in RFC3339 format, defaults to now")
+	limit := flags.Int("limit", 20, "The most traces exported by a query")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:   *service,
+		OperationName: *operation,
+		StartTimeMax:  time.Now(),
+		NumTraces:     *limit,
+	}
+	if *end != "" {
+		query.StartTimeMax, err = time.Parse(time.RFC3339, *end)
+		if err != nil {
+			return errors.Wrap(err, "invalid end")
+		}
+	}
+	query.StartTimeMin = query.StartTimeMax.Add(-24 * time.Hour)
+	if *start != "" {
+		query.StartTimeMin, err = time.Parse(time.RFC3339, *start)
+		if err != nil {
+			return errors.Wrap(err, "invalid start")
+		}
+	}
+
+	store, err = openStore(opts, store, *tenant, conn, client, logger)
+	if err != nil {
+		return err
+	}
+
+	var traces []*model.Trace
+	reader := store.SpanReader()
+	if *traceIDs != "" {
+		for _, id := range strings.Split(*traceIDs, ",") {
+			traceID, err := model.TraceIDFromString(strings.TrimSpace(id))
+			if err != nil {
+				return errors.Wrapf(err, "invalid trace ID %q", id)
+			}
+			trace, err := reader.GetTrace(context.Background(), traceID)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read trace %s", id)
+			}
+			traces = append(traces, trace)
+		}
+	} else {
+		traces, err = reader.FindTraces(context.Background(), query)
+		if err != nil {
+			return errors.Wrap(err, "failed to find traces")
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	writer, err := traceio.NewWriter(*format, w)
+	if err != nil {
+		return err
+	}
+	for _, trace := range traces {
+		err := writer.Write(trace)
+		if err != nil {
+			return errors.Wrap(err, "failed to write trace")
+		}
+	}
+	logger.Info("exported traces", "traces", len(traces))
+
+	return nil
+}
+
+// importTraces writes the traces in a file, with one trace per line, to the store.
+func importTraces(opts options.Options, args []string, store plugin.Store, conn string, client httpclient.Client, logger hclog.Logger) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", traceio.JaegerFormat, "The format of the file, jaeger or otlp")
+	input := flags.String("input", "-", "A path to the file to read, - reads from stdin")
+	tenant := flags.String("tenant", "", "The tenant that the traces are imported for, when tenancy is enabled")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	reader, err := traceio.NewReader(*format, r)
+	if err != nil {
+		return err
+	}
+
+	store, err = openStore(opts, store, *tenant, conn, client, logger)
+	if err != nil {
+		return err
+	}
+
+	// Streams report every span's result when they're closed, so spans aren't lost in the async write queue.
+	stream := store.NewSpanStream()
+	var traces, spans int
+	for {
+		trace, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			stream.Close()
+			return err
+		}
+
+		for _, span := range trace.Spans {
+			err := stream.WriteSpan(span)
+			if err != nil {
+				stream.Close()
+				return errors.Wrapf(err, "failed to write span %s", span.SpanID)
+			}
+			spans++
+		}
+		traces++
+	}
+
+	err = stream.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to write spans")
+	}
+	logger.Info("imported traces", "traces", traces, "spans", spans)
+
+	return nil
+}
+
+// openStore connects the store and loads its partitions, returning the tenant's store when tenancy is enabled.
+func openStore(opts options.Options, store plugin.Store, tenant, conn string, client httpclient.Client, logger hclog.Logger) (plugin.Store, error) {
+	if opts.TenancyEnabled && tenant == "" {
+		return nil, errors.New("a tenant must be given when tenancy is enabled")
+	}
+
+	err := plugin.VerifyCollections(opts, client, conn, store, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	err = plugin.OpenBucket(store, opts.BucketName, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Partitioned spans are only read from, and written to, the partitions that the store knows about.
+	err = store.ManagePartitions()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.TenancyEnabled {
+		return store.TenantStore(tenant)
+	}
+
+	return store, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/httpclient"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/plugin"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/setup"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// initSchema provisions the buckets, scopes, collections and indexes that the plugin needs and then returns, so
+// that schema can be set up separately from running the plugin.
+func initSchema(opts options.Options, args []string, store plugin.Store, conn string, client httpclient.Client, logger hclog.Logger) error {
+	flags := flag.NewFlagSet("init-schema", flag.ContinueOnError)
+	schemaPath := flags.String("schema", "", "A path to a schema definition file, defaults to the schema implied by the plugin's configuration")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	// Buckets, scopes and collections are created through the management API, which Capella doesn't expose.
+	if opts.Capella {
+		return errors.New("init-schema is not supported with capella, create the bucket, scope and collections in the Capella UI and set autoCreateIndexes")
+	}
+
+	schema := setup.SchemaFromOptions(opts)
+	if *schemaPath != "" {
+		schema, err = setup.LoadSchema(*schemaPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = setup.ApplySchema(schema, opts, conn, client, logger)
+	if err != nil {
+		return err
+	}
+
+	err = plugin.VerifyCollections(opts, client, conn, store, logger)
+	if err != nil {
+		return err
+	}
+
+	err = plugin.OpenBucket(store, opts.BucketName, logger)
+	if err != nil {
+		return err
+	}
+
+	err = plugin.VerifyServices(opts, client, conn, store, logger)
+	if err != nil {
+		return err
+	}
+
+	return plugin.CreateIndexes(store, logger)
+}
+
+// initFTSIndex creates a search index over span documents, so that spans can be searched with the search service
+// without hand writing its index definition.
+func initFTSIndex(opts options.Options, args []string, conn string, client httpclient.Client, logger hclog.Logger) error {
+	flags := flag.NewFlagSet("init-fts-index", flag.ContinueOnError)
+	name := flags.String("index-name", opts.FTSIndexName, "The name of the search index, defaults to the fts.indexName option")
+	partitions := flags.Int("partitions", 1, "The number of partitions the index is split into")
+	replicas := flags.Int("replicas", 0, "The number of replicas of each index partition")
+	replace := flags.Bool("replace", false, "Deletes and recreates the index if it already exists")
+	tenant := flags.String("tenant", "", "The tenant whose spans are indexed, when tenancy is enabled")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if opts.Capella {
+		return errors.New("init-fts-index is not supported with capella, create the search index in the Capella UI")
+	}
+	// A search index covers a fixed set of collections, so it can't follow partitions as they're created and dropped.
+	if opts.PartitioningEnabled {
+		return errors.New("search indexes are not supported with partitioning")
+	}
+
+	index := setup.FTSIndexFromOptions(opts)
+	index.Name = *name
+	index.Partitions = *partitions
+	index.Replicas = *replicas
+	if opts.TenancyEnabled {
+		if *tenant == "" {
+			return errors.New("a tenant must be given when tenancy is enabled")
+		}
+		index.Scope = *tenant
+		index.Name = *name + "-" + *tenant
+	}
+
+	return setup.CreateFTSIndex(index, *replace, opts, conn, client, logger)
+}
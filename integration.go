@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/httpclient"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/plugin"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/pkg/errors"
+)
+
+// integrationSuite checks the readers against traces modelled on those of Jaeger's storage integration tests, so that
+// searches keep behaving as they do with Jaeger's reference backends as features are added. The traces are written
+// under service names unique to the run so that they can't be confused with other spans in the cluster.
+type integrationSuite struct {
+	store      plugin.Store
+	timeout    time.Duration
+	traceModel bool
+
+	frontend string
+	backend  string
+	start    time.Time
+	// traces are the written traces, named after what they're searched for by.
+	traces map[string]*model.Trace
+
+	passed int
+	failed int
+}
+
+// integrationTest writes the suite's traces to a live cluster, runs its checks and then purges the traces again,
+// returning an error if any check failed.
+func integrationTest(opts options.Options, args []string, store plugin.Store, conn string, client httpclient.Client, logger hclog.Logger) error {
+	flags := flag.NewFlagSet("integration-test", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", 30*time.Second, "How long each check is retried whilst the indexes catch up with the written spans")
+	tenant := flags.String("tenant", "", "The tenant that the traces are written for, when tenancy is enabled")
+	keep := flags.Bool("keep", false, "Leaves the traces in place rather than purging them")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	err = plugin.VerifyServices(opts, client, conn, store, logger)
+	if err != nil {
+		return err
+	}
+	store, err = openStore(opts, store, *tenant, conn, client, logger)
+	if err != nil {
+		return err
+	}
+
+	run := fmt.Sprintf("integration-%x", rand.New(rand.NewSource(time.Now().UnixNano())).Uint32())
+	suite := &integrationSuite{
+		store:      store,
+		timeout:    *timeout,
+		traceModel: opts.StorageModel == "trace",
+		frontend:   run + "-frontend",
+		backend:    run + "-backend",
+		start:      time.Now().Add(-time.Minute).Truncate(time.Millisecond),
+	}
+	suite.createTraces()
+
+	err = suite.writeTraces()
+	if err == nil {
+		suite.run()
+	}
+	if !*keep {
+		suite.purge(logger)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d passed, %d failed\n", suite.passed, suite.failed)
+	if suite.failed > 0 {
+		return errors.Errorf("%d checks failed", suite.failed)
+	}
+
+	return nil
+}
+
+// createTraces creates a trace of a frontend span calling a backend span, a slow trace with an error and a trace whose
+// tags are only on its logs and process.
+func (s *integrationSuite) createTraces() {
+	random := rand.New(rand.NewSource(s.start.UnixNano()))
+	newTraceID := func() model.TraceID {
+		return model.NewTraceID(random.Uint64(), random.Uint64())
+	}
+	newSpan := func(traceID model.TraceID, service, operation string, offset, duration time.Duration, tags ...model.KeyValue) *model.Span {
+		return &model.Span{
+			TraceID:       traceID,
+			SpanID:        model.NewSpanID(random.Uint64()),
+			OperationName: operation,
+			StartTime:     s.start.Add(offset),
+			Duration:      duration,
+			Tags:          tags,
+			Process:       model.NewProcess(service, []model.KeyValue{model.String("hostname", "host1")}),
+		}
+	}
+
+	callID := newTraceID()
+	call := newSpan(callID, s.frontend, "GET /", 0, 100*time.Millisecond,
+		model.String("span.kind", "server"),
+		model.Int64("http.status_code", 200),
+	)
+	call.Logs = []model.Log{{
+		Timestamp: s.start.Add(10 * time.Millisecond),
+		Fields:    []model.KeyValue{model.String("event", "cache miss")},
+	}}
+	query := newSpan(callID, s.backend, "query", 20*time.Millisecond, 20*time.Millisecond, model.String("span.kind", "server"))
+	query.References = []model.SpanRef{model.NewChildOfRef(callID, call.SpanID)}
+
+	slowID := newTraceID()
+	slow := newSpan(slowID, s.frontend, "GET /", time.Second, 2*time.Second,
+		model.String("span.kind", "server"),
+		model.Bool("error", true),
+	)
+
+	checkoutID := newTraceID()
+	checkout := newSpan(checkoutID, s.frontend, "POST /checkout", 2*time.Second, 500*time.Millisecond)
+	checkout.Process.Tags = []model.KeyValue{model.String("hostname", "host2")}
+	checkout.Logs = []model.Log{{
+		Timestamp: s.start.Add(2100 * time.Millisecond),
+		Fields:    []model.KeyValue{model.String("customer", "alice")},
+	}}
+
+	s.traces = map[string]*model.Trace{
+		"call":     {Spans: []*model.Span{call, query}},
+		"slow":     {Spans: []*model.Span{slow}},
+		"checkout": {Spans: []*model.Span{checkout}},
+	}
+}
+
+// writeTraces writes the traces and waits for them to be written.
+func (s *integrationSuite) writeTraces() error {
+	stream := s.store.NewSpanStream()
+	for _, trace := range s.traces {
+		for _, span := range trace.Spans {
+			err := stream.WriteSpan(span)
+			if err != nil {
+				return errors.Wrap(err, "failed to write span")
+			}
+		}
+	}
+
+	return stream.Close()
+}
+
+func (s *integrationSuite) run() {
+	ctx := context.Background()
+	reader := s.store.SpanReader()
+
+	s.check("GetServices", func() error {
+		services, err := reader.GetServices(ctx)
+		if err != nil {
+			return err
+		}
+		return expectContains(services, s.frontend, s.backend)
+	})
+
+	s.check("GetOperations", func() error {
+		operations, err := reader.GetOperations(ctx, s.frontend)
+		if err != nil {
+			return err
+		}
+		return expectEqual(sorted(operations), []string{"GET /", "POST /checkout"})
+	})
+
+	for _, name := range []string{"call", "slow", "checkout"} {
+		expected := s.traces[name]
+		s.check("GetTrace/"+name, func() error {
+			trace, err := reader.GetTrace(ctx, expected.Spans[0].TraceID)
+			if err != nil {
+				return err
+			}
+			return expectEqual(describeTrace(trace), describeTrace(expected))
+		})
+	}
+
+	s.check("GetTrace/missing", func() error {
+		_, err := reader.GetTrace(ctx, model.NewTraceID(0, 1))
+		if err != spanstore.ErrTraceNotFound {
+			return errors.Errorf("expected %v, got %v", spanstore.ErrTraceNotFound, err)
+		}
+		return nil
+	})
+
+	queries := []struct {
+		name     string
+		query    spanstore.TraceQueryParameters
+		expected []string
+	}{
+		{"Service", spanstore.TraceQueryParameters{ServiceName: s.frontend}, []string{"call", "checkout", "slow"}},
+		{"ChildService", spanstore.TraceQueryParameters{ServiceName: s.backend}, []string{"call"}},
+		{"Operation", spanstore.TraceQueryParameters{ServiceName: s.frontend, OperationName: "GET /"}, []string{"call", "slow"}},
+		{"Tag", spanstore.TraceQueryParameters{ServiceName: s.frontend, Tags: map[string]string{"http.status_code": "200"}}, []string{"call"}},
+		{"BoolTag", spanstore.TraceQueryParameters{ServiceName: s.frontend, Tags: map[string]string{"error": "true"}}, []string{"slow"}},
+		{"LogTag", spanstore.TraceQueryParameters{ServiceName: s.frontend, Tags: map[string]string{"customer": "alice"}}, []string{"checkout"}},
+		{"ProcessTag", spanstore.TraceQueryParameters{ServiceName: s.frontend, Tags: map[string]string{"hostname": "host2"}}, []string{"checkout"}},
+		{"MinDuration", spanstore.TraceQueryParameters{ServiceName: s.frontend, DurationMin: time.Second}, []string{"slow"}},
+		{"MaxDuration", spanstore.TraceQueryParameters{ServiceName: s.frontend, DurationMax: 200 * time.Millisecond}, []string{"call"}},
+		{"DurationRange", spanstore.TraceQueryParameters{ServiceName: s.frontend, DurationMin: 200 * time.Millisecond, DurationMax: time.Second}, []string{"checkout"}},
+		{"TimeRange", spanstore.TraceQueryParameters{ServiceName: s.frontend, StartTimeMin: s.start.Add(500 * time.Millisecond), StartTimeMax: s.start.Add(1500 * time.Millisecond)}, []string{"slow"}},
+		{"NoMatch", spanstore.TraceQueryParameters{ServiceName: s.frontend, Tags: map[string]string{"http.status_code": "404"}}, nil},
+	}
+	for _, q := range queries {
+		query := q.query
+		if query.StartTimeMin.IsZero() {
+			query.StartTimeMin = s.start.Add(-time.Minute)
+			query.StartTimeMax = s.start.Add(10 * time.Minute)
+		}
+		query.NumTraces = 20
+		expected := q.expected
+		s.check("FindTraces/"+q.name, func() error {
+			traces, err := reader.FindTraces(ctx, &query)
+			if err != nil {
+				return err
+			}
+			return expectEqual(s.names(traces), expected)
+		})
+	}
+
+	s.check("FindTraces/Limit", func() error {
+		traces, err := reader.FindTraces(ctx, &spanstore.TraceQueryParameters{
+			ServiceName:  s.frontend,
+			StartTimeMin: s.start.Add(-time.Minute),
+			StartTimeMax: s.start.Add(10 * time.Minute),
+			NumTraces:    1,
+		})
+		if err != nil {
+			return err
+		}
+		if len(traces) != 1 {
+			return errors.Errorf("expected 1 trace, got %d", len(traces))
+		}
+		return nil
+	})
+
+	s.check("GetDependencies", func() error {
+		end := s.start.Add(10 * time.Minute)
+		key, err := plugin.AggregateDependencies(s.store, s.start.Add(-time.Minute), end, time.Hour, s.traceModel)
+		if err != nil {
+			return err
+		}
+		if key != "" {
+			// The dependency document covers every service in the cluster, so it mustn't outlive the check.
+			defer func() {
+				_ = s.store.Execute(fmt.Sprintf("DELETE FROM %s USE KEYS ?", s.store.DependencyKeyspace()), []interface{}{key})
+			}()
+		}
+
+		deps, err := s.store.DependencyReader().GetDependencies(end, 11*time.Minute)
+		if err != nil {
+			return err
+		}
+		for _, dep := range deps {
+			if dep.Parent == s.frontend && dep.Child == s.backend {
+				return expectEqual(dep.CallCount, uint64(1))
+			}
+		}
+		return errors.Errorf("no dependency from %s to %s in %v", s.frontend, s.backend, deps)
+	})
+}
+
+// check runs the check, retrying it until it passes or the timeout passes as indexes are updated asynchronously.
+func (s *integrationSuite) check(name string, check func() error) {
+	deadline := time.Now().Add(s.timeout)
+	for {
+		err := check()
+		if err == nil {
+			s.passed++
+			fmt.Printf("PASS %s\n", name)
+			return
+		}
+		if time.Now().After(deadline) {
+			s.failed++
+			fmt.Printf("FAIL %s: %v\n", name, err)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// names returns the sorted names of the suite's traces among the traces, traces from other runs are ignored.
+func (s *integrationSuite) names(traces []*model.Trace) []string {
+	var names []string
+	for _, trace := range traces {
+		if len(trace.Spans) == 0 {
+			continue
+		}
+		for name, expected := range s.traces {
+			if expected.Spans[0].TraceID == trace.Spans[0].TraceID {
+				names = append(names, name)
+			}
+		}
+	}
+
+	return sorted(names)
+}
+
+// purge deletes the suite's spans.
+func (s *integrationSuite) purge(logger hclog.Logger) {
+	for _, service := range []string{s.frontend, s.backend} {
+		_, err := s.store.PurgeSpans(plugin.PurgeQuery{ServiceName: service}, 0, 100, false)
+		if err != nil {
+			logger.Warn("failed to purge integration test spans", "service", service, "error", err)
+		}
+	}
+}
+
+// describeTrace describes each of the trace's spans in the order of their IDs, with the fields that the suite expects
+// to be stored and read back unchanged.
+func describeTrace(trace *model.Trace) []string {
+	var spans []string
+	for _, span := range trace.Spans {
+		var tags []string
+		for _, tag := range span.Tags {
+			tags = append(tags, tag.Key+"="+tag.AsString())
+		}
+		var processTags []string
+		for _, tag := range span.Process.Tags {
+			processTags = append(processTags, tag.Key+"="+tag.AsString())
+		}
+		var refs []string
+		for _, ref := range span.References {
+			refs = append(refs, ref.RefType.String()+":"+ref.SpanID.String())
+		}
+		spans = append(spans, fmt.Sprintf("%s %s/%s start=%s duration=%s tags=%v process=%v logs=%d refs=%v",
+			span.SpanID, span.Process.ServiceName, span.OperationName, span.StartTime.UTC().Format(time.RFC3339Nano),
+			span.Duration, sorted(tags), sorted(processTags), len(span.Logs), refs))
+	}
+
+	return sorted(spans)
+}
+
+func sorted(values []string) []string {
+	values = append([]string(nil), values...)
+	sort.Strings(values)
+
+	return values
+}
+
+func expectEqual(actual, expected interface{}) error {
+	if !reflect.DeepEqual(actual, expected) {
+		return errors.Errorf("expected %v, got %v", expected, actual)
+	}
+
+	return nil
+}
+
+func expectContains(values []string, expected ...string) error {
+	present := make(map[string]bool, len(values))
+	for _, value := range values {
+		present[value] = true
+	}
+	var missing []string
+	for _, value := range expected {
+		if !present[value] {
+			missing = append(missing, value)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
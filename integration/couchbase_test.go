@@ -0,0 +1,100 @@
+package integration
+
+import (
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/plugin"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+// CouchbaseIntegrationTestSuite runs Jaeger's storage integration suite against a live cluster, configured by the
+// plugin's environment variables in the same way as the plugin itself. The bucket is emptied before each test, so it
+// must be one that's only used by the suite.
+type CouchbaseIntegrationTestSuite struct {
+	StorageIntegration
+	options options.Options
+	store   plugin.Store
+	logger  hclog.Logger
+}
+
+func (s *CouchbaseIntegrationTestSuite) initialize() error {
+	flags := flag.NewFlagSet("integration", flag.ContinueOnError)
+	s.options.AddFlags(flags)
+	v := viper.New()
+	err := s.options.BindEnv(v, flags)
+	if err != nil {
+		return err
+	}
+	s.options.InitFromViper(v)
+	err = s.options.ReadCredentialFiles()
+	if err != nil {
+		return err
+	}
+
+	// The suite reads back what it has just written, so writes are made straight away and queries wait for the
+	// indexes to catch up with them.
+	s.options.ScanConsistency = "request_plus"
+	s.options.WriteBatchSize = 1
+	s.options.AsyncWrites = false
+	s.options.QueryCacheTTL = 0
+
+	s.logger = hclog.New(&hclog.LoggerOptions{Name: "integration", Level: hclog.Warn})
+
+	return s.open()
+}
+
+// open creates a store with empty caches, as the suite expects nothing to be remembered between tests.
+func (s *CouchbaseIntegrationTestSuite) open() error {
+	store, err := plugin.NewCouchbaseStore(s.options, metrics.NullFactory, s.logger)
+	if err != nil {
+		return err
+	}
+	err = plugin.OpenBucket(store, s.options.BucketName, s.logger)
+	if err != nil {
+		return err
+	}
+	err = plugin.CreateIndexes(store, s.logger)
+	if err != nil {
+		return err
+	}
+
+	s.store = store
+	s.SpanWriter = store.SpanWriter()
+	s.SpanReader = store.SpanReader()
+	// Dependencies are aggregated from the spans by the plugin rather than written by a dependency job, so there's no
+	// DependencyWriter and the suite skips its dependency test. The integration-test subcommand checks them instead.
+	s.Refresh = s.refresh
+	s.CleanUp = s.cleanUp
+
+	return nil
+}
+
+func (s *CouchbaseIntegrationTestSuite) refresh() error {
+	return nil
+}
+
+func (s *CouchbaseIntegrationTestSuite) cleanUp() error {
+	err := s.store.Execute("DELETE FROM "+s.store.Keyspace(), nil)
+	if err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+func TestCouchbaseStorage(t *testing.T) {
+	if os.Getenv("STORAGE") != "couchbase" {
+		t.Skip("Integration test against Couchbase skipped; set STORAGE env var to couchbase to run this")
+	}
+	s := &CouchbaseIntegrationTestSuite{}
+	require.NoError(t, s.initialize())
+	require.NoError(t, s.CleanUp())
+	s.IntegrationTestAll(t)
+}
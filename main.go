@@ -2,9 +2,9 @@ package main
 
 import (
 	"flag"
+	"io"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/chvck/couchbase-jaeger-storage-plugin/setup"
@@ -13,8 +13,14 @@ import (
 
 	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
 	"github.com/chvck/couchbase-jaeger-storage-plugin/plugin"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/selftrace"
 
 	"github.com/hashicorp/go-hclog"
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/uber/jaeger-lib/metrics"
+	jprom "github.com/uber/jaeger-lib/metrics/prometheus"
 
 	"github.com/spf13/viper"
 )
@@ -26,13 +32,23 @@ func main() {
 		JSONFormat: true,
 	})
 
+	var options options.Options
 	var configPath string
 	flag.StringVar(&configPath, "config", "", "A path to the plugin's configuration file")
+	options.AddFlags(flag.CommandLine)
 	flag.Parse()
 
 	v := viper.New()
-	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	v.AutomaticEnv()
+	err := options.BindEnv(v, flag.CommandLine)
+	if err != nil {
+		logger.Error("failed to bind environment variables", "error", err)
+		os.Exit(1)
+	}
+	err = options.BindFlags(v, flag.CommandLine)
+	if err != nil {
+		logger.Error("failed to bind flags", "error", err)
+		os.Exit(1)
+	}
 	if configPath != "" {
 		v.SetConfigFile(configPath)
 	}
@@ -45,26 +61,206 @@ func main() {
 		}
 	}
 
-	var options options.Options
 	options.InitFromViper(v)
+	err = options.ReadCredentialFiles()
+	if err != nil {
+		logger.Error("failed to read credentials", "error", err)
+		os.Exit(1)
+	}
+	err = options.ReadRoutingFile()
+	if err != nil {
+		logger.Error("failed to read routes", "error", err)
+		os.Exit(1)
+	}
+
+	logLevel := hclog.LevelFromString(options.LogLevel)
+	if logLevel == hclog.NoLevel {
+		logger.Error("invalid log level", "level", options.LogLevel)
+		os.Exit(1)
+	}
+	if options.LogFormat != "json" && options.LogFormat != "console" {
+		logger.Error("invalid log format", "format", options.LogFormat)
+		os.Exit(1)
+	}
 
-	store, err := plugin.NewCouchbaseStore(options, logger)
+	// Jaeger only forwards plugin logs written in hclog's format, so the logger stays hclog and we just configure it.
+	logger = hclog.New(&hclog.LoggerOptions{
+		Level:      logLevel,
+		Name:       "jaeger-couchbase",
+		JSONFormat: options.LogFormat == "json",
+	})
+
+	if options.SelfTracing {
+		tracer := selftrace.New(options.SelfTracingServiceName, options.SelfTracingEndpoint, &http.Client{Timeout: 5 * time.Second}, logger.Named("selftrace"))
+		defer tracer.Close()
+		opentracing.SetGlobalTracer(tracer)
+	}
+
+	metricsFactory := metrics.NullFactory
+	var metricsMux *http.ServeMux
+	if options.MetricsAddress != "" {
+		registry := prometheus.NewRegistry()
+		metricsFactory = jprom.New(jprom.WithRegisterer(registry)).Namespace(metrics.NSOptions{Name: "jaeger_couchbase"})
+
+		metricsMux = http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	}
+
+	if options.DryRun {
+		logger.Warn("dry run, spans are kept in memory and are lost when the plugin stops")
+		store := plugin.NewMemoryStore(options.DryRunMaxTraces)
+		if options.GRPCAddress != "" {
+			err = plugin.Serve(options.GRPCAddress, store, logger)
+			if err != nil {
+				logger.Error("failed to serve remote storage", "error", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		grpc.Serve(store)
+		return
+	}
+
+	store, err := plugin.NewCouchbaseStore(options, metricsFactory, logger)
 	if err != nil {
 		logger.Error("failed to create couchbase store", "error", err)
 		os.Exit(1)
 	}
 
+	if options.HealthAddress != "" {
+		healthHandler := plugin.HealthHandler(options, store, logger)
+		if metricsMux != nil && options.HealthAddress == options.MetricsAddress {
+			metricsMux.Handle("/live", healthHandler)
+			metricsMux.Handle("/ready", healthHandler)
+		} else {
+			go func() {
+				err := http.ListenAndServe(options.HealthAddress, healthHandler)
+				logger.Error("health endpoint stopped", "error", err)
+			}()
+		}
+	}
+
+	if metricsMux != nil {
+		go func() {
+			err := http.ListenAndServe(options.MetricsAddress, metricsMux)
+			logger.Error("metrics endpoint stopped", "error", err)
+		}()
+	}
+
+	tlsConfig, err := plugin.TLSConfig(options)
+	if err != nil {
+		logger.Error("failed to create TLS configuration", "error", err)
+		os.Exit(1)
+	}
+
 	timeoutDuration := time.Duration(5 * time.Second)
 	cli := &http.Client{
 		Timeout: timeoutDuration,
 	}
+	if tlsConfig != nil {
+		cli.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}
+	}
 
-	splitConnStr := strings.Split(options.ConnStr, "://")
+	// Capella doesn't expose the management API, so there's no node to find and subcommands that use it fail.
 	var conn string
-	if len(splitConnStr) > 1 {
-		conn = splitConnStr[1]
+	if options.Capella {
+		err = plugin.VerifyCapellaCertificate(options, logger)
+		if err != nil {
+			logger.Error("failed to verify capella certificate", "error", err)
+			os.Exit(1)
+		}
+		conn = plugin.Hosts(options.ConnStr)[0]
 	} else {
-		conn = splitConnStr[0]
+		conn, err = plugin.ManagementHost(plugin.Hosts(options.ConnStr), cli, logger)
+		if err != nil {
+			logger.Error("failed to find a cluster node", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if flag.Arg(0) == "init-schema" {
+		err := initSchema(options, flag.Args()[1:], store, conn, cli, logger)
+		if err != nil {
+			logger.Error("failed to initialise schema", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "init-fts-index" {
+		err := initFTSIndex(options, flag.Args()[1:], conn, cli, logger)
+		if err != nil {
+			logger.Error("failed to initialise search index", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "export" {
+		err := exportTraces(options, flag.Args()[1:], store, conn, cli, logger)
+		if err != nil {
+			logger.Error("failed to export traces", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "import" {
+		err := importTraces(options, flag.Args()[1:], store, conn, cli, logger)
+		if err != nil {
+			logger.Error("failed to import traces", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "migrate" {
+		err := migrate(options, flag.Args()[1:], store, conn, cli, logger)
+		if err != nil {
+			logger.Error("failed to migrate spans", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "migrate-schema" {
+		err := migrateSchema(options, flag.Args()[1:], store, conn, cli, logger)
+		if err != nil {
+			logger.Error("failed to migrate schema", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "purge" {
+		err := purge(options, flag.Args()[1:], store, conn, cli, logger)
+		if err != nil {
+			logger.Error("failed to purge spans", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "analyze-indexes" {
+		err := analyzeIndexes(options, flag.Args()[1:], store, conn, cli, logger)
+		if err != nil {
+			logger.Error("failed to analyze indexes", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "integration-test" {
+		err := integrationTest(options, flag.Args()[1:], store, conn, cli, logger)
+		if err != nil {
+			logger.Error("integration test failed", "error", err)
+			os.Exit(1)
+		}
+		return
 	}
 
 	if options.AutoSetup {
@@ -75,17 +271,140 @@ func main() {
 		}
 	}
 
+	if options.KVOnly {
+		logger.Warn("running in key-value only mode: traces can only be searched by service, operation, time and duration, tag searches fail, dependencies are empty, adaptive sampling throughput can't be read, 64 bit IDs of 128 bit traces aren't found and every span is also appended to an index document")
+	}
+
+	err = plugin.VerifyRoles(options, cli, conn, logger)
+	if err != nil {
+		logger.Error("failed to verify roles", "error", err)
+		os.Exit(1)
+	}
+
+	err = plugin.VerifyCollections(options, cli, conn, store, logger)
+	if err != nil {
+		logger.Error("failed to verify collections", "error", err)
+		os.Exit(1)
+	}
+
 	err = plugin.OpenBucket(store, options.BucketName, logger)
 	if err != nil {
 		logger.Error("failed to open bucket", "error", err)
 		os.Exit(1)
 	}
 
+	err = store.OpenRouteBuckets()
+	if err != nil {
+		logger.Error("failed to open route buckets", "error", err)
+		os.Exit(1)
+	}
+
 	err = plugin.VerifyServices(options, cli, conn, store, logger)
 	if err != nil {
 		logger.Error("failed to verify services", "error", err)
 		os.Exit(1)
 	}
 
+	err = plugin.VerifyDatasets(options, store, logger)
+	if err != nil {
+		logger.Error("failed to verify analytics datasets", "error", err)
+		os.Exit(1)
+	}
+
+	err = plugin.CreateViews(store, options.ViewsDesignDocument, logger)
+	if err != nil {
+		logger.Error("failed to create views", "error", err)
+		os.Exit(1)
+	}
+
+	if options.AutoCreateIndexes {
+		err = plugin.CreateIndexes(store, logger)
+		if err != nil {
+			logger.Error("failed to create indexes", "error", err)
+			os.Exit(1)
+		}
+
+		if options.TenancyEnabled {
+			for _, tenant := range options.Tenants {
+				tenantStore, err := store.TenantStore(tenant)
+				if err != nil {
+					logger.Error("failed to create tenant store", "tenant", tenant, "error", err)
+					os.Exit(1)
+				}
+
+				err = plugin.CreateIndexes(tenantStore, logger.With("tenant", tenant))
+				if err != nil {
+					logger.Error("failed to create indexes", "tenant", tenant, "error", err)
+					os.Exit(1)
+				}
+			}
+		}
+
+		for _, routeStore := range store.RouteStores() {
+			err = plugin.CreateIndexes(routeStore, logger.With("keyspace", routeStore.Keyspace()))
+			if err != nil {
+				logger.Error("failed to create indexes", "keyspace", routeStore.Keyspace(), "error", err)
+				os.Exit(1)
+			}
+		}
+	} else {
+		err = plugin.CheckDurationIndexes(options, store, logger)
+		if err != nil {
+			logger.Warn("failed to check indexes", "error", err)
+		}
+	}
+
+	err = plugin.CheckQueryPlans(options, store, metricsFactory, logger)
+	if err != nil {
+		logger.Warn("failed to check query plans", "error", err)
+	}
+
+	if options.PartitioningEnabled {
+		err = store.ManagePartitions()
+		if err != nil {
+			logger.Error("failed to create partitions", "error", err)
+			os.Exit(1)
+		}
+		go plugin.RunPartitionRetention(store, logger)
+	}
+
+	if options.DependencyAggregationInterval > 0 {
+		go plugin.RunDependencyAggregation(store, options.DependencyAggregationInterval, options.DependencyTTL, options.StorageModel == "trace", options.DeepDependencyDepth, logger)
+	}
+
+	if options.RollupsEnabled {
+		go plugin.RunRollups(store, options.RollupsHourlyTTL, options.RollupsDailyTTL, options.StorageModel == "trace", logger)
+	}
+
+	if options.AdminAddress != "" {
+		go func() {
+			err := http.ListenAndServe(options.AdminAddress, plugin.AdminHandler(store, logger))
+			logger.Error("admin endpoint stopped", "error", err)
+		}()
+	}
+
+	if configPath != "" {
+		watchConfig(v, options, store, logger)
+	}
+
+	if options.GRPCAddress != "" {
+		err = plugin.Serve(options.GRPCAddress, store, logger)
+		closeStore(store, logger)
+		if err != nil {
+			logger.Error("failed to serve remote storage", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	grpc.Serve(store)
+	closeStore(store, logger)
+}
+
+// closeStore writes the spans which were accepted but not yet written, once the plugin has stopped serving.
+func closeStore(store io.Closer, logger hclog.Logger) {
+	err := store.Close()
+	if err != nil {
+		logger.Error("failed to close couchbase store", "error", err)
+	}
 }
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/httpclient"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/plugin"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/traceio"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	fileSource  = "file"
+	querySource = "jaeger-query"
+
+	// progressInterval is how often the progress of a migration is logged.
+	progressInterval = 10 * time.Second
+	// minimumWindow is the smallest time window that is read from jaeger-query, windows holding more traces than the
+	// limit are split until they reach it. A minimum window that still holds as many traces as the limit fails the
+	// migration, rather than missing traces.
+	minimumWindow = time.Second
+)
+
+// migrateCheckpoint records how far a migration has got, so that an interrupted migration can carry on from where it
+// stopped.
+type migrateCheckpoint struct {
+	// Records is the number of traces read from a file that have been written.
+	Records int64 `json:"records,omitempty"`
+	// Window is the start, in unix nanoseconds, of the first window read from jaeger-query that hasn't been written.
+	Window int64 `json:"window,omitempty"`
+	Spans  int64 `json:"spans"`
+}
+
+// migration writes spans read from another Jaeger storage backend, confirming that every batch has been written
+// before saving a checkpoint.
+type migration struct {
+	store          plugin.Store
+	stream         plugin.SpanStream
+	interval       time.Duration
+	next           time.Time
+	batchSize      int
+	pending        int
+	checkpointPath string
+	checkpoint     migrateCheckpoint
+	lastProgress   time.Time
+	logger         hclog.Logger
+}
+
+// migrate copies spans from Jaeger's Elasticsearch or Cassandra storage, either from files exported from them or
+// from a jaeger-query in front of them.
+func migrate(opts options.Options, args []string, store plugin.Store, conn string, client httpclient.Client, logger hclog.Logger) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	source := flags.String("source", fileSource, "Where spans are read from, file or jaeger-query")
+	format := flags.String("format", traceio.ElasticsearchFormat, "The format of the file, es, jaeger or otlp")
+	input := flags.String("input", "-", "A path to the file to read, - reads from stdin")
+	tagDotReplacement := flags.String("es-tag-dot-replacement", "@", "The character that dots in tag keys were replaced with in Elasticsearch")
+	queryURL := flags.String("query-url", "", "The URL of the jaeger-query to read traces from, e.g. http://jaeger-query:16686")
+	start := flags.String("start", "", "Reads traces from jaeger-query that started after this time, in RFC3339 format")
+	end := flags.String("end", "", "Reads traces from jaeger-query that started before this time, in RFC3339 format, defaults to now")
+	window := flags.Duration("window", time.Hour, "The time window of traces read from jaeger-query at once")
+	limit := flags.Int("limit", 1000, "The most traces read from jaeger-query by each request")
+	rate := flags.Int("rate", 0, "The most spans written per second, 0 means no limit")
+	batchSize := flags.Int("batch-size", 1000, "The number of spans written between checkpoints")
+	checkpointPath := flags.String("checkpoint", "", "A path to a file recording the migration's progress, the migration resumes from it if it exists")
+	tenant := flags.String("tenant", "", "The tenant that spans are migrated for, when tenancy is enabled")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	m := &migration{
+		batchSize:      *batchSize,
+		checkpointPath: *checkpointPath,
+		lastProgress:   time.Now(),
+		logger:         logger,
+	}
+	if *rate > 0 {
+		m.interval = time.Second / time.Duration(*rate)
+	}
+	err = m.loadCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	switch *source {
+	case fileSource:
+		var r io.Reader = os.Stdin
+		if *input != "-" {
+			f, err := os.Open(*input)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+
+		var reader traceio.Reader
+		if *format == traceio.ElasticsearchFormat {
+			reader = traceio.NewElasticsearchReader(r, *tagDotReplacement)
+		} else {
+			reader, err = traceio.NewReader(*format, r)
+			if err != nil {
+				return err
+			}
+		}
+
+		m.store, err = openStore(opts, store, *tenant, conn, client, logger)
+		if err != nil {
+			return err
+		}
+		err = m.migrateFile(reader)
+	case querySource:
+		if *queryURL == "" || *start == "" {
+			return errors.New("a query URL and start must be given to migrate from jaeger-query")
+		}
+		from, err := time.Parse(time.RFC3339, *start)
+		if err != nil {
+			return errors.Wrap(err, "invalid start")
+		}
+		to := time.Now()
+		if *end != "" {
+			to, err = time.Parse(time.RFC3339, *end)
+			if err != nil {
+				return errors.Wrap(err, "invalid end")
+			}
+		}
+
+		m.store, err = openStore(opts, store, *tenant, conn, client, logger)
+		if err != nil {
+			return err
+		}
+		query := &queryClient{
+			url:    strings.TrimSuffix(*queryURL, "/"),
+			client: &http.Client{Timeout: time.Minute},
+			limit:  *limit,
+		}
+		err = m.migrateQuery(query, from, to, *window)
+	default:
+		return errors.Errorf("unknown source %q", *source)
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Info("migration complete", "spans", m.checkpoint.Spans)
+	return nil
+}
+
+// migrateFile writes every trace in the file, skipping the traces written before the checkpoint was saved.
+func (m *migration) migrateFile(reader traceio.Reader) error {
+	for skipped := int64(0); skipped < m.checkpoint.Records; skipped++ {
+		_, err := reader.Read()
+		if err != nil {
+			return errors.Wrap(err, "failed to skip migrated traces")
+		}
+	}
+
+	for {
+		trace, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		err = m.write(trace)
+		if err != nil {
+			return err
+		}
+		m.checkpoint.Records++
+
+		if m.pending >= m.batchSize {
+			err := m.commit()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return m.commit()
+}
+
+// migrateQuery writes the traces of every service from jaeger-query a window at a time. Traces are read once for
+// each of their services, so traces already written in the window, or the window before, are skipped.
+func (m *migration) migrateQuery(query *queryClient, from, to time.Time, window time.Duration) error {
+	services, err := query.services()
+	if err != nil {
+		return err
+	}
+	sort.Strings(services)
+
+	if m.checkpoint.Window > 0 {
+		from = time.Unix(0, m.checkpoint.Window)
+	}
+
+	previous := make(map[model.TraceID]bool)
+	for windowStart := from; windowStart.Before(to); windowStart = windowStart.Add(window) {
+		windowEnd := windowStart.Add(window)
+		if windowEnd.After(to) {
+			windowEnd = to
+		}
+
+		written := make(map[model.TraceID]bool)
+		for _, service := range services {
+			traces, err := query.traces(service, windowStart, windowEnd)
+			if err != nil {
+				return err
+			}
+
+			for _, trace := range traces {
+				if len(trace.Spans) == 0 {
+					continue
+				}
+				traceID := trace.Spans[0].TraceID
+				if written[traceID] || previous[traceID] {
+					continue
+				}
+				written[traceID] = true
+
+				err := m.write(trace)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		m.checkpoint.Window = windowEnd.UnixNano()
+		err := m.commit()
+		if err != nil {
+			return err
+		}
+		previous = written
+	}
+
+	return nil
+}
+
+// write writes the trace's spans at no more than the rate.
+func (m *migration) write(trace *model.Trace) error {
+	if m.stream == nil {
+		m.stream = m.store.NewSpanStream()
+	}
+
+	for _, span := range trace.Spans {
+		if m.interval > 0 {
+			now := time.Now()
+			if m.next.After(now) {
+				time.Sleep(m.next.Sub(now))
+				now = m.next
+			}
+			m.next = now.Add(m.interval)
+		}
+
+		err := m.stream.WriteSpan(span)
+		if err != nil {
+			return errors.Wrapf(err, "failed to write span %s", span.SpanID)
+		}
+		m.pending++
+	}
+
+	return nil
+}
+
+// commit waits for the pending spans to be written and then saves the checkpoint.
+func (m *migration) commit() error {
+	if m.stream != nil {
+		err := m.stream.Close()
+		m.stream = nil
+		if err != nil {
+			return errors.Wrap(err, "failed to write spans")
+		}
+	}
+	m.checkpoint.Spans += int64(m.pending)
+	m.pending = 0
+
+	if time.Since(m.lastProgress) >= progressInterval {
+		m.logger.Info("migrating spans", "spans", m.checkpoint.Spans)
+		m.lastProgress = time.Now()
+	}
+
+	return m.saveCheckpoint()
+}
+
+func (m *migration) loadCheckpoint() error {
+	if m.checkpointPath == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(m.checkpointPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read checkpoint")
+	}
+
+	err = json.Unmarshal(data, &m.checkpoint)
+	if err != nil {
+		return errors.Wrap(err, "invalid checkpoint")
+	}
+	m.logger.Info("resuming migration", "spans", m.checkpoint.Spans)
+
+	return nil
+}
+
+// saveCheckpoint writes the checkpoint to a temporary file before renaming it, so that the checkpoint is never left
+// half written.
+func (m *migration) saveCheckpoint() error {
+	if m.checkpointPath == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(m.checkpoint)
+	if err != nil {
+		return err
+	}
+
+	tmp := m.checkpointPath + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to write checkpoint")
+	}
+
+	return os.Rename(tmp, m.checkpointPath)
+}
+
+// queryClient reads traces from jaeger-query's HTTP API.
+type queryClient struct {
+	url    string
+	client *http.Client
+	limit  int
+}
+
+func (c *queryClient) services() ([]string, error) {
+	resp, err := c.client.Get(c.url + "/api/services")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read services")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to read services: %s", resp.Status)
+	}
+
+	var services struct {
+		Data []string `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&services)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read services")
+	}
+
+	return services.Data, nil
+}
+
+// traces reads the service's traces that started in the window. jaeger-query returns no more than the limit, so
+// windows holding as many traces as the limit are split in two and read again, and it's an error for a window that
+// can't be split any further to hold as many, as some of its traces may not have been returned.
+func (c *queryClient) traces(service string, start, end time.Time) ([]*model.Trace, error) {
+	params := url.Values{}
+	params.Set("service", service)
+	params.Set("start", fmt.Sprint(start.UnixNano()/int64(time.Microsecond)))
+	params.Set("end", fmt.Sprint(end.UnixNano()/int64(time.Microsecond)))
+	params.Set("limit", fmt.Sprint(c.limit))
+
+	resp, err := c.client.Get(c.url + "/api/traces?" + params.Encode())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read traces of %s", service)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to read traces of %s: %s", service, resp.Status)
+	}
+
+	traces, err := traceio.DecodeQueryResponse(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read traces of %s", service)
+	}
+	if len(traces) < c.limit {
+		return traces, nil
+	}
+	if end.Sub(start) <= minimumWindow {
+		return nil, errors.Errorf("%s has at least %d traces starting between %s and %s, the limit on traces read at once, so some may be missed; run the migration again with a larger -limit", service, c.limit, start.Format(time.RFC3339Nano), end.Format(time.RFC3339Nano))
+	}
+
+	middle := start.Add(end.Sub(start) / 2)
+	first, err := c.traces(service, start, middle)
+	if err != nil {
+		return nil, err
+	}
+	second, err := c.traces(service, middle, end)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(first, second...), nil
+}
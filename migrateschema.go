@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/httpclient"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/plugin"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// migrateSchema upgrades the stored spans to the current version of the span document layout and then returns. Spans
+// are also upgraded as they're read, so migrating is only needed for queries over the new layout to find old spans.
+func migrateSchema(opts options.Options, args []string, store plugin.Store, conn string, client httpclient.Client, logger hclog.Logger) error {
+	flags := flag.NewFlagSet("migrate-schema", flag.ContinueOnError)
+	rate := flags.Int("rate", 1000, "The most documents upgraded per second, 0 means no limit")
+	batchSize := flags.Int("batch-size", 100, "The number of documents upgraded by each statement")
+	dryRun := flags.Bool("dry-run", false, "Reports how many documents would be upgraded without upgrading them")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	err = plugin.VerifyCollections(opts, client, conn, store, logger)
+	if err != nil {
+		return err
+	}
+
+	err = plugin.OpenBucket(store, opts.BucketName, logger)
+	if err != nil {
+		return err
+	}
+
+	migrated, err := store.MigrateSchema(*rate, *batchSize, *dryRun)
+	for _, migration := range plugin.SchemaMigrations() {
+		n, ok := migrated[migration.Version]
+		if !ok {
+			continue
+		}
+		if *dryRun {
+			logger.Info("dry run, no documents were upgraded", "version", migration.Version, "migration", migration.Description, "documents", n)
+		} else {
+			logger.Info("upgraded documents", "version", migration.Version, "migration", migration.Description, "documents", n)
+		}
+	}
+
+	return err
+}
@@ -2,7 +2,13 @@ package options
 
 import (
 	"flag"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
 
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -10,34 +16,731 @@ const bucketName = "couchbase.bucket"
 const username = "couchbase.username"
 const password = "couchbase.password"
 const connStr = "couchbase.connString"
+const capella = "couchbase.capella"
 const useAnalytics = "couchbase.useAnalytics"
 const n1qlFallback = "couchbase.n1qlFallback"
+const analyticsDataverse = "couchbase.analytics.dataverse"
+const analyticsDataset = "couchbase.analytics.dataset"
+const analyticsDependencyDataset = "couchbase.analytics.dependencyDataset"
+const analyticsLink = "couchbase.analytics.link"
+const allowReplicaReads = "couchbase.allowReplicaReads"
 const autoSetup = "couchbase.autoSetup"
+const verifyRoles = "couchbase.verifyRoles"
+const scope = "couchbase.scope"
+const spanCollection = "couchbase.spanCollection"
+const dependencyCollection = "couchbase.dependencyCollection"
+const spanTTL = "couchbase.spanTTL"
+const serviceTTL = "couchbase.serviceTTL"
+const writeBatchSize = "couchbase.writeBatchSize"
+const writeFlushInterval = "couchbase.writeFlushInterval"
+const asyncWrites = "couchbase.asyncWrites"
+const writeQueueSize = "couchbase.writeQueueSize"
+const writeWorkers = "couchbase.writeWorkers"
+const writeQueueFullPolicy = "couchbase.writeQueueFullPolicy"
+const spillDir = "couchbase.spillDir"
+const spillMaxBytes = "couchbase.spillMaxBytes"
+const spillReplayInterval = "couchbase.spillReplayInterval"
+const samplingThroughputTTL = "couchbase.samplingThroughputTTL"
+const autoCreateIndexes = "couchbase.autoCreateIndexes"
+const maxResultBytes = "couchbase.maxResultBytes"
+const maxTracesPerQuery = "couchbase.maxTracesPerQuery"
+const readParallelism = "couchbase.readParallelism"
+const queryCacheTTL = "couchbase.queryCacheTTL"
+const preparedStatements = "couchbase.preparedStatements"
+const metricsAddress = "couchbase.metricsAddress"
+const grpcAddress = "couchbase.grpcAddress"
+const dryRun = "couchbase.dryRun"
+const dryRunMaxTraces = "couchbase.dryRunMaxTraces"
+const ftsIndexName = "couchbase.fts.indexName"
+const ftsTagSearch = "couchbase.fts.tagSearch"
+const ftsFuzziness = "couchbase.fts.fuzziness"
+const ftsMatchWarnings = "couchbase.fts.matchWarnings"
+const viewsEnabled = "couchbase.views.enabled"
+const viewsDesignDocument = "couchbase.views.designDocument"
+const selfTracing = "couchbase.selfTracing"
+const selfTracingEndpoint = "couchbase.selfTracingEndpoint"
+const selfTracingServiceName = "couchbase.selfTracingServiceName"
+const healthAddress = "couchbase.healthAddress"
+const logLevel = "couchbase.logLevel"
+const logFormat = "couchbase.logFormat"
+const slowQueryThreshold = "couchbase.slowQueryThreshold"
+const ca = "couchbase.ca"
+const cert = "couchbase.cert"
+const key = "couchbase.key"
+const insecureSkipVerify = "couchbase.insecureSkipVerify"
+const useCertAuth = "couchbase.useCertAuth"
+const reloadInterval = "couchbase.reloadInterval"
+const usernameFile = "couchbase.usernameFile"
+const passwordFile = "couchbase.passwordFile"
+const authDomain = "couchbase.authDomain"
+const networkType = "couchbase.networkType"
+const kvPoolSize = "couchbase.kvPoolSize"
+const kvQueueSize = "couchbase.kvQueueSize"
+const httpMaxIdleConns = "couchbase.httpMaxIdleConns"
+const httpMaxIdleConnsPerHost = "couchbase.httpMaxIdleConnsPerHost"
+const maxConcurrentQueries = "couchbase.maxConcurrentQueries"
+const maxQueuedQueries = "couchbase.maxQueuedQueries"
+const queryQueueTimeout = "couchbase.queryQueueTimeout"
+const readTimeout = "couchbase.readTimeout"
+const writeTimeout = "couchbase.writeTimeout"
+const dependencyQueryTimeout = "couchbase.dependencyQueryTimeout"
+const maxRetries = "couchbase.maxRetries"
+const retryInitialBackoff = "couchbase.retryInitialBackoff"
+const retryMaxBackoff = "couchbase.retryMaxBackoff"
+const lookupCacheSize = "couchbase.lookupCacheSize"
+const lookupCacheTTL = "couchbase.lookupCacheTTL"
+const storageModel = "couchbase.storageModel"
+const kvOnly = "couchbase.kvOnly"
+const keyStrategy = "couchbase.keyStrategy"
+const durability = "couchbase.durability"
+const scanConsistency = "couchbase.scanConsistency"
+const compression = "couchbase.compression"
+const encoding = "couchbase.encoding"
+const documentLayout = "couchbase.documentLayout"
+const splitStorage = "couchbase.splitStorage"
+const maxSpanSize = "couchbase.maxSpanSize"
+const oversizedSpans = "couchbase.oversizedSpans"
+const sanitizersEnabled = "couchbase.sanitizers.enabled"
+const sanitizersMaxClockSkew = "couchbase.sanitizers.maxClockSkew"
+const tagsIndexAll = "couchbase.tags.indexAll"
+const tagsAllow = "couchbase.tags.allow"
+const tagsDeny = "couchbase.tags.deny"
+const tagsMaxValueLength = "couchbase.tags.maxValueLength"
+const tagsWildcards = "couchbase.tags.wildcards"
+const tagsOperators = "couchbase.tags.operators"
+const skipLogs = "couchbase.skipLogs"
+const skipProcessTags = "couchbase.skipProcessTags"
+const normalizeProcesses = "couchbase.normalizeProcesses"
+const dedupeSpanIDs = "couchbase.dedupeSpanIDs"
+const adjustClockSkew = "couchbase.adjustClockSkew"
+const standardAdjusters = "couchbase.standardAdjusters"
+const dependencyAggregationInterval = "couchbase.dependencyAggregationInterval"
+const dependencyTTL = "couchbase.dependencyTTL"
+const adhocDependencies = "couchbase.adhocDependencies"
+const maxDependencyLookback = "couchbase.maxDependencyLookback"
+const deepDependencyDepth = "couchbase.deepDependencyDepth"
+const tenancyEnabled = "couchbase.tenancy.enabled"
+const tenancyTenants = "couchbase.tenancy.tenants"
+const tenancyTag = "couchbase.tenancy.tag"
+const tenancyDefaultTenant = "couchbase.tenancy.defaultTenant"
+const routingFile = "couchbase.routing.file"
+const spmEnabled = "couchbase.spm.enabled"
+const spmTTL = "couchbase.spm.ttl"
+const spmFlushInterval = "couchbase.spm.flushInterval"
+const spmSketches = "couchbase.spm.sketches"
+const rollupsEnabled = "couchbase.rollups.enabled"
+const rollupsHourlyTTL = "couchbase.rollups.hourlyTTL"
+const rollupsDailyTTL = "couchbase.rollups.dailyTTL"
+const partitioningEnabled = "couchbase.partitioning.enabled"
+const partitioningRetention = "couchbase.partitioning.retention"
+const downsamplingRatio = "couchbase.downsampling.ratio"
+const downsamplingHashSalt = "couchbase.downsampling.hashsalt"
+const tailFilterEnabled = "couchbase.tailFilter.enabled"
+const tailFilterSlowThreshold = "couchbase.tailFilter.slowThreshold"
+const tailFilterRatio = "couchbase.tailFilter.ratio"
+const tailFilterDecisionWait = "couchbase.tailFilter.decisionWait"
+const tailFilterDecisionTTL = "couchbase.tailFilter.decisionTTL"
+const tailFilterMaxBufferedSpans = "couchbase.tailFilter.maxBufferedSpans"
+const writeRateLimitSpans = "couchbase.writeRateLimit.spansPerSecond"
+const writeRateLimitBytes = "couchbase.writeRateLimit.bytesPerSecond"
+const writeRateLimitPolicy = "couchbase.writeRateLimit.policy"
+const adminAddress = "couchbase.adminAddress"
 
 type Options struct {
-	ConnStr         string
-	Username        string
-	Password        string
-	BucketName      string
-	UseAnalytics    bool
-	UseN1QLFallback bool
-	AutoSetup       bool
+	ConnStr           string
+	Capella           bool
+	Username          string
+	Password          string
+	BucketName        string
+	UseAnalytics      bool
+	UseN1QLFallback   bool
+	AllowReplicaReads bool
+	AutoSetup         bool
+	VerifyRoles       bool
+
+	AnalyticsDataverse         string
+	AnalyticsDataset           string
+	AnalyticsDependencyDataset string
+	AnalyticsLink              string
+
+	Scope                string
+	SpanCollection       string
+	DependencyCollection string
+
+	SpanTTL    time.Duration
+	ServiceTTL time.Duration
+
+	WriteBatchSize     int
+	WriteFlushInterval time.Duration
+
+	AsyncWrites          bool
+	WriteQueueSize       int
+	WriteWorkers         int
+	WriteQueueFullPolicy string
+
+	SpillDir            string
+	SpillMaxBytes       int
+	SpillReplayInterval time.Duration
+
+	SamplingThroughputTTL time.Duration
+
+	AutoCreateIndexes bool
+
+	MaxResultBytes     int
+	MaxTracesPerQuery  int
+	ReadParallelism    int
+	QueryCacheTTL      time.Duration
+	PreparedStatements bool
+
+	MetricsAddress string
+	GRPCAddress    string
+	HealthAddress  string
+
+	DryRun          bool
+	DryRunMaxTraces int
+
+	FTSIndexName     string
+	FTSTagSearch     bool
+	FTSFuzziness     int
+	FTSMatchWarnings bool
+
+	ViewsEnabled        bool
+	ViewsDesignDocument string
+
+	SelfTracing            bool
+	SelfTracingEndpoint    string
+	SelfTracingServiceName string
+
+	LogLevel  string
+	LogFormat string
+
+	SlowQueryThreshold time.Duration
+
+	CA                 string
+	Cert               string
+	Key                string
+	InsecureSkipVerify bool
+	UseCertAuth        bool
+	ReloadInterval     time.Duration
+
+	UsernameFile string
+	PasswordFile string
+	AuthDomain   string
+
+	NetworkType string
+
+	KVPoolSize              int
+	KVQueueSize             int
+	HTTPMaxIdleConns        int
+	HTTPMaxIdleConnsPerHost int
+	MaxConcurrentQueries    int
+	MaxQueuedQueries        int
+	QueryQueueTimeout       time.Duration
+
+	ReadTimeout            time.Duration
+	WriteTimeout           time.Duration
+	DependencyQueryTimeout time.Duration
+
+	MaxRetries          int
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+
+	LookupCacheSize int
+	LookupCacheTTL  time.Duration
+
+	StorageModel    string
+	KVOnly          bool
+	KeyStrategy     string
+	Durability      string
+	ScanConsistency string
+	Compression     string
+	Encoding        string
+	DocumentLayout  string
+	SplitStorage    bool
+	MaxSpanSize     int
+	OversizedSpans  string
+
+	Sanitizers             []string
+	SanitizersMaxClockSkew time.Duration
+
+	TagsIndexAll       bool
+	TagsAllow          []string
+	TagsDeny           []string
+	TagsMaxValueLength int
+	TagsWildcards      bool
+	TagsOperators      bool
+
+	SkipLogs           bool
+	SkipProcessTags    bool
+	NormalizeProcesses bool
+	DedupeSpanIDs      bool
+	AdjustClockSkew    bool
+	StandardAdjusters  bool
+
+	DependencyAggregationInterval time.Duration
+	DependencyTTL                 time.Duration
+	AdhocDependencies             bool
+	DeepDependencyDepth           int
+	MaxDependencyLookback         time.Duration
+
+	TenancyEnabled       bool
+	Tenants              []string
+	TenancyTag           string
+	TenancyDefaultTenant string
+
+	RoutingFile string
+	Routes      []Route
+
+	SPMEnabled       bool
+	SPMTTL           time.Duration
+	SPMFlushInterval time.Duration
+	SPMSketches      bool
+
+	RollupsEnabled   bool
+	RollupsHourlyTTL time.Duration
+	RollupsDailyTTL  time.Duration
+	AdminAddress     string
+
+	PartitioningEnabled   bool
+	PartitioningRetention time.Duration
+
+	DownsamplingRatio    float64
+	DownsamplingHashSalt string
+
+	TailFilterEnabled          bool
+	TailFilterSlowThreshold    time.Duration
+	TailFilterRatio            float64
+	TailFilterDecisionWait     time.Duration
+	TailFilterDecisionTTL      time.Duration
+	TailFilterMaxBufferedSpans int
+
+	WriteRateLimitSpans  float64
+	WriteRateLimitBytes  float64
+	WriteRateLimitPolicy string
 }
 
+// AddFlags registers a flag for every option, named after its configuration key.
 func (opt *Options) AddFlags(flagSet *flag.FlagSet) {
+	flagSet.String(connStr, "couchbase://localhost", "The connection string to use for connecting to Couchbase Server")
+	flagSet.Bool(capella, false, "Whether the cluster is a Couchbase Capella cluster, which sets TLS, timeouts and features to suit Capella")
+	flagSet.String(username, "", "The username to use for authentication")
+	flagSet.String(password, "", "The password to use for authentication")
+	flagSet.String(bucketName, "default", "The name of the bucket to use")
+	flagSet.Bool(useAnalytics, true, "Whether or not to use Analytics for queries")
+	flagSet.Bool(n1qlFallback, true, "Whether to fall back to N1QL when the Analytics service cannot be used")
+	flagSet.String(analyticsDataverse, "", "The Analytics dataverse holding the span and dependency datasets, empty uses the dataverse of the bucket or scope")
+	flagSet.String(analyticsDataset, "", "The name of the Analytics dataset of spans, empty names it after the bucket or span collection")
+	flagSet.String(analyticsDependencyDataset, "", "The name of the Analytics dataset of dependencies, empty names it after the bucket or dependency collection")
+	flagSet.String(analyticsLink, "Local", "The Analytics link that the datasets are populated through")
+	flagSet.Bool(allowReplicaReads, false, "Whether to read documents from replicas when the active node cannot be reached")
+	flagSet.Bool(autoSetup, false, "Whether to set up an uninitialized cluster at start up")
+	flagSet.Bool(verifyRoles, true, "Whether to check at start up that the user has the roles the plugin needs")
+	flagSet.String(scope, "", "The scope containing the span and dependency collections")
+	flagSet.String(spanCollection, "", "The collection to store spans in")
+	flagSet.String(dependencyCollection, "", "The collection to read dependencies from, defaults to the span collection")
+	flagSet.Duration(spanTTL, 0, "How long span documents are kept, 0 means forever")
+	flagSet.Duration(serviceTTL, 0, "How long service and operation documents are kept, 0 means forever")
+	flagSet.Int(writeBatchSize, 1, "The maximum number of spans to write in a single bulk operation")
+	flagSet.Duration(writeFlushInterval, 100*time.Millisecond, "The maximum time a span waits for its batch to fill")
+	flagSet.Bool(asyncWrites, false, "Whether spans are queued and written in the background")
+	flagSet.Int(writeQueueSize, 1000, "The maximum number of spans waiting to be written when writes are async")
+	flagSet.Int(writeWorkers, 10, "The number of workers writing queued spans when writes are async")
+	flagSet.String(writeQueueFullPolicy, "block", "What to do when the write queue is full, block or drop")
+	flagSet.String(spillDir, "", "The directory to buffer spans in whilst Couchbase is unreachable, empty disables the buffer")
+	flagSet.Int(spillMaxBytes, 1<<30, "The maximum number of bytes of spans buffered on disk")
+	flagSet.Duration(spillReplayInterval, 10*time.Second, "How often to try writing spans buffered on disk to Couchbase")
+	flagSet.Duration(samplingThroughputTTL, time.Hour, "How long adaptive sampling throughput documents are kept")
+	flagSet.Bool(autoCreateIndexes, false, "Whether to create the indexes used by the plugin at start up")
+	flagSet.Int(maxResultBytes, 0, "The maximum number of bytes of spans a trace query may return, 0 means no limit")
+	flagSet.Int(maxTracesPerQuery, 1000, "The maximum number of traces a search may return, 0 means no limit")
+	flagSet.Int(readParallelism, 8, "How many of the traces found by a search are fetched at once")
+	flagSet.Duration(queryCacheTTL, 30*time.Second, "How long service, operation and dependency results are cached for, 0 disables caching")
+	flagSet.Bool(preparedStatements, true, "Whether to run the hot read path N1QL queries as prepared statements")
+	flagSet.String(metricsAddress, "", "The address to serve Prometheus metrics on")
+	flagSet.String(grpcAddress, "", "The address to serve the remote storage gRPC API on, rather than running as a plugin")
+	flagSet.Bool(dryRun, false, "Whether spans are kept in memory rather than written to Couchbase, for development without a cluster")
+	flagSet.Int(dryRunMaxTraces, 100000, "The most traces kept in memory in a dry run, the oldest are dropped first")
+	flagSet.String(ftsIndexName, "jaeger-spans", "The name of the search index created over span documents by init-fts-index")
+	flagSet.Bool(ftsTagSearch, false, "Whether trace searches by tag use the search index rather than N1QL")
+	flagSet.Int(ftsFuzziness, 0, "The edit distance that tags are matched within when searching by tag with the search index")
+	flagSet.Bool(ftsMatchWarnings, false, "Whether spans found by searching the search index are given warnings saying what matched")
+	flagSet.Bool(viewsEnabled, false, "Whether services, operations and trace IDs are read from views rather than with N1QL")
+	flagSet.String(viewsDesignDocument, "jaeger", "The name of the design document holding the plugin's views")
+	flagSet.Bool(selfTracing, false, "Whether the plugin traces its own span writes, trace searches and queries")
+	flagSet.String(selfTracingEndpoint, "", "The OTLP/HTTP endpoint the plugin's own spans are sent to, e.g. http://collector:4318/v1/traces, they're logged at debug level if empty")
+	flagSet.String(selfTracingServiceName, "couchbase-jaeger-storage-plugin", "The service name of the plugin's own spans, spans of this service aren't traced when written")
+	flagSet.String(healthAddress, "", "The address to serve the liveness and readiness endpoints on")
+	flagSet.String(logLevel, "warn", "The level to log at, one of trace, debug, info, warn or error")
+	flagSet.String(logFormat, "json", "The format to log in, json or console")
+	flagSet.Duration(slowQueryThreshold, 0, "Queries that take longer than this are logged, 0 disables logging")
+	flagSet.String(ca, "", "The path to a PEM encoded CA certificate")
+	flagSet.String(cert, "", "The path to a PEM encoded client certificate")
+	flagSet.String(key, "", "The path to the PEM encoded private key for the client certificate")
+	flagSet.Bool(insecureSkipVerify, false, "Whether to skip verifying the cluster's certificate")
+	flagSet.Bool(useCertAuth, false, "Whether to authenticate using the client certificate")
+	flagSet.Duration(reloadInterval, 30*time.Second, "How often certificate and credential files are checked for changes")
+	flagSet.String(usernameFile, "", "The path to a file containing the username")
+	flagSet.String(passwordFile, "", "The path to a file containing the password")
+	flagSet.String(authDomain, "local", "The domain the user is defined in, local or external for LDAP and SAML users")
+	flagSet.String(networkType, "auto", "The network to connect to nodes on, default, external or auto")
+	flagSet.Int(kvPoolSize, 0, "The number of KV connections to open to each node, 0 uses the SDK default")
+	flagSet.Int(kvQueueSize, 0, "The maximum number of KV operations queued on each connection, 0 uses the SDK default")
+	flagSet.Int(httpMaxIdleConns, 0, "The maximum number of idle HTTP connections to the query, analytics and search services, 0 uses the SDK default")
+	flagSet.Int(httpMaxIdleConnsPerHost, 0, "The maximum number of idle HTTP connections to each node's query, analytics and search services, 0 uses the SDK default")
+	flagSet.Int(maxConcurrentQueries, 0, "The maximum number of queries run at once, 0 means no limit")
+	flagSet.Int(maxQueuedQueries, 0, "The maximum number of queries waiting to run when maxConcurrentQueries are running, further queries fail, 0 means no limit")
+	flagSet.Duration(queryQueueTimeout, 0, "The longest a query waits to run when maxConcurrentQueries are running before failing, 0 waits until the request's deadline")
+	flagSet.Duration(readTimeout, 0, "The timeout for trace, service and operation queries, 0 uses the SDK default")
+	flagSet.Duration(writeTimeout, 0, "The timeout for span writes, 0 uses the SDK default")
+	flagSet.Duration(dependencyQueryTimeout, 0, "The timeout for dependency queries, 0 uses the SDK default")
+	flagSet.Int(maxRetries, 3, "The maximum number of times an operation is retried after a temporary failure")
+	flagSet.Duration(retryInitialBackoff, 50*time.Millisecond, "The backoff before the first retry, doubled for each retry")
+	flagSet.Duration(retryMaxBackoff, time.Second, "The maximum backoff between retries")
+	flagSet.Int(lookupCacheSize, 10000, "The number of recently written services and operations the writer remembers")
+	flagSet.Duration(lookupCacheTTL, 10*time.Minute, "How long the writer skips rewriting a service or operation for")
+	flagSet.String(storageModel, "span", "How spans are stored, span for a document per span or trace for a document per trace")
+	flagSet.Bool(kvOnly, false, "Whether only the data service is used, with spans found through index documents kept by the plugin")
+	flagSet.String(keyStrategy, "spanid", "How span documents are keyed, one of spanid, deterministic or uuid")
+	flagSet.String(durability, "none", "How durable span writes must be, one of none, majority, majorityAndPersist or persistToMajority")
+	flagSet.String(scanConsistency, "not_bounded", "Which writes queries must see, one of not_bounded, request_plus or at_plus")
+	flagSet.String(compression, "none", "How span payloads are compressed, one of none, snappy or zstd")
+	flagSet.String(encoding, "json", "How spans are encoded, json or protobuf")
+	flagSet.String(documentLayout, "model", "The layout of span documents, model or flat")
+	flagSet.Bool(splitStorage, false, "Whether each span is stored as a small searchable document and a compressed body document")
+	flagSet.Int(maxSpanSize, 20*1024*1024, "The largest span document written in bytes, 0 means no limit")
+	flagSet.String(sanitizersEnabled, "utf8,emptyServiceName,negativeDuration,timestamp", "A comma separated list of the sanitizers applied to spans before they're written")
+	flagSet.Duration(sanitizersMaxClockSkew, 24*time.Hour, "How far in the future a span's start time can be before the timestamp sanitizer replaces it")
+	flagSet.String(oversizedSpans, "truncateLogs", "What happens to spans larger than the maximum size, one of truncateLogs, dropTags or reject")
+	flagSet.Bool(tagsIndexAll, true, "Whether every tag not denied is searchable, rather than only the allowed tags")
+	flagSet.String(tagsAllow, "", "A comma separated list of the tags that are searchable when not indexing all tags")
+	flagSet.String(tagsDeny, "", "A comma separated list of the tags that are never searchable")
+	flagSet.Int(tagsMaxValueLength, 255, "The longest tag value that is searchable")
+	flagSet.Bool(tagsWildcards, false, "Whether a * in a searched tag value matches any run of characters, allowing prefix and substring tag searches")
+	flagSet.Bool(tagsOperators, false, "Whether searched tags can hold OR groups, values separated by | or key=value pairs in the __or__ tag")
+	flagSet.Bool(skipLogs, false, "Whether to leave span logs out of traces that are read")
+	flagSet.Bool(skipProcessTags, false, "Whether to leave process tags out of traces that are read")
+	flagSet.Bool(normalizeProcesses, false, "Whether each distinct process is stored once and referenced from spans by hash")
+	flagSet.Bool(dedupeSpanIDs, false, "Whether to give Zipkin style server spans, which share their client span's ID, their own IDs when traces are read")
+	flagSet.Bool(adjustClockSkew, false, "Whether to adjust spans for clock skew between hosts when traces are read")
+	flagSet.Bool(standardAdjusters, false, "Whether to make the same adjustments to traces that are read as jaeger-query does")
+	flagSet.Duration(dependencyAggregationInterval, 0, "How often dependencies are aggregated from spans, 0 disables aggregation")
+	flagSet.Duration(dependencyTTL, 30*24*time.Hour, "How long aggregated dependency documents are kept, 0 means forever")
+	flagSet.Bool(adhocDependencies, false, "Whether dependencies are computed on demand using Analytics")
+	flagSet.Duration(maxDependencyLookback, 24*time.Hour, "The longest lookback dependencies are computed on demand for")
+	flagSet.Int(deepDependencyDepth, 0, "The most services and operations on the call paths aggregated for the deep dependency graph, 0 disables them")
+	flagSet.Bool(tenancyEnabled, false, "Whether each tenant's data is stored in its own scope")
+	flagSet.String(tenancyTenants, "", "A comma separated list of the tenants allowed when tenancy is enabled, empty allows any tenant")
+	flagSet.String(tenancyTag, "tenant", "The span or process tag holding the tenant of spans written without a request context")
+	flagSet.String(tenancyDefaultTenant, "", "The tenant of requests and spans that don't say which tenant they're for, empty rejects them")
+	flagSet.String(routingFile, "", "The path to a file routing the spans of some services to their own buckets or collections")
+	flagSet.Bool(spmEnabled, false, "Whether per minute call, error and latency rollups are kept for service performance monitoring")
+	flagSet.Duration(spmTTL, 7*24*time.Hour, "How long service performance monitoring rollups are kept, 0 means forever")
+	flagSet.Duration(spmFlushInterval, 10*time.Second, "How often the counts of written spans are added to the rollups")
+	flagSet.Bool(spmSketches, false, "Whether rollups also keep latency sketches, which estimate latency quantiles to within 1%")
+	flagSet.Bool(rollupsEnabled, false, "Whether hourly and daily rollups of each service's spans are built")
+	flagSet.Duration(rollupsHourlyTTL, 30*24*time.Hour, "How long hourly rollups are kept, 0 means forever")
+	flagSet.Duration(rollupsDailyTTL, 0, "How long daily rollups are kept, 0 means forever")
+	flagSet.Bool(partitioningEnabled, false, "Whether spans are stored in a collection per day, which is dropped once it's older than the retention")
+	flagSet.Duration(partitioningRetention, 7*24*time.Hour, "How long partitioned spans are kept before their collection is dropped")
+	flagSet.Float64(downsamplingRatio, 1.0, "The fraction of traces stored, spans tagged as errors are always stored")
+	flagSet.String(downsamplingHashSalt, "", "The salt hashed with each trace ID when downsampling")
+	flagSet.Bool(tailFilterEnabled, false, "Whether spans are held back until their trace is known to have an error or a slow span")
+	flagSet.Duration(tailFilterSlowThreshold, time.Second, "The duration at which a span is slow enough for its trace to be kept, 0 disables")
+	flagSet.Float64(tailFilterRatio, 0, "The fraction of traces without errors or slow spans that are kept")
+	flagSet.Duration(tailFilterDecisionWait, 10*time.Second, "How long a trace's spans are held back before deciding whether to keep it")
+	flagSet.Duration(tailFilterDecisionTTL, 5*time.Minute, "How long the decision for a trace is remembered after its last span")
+	flagSet.Int(tailFilterMaxBufferedSpans, 100000, "The most spans held back at once, later spans are decided straight away")
+	flagSet.Float64(writeRateLimitSpans, 0, "The most spans written per second, 0 means no limit")
+	flagSet.Float64(writeRateLimitBytes, 0, "The most bytes of spans written per second, 0 means no limit")
+	flagSet.String(writeRateLimitPolicy, "block", "What to do with spans over the write rate limit, block or drop")
+	flagSet.String(adminAddress, "", "The address to serve the admin API on")
 }
 
-func (opt *Options) InitFromViper(v *viper.Viper) {
-	v.SetDefault(bucketName, "default")
-	v.SetDefault(connStr, "couchbase://localhost")
-	v.SetDefault(useAnalytics, true)
-	v.SetDefault(n1qlFallback, true)
+// BindFlags binds the parsed flags to viper. Flags that were set take precedence over the environment and the
+// configuration file, the defaults of those that weren't are only used when the option is set nowhere else.
+func (opt *Options) BindFlags(v *viper.Viper, flagSet *flag.FlagSet) error {
+	pflags := pflag.NewFlagSet(flagSet.Name(), pflag.ContinueOnError)
+	pflags.AddGoFlagSet(flagSet)
+	flagSet.Visit(func(f *flag.Flag) {
+		pflags.Lookup(f.Name).Changed = true
+	})
+
+	return v.BindPFlags(pflags)
+}
+
+// BindEnv binds every option to the environment variable named after its configuration key, upper cased with dots
+// replaced by underscores, e.g. COUCHBASE_CONNSTRING for couchbase.connString. Options are bound explicitly, rather
+// than only looked up when read, so that viper knows that they're set even when they aren't in the configuration file.
+func (opt *Options) BindEnv(v *viper.Viper, flagSet *flag.FlagSet) error {
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
+	var err error
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if err != nil || !strings.HasPrefix(f.Name, "couchbase.") {
+			return
+		}
+		err = v.BindEnv(f.Name, EnvName(f.Name))
+	})
+
+	return err
+}
 
+// EnvName returns the environment variable that sets the option with the configuration key.
+func EnvName(key string) string {
+	return strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+func (opt *Options) InitFromViper(v *viper.Viper) {
 	opt.ConnStr = v.GetString(connStr)
+	opt.Capella = v.GetBool(capella)
 	opt.Username = v.GetString(username)
 	opt.Password = v.GetString(password)
 	opt.BucketName = v.GetString(bucketName)
 	opt.UseAnalytics = v.GetBool(useAnalytics)
 	opt.UseN1QLFallback = v.GetBool(n1qlFallback)
+	opt.AnalyticsDataverse = v.GetString(analyticsDataverse)
+	opt.AnalyticsDataset = v.GetString(analyticsDataset)
+	opt.AnalyticsDependencyDataset = v.GetString(analyticsDependencyDataset)
+	opt.AnalyticsLink = v.GetString(analyticsLink)
+	opt.AllowReplicaReads = v.GetBool(allowReplicaReads)
 	opt.AutoSetup = v.GetBool(autoSetup)
+	opt.VerifyRoles = v.GetBool(verifyRoles)
+	opt.Scope = v.GetString(scope)
+	opt.SpanCollection = v.GetString(spanCollection)
+	opt.DependencyCollection = v.GetString(dependencyCollection)
+	if opt.DependencyCollection == "" {
+		opt.DependencyCollection = opt.SpanCollection
+	}
+	opt.SpanTTL = v.GetDuration(spanTTL)
+	opt.ServiceTTL = v.GetDuration(serviceTTL)
+	opt.WriteBatchSize = v.GetInt(writeBatchSize)
+	opt.WriteFlushInterval = v.GetDuration(writeFlushInterval)
+	opt.AsyncWrites = v.GetBool(asyncWrites)
+	opt.WriteQueueSize = v.GetInt(writeQueueSize)
+	opt.WriteWorkers = v.GetInt(writeWorkers)
+	opt.WriteQueueFullPolicy = v.GetString(writeQueueFullPolicy)
+	opt.SpillDir = v.GetString(spillDir)
+	opt.SpillMaxBytes = v.GetInt(spillMaxBytes)
+	opt.SpillReplayInterval = v.GetDuration(spillReplayInterval)
+	opt.SamplingThroughputTTL = v.GetDuration(samplingThroughputTTL)
+	opt.AutoCreateIndexes = v.GetBool(autoCreateIndexes)
+	opt.MaxResultBytes = v.GetInt(maxResultBytes)
+	opt.MaxTracesPerQuery = v.GetInt(maxTracesPerQuery)
+	opt.ReadParallelism = v.GetInt(readParallelism)
+	opt.QueryCacheTTL = v.GetDuration(queryCacheTTL)
+	opt.PreparedStatements = v.GetBool(preparedStatements)
+	opt.MetricsAddress = v.GetString(metricsAddress)
+	opt.GRPCAddress = v.GetString(grpcAddress)
+	opt.DryRun = v.GetBool(dryRun)
+	opt.DryRunMaxTraces = v.GetInt(dryRunMaxTraces)
+	opt.FTSIndexName = v.GetString(ftsIndexName)
+	opt.FTSTagSearch = v.GetBool(ftsTagSearch)
+	opt.FTSFuzziness = v.GetInt(ftsFuzziness)
+	opt.FTSMatchWarnings = v.GetBool(ftsMatchWarnings)
+	opt.ViewsEnabled = v.GetBool(viewsEnabled)
+	opt.ViewsDesignDocument = v.GetString(viewsDesignDocument)
+	opt.SelfTracing = v.GetBool(selfTracing)
+	opt.SelfTracingEndpoint = v.GetString(selfTracingEndpoint)
+	opt.SelfTracingServiceName = v.GetString(selfTracingServiceName)
+	opt.HealthAddress = v.GetString(healthAddress)
+	opt.LogLevel = v.GetString(logLevel)
+	opt.LogFormat = v.GetString(logFormat)
+	opt.SlowQueryThreshold = v.GetDuration(slowQueryThreshold)
+	opt.CA = v.GetString(ca)
+	opt.Cert = v.GetString(cert)
+	opt.Key = v.GetString(key)
+	opt.InsecureSkipVerify = v.GetBool(insecureSkipVerify)
+	opt.UseCertAuth = v.GetBool(useCertAuth)
+	opt.ReloadInterval = v.GetDuration(reloadInterval)
+	opt.UsernameFile = v.GetString(usernameFile)
+	opt.PasswordFile = v.GetString(passwordFile)
+	opt.AuthDomain = v.GetString(authDomain)
+	opt.NetworkType = v.GetString(networkType)
+	opt.KVPoolSize = v.GetInt(kvPoolSize)
+	opt.KVQueueSize = v.GetInt(kvQueueSize)
+	opt.HTTPMaxIdleConns = v.GetInt(httpMaxIdleConns)
+	opt.HTTPMaxIdleConnsPerHost = v.GetInt(httpMaxIdleConnsPerHost)
+	opt.MaxConcurrentQueries = v.GetInt(maxConcurrentQueries)
+	opt.MaxQueuedQueries = v.GetInt(maxQueuedQueries)
+	opt.QueryQueueTimeout = v.GetDuration(queryQueueTimeout)
+	opt.ReadTimeout = v.GetDuration(readTimeout)
+	opt.WriteTimeout = v.GetDuration(writeTimeout)
+	opt.DependencyQueryTimeout = v.GetDuration(dependencyQueryTimeout)
+	opt.MaxRetries = v.GetInt(maxRetries)
+	opt.RetryInitialBackoff = v.GetDuration(retryInitialBackoff)
+	opt.RetryMaxBackoff = v.GetDuration(retryMaxBackoff)
+	opt.LookupCacheSize = v.GetInt(lookupCacheSize)
+	opt.LookupCacheTTL = v.GetDuration(lookupCacheTTL)
+	opt.StorageModel = v.GetString(storageModel)
+	opt.KVOnly = v.GetBool(kvOnly)
+	opt.KeyStrategy = v.GetString(keyStrategy)
+	opt.Durability = v.GetString(durability)
+	opt.ScanConsistency = v.GetString(scanConsistency)
+	opt.Compression = v.GetString(compression)
+	opt.Encoding = v.GetString(encoding)
+	opt.DocumentLayout = v.GetString(documentLayout)
+	opt.SplitStorage = v.GetBool(splitStorage)
+	opt.MaxSpanSize = v.GetInt(maxSpanSize)
+	opt.OversizedSpans = v.GetString(oversizedSpans)
+	opt.Sanitizers = stringSlice(v, sanitizersEnabled)
+	opt.SanitizersMaxClockSkew = v.GetDuration(sanitizersMaxClockSkew)
+	opt.TagsIndexAll = v.GetBool(tagsIndexAll)
+	opt.TagsAllow = stringSlice(v, tagsAllow)
+	opt.TagsDeny = stringSlice(v, tagsDeny)
+	opt.TagsMaxValueLength = v.GetInt(tagsMaxValueLength)
+	opt.TagsWildcards = v.GetBool(tagsWildcards)
+	opt.TagsOperators = v.GetBool(tagsOperators)
+	opt.SkipLogs = v.GetBool(skipLogs)
+	opt.SkipProcessTags = v.GetBool(skipProcessTags)
+	opt.NormalizeProcesses = v.GetBool(normalizeProcesses)
+	opt.DedupeSpanIDs = v.GetBool(dedupeSpanIDs)
+	opt.AdjustClockSkew = v.GetBool(adjustClockSkew)
+	opt.StandardAdjusters = v.GetBool(standardAdjusters)
+	opt.DependencyAggregationInterval = v.GetDuration(dependencyAggregationInterval)
+	opt.DependencyTTL = v.GetDuration(dependencyTTL)
+	opt.AdhocDependencies = v.GetBool(adhocDependencies)
+	opt.MaxDependencyLookback = v.GetDuration(maxDependencyLookback)
+	opt.DeepDependencyDepth = v.GetInt(deepDependencyDepth)
+	opt.TenancyEnabled = v.GetBool(tenancyEnabled)
+	opt.Tenants = stringSlice(v, tenancyTenants)
+	opt.TenancyTag = v.GetString(tenancyTag)
+	opt.TenancyDefaultTenant = v.GetString(tenancyDefaultTenant)
+	opt.RoutingFile = v.GetString(routingFile)
+	opt.SPMEnabled = v.GetBool(spmEnabled)
+	opt.SPMTTL = v.GetDuration(spmTTL)
+	opt.SPMFlushInterval = v.GetDuration(spmFlushInterval)
+	opt.SPMSketches = v.GetBool(spmSketches)
+	opt.RollupsEnabled = v.GetBool(rollupsEnabled)
+	opt.RollupsHourlyTTL = v.GetDuration(rollupsHourlyTTL)
+	opt.RollupsDailyTTL = v.GetDuration(rollupsDailyTTL)
+	opt.PartitioningEnabled = v.GetBool(partitioningEnabled)
+	opt.PartitioningRetention = v.GetDuration(partitioningRetention)
+	opt.DownsamplingRatio = v.GetFloat64(downsamplingRatio)
+	opt.DownsamplingHashSalt = v.GetString(downsamplingHashSalt)
+	opt.TailFilterEnabled = v.GetBool(tailFilterEnabled)
+	opt.TailFilterSlowThreshold = v.GetDuration(tailFilterSlowThreshold)
+	opt.TailFilterRatio = v.GetFloat64(tailFilterRatio)
+	opt.TailFilterDecisionWait = v.GetDuration(tailFilterDecisionWait)
+	opt.TailFilterDecisionTTL = v.GetDuration(tailFilterDecisionTTL)
+	opt.TailFilterMaxBufferedSpans = v.GetInt(tailFilterMaxBufferedSpans)
+	opt.WriteRateLimitSpans = v.GetFloat64(writeRateLimitSpans)
+	opt.WriteRateLimitBytes = v.GetFloat64(writeRateLimitBytes)
+	opt.WriteRateLimitPolicy = v.GetString(writeRateLimitPolicy)
+	opt.AdminAddress = v.GetString(adminAddress)
+
+	if opt.Capella {
+		opt.applyCapellaProfile()
+	}
+	// Without the query and analytics services there's nothing to create indexes with or to query.
+	if opt.KVOnly {
+		opt.UseAnalytics = false
+		opt.AutoCreateIndexes = false
+	}
+}
+
+// The timeouts used with Capella unless they're set, requests cross a WAN so take longer than the SDK's defaults
+// allow for.
+const (
+	capellaReadTimeout       = 75 * time.Second
+	capellaWriteTimeout      = 10 * time.Second
+	capellaDependencyTimeout = 75 * time.Second
+)
+
+// applyCapellaProfile sets the options that Capella needs. Capella only accepts TLS connections, so connection
+// strings without a scheme use couchbases://, which with a single host and no port is looked up through DNS SRV
+// records. Capella doesn't expose the management REST API, which the plugin uses to check that the analytics service
+// is running and what roles the user has, so queries use N1QL and roles aren't checked.
+func (opt *Options) applyCapellaProfile() {
+	if !strings.Contains(opt.ConnStr, "://") {
+		opt.ConnStr = "couchbases://" + opt.ConnStr
+	}
+	if opt.ReadTimeout == 0 {
+		opt.ReadTimeout = capellaReadTimeout
+	}
+	if opt.WriteTimeout == 0 {
+		opt.WriteTimeout = capellaWriteTimeout
+	}
+	if opt.DependencyQueryTimeout == 0 {
+		opt.DependencyQueryTimeout = capellaDependencyTimeout
+	}
+	opt.UseAnalytics = false
+	opt.VerifyRoles = false
+}
+
+// ReadCredentialFiles sets the username and password from the username and password files, if they are set.
+func (opt *Options) ReadCredentialFiles() error {
+	if opt.UsernameFile != "" {
+		username, err := readCredentialFile(opt.UsernameFile)
+		if err != nil {
+			return err
+		}
+		opt.Username = username
+	}
+
+	if opt.PasswordFile != "" {
+		password, err := readCredentialFile(opt.PasswordFile)
+		if err != nil {
+			return err
+		}
+		opt.Password = password
+	}
+
+	return nil
+}
+
+func readCredentialFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %s", path)
+	}
+
+	// Secrets are often written with a trailing newline which is never part of the credential.
+	return strings.TrimSpace(string(data)), nil
+}
+
+// stringSlice reads a list option, which is a comma separated string when it's set by a flag or environment variable.
+func stringSlice(v *viper.Viper, key string) []string {
+	var values []string
+	for _, value := range v.GetStringSlice(key) {
+		for _, s := range strings.Split(value, ",") {
+			s = strings.TrimSpace(s)
+			if s != "" {
+				values = append(values, s)
+			}
+		}
+	}
+
+	return values
+}
+
+// reloadable are the options that take effect without restarting the plugin when the configuration file changes.
+var reloadable = map[string]bool{
+	"WriteBatchSize":     true,
+	"WriteFlushInterval": true,
+	"ReadTimeout":        true,
+	"WriteTimeout":       true,
+	"SlowQueryThreshold": true,
+	"LogLevel":           true,
+}
+
+// Changed returns the names of the options that differ in other, split into those that can be reloaded and those
+// that need the plugin to be restarted.
+func (opt *Options) Changed(other Options) (reloaded, restart []string) {
+	current := reflect.ValueOf(*opt)
+	changed := reflect.ValueOf(other)
+	for i := 0; i < current.NumField(); i++ {
+		if reflect.DeepEqual(current.Field(i).Interface(), changed.Field(i).Interface()) {
+			continue
+		}
+
+		name := current.Type().Field(i).Name
+		if reloadable[name] {
+			reloaded = append(reloaded, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+
+	return reloaded, restart
 }
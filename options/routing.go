@@ -0,0 +1,64 @@
+package options
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Route directs the spans of some services to their own bucket or collection, or both, so that a noisy service
+// can't evict the spans of every other service. An empty bucket means the plugin's bucket, an empty collection the
+// span collection and a zero TTL the span TTL.
+type Route struct {
+	Services   []string      `mapstructure:"services"`
+	Bucket     string        `mapstructure:"bucket"`
+	Collection string        `mapstructure:"collection"`
+	TTL        time.Duration `mapstructure:"ttl"`
+}
+
+// routing is the contents of a routing file, which is kept apart from the configuration file as lists of routes
+// can't be set through flags or environment variables.
+type routing struct {
+	Routes []Route `mapstructure:"routes"`
+}
+
+// ReadRoutingFile sets the routes from the routing file, if it is set. Each service may only be routed once.
+func (opt *Options) ReadRoutingFile() error {
+	if opt.RoutingFile == "" {
+		return nil
+	}
+
+	v := viper.New()
+	v.SetConfigFile(opt.RoutingFile)
+
+	err := v.ReadInConfig()
+	if err != nil {
+		return errors.Wrap(err, "failed to read routing file")
+	}
+
+	var file routing
+	err = v.Unmarshal(&file)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse routing file")
+	}
+
+	routed := make(map[string]bool)
+	for i, route := range file.Routes {
+		if len(route.Services) == 0 {
+			return errors.Errorf("route %d has no services", i)
+		}
+		if route.Bucket == "" && route.Collection == "" {
+			return errors.Errorf("route %d has neither a bucket nor a collection", i)
+		}
+		for _, service := range route.Services {
+			if routed[service] {
+				return errors.Errorf("service %q is routed more than once", service)
+			}
+			routed[service] = true
+		}
+	}
+
+	opt.Routes = file.Routes
+	return nil
+}
@@ -0,0 +1,38 @@
+package plugin
+
+import (
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/jaegertracing/jaeger/model/adjuster"
+)
+
+// traceAdjuster returns the adjustments to make to traces as they are read, or nil if there are none. Span IDs are
+// deduplicated first so that clock skew is adjusted using the client and server spans' real parent.
+func traceAdjuster(opts options.Options) adjuster.Adjuster {
+	if opts.StandardAdjusters {
+		return adjuster.Sequence(standardAdjusters()...)
+	}
+
+	var adjusters []adjuster.Adjuster
+	if opts.DedupeSpanIDs {
+		adjusters = append(adjusters, adjuster.SpanIDDeduper())
+	}
+	if opts.AdjustClockSkew {
+		adjusters = append(adjusters, adjuster.ClockSkew())
+	}
+	if len(adjusters) == 0 {
+		return nil
+	}
+
+	return adjuster.Sequence(adjusters...)
+}
+
+// standardAdjusters are the adjusters that jaeger-query applies to every trace it reads, in the same order.
+func standardAdjusters() []adjuster.Adjuster {
+	return []adjuster.Adjuster{
+		adjuster.SpanIDDeduper(),
+		adjuster.ClockSkew(),
+		adjuster.IPTagAdjuster(),
+		adjuster.SortLogFields(),
+		adjuster.SpanReferences(),
+	}
+}
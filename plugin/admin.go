@@ -0,0 +1,67 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// AdminHandler serves the admin API. /rollups returns the hourly or daily rollups of spans as JSON, selected by the
+// query parameters period (hour or day, defaults to hour), service (defaults to every service), and start and end
+// (RFC 3339 timestamps, defaulting to the last day).
+func AdminHandler(store Store, logger hclog.Logger) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rollups", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		period := query.Get("period")
+		switch period {
+		case "":
+			period = hourlyRollup
+		case hourlyRollup, dailyRollup:
+		default:
+			http.Error(w, "period must be hour or day", http.StatusBadRequest)
+			return
+		}
+
+		end, err := timeParam(query.Get("end"), time.Now())
+		if err != nil {
+			http.Error(w, "end must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		start, err := timeParam(query.Get("start"), end.Add(-24*time.Hour))
+		if err != nil {
+			http.Error(w, "start must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+
+		rollups, err := queryRollups(r.Context(), store, period, query.Get("service"), start, end)
+		if err != nil {
+			logger.Warn("failed to read rollups", "error", err)
+			http.Error(w, "failed to read rollups", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(rollups)
+		if err != nil {
+			logger.Debug("failed to write rollups", "error", err)
+		}
+	})
+
+	return mux
+}
+
+func timeParam(value string, defaultTime time.Time) (time.Time, error) {
+	if value == "" {
+		return defaultTime, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
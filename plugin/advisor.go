@@ -0,0 +1,213 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	adviseStmt = "ADVISE %s"
+
+	queryBucketIndexesStmt     = "SELECT RAW name FROM system:indexes WHERE keyspace_id = ? AND bucket_id IS MISSING"
+	queryCollectionIndexesStmt = "SELECT RAW name FROM system:indexes WHERE bucket_id = ? AND scope_id = ? AND keyspace_id = ?"
+)
+
+// indexNamePattern extracts the name of an index from the statement that creates it, primary indexes created without a
+// name are called #primary.
+var indexNamePattern = regexp.MustCompile("^CREATE (?:PRIMARY )?INDEX (`(?:[^`]|``)+`|[^ `(]+)? ?ON ")
+
+// IndexAdvice is the advice of the query service for one of the plugin's queries.
+type IndexAdvice struct {
+	// Query names the query that the advice is for.
+	Query string
+	// CurrentIndexes are the statements of the indexes that the query uses today.
+	CurrentIndexes []string
+	// RecommendedIndexes are the statements of indexes that would serve the query better, and CoveringIndexes those
+	// that would answer it without fetching documents.
+	RecommendedIndexes []string
+	CoveringIndexes    []string
+}
+
+// IndexAdvisorReport is the advice for each of the plugin's queries, along with the indexes on the span keyspace that
+// none of them use.
+type IndexAdvisorReport struct {
+	Advice        []IndexAdvice
+	UnusedIndexes []string
+}
+
+type advisedQuery struct {
+	name      string
+	statement string
+	params    []interface{}
+	// index is the index that the query is meant to use.
+	index string
+}
+
+// adviseResult is the result of an ADVISE statement. recommended_indexes is a message rather than an object when there
+// is nothing to recommend.
+type adviseResult struct {
+	Advice struct {
+		AdviseInfo struct {
+			CurrentIndexes []struct {
+				IndexStatement string `json:"index_statement"`
+			} `json:"current_indexes"`
+			RecommendedIndexes json.RawMessage `json:"recommended_indexes"`
+		} `json:"adviseinfo"`
+	} `json:"advice"`
+}
+
+type recommendedIndexes struct {
+	Indexes []struct {
+		IndexStatement string `json:"index_statement"`
+	} `json:"indexes"`
+	CoveringIndexes []struct {
+		IndexStatement string `json:"index_statement"`
+	} `json:"covering_indexes"`
+}
+
+// AdviseIndexes runs the query service's index advisor over the plugin's span and lookup queries, filled in with
+// example parameters, and finds the indexes on the span keyspace that none of the queries use. The advisor needs
+// Couchbase Server 6.6 or later.
+func AdviseIndexes(store Store, traceModel bool) (*IndexAdvisorReport, error) {
+	report := &IndexAdvisorReport{}
+	used := make(map[string]bool)
+	for _, query := range advisedQueries(store, traceModel) {
+		advice, err := adviseIndexes(store, query)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to advise indexes for %s", query.name)
+		}
+		report.Advice = append(report.Advice, advice)
+
+		for _, statement := range advice.CurrentIndexes {
+			if name, ok := indexName(statement); ok {
+				used[name] = true
+			}
+		}
+	}
+
+	existing, err := keyspaceIndexes(store)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range existing {
+		if !used[name] {
+			report.UnusedIndexes = append(report.UnusedIndexes, name)
+		}
+	}
+	sort.Strings(report.UnusedIndexes)
+
+	return report, nil
+}
+
+// advisedQueries returns the queries that the reader runs against the query service, with example parameters.
+func advisedQueries(store Store, traceModel bool) []advisedQuery {
+	layout := store.DocumentLayout()
+	spans := store.Keyspace()
+	if traceModel {
+		spans = fmt.Sprintf(spansKeyspaceTemplate, store.Keyspace())
+	}
+	end := time.Now()
+	start := end.Add(-time.Hour)
+	tags, patterns := tagPredicates([][]tagTerm{{{key: "error", value: "true"}}}, false)
+	maxDuration := 24 * time.Hour
+
+	queries := []advisedQuery{
+		{"queryIDsByService", traceIDQuery(layout, queryIDsByServiceName, spans), []interface{}{"service", start, end, 20}, "jaeger_service_start_time"},
+		{"queryIDsByServiceNameAndOperation", traceIDQuery(layout, queryIDsByServiceAndOperationName, spans), []interface{}{"service", "operation", start, end, 20}, "jaeger_service_operation_start_time"},
+		{"queryIDsByServiceAndOperationNameAndTags", traceIDQuery(layout, queryIDsByServiceAndOperationNameAndTags, spans), []interface{}{"service", "operation", start, end, tags, patterns, 20}, "jaeger_service_operation_start_time"},
+		{"queryIDsByTagsAndLogs", traceIDQuery(layout, queryIDsByTag, spans), []interface{}{"service", start, end, tags, patterns, 20}, "jaeger_service_start_time"},
+		{"queryIDsByError", traceIDQuery(layout, queryIDsByError, spans), []interface{}{"service", start, end, 20}, "jaeger_service_error_start_time"},
+		{"queryIDsByErrorAndOperationName", traceIDQuery(layout, queryIDsByErrorAndOperationName, spans), []interface{}{"service", "operation", start, end, 20}, "jaeger_service_operation_error_start_time"},
+		{"queryIDsByDuration", traceIDQuery(layout, queryIDsByDuration, spans), []interface{}{"service", start, end, time.Duration(0), maxDuration, 20}, "jaeger_service_start_time_duration"},
+		{"queryIDsByDurationAndOperationName", traceIDQuery(layout, queryIDsByDurationAndOperationName, spans), []interface{}{"service", "operation", start, end, time.Duration(0), maxDuration, 20}, "jaeger_service_operation_start_time_duration"},
+		{"findTraceIDByLow", traceIDsByLowQuery(layout, spans), lowTraceIDParams(layout, 1), "jaeger_trace_id"},
+		{"getServices", fmt.Sprintf(queryServiceNames, store.Keyspace()), nil, "jaeger_services"},
+		{"getOperations", fmt.Sprintf(queryOperations, store.Keyspace()), []interface{}{"service"}, "jaeger_operations"},
+	}
+	// Traces are read by key from trace documents, rather than by query.
+	if !traceModel {
+		queries = append(queries, advisedQuery{"readTrace", spansByTraceIDQuery(layout, store.Keyspace(), "*"), traceIDParams(layout, TraceID{Low: 1}), "jaeger_trace_id"})
+	}
+	for i := range queries {
+		queries[i].params = layoutParams(layout, queries[i].params)
+	}
+
+	return queries
+}
+
+func adviseIndexes(store Store, query advisedQuery) (IndexAdvice, error) {
+	advice := IndexAdvice{Query: query.name}
+	result, err := store.Query(context.Background(), fmt.Sprintf(adviseStmt, query.statement), query.params)
+	if err != nil {
+		return advice, err
+	}
+
+	var row adviseResult
+	for result.Next(&row) {
+		for _, index := range row.Advice.AdviseInfo.CurrentIndexes {
+			advice.CurrentIndexes = append(advice.CurrentIndexes, index.IndexStatement)
+		}
+
+		var recommended recommendedIndexes
+		if json.Unmarshal(row.Advice.AdviseInfo.RecommendedIndexes, &recommended) == nil {
+			for _, index := range recommended.Indexes {
+				advice.RecommendedIndexes = append(advice.RecommendedIndexes, index.IndexStatement)
+			}
+			for _, index := range recommended.CoveringIndexes {
+				advice.CoveringIndexes = append(advice.CoveringIndexes, index.IndexStatement)
+			}
+		}
+		row = adviseResult{}
+	}
+
+	return advice, result.Close()
+}
+
+// keyspaceIndexes returns the names of the indexes on the span keyspace.
+func keyspaceIndexes(store Store) ([]string, error) {
+	statement := queryBucketIndexesStmt
+	params := []interface{}{store.Name()}
+	if parts := splitKeyspace(store.Keyspace()); len(parts) == 3 {
+		statement = queryCollectionIndexesStmt
+		params = []interface{}{parts[0], parts[1], parts[2]}
+	}
+
+	result, err := store.Query(context.Background(), statement, params)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query indexes")
+	}
+
+	var names []string
+	var name string
+	for result.Next(&name) {
+		names = append(names, name)
+	}
+	err = result.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query indexes")
+	}
+
+	return names, nil
+}
+
+// indexName returns the name of the index created by the statement.
+func indexName(statement string) (string, bool) {
+	match := indexNamePattern.FindStringSubmatch(statement)
+	if match == nil {
+		return "", false
+	}
+	if match[1] == "" {
+		return "#primary", true
+	}
+	if parts := splitKeyspace(match[1]); len(parts) == 1 {
+		return parts[0], true
+	}
+
+	return match[1], true
+}
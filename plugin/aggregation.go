@@ -0,0 +1,215 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/pkg/errors"
+)
+
+// Calls between services are confirmed when a client or producer span of one service is the parent of a server or
+// consumer span of the other, so that both sides of the call were traced, and inferred when they're only found from a
+// span of one service referencing a span of another.
+const (
+	confirmedDependency = "confirmed"
+	inferredDependency  = "inferred"
+)
+
+const (
+	// dependencySource and dependencyErrors are the expressions for whether the call from the parent span p to the
+	// child span c is confirmed, and whether it failed, either in the called span or in the client span making it.
+	dependencySource = `CASE WHEN p.span_kind IN ["client", "producer"] AND c.span_kind IN ["server", "consumer"] THEN "` +
+		confirmedDependency + `" ELSE "` + inferredDependency + `" END`
+	dependencyErrors = `SUM(CASE WHEN c.error = true OR (p.span_kind = "client" AND p.error = true) THEN 1 ELSE 0 END)`
+
+	// aggregateDependenciesStmt counts the calls, and failed calls, between each pair of services by joining every
+	// span to the spans it references.
+	aggregateDependenciesStmt = `
+SELECT p.process.service_name AS parent, c.process.service_name AS child, source, COUNT(*) AS call_count, ` + dependencyErrors + ` AS error_count
+FROM %[1]s AS c
+UNNEST c.` + "`references`" + ` AS r
+JOIN %[1]s AS p ON p.trace_id.hi = c.trace_id.hi AND p.trace_id.lo = c.trace_id.lo AND p.span_id = r.span_id
+LET source = ` + dependencySource + `
+WHERE c.start_time >= ? AND c.start_time < ? AND c.` + "`type`" + `="span" AND p.` + "`type`" + `="span"
+GROUP BY p.process.service_name, c.process.service_name, source`
+
+	// aggregateTraceDependenciesStmt is aggregateDependenciesStmt for the trace storage model, where the spans
+	// referenced by a span are always in the same trace document.
+	aggregateTraceDependenciesStmt = `
+SELECT p.process.service_name AS parent, c.process.service_name AS child, source, COUNT(*) AS call_count, ` + dependencyErrors + ` AS error_count
+FROM %[1]s AS t
+UNNEST t.spans AS c
+UNNEST c.` + "`references`" + ` AS r
+UNNEST t.spans AS p
+LET source = ` + dependencySource + `
+WHERE p.span_id = r.span_id AND c.start_time >= ? AND c.start_time < ? AND t.` + "`type`" + `="trace"
+GROUP BY p.process.service_name, c.process.service_name, source`
+)
+
+// DependencyEdge is the calls from one service to another found in the same way, confirmed or inferred, along with
+// how many of them failed. Dependencies aggregated by earlier versions of the plugin, or by external jobs, have no
+// source or error count.
+type DependencyEdge struct {
+	Parent     string `json:"parent"`
+	Child      string `json:"child"`
+	CallCount  uint64 `json:"call_count"`
+	ErrorCount uint64 `json:"error_count"`
+	Source     string `json:"source,omitempty"`
+}
+
+// dependencyLinks merges the edges between each pair of services into the links that Jaeger shows. A link's source is
+// confirmed if any of its calls were, inferred if they all were, and Jaeger's own source for dependencies aggregated
+// without one.
+func dependencyLinks(edges []DependencyEdge) []model.DependencyLink {
+	var links []model.DependencyLink
+	index := make(map[[2]string]int)
+	for _, edge := range edges {
+		source := edge.Source
+		if source == "" {
+			source = model.JaegerDependencyLinkSource
+		}
+
+		pair := [2]string{edge.Parent, edge.Child}
+		if i, ok := index[pair]; ok {
+			links[i].CallCount += edge.CallCount
+			if source == confirmedDependency || links[i].Source == model.JaegerDependencyLinkSource {
+				links[i].Source = source
+			}
+			continue
+		}
+		index[pair] = len(links)
+		links = append(links, model.DependencyLink{Parent: edge.Parent, Child: edge.Child, CallCount: edge.CallCount, Source: source})
+	}
+
+	return links
+}
+
+// dependencyDocument is a materialized set of dependencies for a single time bucket, in the shape read by the
+// dependency reader.
+type dependencyDocument struct {
+	Deps []DependencyEdge `json:"dependencies"`
+	Ts   string           `json:"ts"`
+}
+
+// RunDependencyAggregation aggregates the dependencies between services for each interval and stores them as
+// dependency documents, kept for the ttl, so that the dependency reader doesn't rely on an external job to populate
+// them. Each run covers the last complete interval, starting with one as soon as it's called so that there are
+// dependencies to show without waiting an interval. Rewriting an interval is harmless so several plugins can run the
+// aggregation at once. The call paths of up to pathDepth services and operations are aggregated, and kept for the ttl,
+// too when pathDepth is above 0.
+func RunDependencyAggregation(store Store, interval, ttl time.Duration, traceModel bool, pathDepth int, logger hclog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	aggregateInterval(store, time.Now(), interval, ttl, traceModel, pathDepth, logger)
+	for now := range ticker.C {
+		aggregateInterval(store, now, interval, ttl, traceModel, pathDepth, logger)
+	}
+}
+
+// aggregateInterval aggregates the dependencies of the last interval to complete before now.
+func aggregateInterval(store Store, now time.Time, interval, ttl time.Duration, traceModel bool, pathDepth int, logger hclog.Logger) {
+	end := now.UTC().Truncate(interval)
+	start := end.Add(-interval)
+
+	_, err := AggregateDependencies(store, start, end, ttl, traceModel)
+	if err != nil {
+		logger.Error("failed to aggregate dependencies", "start", start, "end", end, "error", err)
+		return
+	}
+	logger.Debug("aggregated dependencies", "start", start, "end", end)
+
+	if pathDepth > 0 {
+		_, err = AggregateDeepDependencies(store, start, end, ttl, traceModel, pathDepth)
+		if err != nil {
+			logger.Error("failed to aggregate deep dependencies", "start", start, "end", end, "error", err)
+			return
+		}
+		logger.Debug("aggregated deep dependencies", "start", start, "end", end)
+	}
+}
+
+// AggregateDependencies stores the dependencies between services from the spans started between start and end as a
+// dependency document that expires after the ttl, returning the document's key. Nothing is stored, and the key is
+// empty, if there are none.
+func AggregateDependencies(store Store, start, end time.Time, ttl time.Duration, traceModel bool) (string, error) {
+	deps, err := queryDependencies(context.Background(), store, start, end, traceModel)
+	if err != nil {
+		return "", err
+	}
+	if len(deps) == 0 {
+		return "", nil
+	}
+
+	// The dependency collection may differ from the span collection so the document is written using N1QL.
+	doc := dependencyDocument{
+		Deps: deps,
+		Ts:   start.Format(dateLayout),
+	}
+	key := fmt.Sprintf("dependencies::%d", start.Unix())
+
+	err = store.Execute(fmt.Sprintf(upsertStmt, store.DependencyKeyspace()), []interface{}{key, doc, expiryFromTTL(ttl)})
+	if err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// mergeEdges merges the edges found in the same way between each pair of services, which are returned separately when
+// they're queried in parts.
+func mergeEdges(edges []DependencyEdge) []DependencyEdge {
+	var merged []DependencyEdge
+	index := make(map[[3]string]int)
+	for _, edge := range edges {
+		key := [3]string{edge.Parent, edge.Child, edge.Source}
+		if i, ok := index[key]; ok {
+			merged[i].CallCount += edge.CallCount
+			merged[i].ErrorCount += edge.ErrorCount
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, edge)
+	}
+
+	return merged
+}
+
+// queryDependencies computes the dependencies between services from the spans started between start and end, in
+// each keyspace holding them. Calls whose spans were stored in different partitions aren't counted.
+func queryDependencies(ctx context.Context, store Store, start, end time.Time, traceModel bool) ([]DependencyEdge, error) {
+	stmt := aggregateDependenciesStmt
+	if traceModel {
+		stmt = aggregateTraceDependenciesStmt
+	}
+
+	var deps []DependencyEdge
+	for _, keyspace := range store.SpanKeyspaces(start, end) {
+		result, err := store.Query(
+			ctx,
+			fmt.Sprintf(stmt, keyspace),
+			[]interface{}{start.UTC().Format(dateLayout), end.UTC().Format(dateLayout)},
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to query dependencies")
+		}
+
+		for {
+			var dep DependencyEdge
+			if !result.Next(&dep) {
+				break
+			}
+			deps = append(deps, dep)
+		}
+
+		err = result.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to query dependencies")
+		}
+	}
+
+	return mergeEdges(deps), nil
+}
@@ -0,0 +1,233 @@
+package plugin
+
+import (
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// batchWrite is a document waiting to be written as part of a batch, the result of the write is sent on errCh.
+type batchWrite struct {
+	doc   Document
+	errCh chan error
+}
+
+// batcher groups document writes together so that they can be flushed using a single bulk operation. A batch is
+// flushed as soon as it is full, when the flush interval elapses or when a flush is requested, whichever happens
+// first. With the trace storage model the spans of each trace in a batch are coalesced into a single append to the
+// trace's document instead, so chatty traces take a mutation per flush rather than one per span.
+type batcher struct {
+	store         Store
+	traceModel    bool
+	size          int
+	flushInterval time.Duration
+	writes        chan batchWrite
+	flushes       chan struct{}
+	resizes       chan batchSize
+	done          chan struct{}
+	stopped       chan struct{}
+	metrics       *writeMetrics
+	logger        hclog.Logger
+}
+
+// batchSize is a new size and flush interval for the batcher.
+type batchSize struct {
+	size          int
+	flushInterval time.Duration
+}
+
+func newBatcher(store Store, traceModel bool, size int, flushInterval time.Duration, metrics *writeMetrics, logger hclog.Logger) *batcher {
+	b := &batcher{
+		store:         store,
+		traceModel:    traceModel,
+		size:          size,
+		flushInterval: flushInterval,
+		writes:        make(chan batchWrite, size),
+		flushes:       make(chan struct{}, 1),
+		resizes:       make(chan batchSize),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+		metrics:       metrics,
+		logger:        logger,
+	}
+	go b.run()
+
+	return b
+}
+
+// Write adds the document to the current batch and blocks until that batch has been flushed.
+func (b *batcher) Write(doc Document) error {
+	return <-b.enqueue(doc)
+}
+
+// enqueue adds the document to the current batch without waiting, the result of the write is sent on the returned
+// channel once the batch has been flushed.
+func (b *batcher) enqueue(doc Document) <-chan error {
+	errCh := make(chan error, 1)
+	b.writes <- batchWrite{
+		doc:   doc,
+		errCh: errCh,
+	}
+
+	return errCh
+}
+
+// Flush asks for the current batch to be flushed without waiting for it to fill up or for the flush interval.
+func (b *batcher) Flush() {
+	select {
+	case b.flushes <- struct{}{}:
+	default:
+		// A flush is already pending.
+	}
+}
+
+// resize changes the size and flush interval of batches, flushing the current batch if it's already full. A zero flush
+// interval leaves the interval as it was. Batchers that have been closed aren't resized.
+func (b *batcher) resize(size int, flushInterval time.Duration) {
+	if size < 1 {
+		size = 1
+	}
+	select {
+	case b.resizes <- batchSize{size: size, flushInterval: flushInterval}:
+	case <-b.done:
+	}
+}
+
+// Close flushes the writes that are waiting to be batched and stops the batcher once they've been written. Documents
+// mustn't be written once it's called.
+func (b *batcher) Close() error {
+	close(b.done)
+	<-b.stopped
+
+	return nil
+}
+
+func (b *batcher) run() {
+	ticker := time.NewTicker(b.flushInterval)
+	defer func() {
+		ticker.Stop()
+		close(b.stopped)
+	}()
+
+	batch := make([]batchWrite, 0, b.size)
+	for {
+		select {
+		case write := <-b.writes:
+			batch = append(batch, write)
+			if len(batch) >= b.size {
+				b.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				b.flush(batch)
+				batch = batch[:0]
+			}
+		case resize := <-b.resizes:
+			b.size = resize.size
+			if resize.flushInterval > 0 && resize.flushInterval != b.flushInterval {
+				b.flushInterval = resize.flushInterval
+				ticker.Stop()
+				ticker = time.NewTicker(b.flushInterval)
+			}
+			if len(batch) >= b.size {
+				b.flush(batch)
+				batch = batch[:0]
+			}
+		case <-b.flushes:
+			// Writes enqueued before the flush was requested may still be waiting in the channel.
+			batch = b.drain(batch)
+			if len(batch) > 0 {
+				b.flush(batch)
+				batch = batch[:0]
+			}
+		case <-b.done:
+			batch = b.drain(batch)
+			if len(batch) > 0 {
+				b.flush(batch)
+			}
+			return
+		}
+	}
+}
+
+// drain adds any writes waiting in the channel to the batch, flushing whenever the batch fills up.
+func (b *batcher) drain(batch []batchWrite) []batchWrite {
+	for {
+		select {
+		case write := <-b.writes:
+			batch = append(batch, write)
+			if len(batch) >= b.size {
+				b.flush(batch)
+				batch = batch[:0]
+			}
+		default:
+			return batch
+		}
+	}
+}
+
+func (b *batcher) flush(batch []batchWrite) {
+	docs := make([]Document, len(batch))
+	for i, write := range batch {
+		docs[i] = write.doc
+	}
+
+	b.metrics.batchSize.Record(float64(len(docs)))
+
+	var errs []error
+	if b.traceModel {
+		errs = b.appendTraces(docs)
+	} else {
+		errs = b.store.InsertMulti(docs)
+	}
+
+	var failed int
+	for i, write := range batch {
+		if errs[i] != nil {
+			failed++
+		}
+		write.errCh <- errs[i]
+	}
+
+	if failed > 0 {
+		b.logger.Warn("failed to write documents in batch", "failed", failed, "size", len(batch))
+	}
+}
+
+// appendTraces appends the spans of each trace in the batch to the trace's document in one mutation, in the order
+// that they were written, and returns the result of each span's write.
+func (b *batcher) appendTraces(docs []Document) []error {
+	var traceIDs []TraceID
+	traces := make(map[TraceID][]int)
+	for i, doc := range docs {
+		traceID := doc.Value.(Span).TraceID
+		if _, ok := traces[traceID]; !ok {
+			traceIDs = append(traceIDs, traceID)
+		}
+		traces[traceID] = append(traces[traceID], i)
+	}
+
+	errs := make([]error, len(docs))
+	for _, traceID := range traceIDs {
+		indexes := traces[traceID]
+		spans := make([]Span, len(indexes))
+		expiry := 0
+		for j, i := range indexes {
+			spans[j] = docs[i].Value.(Span)
+			if docs[i].Expiry > expiry {
+				expiry = docs[i].Expiry
+			}
+		}
+		if len(spans) > 1 {
+			b.metrics.coalesced.Inc(int64(len(spans)))
+		}
+
+		err := appendSpans(b.store, traceID, spans, expiry)
+		for _, i := range indexes {
+			errs[i] = err
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,159 @@
+package plugin
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+// The queries whose results are cached, used to tag the cache metrics.
+var cachedQueries = []string{"getServices", "getOperations", "getOperationsWithKind", "getDependencies", "getDeepDependencies"}
+
+const servicesCacheKey = "services"
+
+// maxCacheEntries is the most results a cache holds. Keys include the time ranges that were asked for, so without a
+// bound a client asking for many ranges would grow the cache until its entries expired.
+const maxCacheEntries = 1000
+
+// operationsCacheKey is the prefix of the keys of every cached result for the service's operations.
+func operationsCacheKey(service string) string {
+	return "operations::" + keyComponent(service) + "::"
+}
+
+// resultCache holds the results of the queries that the UI polls constantly for a short time, so that repeated
+// polls don't each query the cluster. A nil resultCache caches nothing.
+type resultCache struct {
+	ttl    time.Duration
+	hits   map[string]metrics.Counter
+	misses map[string]metrics.Counter
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newResultCache(ttl time.Duration, factory metrics.Factory) *resultCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	c := &resultCache{
+		ttl:     ttl,
+		hits:    make(map[string]metrics.Counter, len(cachedQueries)),
+		misses:  make(map[string]metrics.Counter, len(cachedQueries)),
+		entries: make(map[string]cacheEntry),
+	}
+	for _, query := range cachedQueries {
+		c.hits[query] = factory.Counter(metrics.Options{
+			Name: "cache_hits",
+			Tags: map[string]string{"query": query},
+			Help: "Number of query results served from the cache",
+		})
+		c.misses[query] = factory.Counter(metrics.Options{
+			Name: "cache_misses",
+			Tags: map[string]string{"query": query},
+			Help: "Number of query results not found in the cache",
+		})
+	}
+
+	return c
+}
+
+// empty returns a new cache with the same TTL and metrics, holding no results.
+func (c *resultCache) empty() *resultCache {
+	if c == nil {
+		return nil
+	}
+
+	return &resultCache{
+		ttl:     c.ttl,
+		hits:    c.hits,
+		misses:  c.misses,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// get returns the cached result of the query, if it hasn't expired.
+func (c *resultCache) get(query, key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		c.misses[query].Inc(1)
+		return nil, false
+	}
+
+	c.hits[query].Inc(1)
+	return entry.value, true
+}
+
+func (c *resultCache) set(key string, value interface{}) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCacheEntries {
+		c.evict()
+	}
+	c.entries[key] = cacheEntry{
+		value:   value,
+		expires: time.Now().Add(c.ttl),
+	}
+}
+
+// evict removes the expired results, or the result closest to expiring if none have, to make room for another.
+func (c *resultCache) evict() {
+	now := time.Now()
+	var oldest string
+	var oldestExpires time.Time
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldest == "" || entry.expires.Before(oldestExpires) {
+			oldest = key
+			oldestExpires = entry.expires
+		}
+	}
+	if len(c.entries) >= maxCacheEntries {
+		delete(c.entries, oldest)
+	}
+}
+
+// invalidate removes every cached result whose key starts with one of the prefixes.
+func (c *resultCache) invalidate(prefixes ...string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.entries {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				delete(c.entries, key)
+				break
+			}
+		}
+	}
+}
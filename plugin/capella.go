@@ -0,0 +1,72 @@
+package plugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// capellaDialTimeout is how long to wait for a Capella node when checking its certificate.
+const capellaDialTimeout = 10 * time.Second
+
+// verifyCapellaOptions checks that the options can be used with Capella, which only accepts TLS connections and
+// doesn't let clusters be set up by their users.
+func verifyCapellaOptions(opts options.Options) error {
+	if !strings.HasPrefix(opts.ConnStr, "couchbases://") {
+		return errors.New("capella requires a couchbases:// connection string")
+	}
+	if opts.CA == "" {
+		return errors.New("capella requires ca, the cluster's root certificate downloaded from the Capella UI")
+	}
+	if opts.AutoSetup {
+		return errors.New("auto setup is not supported with capella")
+	}
+
+	return nil
+}
+
+// VerifyCapellaCertificate connects to a node of a Capella cluster to check that its certificate chain is trusted by
+// the CA, as otherwise the SDK only reports that it failed to connect. The node is found through the cluster's DNS SRV
+// record, as the SDK does, falling back to the host itself.
+func VerifyCapellaCertificate(opts options.Options, logger hclog.Logger) error {
+	hosts := Hosts(opts.ConnStr)
+	if len(hosts) == 0 {
+		return errors.New("connection string contains no hosts")
+	}
+
+	address := net.JoinHostPort(hosts[0], "11207")
+	_, records, err := net.LookupSRV("couchbases", "tcp", hosts[0])
+	if err == nil && len(records) > 0 {
+		address = net.JoinHostPort(strings.TrimSuffix(records[0].Target, "."), strconv.Itoa(int(records[0].Port)))
+	} else {
+		logger.Debug("no SRV record found, connecting to the host", "host", hosts[0], "error", err)
+	}
+
+	config, err := TLSConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: capellaDialTimeout}, "tcp", address, config)
+	if err != nil {
+		switch err.(type) {
+		case x509.UnknownAuthorityError:
+			return errors.Errorf("the certificate presented by %s isn't signed by the CA in %s, download the cluster's root certificate from the Capella UI", address, opts.CA)
+		case x509.HostnameError:
+			return errors.Errorf("the certificate presented by %s isn't valid for that address: %v", address, err)
+		}
+
+		return errors.Wrapf(err, "failed to connect to %s", address)
+	}
+	conn.Close()
+
+	logger.Debug("verified capella certificate", "address", address)
+	return nil
+}
@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"encoding/json"
+
+	"github.com/golang/snappy"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// The codecs that span payloads can be compressed with.
+const (
+	noCompression     = "none"
+	snappyCompression = "snappy"
+	zstdCompression   = "zstd"
+)
+
+// The zstd encoder and decoder are safe for concurrent use with EncodeAll and DecodeAll, they only fail to be created
+// when given invalid options.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// spanPayload holds the bulky parts of a span which are compressed together, the fields used by queries are always
+// left uncompressed.
+type spanPayload struct {
+	Tags        []model.KeyValue `json:"tags"`
+	Logs        []model.Log      `json:"logs"`
+	Events      []Event          `json:"events,omitempty"`
+	ProcessTags []model.KeyValue `json:"process_tags"`
+}
+
+func isValidCompression(codec string) bool {
+	switch codec {
+	case noCompression, snappyCompression, zstdCompression:
+		return true
+	}
+
+	return false
+}
+
+// compress moves the span's tags, logs, events and process tags into its payload, compressed using the codec.
+func (s *Span) compress(codec string) error {
+	payload := spanPayload{
+		Tags:   s.Tags,
+		Logs:   s.Logs,
+		Events: s.Events,
+	}
+	if s.Process != nil {
+		payload.ProcessTags = s.Process.Tags
+		// The process is shared with the span being written so it's copied rather than modified.
+		process := *s.Process
+		process.Tags = nil
+		s.Process = &process
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal span payload")
+	}
+
+	s.Payload, err = compressBytes(codec, data)
+	if err != nil {
+		return err
+	}
+	s.Codec = codec
+	s.Tags = nil
+	s.Logs = nil
+	s.Events = nil
+
+	return nil
+}
+
+// decompress restores the span's tags, logs, events and process tags from its payload.
+func (s *Span) decompress() error {
+	data, err := decompressBytes(s.Codec, s.Payload)
+	if err != nil {
+		return err
+	}
+
+	var payload spanPayload
+	err = json.Unmarshal(data, &payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to unmarshal span payload")
+	}
+
+	s.Tags = payload.Tags
+	s.Logs = payload.Logs
+	s.Events = payload.Events
+	if s.Process != nil {
+		s.Process.Tags = payload.ProcessTags
+	}
+	s.Codec = ""
+	s.Payload = nil
+
+	return nil
+}
+
+func compressBytes(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case snappyCompression:
+		return snappy.Encode(nil, data), nil
+	case zstdCompression:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+
+	return nil, errors.Errorf("unknown compression codec %q", codec)
+}
+
+func decompressBytes(codec string, data []byte) ([]byte, error) {
+	var decompressed []byte
+	var err error
+	switch codec {
+	case snappyCompression:
+		decompressed, err = snappy.Decode(nil, data)
+	case zstdCompression:
+		decompressed, err = zstdDecoder.DecodeAll(data, nil)
+	default:
+		return nil, errors.Errorf("unknown compression codec %q", codec)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress span payload")
+	}
+
+	return decompressed, nil
+}
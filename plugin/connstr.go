@@ -0,0 +1,155 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/httpclient"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// connectionString adds the certificate paths, network type and connection tuning to the connection string, gocb v1
+// can only be given these through its connection string.
+func connectionString(opts options.Options) (string, error) {
+	if opts.Capella {
+		err := verifyCapellaOptions(opts)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	params := url.Values{}
+	switch opts.NetworkType {
+	case "", "auto":
+	case "default", "external":
+		params.Set("network", opts.NetworkType)
+	default:
+		return "", errors.Errorf("unknown network type %q", opts.NetworkType)
+	}
+
+	switch opts.AuthDomain {
+	case "", "local":
+	case "external":
+		// The cluster checks external users' passwords with the LDAP server, so it only accepts them with SASL PLAIN,
+		// which needs the plain password, over TLS. gocb v1 authenticates every KV connection with PLAIN, through
+		// gocbcore's default auth handler, and never negotiates SCRAM, so requiring TLS is all that's needed for PLAIN
+		// to be used and accepted.
+		if !strings.HasPrefix(opts.ConnStr, "couchbases://") {
+			return "", errors.New("external users require a couchbases:// connection string")
+		}
+		if opts.UseCertAuth {
+			return "", errors.New("external users can't authenticate with a certificate")
+		}
+	default:
+		return "", errors.Errorf("unknown auth domain %q", opts.AuthDomain)
+	}
+
+	if opts.UseCertAuth && (opts.Cert == "" || opts.Key == "") {
+		return "", errors.New("certificate authentication requires a cert and key")
+	}
+	if opts.CA != "" || opts.Cert != "" || opts.Key != "" {
+		if !strings.HasPrefix(opts.ConnStr, "couchbases://") {
+			return "", errors.New("certificates can only be used with a couchbases:// connection string")
+		}
+		if opts.CA != "" {
+			params.Set("cacertpath", opts.CA)
+		}
+		if opts.Cert != "" {
+			params.Set("certpath", opts.Cert)
+		}
+		if opts.Key != "" {
+			params.Set("keypath", opts.Key)
+		}
+	}
+
+	tuning := []struct {
+		name  string
+		value int
+	}{
+		{"kv_pool_size", opts.KVPoolSize},
+		{"max_queue_size", opts.KVQueueSize},
+		{"http_max_idle_conns", opts.HTTPMaxIdleConns},
+		{"http_max_idle_conns_per_host", opts.HTTPMaxIdleConnsPerHost},
+	}
+	for _, param := range tuning {
+		if param.value < 0 {
+			return "", errors.Errorf("%s must not be negative", param.name)
+		}
+		// Unset parameters leave the SDK's default in place.
+		if param.value > 0 {
+			params.Set(param.name, strconv.Itoa(param.value))
+		}
+	}
+
+	// Writes only return mutation tokens, which at_plus queries wait for, when they're asked for.
+	if opts.ScanConsistency == "at_plus" {
+		params.Set("fetch_mutation_tokens", "true")
+	}
+
+	if len(params) == 0 {
+		return opts.ConnStr, nil
+	}
+
+	separator := "?"
+	if strings.Contains(opts.ConnStr, "?") {
+		separator = "&"
+	}
+
+	return opts.ConnStr + separator + params.Encode(), nil
+}
+
+// Hosts returns the hosts listed in a connection string, without their ports, so that they can be used for REST
+// requests. Connection strings may list several nodes, e.g. couchbase://node1,node2:11210?network=external.
+func Hosts(connStr string) []string {
+	if i := strings.Index(connStr, "://"); i >= 0 {
+		connStr = connStr[i+3:]
+	}
+	if i := strings.IndexAny(connStr, "/?"); i >= 0 {
+		connStr = connStr[:i]
+	}
+
+	var hosts []string
+	for _, address := range strings.FieldsFunc(connStr, func(r rune) bool { return r == ',' || r == ';' }) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			// The address has no port.
+			host = strings.Trim(address, "[]")
+		}
+		hosts = append(hosts, host)
+	}
+
+	return hosts
+}
+
+// ManagementHost returns the first of the hosts whose management REST API responds, or the first host if none of
+// them do so that callers which wait for the cluster to start still have a host to wait on.
+func ManagementHost(hosts []string, client httpclient.Client, logger hclog.Logger) (string, error) {
+	if len(hosts) == 0 {
+		return "", errors.New("connection string contains no hosts")
+	}
+
+	for _, host := range hosts {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:8091/pools", host), nil)
+		if err != nil {
+			return "", err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			logger.Info("host is unreachable, trying the next host", "host", host, "error", err)
+			continue
+		}
+		resp.Body.Close()
+
+		return host, nil
+	}
+
+	logger.Warn("no hosts responded, using the first host", "host", hosts[0])
+	return hosts[0], nil
+}
@@ -0,0 +1,110 @@
+package plugin
+
+import (
+	"sync"
+
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// The scan consistencies decide which writes a query is guaranteed to see.
+const (
+	// notBoundedConsistency queries the indexes as they are, which is fastest but may miss recent writes.
+	notBoundedConsistency = "not_bounded"
+	// requestPlusConsistency waits for the indexes to include every write made before the query.
+	requestPlusConsistency = "request_plus"
+	// atPlusConsistency waits for the indexes to include the plugin's own recent writes.
+	atPlusConsistency = "at_plus"
+
+	// maximumMutationTokens is the number of recent writes that at_plus queries wait for.
+	maximumMutationTokens = 1024
+)
+
+func isValidScanConsistency(consistency string) bool {
+	switch consistency {
+	case notBoundedConsistency, requestPlusConsistency, atPlusConsistency:
+		return true
+	}
+
+	return false
+}
+
+// mutationTokens holds the mutation tokens of the most recent writes.
+type mutationTokens struct {
+	mu     sync.Mutex
+	tokens []gocb.MutationToken
+	next   int
+}
+
+func newMutationTokens() *mutationTokens {
+	return &mutationTokens{
+		tokens: make([]gocb.MutationToken, 0, maximumMutationTokens),
+	}
+}
+
+func (t *mutationTokens) add(token gocb.MutationToken) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.tokens) < maximumMutationTokens {
+		t.tokens = append(t.tokens, token)
+		return
+	}
+	t.tokens[t.next] = token
+	t.next = (t.next + 1) % maximumMutationTokens
+}
+
+// state returns a mutation state holding the tokens, or nil if there are none. A new state is made each time as the
+// SDK reads it whilst the query is running.
+func (t *mutationTokens) state() *gocb.MutationState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.tokens) == 0 {
+		return nil
+	}
+
+	// Tokens are added oldest first so that the newest token for each vbucket wins.
+	state := gocb.NewMutationState()
+	state.Add(t.tokens[t.next:]...)
+	state.Add(t.tokens[:t.next]...)
+
+	return state
+}
+
+// recordMutation keeps the mutation token of a write for at_plus queries.
+func (cs *couchbaseStore) recordMutation(frag *gocb.DocumentFragment) {
+	if cs.mutations == nil || frag == nil {
+		return
+	}
+
+	cs.mutations.add(frag.MutationToken())
+}
+
+// withN1QLConsistency sets the scan consistency of the query.
+func (cs *couchbaseStore) withN1QLConsistency(query *gocb.N1qlQuery) *gocb.N1qlQuery {
+	switch cs.scanConsistency {
+	case requestPlusConsistency:
+		query.Consistency(gocb.RequestPlus)
+	case atPlusConsistency:
+		// Stores without writes of their own, or that haven't written yet, have nothing to wait for.
+		if cs.mutations == nil {
+			break
+		}
+		if state := cs.mutations.state(); state != nil {
+			query.ConsistentWith(state)
+		}
+	}
+
+	return query
+}
+
+// withAnalyticsConsistency sets the scan consistency of the query. Analytics has no at_plus so it waits for every
+// write instead.
+func (cs *couchbaseStore) withAnalyticsConsistency(query *gocb.AnalyticsQuery) *gocb.AnalyticsQuery {
+	switch cs.scanConsistency {
+	case requestPlusConsistency, atPlusConsistency:
+		query.RawParam("scan_consistency", requestPlusConsistency)
+	}
+
+	return query
+}
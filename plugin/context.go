@@ -0,0 +1,52 @@
+package plugin
+
+import (
+	"context"
+	"time"
+)
+
+// minimumTimeout is the shortest timeout given to a service. A deadline can pass between checking the context and
+// sending the request, and the services reject timeouts that aren't positive or take them to mean no timeout at all.
+const minimumTimeout = time.Millisecond
+
+// timeoutUntil returns the time left until the deadline as a timeout for a service, at least minimumTimeout.
+func timeoutUntil(deadline time.Time) time.Duration {
+	timeout := time.Until(deadline)
+	if timeout < minimumTimeout {
+		return minimumTimeout
+	}
+
+	return timeout
+}
+
+// contextResult stops returning rows once its context is done. Closing the result closes the underlying HTTP
+// response, which the query and analytics services take as a signal to cancel the request.
+type contextResult struct {
+	Result
+	ctx context.Context
+}
+
+func (r *contextResult) Next(valuePtr interface{}) bool {
+	if r.ctx.Err() != nil {
+		return false
+	}
+
+	return r.Result.Next(valuePtr)
+}
+
+func (r *contextResult) NextBytes() []byte {
+	if r.ctx.Err() != nil {
+		return nil
+	}
+
+	return r.Result.NextBytes()
+}
+
+func (r *contextResult) Close() error {
+	err := r.Result.Close()
+	if ctxErr := r.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	return err
+}
@@ -0,0 +1,166 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultDataverse = "Default"
+
+	createDataverseStmt = "CREATE DATAVERSE %s IF NOT EXISTS"
+	createDatasetStmt   = "CREATE DATASET IF NOT EXISTS %s ON %s"
+	connectLinkStmt     = "CONNECT LINK %s.%s"
+	queryDatasets       = "SELECT ds.DataverseName, ds.DatasetName FROM Metadata.`Dataset` ds"
+)
+
+// analyticsNames are the dataverse, datasets and link that analytics statements use, so that several plugins can share
+// an analytics service with datasets of their own. Empty names use the dataverse and datasets named after the
+// keyspaces.
+type analyticsNames struct {
+	dataverse         string
+	spanDataset       string
+	dependencyDataset string
+	link              string
+}
+
+// VerifyDatasets checks that an analytics dataset exists for each keyspace that the store queries, creating any
+// that are missing. If datasets are still missing afterwards then the store falls back to N1QL when allowed to,
+// otherwise an error listing the missing datasets is returned.
+func VerifyDatasets(opts options.Options, store Store, logger hclog.Logger) error {
+	if !store.UsesAnalytics() {
+		return nil
+	}
+
+	keyspaces := []string{store.Keyspace()}
+	if store.DependencyKeyspace() != store.Keyspace() {
+		keyspaces = append(keyspaces, store.DependencyKeyspace())
+	}
+
+	missing, err := missingDatasets(store, keyspaces)
+	if err != nil {
+		return errors.Wrap(err, "failed to list analytics datasets")
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	logger.Warn("analytics datasets are missing, creating them", "datasets", strings.Join(missing, ", "))
+	err = createDatasets(store, keyspaces)
+	if err != nil {
+		logger.Warn("failed to create analytics datasets", "error", err)
+	}
+
+	missing, err = missingDatasets(store, keyspaces)
+	if err != nil {
+		return errors.Wrap(err, "failed to list analytics datasets")
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if opts.UseN1QLFallback {
+		logger.Warn("analytics datasets are missing, falling back to N1QL", "datasets", strings.Join(missing, ", "))
+		store.UseAnalytics(false)
+		return nil
+	}
+
+	return errors.Errorf("missing analytics datasets: %s", strings.Join(missing, ", "))
+}
+
+// missingDatasets returns the names of the datasets that are expected for the keyspaces but do not exist.
+func missingDatasets(store Store, keyspaces []string) ([]string, error) {
+	result, err := store.Query(context.Background(), queryDatasets, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]struct{})
+	var dataset struct {
+		DataverseName string `json:"DataverseName"`
+		DatasetName   string `json:"DatasetName"`
+	}
+	for result.Next(&dataset) {
+		existing[dataset.DataverseName+"."+dataset.DatasetName] = struct{}{}
+	}
+
+	if err = result.Close(); err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, keyspace := range keyspaces {
+		dataverse, name := store.Dataset(keyspace)
+		if _, ok := existing[dataverse+"."+name]; !ok {
+			missing = append(missing, dataverse+"."+name)
+		}
+	}
+
+	return missing, nil
+}
+
+// datasetName returns the dataverse and dataset name that shadow a keyspace. Datasets for named collections live
+// in a dataverse named after the bucket and scope, which analytics reports as "bucket/scope".
+func datasetName(keyspace string) (string, string) {
+	parts := splitKeyspace(keyspace)
+	if len(parts) == 1 {
+		return defaultDataverse, parts[0]
+	}
+
+	return strings.Join(parts[:len(parts)-1], "/"), parts[len(parts)-1]
+}
+
+// datasetReference returns the dataset as it's named in analytics statements, e.g. `bucket`.`scope`.`collection` for
+// the dataset of a collection.
+func datasetReference(dataverse, name string) string {
+	return dataverseReference(dataverse) + "." + QuoteIdentifier(name)
+}
+
+// dataverseReference returns the dataverse as it's named in analytics statements. Dataverses of scopes are reported
+// as "bucket/scope" but named as `bucket`.`scope`.
+func dataverseReference(dataverse string) string {
+	parts := strings.Split(dataverse, "/")
+	for i, part := range parts {
+		parts[i] = QuoteIdentifier(part)
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// createDatasets creates a dataset shadowing each keyspace, so that the reader's queries can be used against either
+// service once the keyspaces are replaced by their datasets, and then connects the link of each dataverse so that the
+// datasets are populated.
+func createDatasets(store Store, keyspaces []string) error {
+	var dataverses []string
+	for _, keyspace := range keyspaces {
+		dataverse, name := store.Dataset(keyspace)
+		if dataverse != defaultDataverse {
+			err := store.ExecuteAnalytics(fmt.Sprintf(createDataverseStmt, dataverseReference(dataverse)), nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := store.ExecuteAnalytics(fmt.Sprintf(createDatasetStmt, datasetReference(dataverse, name), keyspace), nil)
+		if err != nil {
+			return err
+		}
+		if len(dataverses) == 0 || dataverses[len(dataverses)-1] != dataverse {
+			dataverses = append(dataverses, dataverse)
+		}
+	}
+
+	for _, dataverse := range dataverses {
+		err := store.ExecuteAnalytics(fmt.Sprintf(connectLinkStmt, dataverseReference(dataverse), QuoteIdentifier(store.AnalyticsLink())), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
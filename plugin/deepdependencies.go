@@ -0,0 +1,373 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	deepDependencyDocumentType = "ddg"
+
+	// queryPathSpansStmt reads the service, operation and parent of every span started in a period, from which the
+	// call paths of their traces are built. Spans are ordered by trace so that each trace's paths can be built as soon
+	// as its spans have been read, rather than holding every span of the period.
+	queryPathSpansStmt = `
+SELECT s.trace_id, s.span_id, s.process.service_name AS service, s.operation_name AS operation,
+FIRST r.span_id FOR r IN IFMISSINGORNULL(s.` + "`references`" + `, []) WHEN r.trace_id = s.trace_id END AS parent_id
+FROM %s AS s
+WHERE s.start_time >= ? AND s.start_time < ? AND s.` + "`type`" + `="span"
+ORDER BY s.trace_id.hi, s.trace_id.lo`
+
+	queryDeepDependenciesStmt = "SELECT RAW roots FROM %s WHERE `type`=\"ddg\" AND ANY s IN services SATISFIES s = ? END AND `start` >= ? AND `start` < ?"
+
+	deepDependenciesIndexFields = "DISTINCT ARRAY s FOR s IN services END, `start`"
+)
+
+// PathNode is a service and operation on a call path.
+type PathNode struct {
+	Service   string `json:"service"`
+	Operation string `json:"operation"`
+}
+
+// PathAttribute is an attribute of a call path, such as a trace that it was found in.
+type PathAttribute struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// DeepDependencyPath is a call path from a root span through the services of traces, in the shape of the paths of
+// Jaeger's deep dependency graph. Count is the number of traces that the path was found in, and the attributes hold
+// an exemplar_trace_id of one of them.
+type DeepDependencyPath struct {
+	Path       []PathNode      `json:"path"`
+	Count      uint64          `json:"count"`
+	Attributes []PathAttribute `json:"attributes"`
+}
+
+// DeepDependencyReader reads the call paths through a service, and optionally one of its operations, for the deep
+// dependency graph.
+type DeepDependencyReader interface {
+	GetDeepDependencies(ctx context.Context, service, operation string, endTs time.Time, lookback time.Duration) ([]DeepDependencyPath, error)
+}
+
+// pathTrie is a node of a trie of the call paths starting at a root operation. Paths counts the traces with a path
+// that ends at the node, and Exemplar is one of them.
+type pathTrie struct {
+	PathNode
+	Paths    uint64      `json:"paths,omitempty"`
+	Exemplar string      `json:"exemplar,omitempty"`
+	Children []*pathTrie `json:"children,omitempty"`
+}
+
+// child returns the child for the node, adding it if there isn't one.
+func (t *pathTrie) child(node PathNode) *pathTrie {
+	for _, c := range t.Children {
+		if c.PathNode == node {
+			return c
+		}
+	}
+	c := &pathTrie{PathNode: node}
+	t.Children = append(t.Children, c)
+
+	return c
+}
+
+// merge adds the paths of the other trie, which starts at the same node, to the trie.
+func (t *pathTrie) merge(other *pathTrie) {
+	t.Paths += other.Paths
+	if t.Exemplar == "" {
+		t.Exemplar = other.Exemplar
+	}
+	for _, c := range other.Children {
+		t.child(c.PathNode).merge(c)
+	}
+}
+
+// deepDependencyDocument holds the tries of the call paths starting at a root service's operations for a period,
+// along with every service on the paths so that the documents holding a service can be found.
+type deepDependencyDocument struct {
+	Type     string      `json:"type"`
+	Start    string      `json:"start"`
+	Services []string    `json:"services"`
+	Roots    []*pathTrie `json:"roots"`
+}
+
+// insert adds a path starting at the document's service, found in the trace, to the document.
+func (d *deepDependencyDocument) insert(path []PathNode, traceID string) {
+	var node *pathTrie
+	for _, root := range d.Roots {
+		if root.PathNode == path[0] {
+			node = root
+		}
+	}
+	if node == nil {
+		node = &pathTrie{PathNode: path[0]}
+		d.Roots = append(d.Roots, node)
+	}
+	for _, n := range path[1:] {
+		node = node.child(n)
+	}
+	node.Paths++
+	if node.Exemplar == "" {
+		node.Exemplar = traceID
+	}
+
+	for _, n := range path {
+		found := false
+		for _, s := range d.Services {
+			found = found || s == n.Service
+		}
+		if !found {
+			d.Services = append(d.Services, n.Service)
+		}
+	}
+}
+
+// pathSpan is the part of a span that call paths are built from.
+type pathSpan struct {
+	TraceID   TraceID `json:"trace_id"`
+	SpanID    uint64  `json:"span_id"`
+	ParentID  uint64  `json:"parent_id"`
+	Service   string  `json:"service"`
+	Operation string  `json:"operation"`
+}
+
+// AggregateDeepDependencies stores the call paths, of up to maxDepth services and operations, of the traces with spans
+// started between start and end as a document for each root service that expires after the ttl, returning how many
+// were stored. Paths run from each root span to each leaf span, with consecutive spans of the same operation counted
+// once, and a span whose parent started outside the period is taken to be a root.
+func AggregateDeepDependencies(store Store, start, end time.Time, ttl time.Duration, traceModel bool, maxDepth int) (int, error) {
+	docs := make(map[string]*deepDependencyDocument)
+	var services []string
+	err := queryPathSpans(context.Background(), store, start, end, traceModel, func(traceID TraceID, spans map[uint64]*pathSpan) {
+		for _, path := range tracePaths(spans, maxDepth) {
+			doc, ok := docs[path[0].Service]
+			if !ok {
+				doc = &deepDependencyDocument{Type: deepDependencyDocumentType, Start: start.Format(dateLayout)}
+				docs[path[0].Service] = doc
+				services = append(services, path[0].Service)
+			}
+			doc.insert(path, traceID.hex())
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// The dependency collection may differ from the span collection so the documents are written using N1QL.
+	for _, service := range services {
+		key := fmt.Sprintf("ddg::%d::%s", start.Unix(), service)
+		err = store.Execute(fmt.Sprintf(upsertStmt, store.DependencyKeyspace()), []interface{}{key, docs[service], expiryFromTTL(ttl)})
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to write deep dependencies")
+		}
+	}
+
+	return len(services), nil
+}
+
+// maxPathSpans is the most spans of a trace that its call paths are built from, the rest of a bigger trace's spans
+// are dropped so that a runaway trace can't exhaust the plugin's memory.
+const maxPathSpans = 10000
+
+// queryPathSpans reads the spans started between start and end a trace at a time, keyed by span ID, and passes each
+// trace's spans to fn. Each keyspace holding spans is read in turn, so a trace whose spans were stored in different
+// partitions is passed once for each of them.
+func queryPathSpans(ctx context.Context, store Store, start, end time.Time, traceModel bool, fn func(traceID TraceID, spans map[uint64]*pathSpan)) error {
+	for _, keyspace := range store.SpanKeyspaces(start, end) {
+		if traceModel {
+			keyspace = fmt.Sprintf(spansKeyspaceTemplate, keyspace)
+		}
+
+		result, err := store.Query(
+			ctx,
+			fmt.Sprintf(queryPathSpansStmt, keyspace),
+			[]interface{}{start.UTC().Format(dateLayout), end.UTC().Format(dateLayout)},
+		)
+		if err != nil {
+			return errors.Wrap(err, "failed to query deep dependencies")
+		}
+
+		var traceID TraceID
+		spans := make(map[uint64]*pathSpan)
+		for {
+			span := &pathSpan{}
+			if !result.Next(span) {
+				break
+			}
+			if span.TraceID != traceID && len(spans) > 0 {
+				fn(traceID, spans)
+				spans = make(map[uint64]*pathSpan)
+			}
+			traceID = span.TraceID
+			if len(spans) < maxPathSpans {
+				spans[span.SpanID] = span
+			}
+		}
+		if len(spans) > 0 {
+			fn(traceID, spans)
+		}
+
+		err = result.Close()
+		if err != nil {
+			return errors.Wrap(err, "failed to query deep dependencies")
+		}
+	}
+
+	return nil
+}
+
+// tracePaths returns the distinct call paths of a trace's spans, cut off after maxDepth services and operations.
+func tracePaths(spans map[uint64]*pathSpan, maxDepth int) [][]PathNode {
+	children := make(map[uint64][]*pathSpan)
+	var roots []*pathSpan
+	for _, span := range spans {
+		if _, ok := spans[span.ParentID]; ok && span.ParentID != span.SpanID {
+			children[span.ParentID] = append(children[span.ParentID], span)
+		} else {
+			roots = append(roots, span)
+		}
+	}
+
+	var paths [][]PathNode
+	seen := make(map[string]bool)
+	var walk func(span *pathSpan, path []PathNode)
+	walk = func(span *pathSpan, path []PathNode) {
+		node := PathNode{Service: span.Service, Operation: span.Operation}
+		if len(path) == 0 || path[len(path)-1] != node {
+			path = append(path, node)
+		}
+		if len(children[span.SpanID]) > 0 && len(path) < maxDepth {
+			for _, child := range children[span.SpanID] {
+				walk(child, path)
+			}
+			return
+		}
+
+		key := pathKey(path)
+		if !seen[key] {
+			seen[key] = true
+			paths = append(paths, append([]PathNode(nil), path...))
+		}
+	}
+	for _, root := range roots {
+		walk(root, nil)
+	}
+
+	return paths
+}
+
+func pathKey(path []PathNode) string {
+	parts := make([]string, len(path))
+	for i, node := range path {
+		parts[i] = strconv.Quote(node.Service) + ":" + strconv.Quote(node.Operation)
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// GetDeepDependencies reads the call paths through the service, and the operation when it's set, from the paths
+// aggregated over the lookback.
+func (cs *couchbaseDependencyReader) GetDeepDependencies(ctx context.Context, service, operation string, endTs time.Time, lookback time.Duration) ([]DeepDependencyPath, error) {
+	// Deep dependencies are aggregated an interval at a time, so requests ending in the same minute read the same
+	// documents.
+	key := "ddg::" + strconv.Quote(service) + "::" + strconv.Quote(operation) + "::" + endTs.Truncate(time.Minute).Format(dateLayout) + "::" + lookback.String()
+	if paths, ok := cs.cache.get("getDeepDependencies", key); ok {
+		return paths.([]DeepDependencyPath), nil
+	}
+
+	start := time.Now()
+	paths, err := cs.getDeepDependencies(withQueryName(ctx, "getDeepDependencies"), service, operation, endTs, lookback)
+	cs.metrics.record("getDeepDependencies", start, err)
+	if err != nil {
+		cs.logger.Warn("deep dependency query failed", "error", err)
+	} else {
+		cs.cache.set(key, paths)
+	}
+
+	return paths, err
+}
+
+func (cs *couchbaseDependencyReader) getDeepDependencies(ctx context.Context, service, operation string, endTs time.Time, lookback time.Duration) ([]DeepDependencyPath, error) {
+	// Paths are only ever found by querying, so in key-value only mode there are none.
+	if cs.kvOnly {
+		return nil, nil
+	}
+
+	if cs.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cs.timeout)
+		defer cancel()
+	}
+
+	result, err := cs.store.Query(
+		ctx,
+		fmt.Sprintf(queryDeepDependenciesStmt, cs.store.DependencyKeyspace()),
+		[]interface{}{service, endTs.Add(-lookback).Format(dateLayout), endTs.Format(dateLayout)},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading deep dependencies from storage")
+	}
+
+	// The tries of each period are merged, so that a path found in several periods is returned once.
+	var roots []*pathTrie
+	for {
+		var docRoots []*pathTrie
+		if !result.Next(&docRoots) {
+			break
+		}
+		for _, root := range docRoots {
+			var merged bool
+			for _, r := range roots {
+				if r.PathNode == root.PathNode {
+					r.merge(root)
+					merged = true
+				}
+			}
+			if !merged {
+				roots = append(roots, root)
+			}
+		}
+	}
+
+	if err = result.Close(); err != nil {
+		return nil, errors.Wrap(err, "Error reading deep dependencies from storage")
+	}
+
+	var paths []DeepDependencyPath
+	var walk func(node *pathTrie, path []PathNode)
+	walk = func(node *pathTrie, path []PathNode) {
+		path = append(path, node.PathNode)
+		if node.Paths > 0 && pathThrough(path, service, operation) {
+			paths = append(paths, DeepDependencyPath{
+				Path:       append([]PathNode(nil), path...),
+				Count:      node.Paths,
+				Attributes: []PathAttribute{{Key: "exemplar_trace_id", Value: node.Exemplar}},
+			})
+		}
+		for _, child := range node.Children {
+			walk(child, path)
+		}
+	}
+	for _, root := range roots {
+		walk(root, nil)
+	}
+
+	return paths, nil
+}
+
+// pathThrough reports whether the path goes through the service, and the operation when it's set.
+func pathThrough(path []PathNode, service, operation string) bool {
+	for _, node := range path {
+		if node.Service == service && (operation == "" || node.Operation == operation) {
+			return true
+		}
+	}
+
+	return false
+}
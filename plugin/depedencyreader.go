@@ -1,8 +1,11 @@
 package plugin
 
 import (
+	"context"
+	"fmt"
 	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/model"
 	"github.com/pkg/errors"
 )
@@ -12,24 +15,101 @@ var (
 )
 
 type Dependency struct {
-	Deps []model.DependencyLink `json:"dependencies"`
-	Ts   time.Time              `json:"ts"`
+	Deps []DependencyEdge `json:"dependencies"`
+	Ts   time.Time        `json:"ts"`
+}
+
+// DependencyEdgeReader reads the dependencies between services along with how many calls failed and whether they were
+// confirmed or inferred, e.g. to shade the edges of the dependency graph by their error rate.
+type DependencyEdgeReader interface {
+	GetDependencyEdges(ctx context.Context, endTs time.Time, lookback time.Duration) ([]DependencyEdge, error)
 }
 
 type couchbaseDependencyReader struct {
-	store Store
+	store       Store
+	timeout     time.Duration
+	adhoc       bool
+	maxLookback time.Duration
+	traceModel  bool
+	kvOnly      bool
+	cache       *resultCache
+	metrics     *readMetrics
+	logger      hclog.Logger
 }
 
 func (cs *couchbaseDependencyReader) GetDependencies(endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	return cs.GetDependenciesContext(context.Background(), endTs, lookback)
+}
+
+// GetDependenciesContext is GetDependencies for callers that have a context, which the dependency query is
+// abandoned with.
+func (cs *couchbaseDependencyReader) GetDependenciesContext(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	edges, err := cs.GetDependencyEdges(ctx, endTs, lookback)
+	if err != nil {
+		return nil, err
+	}
+
+	return dependencyLinks(edges), nil
+}
+
+// GetDependencyEdges reads the dependencies with a separate edge for the confirmed and inferred calls between each
+// pair of services, along with how many of the calls failed.
+func (cs *couchbaseDependencyReader) GetDependencyEdges(ctx context.Context, endTs time.Time, lookback time.Duration) ([]DependencyEdge, error) {
+	// The UI asks for dependencies up to now, so requests ending in the same minute share a result.
+	key := "dependencies::" + endTs.Truncate(time.Minute).Format(dateLayout) + "::" + lookback.String()
+	if deps, ok := cs.cache.get("getDependencies", key); ok {
+		return deps.([]DependencyEdge), nil
+	}
+
+	start := time.Now()
+	deps, err := cs.getDependencies(withQueryName(ctx, "getDependencies"), endTs, lookback)
+	cs.metrics.record("getDependencies", start, err)
+	if err != nil {
+		cs.logger.Warn("dependency query failed", "error", err)
+	} else {
+		cs.cache.set(key, deps)
+	}
+
+	return deps, err
+}
+
+func (cs *couchbaseDependencyReader) getDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]DependencyEdge, error) {
+	// Dependencies are only ever found by querying, so in key-value only mode there are none.
+	if cs.kvOnly {
+		return nil, nil
+	}
+
+	if cs.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cs.timeout)
+		defer cancel()
+	}
+
+	// Computing dependencies on demand is only worth it with analytics, N1QL would be far too slow at the joins.
+	if cs.adhoc && cs.store.UsesAnalytics() {
+		if cs.maxLookback > 0 && lookback > cs.maxLookback {
+			cs.logger.Warn("dependency lookback exceeds the maximum, truncating it", "lookback", lookback, "max", cs.maxLookback)
+			lookback = cs.maxLookback
+		}
+
+		deps, err := queryDependencies(ctx, cs.store, endTs.Add(-lookback), endTs, cs.traceModel)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error reading dependencies from storage")
+		}
+
+		return deps, nil
+	}
+
 	result, err := cs.store.Query(
-		depsSelectStmt,
+		ctx,
+		fmt.Sprintf(depsSelectStmt, cs.store.DependencyKeyspace()),
 		[]interface{}{endTs.Add(-1 * lookback).Format(dateLayout), endTs.Format(dateLayout)},
 	)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error reading dependencies from storage")
 	}
 
-	var deps []model.DependencyLink
+	var deps []DependencyEdge
 	var resDep Dependency
 	for result.Next(&resDep) {
 		for _, dep := range resDep.Deps {
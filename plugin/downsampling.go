@@ -0,0 +1,74 @@
+package plugin
+
+import (
+	"hash"
+	"hash/fnv"
+	"math"
+	"math/big"
+	"sync"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// traceIDSize is the size of a trace ID when marshalled, the high and low halves in big endian order.
+const traceIDSize = 16
+
+// downsampler keeps a deterministic fraction of traces, deciding in the same way as jaeger-collector's downsampling
+// so that a trace is kept or dropped by every collector and plugin configured with the same ratio and salt. The FNV-1a
+// hash of the salt followed by the trace ID is compared against the ratio's fraction of the hash space.
+type downsampler struct {
+	threshold  uint64
+	saltLength int
+	hashers    sync.Pool
+}
+
+// hasher holds a buffer with the salt already copied in, so that only the trace ID has to be copied for each span.
+type hasher struct {
+	hash   hash.Hash64
+	buffer []byte
+}
+
+// newDownsampler returns a downsampler keeping ratio of traces, or nil if every trace is kept.
+func newDownsampler(ratio float64, salt string) *downsampler {
+	if ratio >= 1 {
+		return nil
+	}
+
+	saltBytes := []byte(salt)
+	return &downsampler{
+		threshold:  downsamplingThreshold(ratio),
+		saltLength: len(saltBytes),
+		hashers: sync.Pool{
+			New: func() interface{} {
+				buffer := make([]byte, len(saltBytes)+traceIDSize)
+				copy(buffer, saltBytes)
+				return &hasher{hash: fnv.New64a(), buffer: buffer}
+			},
+		},
+	}
+}
+
+// downsamplingThreshold scales the largest hash by the ratio using big floats, as converting math.MaxUint64 to a
+// float64 loses its lowest bits.
+func downsamplingThreshold(ratio float64) uint64 {
+	boundary := new(big.Float).SetInt(new(big.Int).SetUint64(math.MaxUint64))
+	threshold, _ := boundary.Mul(boundary, big.NewFloat(ratio)).Uint64()
+
+	return threshold
+}
+
+// keep reports whether the span's trace is kept, spans tagged as errors are always kept.
+func (d *downsampler) keep(span *model.Span) bool {
+	if d == nil || isErrorSpan(span) {
+		return true
+	}
+
+	h := d.hashers.Get().(*hasher)
+	defer d.hashers.Put(h)
+
+	h.hash.Reset()
+	_, _ = span.TraceID.MarshalTo(h.buffer[d.saltLength:])
+	_, _ = h.hash.Write(h.buffer)
+
+	return h.hash.Sum64() <= d.threshold
+}
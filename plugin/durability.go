@@ -0,0 +1,47 @@
+package plugin
+
+// The durability levels decide how many nodes a write must reach before it succeeds. gocb v1 has no synchronous
+// durability so the levels are met by observing the write on the replicas after it's been applied.
+const (
+	// noDurability returns as soon as the active node has the write in memory.
+	noDurability = "none"
+	// majorityDurability waits for the write to be in memory on a majority of the active and replica nodes.
+	majorityDurability = "majority"
+	// majorityAndPersistDurability waits for the write to be in memory on a majority of nodes and persisted on the
+	// active node.
+	majorityAndPersistDurability = "majorityAndPersist"
+	// persistToMajorityDurability waits for the write to be persisted on a majority of nodes.
+	persistToMajorityDurability = "persistToMajority"
+)
+
+func isValidDurability(durability string) bool {
+	switch durability {
+	case noDurability, majorityDurability, majorityAndPersistDurability, persistToMajorityDurability:
+		return true
+	}
+
+	return false
+}
+
+// isDurable reports whether writes have to wait for durability to be observed.
+func (cs *couchbaseStore) isDurable() bool {
+	return cs.durability != "" && cs.durability != noDurability
+}
+
+// durabilityRequirements returns the number of replicas that writes must be replicated to and the number of nodes,
+// including the active node, that writes must be persisted to in order to meet the durability level.
+func (cs *couchbaseStore) durabilityRequirements() (replicateTo, persistTo uint) {
+	replicas := cs.currentBucket().IoRouter().NumReplicas()
+	majority := uint((replicas+1)/2 + 1)
+
+	switch cs.durability {
+	case majorityDurability:
+		return majority - 1, 0
+	case majorityAndPersistDurability:
+		return majority - 1, 1
+	case persistToMajorityDurability:
+		return 0, majority
+	}
+
+	return 0, 0
+}
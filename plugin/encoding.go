@@ -0,0 +1,68 @@
+package plugin
+
+import (
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/pkg/errors"
+)
+
+// The encodings that spans can be stored with.
+const (
+	jsonEncoding     = "json"
+	protobufEncoding = "protobuf"
+)
+
+func isValidEncoding(encoding string) bool {
+	return encoding == jsonEncoding || encoding == protobufEncoding
+}
+
+// encodeProto stores the whole span as the Jaeger protobuf model in the span's payload, compressed using the codec
+// if there is one. Only the fields used by queries are kept as JSON.
+func (s *Span) encodeProto(span *model.Span, codec string) error {
+	data, err := span.Marshal()
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal span")
+	}
+
+	if codec != "" && codec != noCompression {
+		data, err = compressBytes(codec, data)
+		if err != nil {
+			return err
+		}
+		s.Codec = codec
+	}
+
+	s.Encoding = protobufEncoding
+	s.Payload = data
+	s.Tags = nil
+	s.Logs = nil
+	s.Events = nil
+	s.Warnings = nil
+	for i := range s.References {
+		s.References[i].Attributes = nil
+	}
+	if s.Process != nil {
+		s.Process = &model.Process{ServiceName: s.Process.ServiceName}
+	}
+
+	return nil
+}
+
+// decodeProto decodes the span from its protobuf payload.
+func (s *Span) decodeProto() (*model.Span, error) {
+	data := s.Payload
+	if s.Codec != "" {
+		var err error
+		data, err = decompressBytes(s.Codec, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var span model.Span
+	err := span.Unmarshal(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal span")
+	}
+
+	return &span, nil
+}
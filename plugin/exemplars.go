@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/pkg/errors"
+)
+
+// durationBucketTag is the tag that searches for exemplar traces, those with spans that took about a quantile of the
+// latencies of their service or operation, e.g. duration.bucket=p99.
+const durationBucketTag = "duration.bucket"
+
+// exemplarWindow is how far, relative to the quantile, the durations of exemplar spans can be from it.
+const exemplarWindow = 0.05
+
+// parseDurationBucket returns the quantile named by a duration.bucket value such as p50, p99 or p99.9.
+func parseDurationBucket(value string) (float64, error) {
+	if !strings.HasPrefix(value, "p") {
+		return 0, errors.Errorf("%s %q must be a percentile such as p99", durationBucketTag, value)
+	}
+	percentile, err := strconv.ParseFloat(strings.TrimPrefix(value, "p"), 64)
+	if err != nil || percentile <= 0 || percentile > 100 {
+		return 0, errors.Errorf("%s %q must be a percentile such as p99", durationBucketTag, value)
+	}
+
+	return percentile / 100, nil
+}
+
+// exemplarQuery converts a search for exemplar traces into a search for the traces with spans whose durations are
+// within exemplarWindow of the quantile, which is read from the service performance rollups over the search's period.
+// Searches without the duration.bucket tag are returned as they are, while nil is returned when there were no spans
+// to take the quantile of.
+func (cs *couchbaseSpanReader) exemplarQuery(ctx context.Context, traceQuery *spanstore.TraceQueryParameters) (*spanstore.TraceQueryParameters, error) {
+	value, ok := traceQuery.Tags[durationBucketTag]
+	if !ok {
+		return traceQuery, nil
+	}
+	q, err := parseDurationBucket(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(traceQuery.Tags) > 1 {
+		return nil, errors.Errorf("%s can't be searched for along with other tags", durationBucketTag)
+	}
+	metricsReader := cs.store.MetricsReader()
+	if metricsReader == nil {
+		return nil, errors.Errorf("%s searches need spm.enabled", durationBucketTag)
+	}
+
+	latency, err := metricsReader.GetLatencyQuantile(ctx, &LatencyQuantileParameters{
+		ServiceName:   traceQuery.ServiceName,
+		OperationName: traceQuery.OperationName,
+		StartTime:     traceQuery.StartTimeMin,
+		EndTime:       traceQuery.StartTimeMax,
+		Quantile:      q,
+	})
+	if err != nil || latency == nil {
+		return nil, err
+	}
+
+	window := time.Duration(float64(*latency) * exemplarWindow)
+	if window < time.Microsecond {
+		window = time.Microsecond
+	}
+	exemplars := *traceQuery
+	exemplars.Tags = nil
+	exemplars.DurationMin = *latency - window
+	exemplars.DurationMax = *latency + window
+	if exemplars.DurationMin < 0 {
+		exemplars.DurationMin = 0
+	}
+
+	return &exemplars, nil
+}
@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// activity records when an operation last succeeded.
+type activity struct {
+	last int64
+}
+
+func (a *activity) record() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// time returns when the operation last succeeded, or the zero time if it never has.
+func (a *activity) time() time.Time {
+	last := atomic.LoadInt64(&a.last)
+	if last == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, last)
+}
+
+// healthStatus is the body of the health endpoints.
+type healthStatus struct {
+	Status         string     `json:"status"`
+	Bucket         string     `json:"bucket,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	MissingIndexes []string   `json:"missing_indexes,omitempty"`
+	LastRead       *time.Time `json:"last_read,omitempty"`
+	LastWrite      *time.Time `json:"last_write,omitempty"`
+}
+
+// Ping checks that the KV service of every node holding the bucket can be reached.
+func (cs *couchbaseStore) Ping() error {
+	bucket := cs.currentBucket()
+	if bucket == nil {
+		return errors.New("bucket is not open")
+	}
+
+	report, err := bucket.Ping([]gocb.ServiceType{gocb.MemdService})
+	if err != nil {
+		return errors.Wrap(err, "failed to ping bucket")
+	}
+	for _, service := range report.Services {
+		if !service.Success {
+			return errors.Errorf("failed to ping %s", service.Endpoint)
+		}
+	}
+
+	return nil
+}
+
+// Activity returns when spans were last successfully read and written.
+func (cs *couchbaseStore) Activity() (lastRead, lastWrite time.Time) {
+	lastRead = cs.readMetrics.lastSuccess.time()
+	if cs.writer != nil {
+		lastWrite = cs.writer.metrics.lastSuccess.time()
+	}
+
+	return lastRead, lastWrite
+}
+
+// HealthHandler serves the liveness endpoint at /live, which only checks that the plugin is responding, and the
+// readiness endpoint at /ready, which checks that the bucket can be reached and reports any missing indexes. Both
+// report when spans were last read and written. The liveness endpoint never goes to the cluster, so that a slow
+// cluster can't get a healthy plugin restarted.
+func HealthHandler(opts options.Options, store Store, logger hclog.Logger) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, healthOf(store, nil), logger)
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		err := store.Ping()
+		code := http.StatusOK
+		status := healthOf(store, err)
+		if err != nil {
+			code = http.StatusServiceUnavailable
+		} else {
+			missing, err := missingIndexes(opts, store)
+			if err == nil {
+				status.MissingIndexes = missing
+			}
+		}
+		writeHealth(w, code, status, logger)
+	})
+
+	return mux
+}
+
+func healthOf(store Store, err error) healthStatus {
+	status := healthStatus{
+		Status: "ok",
+	}
+	if err != nil {
+		status.Status = "unavailable"
+		status.Error = err.Error()
+	} else {
+		status.Bucket = store.Name()
+	}
+
+	lastRead, lastWrite := store.Activity()
+	if !lastRead.IsZero() {
+		status.LastRead = &lastRead
+	}
+	if !lastWrite.IsZero() {
+		status.LastWrite = &lastWrite
+	}
+
+	return status
+}
+
+func writeHealth(w http.ResponseWriter, code int, status healthStatus, logger hclog.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		logger.Debug("failed to write health status", "error", err)
+	}
+}
@@ -0,0 +1,325 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+const (
+	createPrimaryIndexStmt = "CREATE PRIMARY INDEX ON %s"
+	createSpanIndexStmt    = "CREATE INDEX `%s` ON %s(%s) WHERE `type`=\"span\""
+	createIndexStmt        = "CREATE INDEX `%s` ON %s(%s)"
+	createLookupIndexStmt  = "CREATE INDEX `%s` ON %s(%s) WHERE `type`=\"%s\""
+	queryIndexNamesStmt    = "SELECT RAW name FROM system:indexes WHERE name IN ? AND state = \"online\""
+	queryIndexKeysStmt     = "SELECT name, index_key FROM system:indexes WHERE name IN ?"
+
+	servicesIndexFields   = "service_name"
+	operationsIndexFields = "service_name, span_kind, operation_name"
+)
+
+// spanIndex is a secondary index over span documents, or only over those matching Where when it's set. The index keys
+// are Fields, led by the span's service name or trace ID when Service or TraceID is set, as those are stored differently
+// in each document layout.
+type spanIndex struct {
+	Name    string
+	Service bool
+	TraceID bool
+	Fields  string
+	Where   string
+}
+
+// fields returns the index keys over span documents in the layout.
+func (i spanIndex) fields(layout string) string {
+	var keys []string
+	if i.Service {
+		keys = append(keys, layoutFields(layout).serviceName)
+	}
+	if i.TraceID {
+		keys = append(keys, layoutFields(layout).traceIDKeys)
+	}
+	if i.Fields != "" {
+		keys = append(keys, i.Fields)
+	}
+
+	return strings.Join(keys, ", ")
+}
+
+// statement returns the statement creating the index on the keyspace, over span documents in the layout.
+func (i spanIndex) statement(keyspace, layout string) string {
+	stmt := fmt.Sprintf(createSpanIndexStmt, i.Name, keyspace, i.fields(layout))
+	if i.Where != "" {
+		stmt += " AND " + i.Where
+	}
+
+	return stmt
+}
+
+// durationIndexes are the span indexes which the duration queries need to avoid scanning every span of a service.
+var durationIndexes = []string{"jaeger_service_start_time_duration", "jaeger_service_operation_start_time_duration"}
+
+// viewIndexes are the indexes which aren't needed when services, operations and trace IDs are read from views.
+var viewIndexes = map[string]bool{
+	"jaeger_service_start_time":           true,
+	"jaeger_service_operation_start_time": true,
+	"jaeger_services":                     true,
+	"jaeger_operations":                   true,
+}
+
+// spanIndexes are the indexes over span documents. The service and operation indexes end with trace_id so that they
+// cover the trace ID searches, which then never fetch the spans themselves. The error indexes only hold failed spans,
+// so that searches for errors alone scan far fewer entries than matching every span's searchable tags.
+var spanIndexes = []spanIndex{
+	{Name: "jaeger_trace_id", TraceID: true},
+	{Name: "jaeger_service_start_time", Service: true, Fields: "start_time, trace_id"},
+	{Name: "jaeger_service_operation_start_time", Service: true, Fields: "operation_name, start_time, trace_id"},
+	{Name: "jaeger_service_start_time_duration", Service: true, Fields: "start_time, duration, trace_id"},
+	{Name: "jaeger_service_operation_start_time_duration", Service: true, Fields: "operation_name, start_time, duration, trace_id"},
+	{Name: "jaeger_start_time", Fields: "start_time"},
+	{Name: "jaeger_service_error_start_time", Service: true, Fields: "start_time, trace_id", Where: "error = true"},
+	{Name: "jaeger_service_operation_error_start_time", Service: true, Fields: "operation_name, start_time, trace_id", Where: "error = true"},
+}
+
+// CreateIndexes creates the indexes that the reader's queries depend on, along with the analytics dataset when
+// analytics is in use. Indexes that already exist are left untouched, but a warning is logged for any span index
+// created by an earlier version with different keys, and those replaced by views aren't created when views are in use.
+func CreateIndexes(store Store, logger hclog.Logger) error {
+	keyspaces := []string{store.Keyspace()}
+	if store.DependencyKeyspace() != store.Keyspace() {
+		keyspaces = append(keyspaces, store.DependencyKeyspace())
+	}
+
+	for _, keyspace := range keyspaces {
+		err := createIndex(store, fmt.Sprintf(createPrimaryIndexStmt, keyspace), logger)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create primary index on %s", keyspace)
+		}
+	}
+
+	for _, index := range spanIndexes {
+		if store.UsesViews() && viewIndexes[index.Name] {
+			continue
+		}
+		err := createIndex(store, spanIndexStatement(store, index), logger)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create index %s", index.Name)
+		}
+	}
+	err := checkIndexKeys(store, logger)
+	if err != nil {
+		return err
+	}
+
+	// The lookup indexes cover the service and operation queries so that they never fetch documents.
+	if !store.UsesViews() {
+		err = createIndex(store, fmt.Sprintf(createLookupIndexStmt, "jaeger_services", store.Keyspace(), servicesIndexFields, "service"), logger)
+		if err != nil {
+			return errors.Wrap(err, "failed to create index jaeger_services")
+		}
+
+		err = createIndex(store, fmt.Sprintf(createLookupIndexStmt, "jaeger_operations", store.Keyspace(), operationsIndexFields, "operation"), logger)
+		if err != nil {
+			return errors.Wrap(err, "failed to create index jaeger_operations")
+		}
+	}
+
+	err = createIndex(store, fmt.Sprintf(createLookupIndexStmt, "jaeger_spm", store.Keyspace(), "service_name, minute", spmDocumentType), logger)
+	if err != nil {
+		return errors.Wrap(err, "failed to create index jaeger_spm")
+	}
+
+	err = createIndex(store, fmt.Sprintf(createLookupIndexStmt, "jaeger_rollups", store.Keyspace(), "period, `start`, service_name", rollupDocumentType), logger)
+	if err != nil {
+		return errors.Wrap(err, "failed to create index jaeger_rollups")
+	}
+
+	err = createIndex(store, fmt.Sprintf(createIndexStmt, "jaeger_dependencies_ts", store.DependencyKeyspace(), "ts"), logger)
+	if err != nil {
+		return errors.Wrap(err, "failed to create index jaeger_dependencies_ts")
+	}
+
+	err = createIndex(store, fmt.Sprintf(createLookupIndexStmt, "jaeger_ddg", store.DependencyKeyspace(), deepDependenciesIndexFields, deepDependencyDocumentType), logger)
+	if err != nil {
+		return errors.Wrap(err, "failed to create index jaeger_ddg")
+	}
+
+	if store.UsesAnalytics() {
+		err = createDatasets(store, keyspaces)
+		if err != nil {
+			return errors.Wrap(err, "failed to create analytics datasets")
+		}
+	}
+
+	return nil
+}
+
+// indexStatement returns the statement creating the named span or lookup index.
+func indexStatement(store Store, name string) string {
+	for _, index := range spanIndexes {
+		if index.Name == name {
+			return spanIndexStatement(store, index)
+		}
+	}
+
+	switch name {
+	case "jaeger_services":
+		return fmt.Sprintf(createLookupIndexStmt, name, store.Keyspace(), servicesIndexFields, "service")
+	case "jaeger_operations":
+		return fmt.Sprintf(createLookupIndexStmt, name, store.Keyspace(), operationsIndexFields, "operation")
+	}
+
+	return ""
+}
+
+// spanIndexStatement returns the statement creating the span index, over the fields of the store's document layout.
+func spanIndexStatement(store Store, index spanIndex) string {
+	return index.statement(store.Keyspace(), store.DocumentLayout())
+}
+
+func createIndex(store Store, statement string, logger hclog.Logger) error {
+	err := store.Execute(statement, nil)
+	if err != nil && strings.Contains(err.Error(), "already exists") {
+		logger.Debug("index already exists", "statement", statement)
+		return nil
+	}
+
+	return err
+}
+
+// indexKeys is a span index as listed in system:indexes.
+type indexKeys struct {
+	Name     string   `json:"name"`
+	IndexKey []string `json:"index_key"`
+}
+
+// checkIndexKeys warns about the span indexes whose keys differ from those that would be created now, such as those
+// created before the service and operation indexes covered trace IDs, as queries can't rely on them. They must be
+// dropped and created again.
+func checkIndexKeys(store Store, logger hclog.Logger) error {
+	if store.UsesAnalytics() {
+		return nil
+	}
+
+	names := make([]string, len(spanIndexes))
+	for i, index := range spanIndexes {
+		names[i] = index.Name
+	}
+	result, err := store.Query(context.Background(), queryIndexKeysStmt, []interface{}{names})
+	if err != nil {
+		return errors.Wrap(err, "failed to query indexes")
+	}
+
+	var existing indexKeys
+	for result.Next(&existing) {
+		for _, index := range spanIndexes {
+			if index.Name != existing.Name {
+				continue
+			}
+			keys := index.fields(store.DocumentLayout())
+			if normalizeIndexKeys(existing.IndexKey) != normalizeIndexKeys(strings.Split(keys, ",")) {
+				logger.Warn(
+					"index was created by an earlier version with different keys, drop it and create it again",
+					"index", existing.Name,
+					"keys", strings.Join(existing.IndexKey, ", "),
+					"statement", spanIndexStatement(store, index),
+				)
+			}
+		}
+		existing = indexKeys{}
+	}
+	err = result.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to query indexes")
+	}
+
+	return nil
+}
+
+// normalizeIndexKeys returns index keys in a form that can be compared whether they're as written when creating the
+// index or as listed in system:indexes, which quotes and brackets them.
+func normalizeIndexKeys(keys []string) string {
+	normalized := make([]string, len(keys))
+	for i, key := range keys {
+		normalized[i] = strings.NewReplacer("`", "", "(", "", ")", "", " ", "").Replace(key)
+	}
+
+	return strings.Join(normalized, ",")
+}
+
+// CheckDurationIndexes warns about any of the indexes used by the duration queries that don't exist, recommending the
+// statements to create them. Spans read through analytics or from trace documents don't use the indexes.
+func CheckDurationIndexes(opts options.Options, store Store, logger hclog.Logger) error {
+	if store.UsesAnalytics() || opts.StorageModel == "trace" {
+		return nil
+	}
+
+	existing, err := existingIndexes(store, durationIndexes)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range spanIndexes {
+		for _, name := range durationIndexes {
+			if index.Name == name && !existing[name] {
+				logger.Warn(
+					"index used by duration queries is missing, duration searches will scan every span of a service",
+					"index", name,
+					"statement", spanIndexStatement(store, index),
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+// missingIndexes returns the names of the span indexes that don't exist. Spans read through analytics or from trace
+// documents don't use the indexes so none are missing.
+func missingIndexes(opts options.Options, store Store) ([]string, error) {
+	if store.UsesAnalytics() || opts.StorageModel == "trace" {
+		return nil, nil
+	}
+
+	names := make([]string, len(spanIndexes))
+	for i, index := range spanIndexes {
+		names[i] = index.Name
+	}
+
+	existing, err := existingIndexes(store, names)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, name := range names {
+		if !existing[name] {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing, nil
+}
+
+// existingIndexes returns which of the named indexes exist and are online.
+func existingIndexes(store Store, names []string) (map[string]bool, error) {
+	result, err := store.Query(context.Background(), queryIndexNamesStmt, []interface{}{names})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query indexes")
+	}
+
+	existing := make(map[string]bool)
+	var name string
+	for result.Next(&name) {
+		existing[name] = true
+	}
+	err = result.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query indexes")
+	}
+
+	return existing, nil
+}
@@ -0,0 +1,83 @@
+package plugin
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// ErrResultTooLarge occurs when a query returns more data than the reader is allowed to hold in memory
+var ErrResultTooLarge = errors.New("query result is larger than the maximum result size")
+
+// spanIterator decodes span rows from a query result one at a time so that only the spans being assembled into
+// traces are held in memory. Iteration stops with ErrResultTooLarge once more than maxBytes of rows have been read,
+// a maxBytes of zero means there is no limit. Rows in the flat layout are converted to the model layout.
+type spanIterator struct {
+	result   Result
+	maxBytes int
+	layout   string
+	read     int
+	err      error
+}
+
+func newSpanIterator(result Result, maxBytes int, layout string) *spanIterator {
+	return &spanIterator{
+		result:   result,
+		maxBytes: maxBytes,
+		layout:   layout,
+	}
+}
+
+// Next decodes the next span, returning false once there are no more spans or an error has occurred.
+func (it *spanIterator) Next() (*Span, bool) {
+	if it.err != nil {
+		return nil, false
+	}
+
+	row := it.result.NextBytes()
+	if row == nil {
+		return nil, false
+	}
+
+	it.read += len(row)
+	if it.maxBytes > 0 && it.read > it.maxBytes {
+		it.err = ErrResultTooLarge
+		return nil, false
+	}
+
+	if it.layout == flatLayout {
+		var flat FlatSpan
+		err := json.Unmarshal(row, &flat)
+		if err != nil {
+			it.err = err
+			return nil, false
+		}
+		span, err := flat.toSpan()
+		if err != nil {
+			it.err = err
+			return nil, false
+		}
+
+		return span, true
+	}
+
+	// Each row is decoded into a new span as decoding into a reused one would share slices between spans.
+	var span Span
+	err := json.Unmarshal(row, &span)
+	if err != nil {
+		it.err = err
+		return nil, false
+	}
+
+	return &span, true
+}
+
+// Close closes the underlying result, returning the first error that occurred whilst iterating.
+func (it *spanIterator) Close() error {
+	err := it.result.Close()
+	if it.err != nil {
+		return it.err
+	}
+
+	return err
+}
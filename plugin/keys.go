@@ -0,0 +1,73 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/pkg/errors"
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// The key strategies decide the keys that span documents are written with.
+const (
+	// spanIDKeyStrategy keys spans by their span ID alone, which is how spans have always been keyed.
+	spanIDKeyStrategy = "spanid"
+	// deterministicKeyStrategy keys spans by trace ID, span ID and a hash of the span, so a span that's written
+	// again is written with the same key whilst distinct spans sharing a span ID (e.g. Zipkin shared spans) are not.
+	deterministicKeyStrategy = "deterministic"
+	// uuidKeyStrategy keys spans with a random UUID.
+	uuidKeyStrategy = "uuid"
+)
+
+func isValidKeyStrategy(strategy string) bool {
+	switch strategy {
+	case spanIDKeyStrategy, deterministicKeyStrategy, uuidKeyStrategy:
+		return true
+	}
+
+	return false
+}
+
+// spanKey builds the key of the span's document using the key strategy.
+func spanKey(strategy string, span *model.Span) (string, error) {
+	switch strategy {
+	case deterministicKeyStrategy:
+		hash, err := model.HashCode(span)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to hash span")
+		}
+
+		return fmt.Sprintf("%s%016x/%016x", traceKeyPrefix(span.TraceID), uint64(span.SpanID), hash), nil
+	case uuidKeyStrategy:
+		return uuid.New().String(), nil
+	}
+
+	return fmt.Sprintf("%d", uint64(span.SpanID)), nil
+}
+
+// traceKeyPrefix is the prefix shared by the keys of every span in the trace with the deterministic key strategy.
+func traceKeyPrefix(traceID model.TraceID) string {
+	return fmt.Sprintf("%016x%016x/", traceID.High, traceID.Low)
+}
+
+// keyEscaper escapes the "::" separator out of the names that document keys are built from, by escaping every colon,
+// so that a service or operation name containing "::" can't give two documents the same key. Names without a colon or
+// percent sign are left as they are, so their keys are the same as they've always been.
+var keyEscaper = strings.NewReplacer("%", "%25", ":", "%3A")
+
+// keyComponent returns a name escaped to be joined with others by "::" in a key.
+func keyComponent(name string) string {
+	return keyEscaper.Replace(name)
+}
+
+// isDocumentExists reports whether an insert failed because the document already exists, either from KV or from a
+// N1QL INSERT into a named collection.
+func isDocumentExists(err error) bool {
+	if errors.Cause(err) == gocb.ErrKeyExists {
+		return true
+	}
+
+	return strings.Contains(strings.ToLower(err.Error()), "duplicate key")
+}
@@ -0,0 +1,288 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/pkg/errors"
+)
+
+// In key-value only mode the plugin can't query for spans, so it keeps index documents of its own which are read
+// with KV gets. Every span is recorded in a trace index document of its service and the minute it started in, and
+// the services and their operations are kept in lookup documents.
+const (
+	kvServicesKey = "kv::services"
+
+	// kvIndexShards is how many trace index documents each service's spans are spread over for each minute, by trace
+	// ID, so that a busy service neither contends on one document nor fills it.
+	kvIndexShards = 8
+
+	// kvIndexBatchMinutes is how many minutes of trace index documents are fetched at once when searching, searches
+	// work back from the end of their time range so usually only the first batch is needed.
+	kvIndexBatchMinutes = 15
+
+	// kvEmptyKindField stands for the empty span kind in the operations lookup document, as a sub-document path can't
+	// have an empty field. It can't clash with a kind as span kinds are single words.
+	kvEmptyKindField = "-"
+)
+
+// ErrKVOnlyTagSearch occurs when searching by tag in key-value only mode, as spans aren't indexed by their tags.
+var ErrKVOnlyTagSearch = errors.New("searching by tag is not supported in key-value only mode")
+
+// kvIndexEntry records a span in a trace index document. Start times and durations are in microseconds.
+type kvIndexEntry struct {
+	TraceID       TraceID `json:"trace_id"`
+	OperationName string  `json:"operation_name"`
+	StartTime     int64   `json:"start_time"`
+	Duration      int64   `json:"duration"`
+}
+
+// kvIndexDocument holds the spans of a service that started in a minute, keyed by trace and span ID so that writing a
+// span again, such as when a timed out write is retried, replaces its entry. Documents written before they were
+// sharded list the spans instead.
+type kvIndexDocument struct {
+	Entries map[string]kvIndexEntry `json:"entries"`
+	Spans   []kvIndexEntry          `json:"spans"`
+}
+
+func kvOperationsKey(service string) string {
+	return fmt.Sprintf("kv::operations::%s", service)
+}
+
+// kvTracesKey is the key of a shard of the trace index documents of the service in the minute.
+func kvTracesKey(service string, minute int64, shard uint64) string {
+	return fmt.Sprintf("kv::traces::%s::%d::%d", service, minute, shard)
+}
+
+// kvLegacyTracesKey is the key of the single trace index document that the service's spans in the minute were
+// appended to before the documents were sharded. They're still read until they expire.
+func kvLegacyTracesKey(service string, minute int64) string {
+	return fmt.Sprintf("kv::traces::%s::%d", service, minute)
+}
+
+// kvEntryKey identifies the span's entry in its trace index document.
+func kvEntryKey(span Span) string {
+	return fmt.Sprintf("%016x%016x%016x", span.TraceID.High, span.TraceID.Low, span.SpanID)
+}
+
+// kvKindField returns the field of the span kind in the operations lookup document.
+func kvKindField(kind string) string {
+	if kind == "" {
+		return kvEmptyKindField
+	}
+
+	return kind
+}
+
+// subdocField escapes a name so that it's a single field of a sub-document path, however many dots it has.
+func subdocField(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// kvIndex keeps and reads the index documents used in key-value only mode.
+type kvIndex struct {
+	store      Store
+	spanTTL    time.Duration
+	serviceTTL time.Duration
+	lookups    *lookupCache
+	cache      *resultCache
+	logger     hclog.Logger
+}
+
+// record adds the span to the trace index document of its service and minute, and its service and operation to
+// the lookup documents if they haven't been written recently. It takes the place of the writer's lookup documents.
+// A span that doesn't fit in its full trace index document is stored but can't be found by searching.
+func (i *kvIndex) record(span Span, start time.Time) error {
+	service := span.Process.ServiceName
+	entry := kvIndexEntry{
+		TraceID:       span.TraceID,
+		OperationName: span.OperationName,
+		StartTime:     start.UnixNano() / int64(time.Microsecond),
+		Duration:      int64(span.Duration / time.Microsecond),
+	}
+	key := kvTracesKey(service, start.Unix()/60, span.TraceID.Low%kvIndexShards)
+	err := i.store.AddCounters(key, map[string]interface{}{"entries." + kvEntryKey(span): entry}, nil, expiryFromTTL(i.spanTTL))
+	if isDocumentTooBig(err) {
+		i.logger.Warn("trace index document is full, the span won't be found by searches", "key", key, "trace_id", span.TraceID)
+	} else if err != nil {
+		return err
+	}
+
+	lookups := []struct {
+		key   string
+		path  string
+		cache string
+	}{
+		{kvServicesKey, "services." + subdocField(service), serviceKey(service)},
+		{
+			kvOperationsKey(service),
+			"operations." + subdocField(span.OperationName) + "." + subdocField(kvKindField(span.SpanKind)),
+			operationKey(service, span.OperationName, span.SpanKind),
+		},
+	}
+	for _, lookup := range lookups {
+		if i.lookups != nil && !i.lookups.needsWrite(lookup.cache) {
+			continue
+		}
+
+		err := i.store.AddCounters(lookup.key, map[string]interface{}{lookup.path: true}, nil, expiryFromTTL(i.serviceTTL))
+		if err != nil {
+			return err
+		}
+		if i.lookups != nil {
+			i.lookups.markWritten(lookup.cache)
+		}
+		i.cache.invalidate(servicesCacheKey, operationsCacheKey(service))
+	}
+
+	return nil
+}
+
+func (i *kvIndex) services() ([]string, error) {
+	var found map[string]bool
+	err := i.store.GetField(kvServicesKey, "services", &found)
+	if err == ErrDocumentNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	services := make([]string, 0, len(found))
+	for service := range found {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	return services, nil
+}
+
+// operations returns the operations of the service, optionally filtered to a single kind.
+func (i *kvIndex) operations(service, kind string) ([]Operation, error) {
+	var found map[string]map[string]bool
+	err := i.store.GetField(kvOperationsKey(service), "operations", &found)
+	if err == ErrDocumentNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var operations []Operation
+	for name, kinds := range found {
+		for k := range kinds {
+			if k == kvEmptyKindField {
+				k = ""
+			}
+			if kind == "" || k == kind {
+				operations = append(operations, Operation{Name: name, SpanKind: k})
+			}
+		}
+	}
+	sort.Slice(operations, func(a, b int) bool {
+		if operations[a].Name != operations[b].Name {
+			return operations[a].Name < operations[b].Name
+		}
+		return operations[a].SpanKind < operations[b].SpanKind
+	})
+
+	return operations, nil
+}
+
+func (i *kvIndex) operationNames(service string) ([]string, error) {
+	operations, err := i.operations(service, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for j, operation := range operations {
+		if j == 0 || operations[j-1].Name != operation.Name {
+			names = append(names, operation.Name)
+		}
+	}
+
+	return names, nil
+}
+
+// findTraceIDs reads the service's trace index documents from the end of the query's time range back to its start,
+// most recent spans first, until enough matching traces have been found.
+func (i *kvIndex) findTraceIDs(ctx context.Context, traceQuery *spanstore.TraceQueryParameters) ([]TraceID, error) {
+	if len(traceQuery.Tags) > 0 {
+		return nil, ErrKVOnlyTagSearch
+	}
+	if traceQuery.ServiceName == "" {
+		return nil, ErrServiceNameNotSet
+	}
+
+	var traceIDs []TraceID
+	seen := make(UniqueTraceIDs)
+	first := traceQuery.StartTimeMin.Unix() / 60
+	for minute := traceQuery.StartTimeMax.Unix() / 60; minute >= first && len(traceIDs) < traceQuery.NumTraces; minute -= kvIndexBatchMinutes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var docs []Document
+		for m := minute; m > minute-kvIndexBatchMinutes && m >= first; m-- {
+			for shard := uint64(0); shard < kvIndexShards; shard++ {
+				docs = append(docs, Document{Key: kvTracesKey(traceQuery.ServiceName, m, shard), Value: &kvIndexDocument{}})
+			}
+			docs = append(docs, Document{Key: kvLegacyTracesKey(traceQuery.ServiceName, m), Value: &kvIndexDocument{}})
+		}
+
+		var entries []kvIndexEntry
+		for j, err := range i.store.GetMulti(docs) {
+			if err == ErrDocumentNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			doc := docs[j].Value.(*kvIndexDocument)
+			entries = append(entries, doc.Spans...)
+			for _, entry := range doc.Entries {
+				entries = append(entries, entry)
+			}
+		}
+		sort.Slice(entries, func(a, b int) bool {
+			return entries[a].StartTime > entries[b].StartTime
+		})
+
+		for _, entry := range entries {
+			if len(traceIDs) >= traceQuery.NumTraces {
+				break
+			}
+			if _, ok := seen[entry.TraceID]; ok || !entry.matches(traceQuery) {
+				continue
+			}
+			seen.Add(entry.TraceID)
+			traceIDs = append(traceIDs, entry.TraceID)
+		}
+	}
+
+	return traceIDs, nil
+}
+
+// matches reports whether the span matches the query's time range, operation and durations.
+func (e kvIndexEntry) matches(traceQuery *spanstore.TraceQueryParameters) bool {
+	start := time.Unix(0, e.StartTime*int64(time.Microsecond))
+	if start.Before(traceQuery.StartTimeMin) || start.After(traceQuery.StartTimeMax) {
+		return false
+	}
+	if traceQuery.OperationName != "" && e.OperationName != traceQuery.OperationName {
+		return false
+	}
+
+	duration := time.Duration(e.Duration) * time.Microsecond
+	if traceQuery.DurationMin != 0 && duration < traceQuery.DurationMin {
+		return false
+	}
+
+	return traceQuery.DurationMax == 0 || duration <= traceQuery.DurationMax
+}
@@ -0,0 +1,347 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/pkg/errors"
+)
+
+// The layouts that span documents can be stored in. The model layout is the span as the plugin models it, while the
+// flat layout is meant to be queried by hand: IDs are hex strings, times and durations are microseconds since the
+// epoch and the service name is a top level field.
+const (
+	modelLayout = "model"
+	flatLayout  = "flat"
+)
+
+func isValidLayout(layout string) bool {
+	return layout == modelLayout || layout == flatLayout
+}
+
+// documentFields are the N1QL expressions for the span fields that each layout stores differently, which queries and
+// indexes are built from.
+type documentFields struct {
+	// serviceName is the span's service name.
+	serviceName string
+	// traceIDKeys are the index keys over the span's trace ID.
+	traceIDKeys string
+	// traceIDMatch matches the trace ID given by traceIDParams.
+	traceIDMatch string
+	// lowTraceIDMatch matches the 128 bit trace IDs with the low 64 bits given by lowTraceIDParams.
+	lowTraceIDMatch string
+}
+
+var (
+	modelFields = documentFields{
+		serviceName:     "process.service_name",
+		traceIDKeys:     "trace_id.hi, trace_id.lo",
+		traceIDMatch:    "trace_id.hi = ? AND trace_id.lo = ?",
+		lowTraceIDMatch: "trace_id.hi IS NOT MISSING AND trace_id.lo = ?",
+	}
+	flatFields = documentFields{
+		serviceName:     "service_name",
+		traceIDKeys:     "trace_id",
+		traceIDMatch:    "trace_id = ?",
+		lowTraceIDMatch: "trace_id LIKE ?",
+	}
+)
+
+// layoutFields returns the fields of span documents in the layout.
+func layoutFields(layout string) documentFields {
+	if layout == flatLayout {
+		return flatFields
+	}
+
+	return modelFields
+}
+
+// traceIDQuery fills the keyspace that spans are read from, and the layout's service name field, into one of the
+// trace ID query templates.
+func traceIDQuery(layout, query, keyspace string) string {
+	return fmt.Sprintf(query, keyspace, layoutFields(layout).serviceName)
+}
+
+// spansByTraceIDQuery returns the query reading the projected fields of a trace's spans in the layout.
+func spansByTraceIDQuery(layout, keyspace, fields string) string {
+	return fmt.Sprintf(querySpanByTraceID, keyspace, fields, layoutFields(layout).traceIDMatch)
+}
+
+// traceIDsByLowQuery returns the query finding the trace IDs whose low 64 bits match in the layout.
+func traceIDsByLowQuery(layout, keyspace string) string {
+	return fmt.Sprintf(queryTraceIDsByLow, keyspace, layoutFields(layout).lowTraceIDMatch)
+}
+
+// layoutParams converts the start times and durations in a query's parameters to microseconds for the flat layout.
+func layoutParams(layout string, params []interface{}) []interface{} {
+	if layout != flatLayout {
+		return params
+	}
+
+	converted := make([]interface{}, len(params))
+	for i, param := range params {
+		switch p := param.(type) {
+		case time.Time:
+			converted[i] = toMicros(p)
+		case time.Duration:
+			converted[i] = p.Nanoseconds() / int64(time.Microsecond)
+		default:
+			converted[i] = param
+		}
+	}
+
+	return converted
+}
+
+// layoutTime returns a start time as it's stored in the layout.
+func layoutTime(layout string, t time.Time) interface{} {
+	if layout == flatLayout {
+		return toMicros(t)
+	}
+
+	return t.UTC().Format(dateLayout)
+}
+
+// layoutTraceIDs returns trace IDs as they're stored in the layout.
+func layoutTraceIDs(layout string, traceIDs []TraceID) interface{} {
+	if layout != flatLayout {
+		return traceIDs
+	}
+
+	hexIDs := make([]string, len(traceIDs))
+	for i, traceID := range traceIDs {
+		hexIDs[i] = traceID.hex()
+	}
+
+	return hexIDs
+}
+
+// traceIDParams returns the parameters matching a trace ID in the layout.
+func traceIDParams(layout string, traceID TraceID) []interface{} {
+	if layout == flatLayout {
+		return []interface{}{traceID.hex()}
+	}
+
+	return []interface{}{traceID.High, traceID.Low}
+}
+
+// lowTraceIDParams returns the parameters matching the trace IDs whose low 64 bits are low in the layout.
+func lowTraceIDParams(layout string, low uint64) []interface{} {
+	if layout == flatLayout {
+		return []interface{}{fmt.Sprintf("%%%016x", low)}
+	}
+
+	return []interface{}{low}
+}
+
+func (t TraceID) hex() string {
+	return fmt.Sprintf("%016x%016x", t.High, t.Low)
+}
+
+// UnmarshalJSON decodes a trace ID stored in either layout, as its high and low bits or as a hex string.
+func (t *TraceID) UnmarshalJSON(data []byte) error {
+	if len(data) == 0 || data[0] != '"' {
+		type bits TraceID
+		return json.Unmarshal(data, (*bits)(t))
+	}
+
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	traceID, err := parseHexTraceID(s)
+	if err != nil {
+		return err
+	}
+	*t = traceID
+
+	return nil
+}
+
+func parseHexTraceID(s string) (TraceID, error) {
+	if len(s) != 32 {
+		return TraceID{}, errors.Errorf("trace ID %q is not 32 hex digits", s)
+	}
+	high, err := strconv.ParseUint(s[:16], 16, 64)
+	if err != nil {
+		return TraceID{}, errors.Wrapf(err, "invalid trace ID %q", s)
+	}
+	low, err := strconv.ParseUint(s[16:], 16, 64)
+	if err != nil {
+		return TraceID{}, errors.Wrapf(err, "invalid trace ID %q", s)
+	}
+
+	return TraceID{High: high, Low: low}, nil
+}
+
+func toMicros(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+func fromMicros(micros int64) time.Time {
+	return time.Unix(0, micros*int64(time.Microsecond)).UTC()
+}
+
+// FlatSpan is a span stored in the flat layout. It holds everything that the model layout does, so spans read back
+// the same in either layout.
+type FlatSpan struct {
+	TraceID       string           `json:"trace_id"`
+	SpanID        string           `json:"span_id"`
+	ParentSpanID  string           `json:"parent_span_id,omitempty"`
+	OperationName string           `json:"operation_name"`
+	ServiceName   string           `json:"service_name"`
+	SpanKind      string           `json:"span_kind,omitempty"`
+	StartTime     int64            `json:"start_time"`
+	Duration      int64            `json:"duration"`
+	Flags         model.Flags      `json:"flags"`
+	Tags          []model.KeyValue `json:"tags"`
+	ProcessTags   []model.KeyValue `json:"process_tags,omitempty"`
+	ProcessID     string           `json:"process_id,omitempty"`
+	Logs          []FlatLog        `json:"logs,omitempty"`
+	Events        []FlatEvent      `json:"events,omitempty"`
+	References    []FlatSpanRef    `json:"references,omitempty"`
+	Warnings      []string         `json:"warnings,omitempty"`
+	ProcessedTags []string         `json:"processed_tags"`
+	Error         bool             `json:"error,omitempty"`
+	Type          string           `json:"type"`
+}
+
+type FlatLog struct {
+	Timestamp int64            `json:"timestamp"`
+	Fields    []model.KeyValue `json:"fields"`
+}
+
+type FlatEvent struct {
+	Name       string           `json:"name"`
+	Timestamp  int64            `json:"timestamp"`
+	Attributes []model.KeyValue `json:"attributes,omitempty"`
+}
+
+type FlatSpanRef struct {
+	TraceID    string           `json:"trace_id"`
+	SpanID     string           `json:"span_id"`
+	RefType    string           `json:"ref_type"`
+	Attributes []model.KeyValue `json:"attributes,omitempty"`
+}
+
+// flatten converts a span in the model layout to the flat layout. The start time is taken from the original span as
+// the model layout only keeps milliseconds.
+func (s *Span) flatten(startTime time.Time) FlatSpan {
+	flat := FlatSpan{
+		TraceID:       s.TraceID.hex(),
+		SpanID:        fmt.Sprintf("%016x", s.SpanID),
+		OperationName: s.OperationName,
+		SpanKind:      s.SpanKind,
+		StartTime:     toMicros(startTime),
+		Duration:      s.Duration.Nanoseconds() / int64(time.Microsecond),
+		Flags:         s.Flags,
+		Tags:          s.Tags,
+		ProcessID:     s.ProcessID,
+		Warnings:      s.Warnings,
+		ProcessedTags: s.ProcessedTags,
+		Error:         s.Error,
+		Type:          s.Type,
+	}
+	if s.Process != nil {
+		flat.ServiceName = s.Process.ServiceName
+		flat.ProcessTags = s.Process.Tags
+	}
+	for _, log := range s.Logs {
+		flat.Logs = append(flat.Logs, FlatLog{Timestamp: toMicros(log.Timestamp), Fields: log.Fields})
+	}
+	for _, event := range s.Events {
+		flat.Events = append(flat.Events, FlatEvent{Name: event.Name, Timestamp: toMicros(event.Timestamp), Attributes: event.Attributes})
+	}
+	for _, ref := range s.References {
+		refType := model.SpanRefType(ref.RefType)
+		flat.References = append(flat.References, FlatSpanRef{
+			TraceID:    ref.TraceID.hex(),
+			SpanID:     fmt.Sprintf("%016x", ref.SpanID),
+			RefType:    refType.String(),
+			Attributes: ref.Attributes,
+		})
+		if flat.ParentSpanID == "" && refType == model.ChildOf && ref.TraceID == s.TraceID {
+			flat.ParentSpanID = fmt.Sprintf("%016x", ref.SpanID)
+		}
+	}
+
+	return flat
+}
+
+// toSpan converts a span in the flat layout back to the model layout.
+func (f *FlatSpan) toSpan() (*Span, error) {
+	traceID, err := parseHexTraceID(f.TraceID)
+	if err != nil {
+		return nil, err
+	}
+	spanID, err := strconv.ParseUint(f.SpanID, 16, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid span ID %q", f.SpanID)
+	}
+
+	span := &Span{
+		TraceID:       traceID,
+		SpanID:        spanID,
+		OperationName: f.OperationName,
+		SpanKind:      f.SpanKind,
+		StartTime:     fromMicros(f.StartTime).Format(time.RFC3339Nano),
+		Duration:      time.Duration(f.Duration) * time.Microsecond,
+		Flags:         f.Flags,
+		Tags:          f.Tags,
+		Process:       &model.Process{ServiceName: f.ServiceName, Tags: f.ProcessTags},
+		ProcessID:     f.ProcessID,
+		Warnings:      f.Warnings,
+		ProcessedTags: f.ProcessedTags,
+		Error:         f.Error,
+		Type:          f.Type,
+		SchemaVersion: currentSchemaVersion,
+	}
+	for _, log := range f.Logs {
+		span.Logs = append(span.Logs, model.Log{Timestamp: fromMicros(log.Timestamp), Fields: log.Fields})
+	}
+	for _, event := range f.Events {
+		span.Events = append(span.Events, Event{Name: event.Name, Timestamp: fromMicros(event.Timestamp), Attributes: event.Attributes})
+	}
+	for _, ref := range f.References {
+		refTraceID, err := parseHexTraceID(ref.TraceID)
+		if err != nil {
+			return nil, err
+		}
+		refSpanID, err := strconv.ParseUint(ref.SpanID, 16, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid span ID %q", ref.SpanID)
+		}
+		span.References = append(span.References, SpanRef{
+			TraceID:    refTraceID,
+			SpanID:     refSpanID,
+			RefType:    model.SpanRefType_value[ref.RefType],
+			Attributes: ref.Attributes,
+		})
+	}
+
+	return span, nil
+}
+
+// flatSpanFields returns the projection used when reading spans in the flat layout, leaving out logs, events and
+// process tags when they aren't wanted.
+func flatSpanFields(prefix string, skipLogs, skipProcessTags bool) string {
+	names := []string{"trace_id", "span_id", "operation_name", "service_name", "span_kind", "flags", "start_time", "duration", "tags", "references"}
+	if !skipLogs {
+		names = append(names, "logs", "events")
+	}
+	if !skipProcessTags {
+		names = append(names, "process_tags")
+	}
+
+	fields := make([]string, len(names))
+	for i, name := range names {
+		fields[i] = prefix + name
+	}
+
+	return strings.Join(fields, ", ")
+}
@@ -0,0 +1,100 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrQueryQueueFull occurs when a query can't run because too many queries are already waiting to run
+var ErrQueryQueueFull = errors.New("too many queries are waiting to run")
+
+// ErrQueryQueueTimeout occurs when a query has waited too long to run
+var ErrQueryQueueTimeout = errors.New("timed out waiting for a query to finish")
+
+// queryLimiter limits the number of queries that run at once, queueing the rest. A nil limiter doesn't limit queries.
+type queryLimiter struct {
+	slots chan struct{}
+	// queued is the number of queries waiting to run, used atomically.
+	queued    int32
+	maxQueued int32
+	timeout   time.Duration
+}
+
+// newQueryLimiter returns a limiter running at most max queries at once. At most maxQueued queries wait to run, each
+// for at most the timeout, zero meaning no limit for either.
+func newQueryLimiter(max, maxQueued int, timeout time.Duration) *queryLimiter {
+	if max <= 0 {
+		return nil
+	}
+
+	return &queryLimiter{
+		slots:     make(chan struct{}, max),
+		maxQueued: int32(maxQueued),
+		timeout:   timeout,
+	}
+}
+
+// acquire waits for a query to be allowed to run, returning a function that must be called once the query has
+// finished.
+func (l *queryLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		err := l.wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.slots
+		})
+	}, nil
+}
+
+// wait queues for a query to be allowed to run.
+func (l *queryLimiter) wait(ctx context.Context) error {
+	queued := atomic.AddInt32(&l.queued, 1)
+	defer atomic.AddInt32(&l.queued, -1)
+	if l.maxQueued > 0 && queued > l.maxQueued {
+		return ErrQueryQueueFull
+	}
+
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		timer := time.NewTimer(l.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return ErrQueryQueueTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedResult lets another query run once it's closed.
+type limitedResult struct {
+	Result
+	release func()
+}
+
+func (r *limitedResult) Close() error {
+	defer r.release()
+
+	return r.Result.Close()
+}
@@ -0,0 +1,104 @@
+package plugin
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// serviceDocument is a lookup document recording that a service has written spans, so that services can be listed
+// without scanning every span.
+type serviceDocument struct {
+	ServiceName string `json:"service_name"`
+	Type        string `json:"type"`
+}
+
+// operationDocument is a lookup document recording an operation of a service and the kind of span it was seen on.
+type operationDocument struct {
+	ServiceName   string `json:"service_name"`
+	OperationName string `json:"operation_name"`
+	SpanKind      string `json:"span_kind"`
+	Type          string `json:"type"`
+}
+
+func serviceKey(service string) string {
+	return fmt.Sprintf("service::%s", keyComponent(service))
+}
+
+func operationKey(service, operation, kind string) string {
+	return fmt.Sprintf("operation::%s::%s::%s", keyComponent(service), keyComponent(operation), keyComponent(kind))
+}
+
+// lookupCache is an LRU cache of the lookup documents that have been written recently so that they aren't upserted
+// for every span. Entries expire after ttl so that the documents are rewritten, and kept alive when they have an
+// expiry, a ttl of zero means entries only leave the cache when evicted.
+type lookupCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type lookupCacheEntry struct {
+	key     string
+	written time.Time
+}
+
+// newLookupCache creates a cache holding up to size entries for ttl, which is capped at half of the lookup documents'
+// TTL so that they are always rewritten before they expire.
+func newLookupCache(size int, ttl, serviceTTL time.Duration) *lookupCache {
+	if serviceTTL > 0 && (ttl <= 0 || ttl > serviceTTL/2) {
+		ttl = serviceTTL / 2
+	}
+
+	return &lookupCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// needsWrite reports whether the lookup document needs to be written.
+func (c *lookupCache) needsWrite(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return true
+	}
+
+	entry := elem.Value.(*lookupCacheEntry)
+	if c.ttl > 0 && time.Since(entry.written) > c.ttl {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return true
+	}
+
+	c.lru.MoveToFront(elem)
+	return false
+}
+
+// markWritten records that the lookup document has been written, evicting the least recently used entry if the
+// cache is full.
+func (c *lookupCache) markWritten(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*lookupCacheEntry).written = time.Now()
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&lookupCacheEntry{key: key, written: time.Now()})
+	if c.size > 0 && c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lookupCacheEntry).key)
+	}
+}
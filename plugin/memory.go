@@ -0,0 +1,34 @@
+package plugin
+
+import (
+	"github.com/jaegertracing/jaeger/pkg/memory/config"
+	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
+	"github.com/jaegertracing/jaeger/plugin/storage/memory"
+	"github.com/jaegertracing/jaeger/storage/dependencystore"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// memoryStore keeps spans in memory using Jaeger's own in-memory storage, so that the plugin can be run, and its gRPC
+// plumbing exercised, without a cluster. Dependencies are computed from the stored spans.
+type memoryStore struct {
+	store *memory.Store
+}
+
+// NewMemoryStore returns a store keeping up to maxTraces traces in memory, dropping the oldest once it's full.
+func NewMemoryStore(maxTraces int) shared.StoragePlugin {
+	return &memoryStore{
+		store: memory.WithConfiguration(config.Configuration{MaxTraces: maxTraces}),
+	}
+}
+
+func (m *memoryStore) SpanReader() spanstore.Reader {
+	return m.store
+}
+
+func (m *memoryStore) SpanWriter() spanstore.Writer {
+	return m.store
+}
+
+func (m *memoryStore) DependencyReader() dependencystore.Reader {
+	return m.store
+}
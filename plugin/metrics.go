@@ -0,0 +1,257 @@
+package plugin
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uber/jaeger-lib/metrics"
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+var errorClasses = []string{"timeout", "temporary_failure", "out_of_memory", "key_exists", "key_not_found", "result_too_large", "other"}
+
+// errorMetrics counts errors by the class of Couchbase error that caused them.
+type errorMetrics map[string]metrics.Counter
+
+func newErrorMetrics(factory metrics.Factory, name string) errorMetrics {
+	m := make(errorMetrics, len(errorClasses))
+	for _, class := range errorClasses {
+		m[class] = factory.Counter(metrics.Options{
+			Name: name,
+			Tags: map[string]string{"class": class},
+			Help: "Number of errors by Couchbase error class",
+		})
+	}
+
+	return m
+}
+
+func (m errorMetrics) record(err error) {
+	m[errorClass(err)].Inc(1)
+}
+
+// writeMetrics are recorded whilst writing spans.
+type writeMetrics struct {
+	spansWritten metrics.Counter
+	latency      metrics.Timer
+	batchSize    metrics.Histogram
+	coalesced    metrics.Counter
+	spansDropped metrics.Counter
+	spilled      metrics.Counter
+	replayed     metrics.Counter
+	spillDropped metrics.Counter
+	downsampled  metrics.Counter
+	tailDropped  metrics.Counter
+	rateLimited  metrics.Counter
+	truncated    metrics.Counter
+	oversized    metrics.Counter
+	errors       errorMetrics
+	lastSuccess  activity
+}
+
+func newWriteMetrics(factory metrics.Factory) *writeMetrics {
+	return &writeMetrics{
+		spansWritten: factory.Counter(metrics.Options{
+			Name: "spans_written",
+			Help: "Number of spans successfully written",
+		}),
+		latency: factory.Timer(metrics.TimerOptions{
+			Name: "write_latency",
+			Help: "Latency of span writes",
+		}),
+		batchSize: factory.Histogram(metrics.HistogramOptions{
+			Name:    "write_batch_size",
+			Help:    "Number of documents in each bulk write",
+			Buckets: []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000},
+		}),
+		coalesced: factory.Counter(metrics.Options{
+			Name: "spans_coalesced",
+			Help: "Number of spans appended to their trace document together with other spans of the trace",
+		}),
+		spansDropped: factory.Counter(metrics.Options{
+			Name: "spans_dropped",
+			Help: "Number of spans dropped because the write queue was full",
+		}),
+		spilled: factory.Counter(metrics.Options{
+			Name: "spans_spilled",
+			Help: "Number of spans buffered on disk because Couchbase was unreachable",
+		}),
+		replayed: factory.Counter(metrics.Options{
+			Name: "spans_replayed",
+			Help: "Number of spans buffered on disk that have been written to Couchbase",
+		}),
+		spillDropped: factory.Counter(metrics.Options{
+			Name: "spans_spill_dropped",
+			Help: "Number of spans dropped because the disk buffer was full",
+		}),
+		downsampled: factory.Counter(metrics.Options{
+			Name: "spans_downsampled",
+			Help: "Number of spans dropped by downsampling",
+		}),
+		tailDropped: factory.Counter(metrics.Options{
+			Name: "spans_tail_dropped",
+			Help: "Number of spans dropped because their trace had no errors or slow spans",
+		}),
+		rateLimited: factory.Counter(metrics.Options{
+			Name: "spans_rate_limited",
+			Help: "Number of spans dropped for being over the write rate limit",
+		}),
+		truncated: factory.Counter(metrics.Options{
+			Name: "spans_truncated",
+			Help: "Number of spans whose logs or tags were cut down to fit the maximum span size",
+		}),
+		oversized: factory.Counter(metrics.Options{
+			Name: "spans_oversized",
+			Help: "Number of spans rejected for being larger than the maximum span size",
+		}),
+		errors: newErrorMetrics(factory, "write_errors"),
+	}
+}
+
+func (m *writeMetrics) record(start time.Time, err error) {
+	m.latency.Record(time.Since(start))
+	if err != nil {
+		m.errors.record(err)
+		return
+	}
+	m.spansWritten.Inc(1)
+	m.lastSuccess.record()
+}
+
+// queryMetrics are recorded for each type of query.
+type queryMetrics struct {
+	latency metrics.Timer
+	errors  errorMetrics
+}
+
+// readMetrics are recorded whilst querying, query metrics are tagged with the type of query.
+type readMetrics struct {
+	factory            metrics.Factory
+	analyticsFallbacks metrics.Counter
+	replicaReads       metrics.Counter
+	newerSchemaSpans   metrics.Counter
+	lastSuccess        activity
+
+	mu       sync.Mutex
+	queries  map[string]*queryMetrics
+	services map[string]*serviceMetrics
+}
+
+// serviceMetrics are recorded from the stats that the query or analytics service sends with each result.
+type serviceMetrics struct {
+	elapsedTime   metrics.Timer
+	executionTime metrics.Timer
+	resultSize    metrics.Histogram
+	errors        metrics.Counter
+}
+
+func newReadMetrics(factory metrics.Factory) *readMetrics {
+	return &readMetrics{
+		factory: factory,
+		analyticsFallbacks: factory.Counter(metrics.Options{
+			Name: "analytics_fallbacks",
+			Help: "Number of analytics queries retried using N1QL",
+		}),
+		replicaReads: factory.Counter(metrics.Options{
+			Name: "replica_reads",
+			Help: "Number of documents read from a replica because the active node could not be reached",
+		}),
+		newerSchemaSpans: factory.Counter(metrics.Options{
+			Name: "spans_newer_schema",
+			Help: "Number of spans read that were written by a newer version of the plugin, e.g. during a rolling upgrade",
+		}),
+		queries:  make(map[string]*queryMetrics),
+		services: make(map[string]*serviceMetrics),
+	}
+}
+
+func (m *readMetrics) record(query string, start time.Time, err error) {
+	m.mu.Lock()
+	qm, ok := m.queries[query]
+	if !ok {
+		factory := m.factory.Namespace(metrics.NSOptions{
+			Tags: map[string]string{"query": query},
+		})
+		qm = &queryMetrics{
+			latency: factory.Timer(metrics.TimerOptions{
+				Name: "query_latency",
+				Help: "Latency of queries",
+			}),
+			errors: newErrorMetrics(factory, "query_errors"),
+		}
+		m.queries[query] = qm
+	}
+	m.mu.Unlock()
+
+	qm.latency.Record(time.Since(start))
+	if err != nil {
+		qm.errors.record(err)
+		return
+	}
+	m.lastSuccess.record()
+}
+
+// recordStats records the stats that the service sent with a result, tagged with the service that ran the query and
+// the query's name.
+func (m *readMetrics) recordStats(stats queryStats) {
+	key := stats.service + "::" + stats.query
+	m.mu.Lock()
+	sm, ok := m.services[key]
+	if !ok {
+		factory := m.factory.Namespace(metrics.NSOptions{
+			Tags: map[string]string{"service": stats.service, "query": stats.query},
+		})
+		sm = &serviceMetrics{
+			elapsedTime: factory.Timer(metrics.TimerOptions{
+				Name: "query_service_elapsed_time",
+				Help: "Time from the service receiving each query to sending the last row, as reported by the service",
+			}),
+			executionTime: factory.Timer(metrics.TimerOptions{
+				Name: "query_service_execution_time",
+				Help: "Time spent executing each query, as reported by the service",
+			}),
+			resultSize: factory.Histogram(metrics.HistogramOptions{
+				Name:    "query_service_result_size",
+				Help:    "Size in bytes of each query's results, as reported by the service",
+				Buckets: []float64{1 << 10, 1 << 12, 1 << 14, 1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24},
+			}),
+			errors: factory.Counter(metrics.Options{
+				Name: "query_service_errors",
+				Help: "Number of errors reported by the service in query results",
+			}),
+		}
+		m.services[key] = sm
+	}
+	m.mu.Unlock()
+
+	sm.elapsedTime.Record(stats.elapsedTime)
+	sm.executionTime.Record(stats.executionTime)
+	sm.resultSize.Record(float64(stats.resultSize))
+	sm.errors.Inc(int64(stats.errorCount))
+}
+
+// errorClass groups errors into a small set of classes so that they can be used as metric tags.
+func errorClass(err error) string {
+	switch errors.Cause(err) {
+	case gocb.ErrTimeout:
+		return "timeout"
+	case gocb.ErrTmpFail:
+		return "temporary_failure"
+	case gocb.ErrOutOfMemory:
+		return "out_of_memory"
+	case gocb.ErrKeyExists:
+		return "key_exists"
+	case gocb.ErrKeyNotFound:
+		return "key_not_found"
+	case ErrResultTooLarge:
+		return "result_too_large"
+	}
+
+	if strings.Contains(strings.ToLower(err.Error()), "timeout") {
+		return "timeout"
+	}
+
+	return "other"
+}
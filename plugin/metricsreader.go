@@ -0,0 +1,423 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+const (
+	querySPMRollups = `
+SELECT service_name, operation_name, span_kind, minute, calls, errors, latency_buckets, latency_sketch
+FROM %s
+WHERE service_name IN ? AND minute >= ? AND minute < ? AND ` + "`type`" + `="spm"`
+	querySPMLatencies = `
+SELECT span_kind, calls, latency_buckets, latency_sketch
+FROM %s
+WHERE service_name = ? AND minute >= ? AND minute < ? AND ` + "`type`" + `="spm"`
+	querySPMOperationLatencies = `
+SELECT span_kind, calls, latency_buckets, latency_sketch
+FROM %s
+WHERE service_name = ? AND operation_name = ? AND minute >= ? AND minute < ? AND ` + "`type`" + `="spm"`
+
+	// minimumStep is the smallest step that metrics can be read at, rollups are kept per minute.
+	minimumStep = time.Minute
+)
+
+// MetricsReader serves service performance monitoring, it mirrors the metrics reader API that later versions of
+// Jaeger use for the Monitor tab.
+type MetricsReader interface {
+	GetLatencies(ctx context.Context, params *MetricsQueryParameters) (*MetricFamily, error)
+	GetCallRates(ctx context.Context, params *MetricsQueryParameters) (*MetricFamily, error)
+	GetErrorRates(ctx context.Context, params *MetricsQueryParameters) (*MetricFamily, error)
+	GetMinStepDuration(ctx context.Context) (time.Duration, error)
+	GetLatencyQuantile(ctx context.Context, params *LatencyQuantileParameters) (*time.Duration, error)
+}
+
+// MetricsQueryParameters selects the services, span kinds and time range that metrics are read for. An empty
+// SpanKinds matches spans of any kind. Quantile is only used by GetLatencies.
+type MetricsQueryParameters struct {
+	ServiceNames     []string
+	GroupByOperation bool
+	EndTime          time.Time
+	Lookback         time.Duration
+	Step             time.Duration
+	SpanKinds        []string
+	Quantile         float64
+}
+
+// LatencyQuantileParameters selects the spans of a service, or of one of its operations, and the period that a latency
+// quantile is read for. An empty SpanKinds matches spans of any kind.
+type LatencyQuantileParameters struct {
+	ServiceName   string
+	OperationName string
+	SpanKinds     []string
+	StartTime     time.Time
+	EndTime       time.Time
+	Quantile      float64
+}
+
+// MetricFamily is a set of metrics of the same kind, one per service or per service and operation.
+type MetricFamily struct {
+	Name    string
+	Help    string
+	Metrics []Metric
+}
+
+// Metric is a time series of a service's, or operation's, metric.
+type Metric struct {
+	Labels map[string]string
+	Points []MetricPoint
+}
+
+// MetricPoint is the value of a metric over the step starting at Timestamp. Value is nil when there were no spans
+// in the step.
+type MetricPoint struct {
+	Timestamp time.Time
+	Value     *float64
+}
+
+type couchbaseMetricsReader struct {
+	store   Store
+	timeout time.Duration
+	metrics *readMetrics
+	logger  hclog.Logger
+}
+
+// stepCounts are the calls, errors and latencies of a service or operation's spans in a step.
+type stepCounts struct {
+	calls   int64
+	errors  int64
+	buckets []int64
+	sketch  map[int]int64
+}
+
+func newStepCounts() *stepCounts {
+	return &stepCounts{
+		buckets: make([]int64, len(latencyBucketBounds)+1),
+		sketch:  make(map[int]int64),
+	}
+}
+
+// add adds the counts of a rollup document.
+func (c *stepCounts) add(doc *spmDocument) {
+	c.calls += doc.Calls
+	c.errors += doc.Errors
+	for bucket, n := range doc.LatencyBuckets {
+		b, err := strconv.Atoi(bucket)
+		if err != nil || b < 0 || b >= len(c.buckets) {
+			continue
+		}
+		c.buckets[b] += n
+	}
+	addSketch(c.sketch, doc.LatencySketch)
+}
+
+// latency returns the q quantile of the latencies, in milliseconds. It's read from the latency sketch when every call
+// was counted in one, and estimated from the histogram otherwise, e.g. for minutes written before sketches were kept.
+func (c *stepCounts) latency(q float64) float64 {
+	var sketched int64
+	for _, n := range c.sketch {
+		sketched += n
+	}
+	if sketched > 0 && sketched == c.calls {
+		return sketchQuantile(c.sketch, q)
+	}
+
+	return quantile(c.buckets, q)
+}
+
+func (cs *couchbaseMetricsReader) GetLatencies(ctx context.Context, params *MetricsQueryParameters) (*MetricFamily, error) {
+	if params.Quantile <= 0 || params.Quantile > 1 {
+		return nil, errors.Errorf("quantile %v must be in (0, 1]", params.Quantile)
+	}
+
+	return cs.read(ctx, "getLatencies", "latencies", fmt.Sprintf("%vth quantile latency, in milliseconds", params.Quantile*100), params, func(c *stepCounts) *float64 {
+		if c.calls == 0 {
+			return nil
+		}
+		latency := c.latency(params.Quantile)
+
+		return &latency
+	})
+}
+
+func (cs *couchbaseMetricsReader) GetCallRates(ctx context.Context, params *MetricsQueryParameters) (*MetricFamily, error) {
+	return cs.read(ctx, "getCallRates", "call_rate", "Calls per second", params, func(c *stepCounts) *float64 {
+		rate := float64(c.calls) / params.Step.Seconds()
+
+		return &rate
+	})
+}
+
+func (cs *couchbaseMetricsReader) GetErrorRates(ctx context.Context, params *MetricsQueryParameters) (*MetricFamily, error) {
+	return cs.read(ctx, "getErrorRates", "error_rate", "Fraction of calls that were errors", params, func(c *stepCounts) *float64 {
+		if c.calls == 0 {
+			return nil
+		}
+		rate := float64(c.errors) / float64(c.calls)
+
+		return &rate
+	})
+}
+
+func (cs *couchbaseMetricsReader) GetMinStepDuration(ctx context.Context) (time.Duration, error) {
+	return minimumStep, nil
+}
+
+// read fetches the rollups that params selects and computes a metric for every service, or operation, and step.
+func (cs *couchbaseMetricsReader) read(ctx context.Context, queryName, name, help string, params *MetricsQueryParameters, value func(*stepCounts) *float64) (*MetricFamily, error) {
+	if len(params.ServiceNames) == 0 {
+		return nil, errors.New("at least one service name must be given")
+	}
+	// The defaults are filled in on a copy, the caller's parameters are left as they are.
+	query := *params
+	params = &query
+	if params.Step < minimumStep {
+		params.Step = minimumStep
+	}
+	if params.EndTime.IsZero() {
+		params.EndTime = time.Now()
+	}
+
+	if cs.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cs.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	series, steps, err := cs.querySteps(ctx, params)
+	cs.metrics.record(queryName, start, err)
+	if err != nil {
+		cs.logger.Warn("metrics query failed", "query", queryName, "error", err)
+		return nil, errors.Wrap(err, "Error reading metrics from storage")
+	}
+
+	prefix := "service_"
+	if params.GroupByOperation {
+		prefix = "service_operation_"
+	}
+	family := &MetricFamily{
+		Name: prefix + name,
+		Help: help,
+	}
+	for _, key := range sortedSeries(series) {
+		metric := Metric{
+			Labels: map[string]string{"service_name": key.service},
+		}
+		if params.GroupByOperation {
+			metric.Labels["operation"] = key.operation
+		}
+		for i, step := range steps {
+			counts := series[key][i]
+			if counts == nil {
+				counts = &stepCounts{}
+			}
+			metric.Points = append(metric.Points, MetricPoint{
+				Timestamp: step,
+				Value:     value(counts),
+			})
+		}
+		family.Metrics = append(family.Metrics, metric)
+	}
+
+	return family, nil
+}
+
+// seriesKey identifies a service, or a service's operation when metrics are grouped by operation.
+type seriesKey struct {
+	service   string
+	operation string
+}
+
+// querySteps sums the rollups of each series into steps, returning the counts of each series' steps along with the
+// start of each step.
+func (cs *couchbaseMetricsReader) querySteps(ctx context.Context, params *MetricsQueryParameters) (map[seriesKey][]*stepCounts, []time.Time, error) {
+	from := params.EndTime.Add(-params.Lookback).Truncate(time.Minute)
+	var steps []time.Time
+	for step := from; step.Before(params.EndTime); step = step.Add(params.Step) {
+		steps = append(steps, step)
+	}
+
+	kinds := make(map[string]bool, len(params.SpanKinds))
+	for _, kind := range params.SpanKinds {
+		kinds[kind] = true
+	}
+
+	queryStmt := fmt.Sprintf(querySPMRollups, cs.store.Keyspace())
+	result, err := cs.store.QueryPrepared(ctx, queryStmt, []interface{}{params.ServiceNames, from.Unix(), params.EndTime.Unix()})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	series := make(map[seriesKey][]*stepCounts)
+	var doc spmDocument
+	for result.Next(&doc) {
+		if len(kinds) > 0 && !kinds[doc.SpanKind] {
+			continue
+		}
+
+		key := seriesKey{service: doc.ServiceName}
+		if params.GroupByOperation {
+			key.operation = doc.OperationName
+		}
+		if _, ok := series[key]; !ok {
+			series[key] = make([]*stepCounts, len(steps))
+		}
+
+		i := int(time.Unix(doc.Minute, 0).Sub(from) / params.Step)
+		if i < 0 || i >= len(steps) {
+			continue
+		}
+		counts := series[key][i]
+		if counts == nil {
+			counts = newStepCounts()
+			series[key][i] = counts
+		}
+		counts.add(&doc)
+
+		doc = spmDocument{}
+	}
+
+	err = result.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return series, steps, nil
+}
+
+// GetLatencyQuantile reads the quantile of the latencies of a service's, or operation's, spans over a period from the
+// rollups, e.g. to find the traces slower than an operation's 99th percentile. It's nil when there were no spans. The
+// period is widened to whole minutes, and the quantile is accurate to within 1% of the latency when spm.sketches is set.
+func (cs *couchbaseMetricsReader) GetLatencyQuantile(ctx context.Context, params *LatencyQuantileParameters) (*time.Duration, error) {
+	if params.ServiceName == "" {
+		return nil, errors.New("a service name must be given")
+	}
+	if params.Quantile <= 0 || params.Quantile > 1 {
+		return nil, errors.Errorf("quantile %v must be in (0, 1]", params.Quantile)
+	}
+	// The defaults are filled in on a copy, the caller's parameters are left as they are.
+	query := *params
+	params = &query
+	if params.EndTime.IsZero() {
+		params.EndTime = time.Now()
+	}
+
+	if cs.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cs.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	counts, err := cs.queryLatencies(withQueryName(ctx, "getLatencyQuantile"), params)
+	cs.metrics.record("getLatencyQuantile", start, err)
+	if err != nil {
+		cs.logger.Warn("metrics query failed", "query", "getLatencyQuantile", "error", err)
+		return nil, errors.Wrap(err, "Error reading metrics from storage")
+	}
+	if counts.calls == 0 {
+		return nil, nil
+	}
+
+	latency := time.Duration(counts.latency(params.Quantile) * float64(time.Millisecond))
+
+	return &latency, nil
+}
+
+// queryLatencies sums the rollups of the spans that params selects.
+func (cs *couchbaseMetricsReader) queryLatencies(ctx context.Context, params *LatencyQuantileParameters) (*stepCounts, error) {
+	from := params.StartTime.Truncate(time.Minute).Unix()
+	var queryStmt string
+	var queryParams []interface{}
+	if params.OperationName == "" {
+		queryStmt = fmt.Sprintf(querySPMLatencies, cs.store.Keyspace())
+		queryParams = []interface{}{params.ServiceName, from, params.EndTime.Unix()}
+	} else {
+		queryStmt = fmt.Sprintf(querySPMOperationLatencies, cs.store.Keyspace())
+		queryParams = []interface{}{params.ServiceName, params.OperationName, from, params.EndTime.Unix()}
+	}
+
+	kinds := make(map[string]bool, len(params.SpanKinds))
+	for _, kind := range params.SpanKinds {
+		kinds[kind] = true
+	}
+
+	result, err := cs.store.QueryPrepared(ctx, queryStmt, queryParams)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := newStepCounts()
+	var doc spmDocument
+	for result.Next(&doc) {
+		if len(kinds) == 0 || kinds[doc.SpanKind] {
+			counts.add(&doc)
+		}
+
+		doc = spmDocument{}
+	}
+
+	err = result.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+func sortedSeries(series map[seriesKey][]*stepCounts) []seriesKey {
+	keys := make([]seriesKey, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].service != keys[j].service {
+			return keys[i].service < keys[j].service
+		}
+		return keys[i].operation < keys[j].operation
+	})
+
+	return keys
+}
+
+// quantile estimates the q quantile of the latencies counted in the histogram buckets, interpolating linearly within
+// the bucket that the quantile falls in. Latencies in the unbounded bucket are taken to be the largest bound.
+func quantile(buckets []int64, q float64) float64 {
+	var total int64
+	for _, n := range buckets {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := q * float64(total)
+	var cumulative float64
+	for i, n := range buckets {
+		if n == 0 || cumulative+float64(n) < rank {
+			cumulative += float64(n)
+			continue
+		}
+		if i == len(latencyBucketBounds) {
+			return latencyBucketBounds[len(latencyBucketBounds)-1]
+		}
+
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBucketBounds[i-1]
+		}
+		upper := latencyBucketBounds[i]
+
+		return lower + (upper-lower)*(rank-cumulative)/float64(n)
+	}
+
+	return latencyBucketBounds[len(latencyBucketBounds)-1]
+}
@@ -12,9 +12,10 @@ type TraceID struct {
 }
 
 type SpanRef struct {
-	TraceID TraceID `json:"trace_id"`
-	SpanID  uint64  `json:"span_id"`
-	RefType int32   `json:"ref_type"`
+	TraceID    TraceID          `json:"trace_id"`
+	SpanID     uint64           `json:"span_id"`
+	RefType    int32            `json:"ref_type"`
+	Attributes []model.KeyValue `json:"attributes,omitempty"`
 }
 
 type Span struct {
@@ -25,13 +26,34 @@ type Span struct {
 	Duration      time.Duration    `json:"duration"`
 	Tags          []model.KeyValue `json:"tags"`
 	Logs          []model.Log      `json:"logs"`
+	Events        []Event          `json:"events,omitempty"`
 	Process       *model.Process   `json:"process,omitempty"`
 	ProcessID     string           `json:"process_id,omitempty"`
+	ProcessHash   string           `json:"process_hash,omitempty"`
 	Warnings      []string         `json:"warnings,omitempty"`
 	TraceID       TraceID          `json:"trace_id"`
 	SpanID        uint64           `json:"span_id"`
 	Type          string           `json:"type"`
 	ProcessedTags []string         `json:"processed_tags"`
+	SpanKind      string           `json:"span_kind,omitempty"`
+	Error         bool             `json:"error,omitempty"`
+	Encoding      string           `json:"encoding,omitempty"`
+	Codec         string           `json:"codec,omitempty"`
+	Payload       []byte           `json:"payload,omitempty"`
+	SchemaVersion int              `json:"schema_version,omitempty"`
+	Body          string           `json:"body,omitempty"`
+}
+
+// OperationQueryParameters filters the operations of a service, an empty SpanKind matches spans of any kind.
+type OperationQueryParameters struct {
+	ServiceName string
+	SpanKind    string
+}
+
+// Operation is an operation name along with the kind of the spans it was recorded on.
+type Operation struct {
+	Name     string `json:"operation_name"`
+	SpanKind string `json:"span_kind"`
 }
 
 type Tag struct {
@@ -65,7 +87,8 @@ func (u UniqueTraceIDs) Add(traceID TraceID) {
 }
 
 func (s *Span) toDomain() (*model.Span, error) {
-	startTime, err := time.Parse(dateLayout, s.StartTime)
+	// Spans read from the flat layout have their start time to the microsecond.
+	startTime, err := time.Parse(time.RFC3339Nano, s.StartTime)
 	if err != nil {
 		return nil, err
 	}
@@ -92,6 +115,8 @@ func (s *Span) toDomain() (*model.Span, error) {
 			RefType: model.SpanRefType(ref.RefType),
 		})
 	}
+	modelSpan.Tags = joinLinkAttributes(modelSpan.Tags, s.References)
+	modelSpan.Logs = joinEvents(modelSpan.Logs, s.Events)
 
 	return modelSpan, nil
 }
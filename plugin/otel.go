@@ -0,0 +1,144 @@
+package plugin
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const (
+	// EventNameField is the log field that Jaeger clients, and the translation of OTLP spans to Jaeger spans, record
+	// the name of an event in.
+	EventNameField = "event"
+	// EventMarkerField marks the logs which are OTel span events, which the OTLP import adds as the last field of the
+	// logs it translates events to. Only marked logs are stored as events, as Jaeger clients name plain logs with an
+	// event field too and those must read back exactly as they were written.
+	EventMarkerField = "otel.event"
+	// LinkAttributePrefix prefixes the span tags which carry the attributes of an OTel link, as Jaeger's references
+	// have nowhere to hold them. The prefix is followed by the index of the link's reference and a dot, e.g.
+	// otel.link.0.peer.service.
+	LinkAttributePrefix = "otel.link."
+)
+
+// Event is a span event, a log with a name. Events are stored apart from logs so that their names can be queried.
+type Event struct {
+	Name       string           `json:"name"`
+	Timestamp  time.Time        `json:"timestamp"`
+	Attributes []model.KeyValue `json:"attributes,omitempty"`
+}
+
+// EventLog returns the log that an OTel span event is translated to, its name followed by its attributes and marked
+// as an event.
+func EventLog(name string, timestamp time.Time, attributes []model.KeyValue) model.Log {
+	fields := make([]model.KeyValue, 0, len(attributes)+2)
+	fields = append(fields, model.String(EventNameField, name))
+	fields = append(fields, attributes...)
+	fields = append(fields, model.Bool(EventMarkerField, true))
+
+	return model.Log{Timestamp: timestamp, Fields: fields}
+}
+
+// isEventLog reports whether the log was translated from an OTel span event, so has the shape that EventLog gives it.
+func isEventLog(log model.Log) bool {
+	n := len(log.Fields)
+	if n < 2 {
+		return false
+	}
+	name, marker := log.Fields[0], log.Fields[n-1]
+
+	return name.Key == EventNameField && name.VType == model.StringType &&
+		marker.Key == EventMarkerField && marker.VType == model.BoolType && marker.Bool()
+}
+
+// splitEvents separates the logs which are OTel span events from the other logs.
+func splitEvents(logs []model.Log) ([]model.Log, []Event) {
+	var remaining []model.Log
+	var events []Event
+	for _, log := range logs {
+		if !isEventLog(log) {
+			remaining = append(remaining, log)
+			continue
+		}
+
+		n := len(log.Fields)
+		events = append(events, Event{
+			Name:       log.Fields[0].VStr,
+			Timestamp:  log.Timestamp,
+			Attributes: log.Fields[1 : n-1],
+		})
+	}
+
+	return remaining, events
+}
+
+// joinEvents returns the events to the logs, as they were before being split from them, in time order.
+func joinEvents(logs []model.Log, events []Event) []model.Log {
+	if len(events) == 0 {
+		return logs
+	}
+
+	for _, event := range events {
+		logs = append(logs, EventLog(event.Name, event.Timestamp, event.Attributes))
+	}
+	sort.SliceStable(logs, func(i, j int) bool {
+		return logs[i].Timestamp.Before(logs[j].Timestamp)
+	})
+
+	return logs
+}
+
+// splitLinkAttributes moves the tags carrying link attributes onto the references that they belong to, returning the
+// other tags. Tags for references that don't exist are left as tags.
+func splitLinkAttributes(tags []model.KeyValue, refs []SpanRef) []model.KeyValue {
+	var remaining []model.KeyValue
+	for _, tag := range tags {
+		i, key, ok := ParseLinkAttribute(tag.Key)
+		if !ok || i >= len(refs) {
+			remaining = append(remaining, tag)
+			continue
+		}
+
+		tag.Key = key
+		refs[i].Attributes = append(refs[i].Attributes, tag)
+	}
+
+	return remaining
+}
+
+// joinLinkAttributes returns the attributes of the references to the tags.
+func joinLinkAttributes(tags []model.KeyValue, refs []SpanRef) []model.KeyValue {
+	for i, ref := range refs {
+		for _, attribute := range ref.Attributes {
+			attribute.Key = LinkAttributeKey(i, attribute.Key)
+			tags = append(tags, attribute)
+		}
+	}
+
+	return tags
+}
+
+// LinkAttributeKey returns the tag key carrying the attribute of the link with the reference index i.
+func LinkAttributeKey(i int, key string) string {
+	return LinkAttributePrefix + strconv.Itoa(i) + "." + key
+}
+
+// ParseLinkAttribute returns the reference index and attribute key of a link attribute's tag key.
+func ParseLinkAttribute(key string) (int, string, bool) {
+	if !strings.HasPrefix(key, LinkAttributePrefix) {
+		return 0, "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(key, LinkAttributePrefix), ".", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", false
+	}
+	i, err := strconv.Atoi(parts[0])
+	if err != nil || i < 0 {
+		return 0, "", false
+	}
+
+	return i, parts[1], true
+}
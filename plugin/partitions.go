@@ -0,0 +1,360 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/pkg/errors"
+)
+
+const (
+	// partitionLayout is the suffix of each partition's collection name, each partition holds a day of spans.
+	partitionLayout = "2006_01_02"
+	// defaultPartitionPrefix prefixes partition names when spans would otherwise be stored in the default collection.
+	defaultPartitionPrefix = "spans"
+
+	createCollectionStmt   = "CREATE COLLECTION %s"
+	dropCollectionStmt     = "DROP COLLECTION %s"
+	queryPartitionNameStmt = "SELECT RAW name FROM system:keyspaces WHERE `bucket` = ? AND `scope` = ? AND name LIKE ?"
+)
+
+// partitionManager stores spans in a collection per day, named after the span collection and the day, and drops
+// whole collections once they're older than the retention period rather than expiring each span. Partitions are
+// created a day ahead so that they're ready, along with their indexes, before spans are written to them.
+type partitionManager struct {
+	store     *couchbaseStore
+	retention time.Duration
+	logger    hclog.Logger
+
+	mu     sync.RWMutex
+	stores map[string]*couchbaseStore
+}
+
+func newPartitionManager(store *couchbaseStore, retention time.Duration, logger hclog.Logger) *partitionManager {
+	return &partitionManager{
+		store:     store,
+		retention: retention,
+		logger:    logger,
+		stores:    make(map[string]*couchbaseStore),
+	}
+}
+
+// ManagePartitions creates the partitions for today and tomorrow, and drops the partitions that are older than the
+// retention period.
+func (cs *couchbaseStore) ManagePartitions() error {
+	if cs.partitions == nil {
+		return nil
+	}
+
+	return cs.partitions.manage(time.Now().UTC())
+}
+
+// RunPartitionRetention manages the store's partitions every hour.
+func RunPartitionRetention(store Store, logger hclog.Logger) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := store.ManagePartitions()
+		if err != nil {
+			logger.Error("failed to manage partitions", "error", err)
+		}
+	}
+}
+
+func (m *partitionManager) manage(now time.Time) error {
+	today := now.Truncate(24 * time.Hour)
+	for _, day := range []time.Time{today, today.AddDate(0, 0, 1)} {
+		err := m.create(m.name(day))
+		if err != nil {
+			return err
+		}
+	}
+
+	names, err := m.list()
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool, len(names))
+	for _, name := range names {
+		day, ok := m.day(name)
+		if !ok {
+			continue
+		}
+		if day.AddDate(0, 0, 1).Before(now.Add(-m.retention)) {
+			err := m.drop(name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		existing[name] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name := range existing {
+		if _, ok := m.stores[name]; !ok {
+			m.stores[name] = m.store.forPartition(name)
+		}
+	}
+	for name := range m.stores {
+		if !existing[name] {
+			delete(m.stores, name)
+		}
+	}
+
+	return nil
+}
+
+// create creates the partition's collection and its span indexes, if they don't exist.
+func (m *partitionManager) create(name string) error {
+	ks := m.keyspace(name)
+	err := m.store.Execute(fmt.Sprintf(createCollectionStmt, ks), nil)
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		return errors.Wrapf(err, "failed to create partition %s", name)
+	}
+
+	err = createIndex(m.store, fmt.Sprintf(createPrimaryIndexStmt, ks), m.logger)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create primary index on %s", name)
+	}
+	for _, index := range spanIndexes {
+		err := createIndex(m.store, index.statement(ks, modelLayout), m.logger)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create index %s on %s", index.Name, name)
+		}
+	}
+
+	return nil
+}
+
+func (m *partitionManager) drop(name string) error {
+	err := m.store.Execute(fmt.Sprintf(dropCollectionStmt, m.keyspace(name)), nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to drop partition %s", name)
+	}
+	m.logger.Info("dropped partition", "partition", name)
+
+	return nil
+}
+
+// list returns the names of the partitions that exist.
+func (m *partitionManager) list() ([]string, error) {
+	scope := m.store.scope
+	if scope == "" {
+		scope = defaultScope
+	}
+
+	result, err := m.store.Query(context.Background(), queryPartitionNameStmt, []interface{}{m.store.Name(), scope, m.prefix() + "_%"})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list partitions")
+	}
+
+	var names []string
+	var name string
+	for result.Next(&name) {
+		names = append(names, name)
+	}
+	err = result.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list partitions")
+	}
+
+	return names, nil
+}
+
+// prefix returns the prefix of the partitions' names, which is the name of the collection spans would otherwise be
+// stored in.
+func (m *partitionManager) prefix() string {
+	if m.store.spanCollection == "" || m.store.spanCollection == defaultCollection {
+		return defaultPartitionPrefix
+	}
+
+	return m.store.spanCollection
+}
+
+func (m *partitionManager) name(day time.Time) string {
+	return m.prefix() + "_" + day.UTC().Format(partitionLayout)
+}
+
+// day returns the day that the partition holds spans for.
+func (m *partitionManager) day(name string) (time.Time, bool) {
+	prefix := m.prefix() + "_"
+	if !strings.HasPrefix(name, prefix) {
+		return time.Time{}, false
+	}
+
+	day, err := time.Parse(partitionLayout, strings.TrimPrefix(name, prefix))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return day, true
+}
+
+func (m *partitionManager) keyspace(name string) string {
+	return keyspace(m.store.Name(), m.store.scope, name)
+}
+
+// storeFor returns the store for the partition holding spans started at t.
+func (m *partitionManager) storeFor(t time.Time) (*couchbaseStore, error) {
+	name := m.name(t)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	store, ok := m.stores[name]
+	if !ok {
+		return nil, errors.Errorf("partition %s does not exist", name)
+	}
+
+	return store, nil
+}
+
+// storesBetween returns the stores of the partitions holding spans started between start and end, newest first. Zero
+// times leave that end of the range open.
+func (m *partitionManager) storesBetween(start, end time.Time) []*couchbaseStore {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var names []string
+	for name := range m.stores {
+		day, _ := m.day(name)
+		if !start.IsZero() && day.AddDate(0, 0, 1).Before(start) {
+			continue
+		}
+		if !end.IsZero() && day.After(end) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	stores := make([]*couchbaseStore, len(names))
+	for i, name := range names {
+		stores[i] = m.stores[name]
+	}
+
+	return stores
+}
+
+// forPartition returns a store for the partition's collection. Partition stores share their parent's bucket and
+// metrics and are always queried using N1QL. Lookup documents, and the error field document, stay in the parent's
+// collection.
+func (cs *couchbaseStore) forPartition(name string) *couchbaseStore {
+	store := cs.derive(cs.logger.With("partition", name))
+	store.parent = cs
+	store.spanCollection = name
+	store.errorField = cs.errorField
+
+	return store
+}
+
+// getPartitionedTrace fetches the trace from every partition, as a trace's spans may have started either side of
+// midnight.
+func (cs *couchbaseSpanReader) getPartitionedTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+	var trace model.Trace
+	for _, store := range cs.partitions.storesBetween(time.Time{}, time.Time{}) {
+		partial, err := store.spanReader().findTrace(ctx, traceID)
+		if err == spanstore.ErrTraceNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		trace.Spans = append(trace.Spans, partial.Spans...)
+	}
+	if len(trace.Spans) == 0 {
+		return nil, spanstore.ErrTraceNotFound
+	}
+
+	return &trace, nil
+}
+
+// findPartitionedTraceIDs finds matching traces in the partitions covering the search's time range, querying up to
+// readParallelism partitions at once. Traces are returned newest partition first, up to the number of traces requested
+// if there's a limit.
+func (cs *couchbaseSpanReader) findPartitionedTraceIDs(ctx context.Context, traceQuery *spanstore.TraceQueryParameters) ([]TraceID, error) {
+	stores := cs.partitions.storesBetween(traceQuery.StartTimeMin, traceQuery.StartTimeMax)
+
+	// The first failure cancels the queries that are still running.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parallelism := cs.readParallelism
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+
+	// Each partition has its own slot so that newer partitions' traces come first.
+	results := make([][]TraceID, len(stores))
+	var errOnce sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallelism)
+	for i, store := range stores {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, store *couchbaseStore) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			found, err := store.spanReader().findTraceIDs(ctx, traceQuery)
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			results[i] = found
+		}(i, store)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	var traceIDs []TraceID
+	seen := make(UniqueTraceIDs)
+	for _, found := range results {
+		for _, traceID := range found {
+			if traceQuery.NumTraces > 0 && len(traceIDs) >= traceQuery.NumTraces {
+				return traceIDs, nil
+			}
+			if _, ok := seen[traceID]; ok {
+				continue
+			}
+			seen.Add(traceID)
+			traceIDs = append(traceIDs, traceID)
+		}
+	}
+
+	return traceIDs, nil
+}
+
+// SpanKeyspaces returns the keyspaces holding the spans started between start and end, which are the span keyspace
+// and, when partitioning is enabled, the partitions covering the range.
+func (cs *couchbaseStore) SpanKeyspaces(start, end time.Time) []string {
+	keyspaces := []string{cs.Keyspace()}
+	if cs.partitions != nil {
+		for _, store := range cs.partitions.storesBetween(start, end) {
+			keyspaces = append(keyspaces, store.Keyspace())
+		}
+	}
+
+	return keyspaces
+}
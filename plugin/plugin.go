@@ -1,8 +1,11 @@
 package plugin
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/chvck/couchbase-jaeger-storage-plugin/httpclient"
@@ -11,7 +14,16 @@ import (
 	"github.com/pkg/errors"
 )
 
-func VerifyServices(opts options.Options, httpClient httpclient.Client, conn string, store *couchbaseStore, logger hclog.Logger) error {
+func VerifyServices(opts options.Options, httpClient httpclient.Client, conn string, store Store, logger hclog.Logger) error {
+	// Capella doesn't expose the management API that services are checked through, and always runs the query service.
+	if opts.Capella {
+		return nil
+	}
+	// Key-value only mode doesn't use the query or analytics services.
+	if opts.KVOnly {
+		return nil
+	}
+
 	if opts.UseAnalytics {
 		err := VerifyAnalyticsSupported(httpClient, conn, logger)
 		if err == nil {
@@ -36,6 +48,41 @@ func VerifyServices(opts options.Options, httpClient httpclient.Client, conn str
 	return nil
 }
 
+// VerifyCollections checks that the cluster supports collections before telling the store to use any
+// configured scope and collections, clusters older than 7.0 fall back to the default collection. Tenancy stores each
+// tenant in its own scope, partitioning stores each day in its own collection and routes may store services in their
+// own collections, so none of them can fall back. Capella clusters always support collections.
+func VerifyCollections(opts options.Options, httpClient httpclient.Client, conn string, store Store, logger hclog.Logger) error {
+	if !opts.TenancyEnabled && !opts.PartitioningEnabled && !hasCollectionRoutes(opts) && isDefaultCollection(opts.Scope, opts.SpanCollection) && isDefaultCollection(opts.Scope, opts.DependencyCollection) {
+		return nil
+	}
+	if opts.Capella {
+		store.UseCollections(opts.Scope, opts.SpanCollection, opts.DependencyCollection)
+		return nil
+	}
+
+	supported, err := collectionsSupported(httpClient, conn)
+	if err != nil {
+		return errors.Wrap(err, "failed to verify collections supported")
+	}
+	if !supported && opts.TenancyEnabled {
+		return errors.New("tenancy requires a cluster that supports collections")
+	}
+	if !supported && opts.PartitioningEnabled {
+		return errors.New("partitioning requires a cluster that supports collections")
+	}
+	if !supported && hasCollectionRoutes(opts) {
+		return errors.New("routing services to collections requires a cluster that supports collections")
+	}
+	if !supported {
+		logger.Warn("collections are not supported by this cluster, falling back to the default collection")
+		return nil
+	}
+
+	store.UseCollections(opts.Scope, opts.SpanCollection, opts.DependencyCollection)
+	return nil
+}
+
 func OpenBucket(store Store, bucketName string, logger hclog.Logger) error {
 	timer := time.NewTimer(10 * time.Second)
 	waitCh := make(chan struct{})
@@ -58,7 +105,6 @@ func OpenBucket(store Store, bucketName string, logger hclog.Logger) error {
 		return errors.New("timed out trying to open bucket")
 	case <-waitCh:
 		timer.Stop()
-		populateQueries(bucketName)
 		return nil
 	}
 }
@@ -112,15 +158,31 @@ func verifyN1QLSupported(client httpclient.Client, connStr string, logger hclog.
 	return verifyServiceSupported(client, connStr, "8091", "_p/query/admin/ping", logger)
 }
 
-func populateQueries(bucketName string) {
-	querySpanByTraceID = fmt.Sprintf(querySpanByTraceID, bucketName)
-	queryServiceNames = fmt.Sprintf(queryServiceNames, bucketName)
-	queryOperationNames = fmt.Sprintf(queryOperationNames, bucketName)
-	queryIDsByTag = fmt.Sprintf(queryIDsByTag, bucketName)
-	queryIDsByServiceName = fmt.Sprintf(queryIDsByServiceName, bucketName)
-	queryIDsByServiceAndOperationName = fmt.Sprintf(queryIDsByServiceAndOperationName, bucketName)
-	queryIDsByServiceAndOperationNameAndTags = fmt.Sprintf(queryIDsByServiceAndOperationNameAndTags, bucketName)
-	queryIDsByDuration = fmt.Sprintf(queryIDsByDuration, bucketName)
-
-	depsSelectStmt = fmt.Sprintf(depsSelectStmt, bucketName)
+// collectionsSupported reports whether the cluster is running Couchbase Server 7.0 or above.
+func collectionsSupported(client httpclient.Client, conn string) (bool, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:8091/pools", conn), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var pools struct {
+		ImplementationVersion string `json:"implementationVersion"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&pools)
+	if err != nil {
+		return false, err
+	}
+
+	major, err := strconv.Atoi(strings.SplitN(pools.ImplementationVersion, ".", 2)[0])
+	if err != nil {
+		return false, errors.Wrapf(err, "unexpected cluster version %q", pools.ImplementationVersion)
+	}
+
+	return major >= 7, nil
 }
@@ -0,0 +1,163 @@
+package plugin
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/pkg/errors"
+)
+
+// When processes are normalized each distinct process is stored once, in a document keyed by a hash of its service
+// name and tags, and spans only keep their service name along with the hash. Processes often carry large sets of
+// resource tags which are otherwise repeated in every span.
+const processDocumentType = "process"
+
+// processDocument holds a process that spans refer to by its hash.
+type processDocument struct {
+	ServiceName string           `json:"service_name"`
+	Tags        []model.KeyValue `json:"tags"`
+	Type        string           `json:"type"`
+}
+
+func processKey(hash string) string {
+	return "process::" + hash
+}
+
+// processHash returns a hash of the process's service name and tags. The hash is cryptographic so that two processes
+// never share a document.
+func processHash(process *model.Process) (string, error) {
+	h := sha256.New()
+	err := process.Hash(h)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to hash process")
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+// processExpiry returns the expiry of process documents, twice the spans' TTL. Process documents are rewritten at
+// least every half of the spans' TTL, so every span expires before the process it refers to.
+func processExpiry(spanTTL time.Duration) int {
+	return expiryFromTTL(2 * spanTTL)
+}
+
+// processCache is an LRU cache of the tags of the processes that have been read, processes never change so entries
+// only leave the cache when evicted. A nil processCache means processes aren't normalized.
+type processCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type processCacheEntry struct {
+	hash string
+	tags []model.KeyValue
+}
+
+func newProcessCache(size int) *processCache {
+	return &processCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// empty returns an empty cache of the same size, or nil if processes aren't normalized.
+func (c *processCache) empty() *processCache {
+	if c == nil {
+		return nil
+	}
+
+	return newProcessCache(c.size)
+}
+
+// get returns the tags of the process with the hash, reading its document from the store if it isn't cached.
+func (c *processCache) get(store Store, hash string) ([]model.KeyValue, error) {
+	c.mu.Lock()
+	if elem, ok := c.entries[hash]; ok {
+		c.lru.MoveToFront(elem)
+		c.mu.Unlock()
+		return elem.Value.(*processCacheEntry).tags, nil
+	}
+	c.mu.Unlock()
+
+	var doc processDocument
+	err := store.Get(processKey(hash), &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[hash]; !ok {
+		c.entries[hash] = c.lru.PushFront(&processCacheEntry{hash: hash, tags: doc.Tags})
+		if c.size > 0 && c.lru.Len() > c.size {
+			oldest := c.lru.Back()
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*processCacheEntry).hash)
+		}
+	}
+
+	return doc.Tags, nil
+}
+
+// normalizeProcess replaces the span's process with just its service name, recording the hash of the full process.
+// The process is shared with the span being written so it's replaced rather than modified.
+func (s *Span) normalizeProcess() error {
+	if s.Process == nil {
+		return nil
+	}
+
+	hash, err := processHash(s.Process)
+	if err != nil {
+		return err
+	}
+	s.ProcessHash = hash
+	s.Process = &model.Process{ServiceName: s.Process.ServiceName}
+
+	return nil
+}
+
+// writeProcess writes the document of the span's process, unless it has been written recently.
+func (cs *couchbaseSpanWriter) writeProcess(span *model.Span, hash string) error {
+	key := processKey(hash)
+	if !cs.processes.needsWrite(key) {
+		return nil
+	}
+
+	doc := processDocument{
+		ServiceName: span.Process.ServiceName,
+		Tags:        span.Process.Tags,
+		Type:        processDocumentType,
+	}
+	err := cs.store.Upsert(key, doc, processExpiry(cs.spanTTL))
+	if err != nil {
+		return errors.Wrap(err, "failed to write process")
+	}
+	cs.processes.markWritten(key)
+
+	return nil
+}
+
+// joinProcess restores the tags of a span's normalized process. A span whose process can't be read is returned with
+// just its service name and a warning.
+func (cs *couchbaseSpanReader) joinProcess(dbSpan *Span, span *model.Span) {
+	if dbSpan.ProcessHash == "" || cs.processes == nil || cs.skipProcessTags || span.Process == nil {
+		return
+	}
+
+	tags, err := cs.processes.get(cs.store, dbSpan.ProcessHash)
+	if err != nil {
+		cs.logger.Debug("failed to read process", "hash", dbSpan.ProcessHash, "error", err)
+		span.Warnings = append(span.Warnings, "process tags could not be read: "+err.Error())
+		return
+	}
+	span.Process.Tags = tags
+}
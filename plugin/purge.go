@@ -0,0 +1,158 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	purgeSpanKeysStmt = "SELECT RAW META(b).id FROM %s AS b WHERE b.`type`=\"span\" AND %s"
+	// purgeTraceKeysStmt selects the trace documents holding a matching span, the spans are aliased as b so that the
+	// same predicates can be used for both storage models.
+	purgeTraceKeysStmt = "SELECT RAW META(t).id FROM %s AS t WHERE t.`type`=\"trace\" AND ANY b IN t.spans SATISFIES %s END"
+	purgeStmt          = "DELETE FROM %s USE KEYS ?"
+)
+
+// PurgeQuery selects the spans to purge, spans must match every field that is set. At least one field must be set.
+type PurgeQuery struct {
+	ServiceName  string
+	TraceIDs     []TraceID
+	StartTimeMin time.Time
+	StartTimeMax time.Time
+}
+
+// predicates returns the N1QL predicates matching the query's spans in the layout, which are aliased as b.
+func (q PurgeQuery) predicates(layout string) (string, []interface{}, error) {
+	var where []string
+	var params []interface{}
+	if q.ServiceName != "" {
+		where = append(where, "b."+layoutFields(layout).serviceName+" = ?")
+		params = append(params, q.ServiceName)
+	}
+	if len(q.TraceIDs) > 0 {
+		where = append(where, "b.trace_id IN ?")
+		params = append(params, layoutTraceIDs(layout, q.TraceIDs))
+	}
+	if !q.StartTimeMin.IsZero() {
+		where = append(where, "b.start_time >= ?")
+		params = append(params, layoutTime(layout, q.StartTimeMin))
+	}
+	if !q.StartTimeMax.IsZero() {
+		where = append(where, "b.start_time < ?")
+		params = append(params, layoutTime(layout, q.StartTimeMax))
+	}
+	if len(where) == 0 {
+		return "", nil, errors.New("a service, trace IDs or time range must be given")
+	}
+
+	return strings.Join(where, " AND "), params, nil
+}
+
+// PurgeSpans deletes the spans matching the query, at no more than rate documents per second and batchSize documents
+// at a time, and returns the number of documents deleted. With the trace storage model every trace document holding a
+// matching span is deleted. A dry run only counts the documents that would be deleted.
+func (cs *couchbaseStore) PurgeSpans(query PurgeQuery, rate, batchSize int, dryRun bool) (int, error) {
+	where, params, err := query.predicates(cs.layout)
+	if err != nil {
+		return 0, err
+	}
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	keyspaces := []string{cs.Keyspace()}
+	if cs.partitions != nil {
+		names, err := cs.partitions.list()
+		if err != nil {
+			return 0, err
+		}
+		for _, name := range names {
+			keyspaces = append(keyspaces, cs.partitions.keyspace(name))
+		}
+	}
+
+	var purged int
+	for _, ks := range keyspaces {
+		n, err := cs.purgeKeyspace(ks, where, params, rate, batchSize, dryRun)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
+
+// purgeKeyspace streams the keys of the matching documents in the keyspace and deletes them a batch at a time,
+// waiting between batches to stay under the rate.
+func (cs *couchbaseStore) purgeKeyspace(ks, where string, params []interface{}, rate, batchSize int, dryRun bool) (int, error) {
+	stmt := purgeSpanKeysStmt
+	if cs.traceModel {
+		stmt = purgeTraceKeysStmt
+	}
+
+	result, err := cs.Query(context.Background(), fmt.Sprintf(stmt, ks, where), params)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to query documents to purge")
+	}
+
+	var purged int
+	batch := make([]string, 0, batchSize)
+	remove := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		start := time.Now()
+		if !dryRun {
+			// Span bodies are deleted along with their span documents, keys that don't exist are skipped.
+			keys := batch
+			if !cs.traceModel {
+				keys = withBodyKeys(batch)
+			}
+			err := cs.Execute(fmt.Sprintf(purgeStmt, ks), []interface{}{keys})
+			if err != nil {
+				return errors.Wrap(err, "failed to delete documents")
+			}
+		}
+		purged += len(batch)
+		cs.logger.Debug("purged documents", "keyspace", ks, "documents", len(batch), "dry_run", dryRun)
+		batch = batch[:0]
+
+		if rate > 0 && !dryRun {
+			wait := time.Duration(float64(batchSize)/float64(rate)*float64(time.Second)) - time.Since(start)
+			if wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		return nil
+	}
+
+	var key string
+	for result.Next(&key) {
+		batch = append(batch, key)
+		if len(batch) == batchSize {
+			err := remove()
+			if err != nil {
+				result.Close()
+				return purged, err
+			}
+		}
+	}
+	err = remove()
+	if err != nil {
+		result.Close()
+		return purged, err
+	}
+
+	err = result.Close()
+	if err != nil {
+		return purged, errors.Wrap(err, "failed to query documents to purge")
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,107 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+const explainStmt = "EXPLAIN %s"
+
+// primaryScanOperators are the plan operators that read every document in the keyspace.
+var primaryScanOperators = map[string]bool{
+	"PrimaryScan":  true,
+	"PrimaryScan3": true,
+}
+
+// viewQueries are the queries that aren't run when services, operations and trace IDs are read from views.
+var viewQueries = map[string]bool{
+	"queryIDsByService":                 true,
+	"queryIDsByServiceNameAndOperation": true,
+	"getServices":                       true,
+	"getOperations":                     true,
+}
+
+// CheckQueryPlans explains each of the reader's queries and warns about any that would scan the whole keyspace
+// because the index it's meant to use is missing, recommending the statement to create the index. The number of such
+// queries is reported in the queries_without_index gauge. Queries run through analytics or over trace documents don't
+// use the indexes so aren't checked.
+func CheckQueryPlans(opts options.Options, store Store, metricsFactory metrics.Factory, logger hclog.Logger) error {
+	if store.UsesAnalytics() || opts.StorageModel == "trace" || opts.KVOnly {
+		return nil
+	}
+
+	unindexed := 0
+	for _, query := range advisedQueries(store, false) {
+		if store.UsesViews() && viewQueries[query.name] {
+			continue
+		}
+
+		primaryScan, err := usesPrimaryScan(store, query)
+		if err != nil {
+			return errors.Wrapf(err, "failed to explain %s", query.name)
+		}
+		if !primaryScan {
+			continue
+		}
+
+		unindexed++
+		logger.Warn(
+			"query will scan every document in the keyspace because its index is missing, searches will be slow",
+			"query", query.name,
+			"index", query.index,
+			"statement", indexStatement(store, query.index),
+		)
+	}
+
+	metricsFactory.Gauge(metrics.Options{
+		Name: "queries_without_index",
+		Help: "Number of the plugin's queries that scan the whole keyspace because their index is missing",
+	}).Update(int64(unindexed))
+
+	return nil
+}
+
+// usesPrimaryScan reports whether the query's plan scans the primary index.
+func usesPrimaryScan(store Store, query advisedQuery) (bool, error) {
+	result, err := store.Query(context.Background(), fmt.Sprintf(explainStmt, query.statement), query.params)
+	if err != nil {
+		return false, err
+	}
+
+	found := false
+	var plan map[string]interface{}
+	for result.Next(&plan) {
+		found = found || hasOperator(plan, primaryScanOperators)
+		plan = nil
+	}
+
+	return found, result.Close()
+}
+
+// hasOperator reports whether any operator of the plan, or of the plans nested within it, is one of the operators.
+func hasOperator(plan interface{}, operators map[string]bool) bool {
+	switch p := plan.(type) {
+	case map[string]interface{}:
+		if op, ok := p["#operator"].(string); ok && operators[op] {
+			return true
+		}
+		for _, v := range p {
+			if hasOperator(v, operators) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, v := range p {
+			if hasOperator(v, operators) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,85 @@
+package plugin
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// queryStats are the metrics that the query or analytics service sends after the last row of a result. Comparing
+// their times with the plugin's own query latency shows how much of a slow query is spent in the service.
+type queryStats struct {
+	service       string
+	query         string
+	elapsedTime   time.Duration
+	executionTime time.Duration
+	resultCount   uint
+	resultSize    uint
+	errorCount    uint
+}
+
+// resultStats returns the stats of a N1QL or analytics result, which are only set once it's been closed.
+func resultStats(result interface{}) (queryStats, bool) {
+	switch res := result.(type) {
+	case gocb.QueryResults:
+		m := res.Metrics()
+		return queryStats{
+			service:       "n1ql",
+			elapsedTime:   m.ElapsedTime,
+			executionTime: m.ExecutionTime,
+			resultCount:   m.ResultCount,
+			resultSize:    m.ResultSize,
+			errorCount:    m.ErrorCount,
+		}, true
+	case gocb.AnalyticsResults:
+		m := res.Metrics()
+		return queryStats{
+			service:       "analytics",
+			elapsedTime:   m.ElapsedTime,
+			executionTime: m.ExecutionTime,
+			resultCount:   m.ResultCount,
+			resultSize:    m.ResultSize,
+			errorCount:    m.ErrorCount,
+		}, true
+	}
+
+	return queryStats{}, false
+}
+
+// unnamedQuery is the name that the stats of queries run without a name are tagged with.
+const unnamedQuery = "other"
+
+type queryNameKey struct{}
+
+// withQueryName names the queries run with the context, so that their stats are tagged with the name.
+func withQueryName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, queryNameKey{}, name)
+}
+
+// queryName returns the name of the queries run with the context.
+func queryName(ctx context.Context) string {
+	if name, ok := ctx.Value(queryNameKey{}).(string); ok {
+		return name
+	}
+
+	return unnamedQuery
+}
+
+// statsResult records the stats of the query once the result is closed. It wraps the result from the SDK directly, as
+// the result's type tells whether the query fell back from analytics to N1QL.
+type statsResult struct {
+	Result
+	query   string
+	metrics *readMetrics
+}
+
+func (r *statsResult) Close() error {
+	err := r.Result.Close()
+	if stats, ok := resultStats(r.Result); ok {
+		stats.query = r.query
+		r.metrics.recordStats(stats)
+	}
+
+	return err
+}
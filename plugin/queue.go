@@ -0,0 +1,73 @@
+package plugin
+
+import (
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// writeQueue is a spanstore.Writer that queues spans in memory and writes them in the background using a pool of
+// workers, so that WriteSpan returns without waiting on Couchbase.
+type writeQueue struct {
+	writer       spanstore.Writer
+	spans        chan *model.Span
+	dropWhenFull bool
+	metrics      *writeMetrics
+	logger       hclog.Logger
+	workers      sync.WaitGroup
+}
+
+func newWriteQueue(writer spanstore.Writer, size, workers int, dropWhenFull bool, metrics *writeMetrics, logger hclog.Logger) *writeQueue {
+	q := &writeQueue{
+		writer:       writer,
+		spans:        make(chan *model.Span, size),
+		dropWhenFull: dropWhenFull,
+		metrics:      metrics,
+		logger:       logger,
+	}
+	q.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+
+	return q
+}
+
+// WriteSpan queues the span to be written. If the queue is full then it either blocks until there is room or drops
+// the span, depending on the queue's policy.
+func (q *writeQueue) WriteSpan(span *model.Span) error {
+	if !q.dropWhenFull {
+		q.spans <- span
+		return nil
+	}
+
+	select {
+	case q.spans <- span:
+	default:
+		q.metrics.spansDropped.Inc(1)
+		q.logger.Debug("write queue is full, dropping span")
+	}
+
+	return nil
+}
+
+// Close waits for the queued spans to be written and then closes the writer. Spans mustn't be written once it's called.
+func (q *writeQueue) Close() error {
+	close(q.spans)
+	q.workers.Wait()
+
+	return closeWriter(q.writer)
+}
+
+func (q *writeQueue) work() {
+	defer q.workers.Done()
+
+	for span := range q.spans {
+		err := q.writer.WriteSpan(span)
+		if err != nil {
+			q.logger.Error("failed to write queued span", "error", err)
+		}
+	}
+}
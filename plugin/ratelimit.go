@@ -0,0 +1,141 @@
+package plugin
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// tokenBucket allows rate tokens a second, with bursts of up to a second's worth. A nil bucket allows everything.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens earned since the bucket was last used.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// cost caps n at the burst size, so that a single span larger than the burst can still be written.
+func (b *tokenBucket) cost(n float64) float64 {
+	if n > b.rate {
+		return b.rate
+	}
+
+	return n
+}
+
+// available reports whether n tokens can be taken without waiting.
+func (b *tokenBucket) available(now time.Time, n float64) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+
+	return b.tokens >= b.cost(n)
+}
+
+// take takes n tokens, returning how long to wait until they would have been earned. Tokens are taken up front so
+// that waiting callers queue up behind each other.
+func (b *tokenBucket) take(now time.Time, n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= b.cost(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimiter is a spanstore.Writer that limits the spans and bytes written per second, either making writes wait
+// for the limit or dropping spans over it. Writes that are waiting when the limiter is closed are made straight away.
+type rateLimiter struct {
+	writer          spanstore.Writer
+	dropWhenLimited bool
+	metrics         *writeMetrics
+	logger          hclog.Logger
+	done            chan struct{}
+	writes          sync.WaitGroup
+
+	mu    sync.Mutex
+	spans *tokenBucket
+	bytes *tokenBucket
+}
+
+func newRateLimiter(writer spanstore.Writer, spansPerSecond, bytesPerSecond float64, dropWhenLimited bool, metrics *writeMetrics, logger hclog.Logger) *rateLimiter {
+	return &rateLimiter{
+		writer:          writer,
+		dropWhenLimited: dropWhenLimited,
+		metrics:         metrics,
+		logger:          logger,
+		done:            make(chan struct{}),
+		spans:           newTokenBucket(spansPerSecond),
+		bytes:           newTokenBucket(bytesPerSecond),
+	}
+}
+
+func (l *rateLimiter) WriteSpan(span *model.Span) error {
+	var size float64
+	if l.bytes != nil {
+		size = float64(span.Size())
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.dropWhenLimited && (!l.spans.available(now, 1) || !l.bytes.available(now, size)) {
+		l.mu.Unlock()
+		l.metrics.rateLimited.Inc(1)
+		l.logger.Debug("over the write rate limit, dropping span")
+		return nil
+	}
+	wait := l.spans.take(now, 1)
+	if bytesWait := l.bytes.take(now, size); bytesWait > wait {
+		wait = bytesWait
+	}
+	l.mu.Unlock()
+
+	l.writes.Add(1)
+	defer l.writes.Done()
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-l.done:
+			timer.Stop()
+		}
+	}
+
+	return l.writer.WriteSpan(span)
+}
+
+// Close stops writes waiting for the limit, waits for them to be written and then closes the writer.
+func (l *rateLimiter) Close() error {
+	close(l.done)
+	l.writes.Wait()
+
+	return closeWriter(l.writer)
+}
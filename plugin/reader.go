@@ -3,9 +3,13 @@ package plugin
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/model/adjuster"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 	"github.com/opentracing/opentracing-go"
 	ottag "github.com/opentracing/opentracing-go/ext"
@@ -15,53 +19,73 @@ import (
 
 var (
 	querySpanByTraceID = `
-SELECT trace_id, span_id, operation_name, flags, start_time, duration, tags, logs, references, process
-FROM %s
-WHERE trace_id.hi = ? AND trace_id.lo = ? AND ` + "`type`" + `="span"`
-	queryServiceNames   = `SELECT DISTINCT process.service_name from %s where ` + "`type`" + `="span"`
-	queryOperationNames = `SELECT DISTINCT operation_name from %s where process.service_name = ? AND ` + "`type`" + `="span"`
-	queryIDsByTag       = `
-SELECT DISTINCT RAW b.trace_id
-FROM %s AS b
-WHERE b.process.service_name = ? AND b.start_time > ? AND b.start_time < ? AND ` + "b.`type`" + `="span" AND (EVERY tag IN ? SATISFIES tag IN b.processed_tags END)
-ORDER BY b.start_time DESC
+SELECT %[2]s
+FROM %[1]s
+WHERE %[3]s AND ` + "`type`" + `="span"`
+	querySpanKeysByTraceID = "SELECT RAW META(b).id FROM %s AS b WHERE META(b).id LIKE ?"
+	queryTraceIDsByLow     = "SELECT DISTINCT RAW trace_id FROM %[1]s WHERE %[2]s AND `type`=\"span\" LIMIT 2"
+	queryServiceNames      = `SELECT DISTINCT service_name from %s where service_name IS NOT MISSING AND ` + "`type`" + `="service"`
+	queryOperationNames    = `SELECT DISTINCT operation_name from %s where service_name = ? AND ` + "`type`" + `="operation"`
+	queryOperations        = `SELECT DISTINCT operation_name, span_kind from %s where service_name = ? AND ` + "`type`" + `="operation"`
+	queryOperationsByKind  = `SELECT DISTINCT operation_name, span_kind from %s where service_name = ? AND span_kind = ? AND ` + "`type`" + `="operation"`
+	queryIDsByTag          = `
+SELECT RAW b.trace_id
+FROM %[1]s AS b
+WHERE b.%[2]s = ? AND b.start_time > ? AND b.start_time < ? AND ` + "b.`type`" + `="span" AND (EVERY alts IN ? SATISFIES (ANY tag IN alts SATISFIES tag IN b.processed_tags END) END) AND (EVERY ps IN ? SATISFIES (ANY tag IN b.processed_tags SATISFIES (ANY p IN ps SATISFIES REGEXP_LIKE(tag, p) END) END) END)
+GROUP BY b.trace_id
+ORDER BY MAX(b.start_time) DESC
 LIMIT ?`
 	queryIDsByServiceName = `
-SELECT DISTINCT RAW sb.trace_id
-FROM %s sb
-WHERE sb.process.service_name = ? AND sb.start_time > ? AND sb.start_time < ? AND ` + "sb.`type`" + `="span"
-ORDER BY sb.start_time DESC
+SELECT RAW sb.trace_id
+FROM %[1]s sb
+WHERE sb.%[2]s = ? AND sb.start_time > ? AND sb.start_time < ? AND ` + "sb.`type`" + `="span"
+GROUP BY sb.trace_id
+ORDER BY MAX(sb.start_time) DESC
 LIMIT ?`
 	queryIDsByServiceAndOperationName = `
-SELECT DISTINCT RAW trace_id
-FROM %s AS b
-WHERE process.service_name = ? AND operation_name = ? AND start_time > ? AND start_time < ? AND` + "`type`" + `="span"
-ORDER BY start_time DESC
+SELECT RAW trace_id
+FROM %[1]s AS b
+WHERE %[2]s = ? AND operation_name = ? AND start_time > ? AND start_time < ? AND` + "`type`" + `="span"
+GROUP BY trace_id
+ORDER BY MAX(start_time) DESC
 LIMIT ?`
 	queryIDsByServiceAndOperationNameAndTags = `
-SELECT DISTINCT RAW trace_id
-FROM %s AS b
-WHERE process.service_name = ? AND operation_name = ? AND start_time > ? AND start_time < ? AND` + "`type`" + `="span"
-AND (EVERY tag IN ? SATISFIES tag IN b.processed_tags END)
-ORDER BY start_time DESC
+SELECT RAW trace_id
+FROM %[1]s AS b
+WHERE %[2]s = ? AND operation_name = ? AND start_time > ? AND start_time < ? AND` + "`type`" + `="span"
+AND (EVERY alts IN ? SATISFIES (ANY tag IN alts SATISFIES tag IN b.processed_tags END) END) AND (EVERY ps IN ? SATISFIES (ANY tag IN b.processed_tags SATISFIES (ANY p IN ps SATISFIES REGEXP_LIKE(tag, p) END) END) END)
+GROUP BY trace_id
+ORDER BY MAX(start_time) DESC
+LIMIT ?`
+	queryIDsByError = `
+SELECT RAW b.trace_id
+FROM %[1]s AS b
+WHERE b.%[2]s = ? AND b.start_time > ? AND b.start_time < ? AND ` + "b.`type`" + `="span" AND b.error = true
+GROUP BY b.trace_id
+ORDER BY MAX(b.start_time) DESC
+LIMIT ?`
+	queryIDsByErrorAndOperationName = `
+SELECT RAW b.trace_id
+FROM %[1]s AS b
+WHERE b.%[2]s = ? AND b.operation_name = ? AND b.start_time > ? AND b.start_time < ? AND ` + "b.`type`" + `="span" AND b.error = true
+GROUP BY b.trace_id
+ORDER BY MAX(b.start_time) DESC
 LIMIT ?`
 	queryIDsByDuration = `
-SELECT DISTINCT RAW trace_id
-FROM %s AS b
-WHERE process.service_name = ? AND duration > ? AND duration < ? AND ` + "`type`" + `="span"
+SELECT RAW trace_id
+FROM %[1]s AS b
+WHERE %[2]s = ? AND start_time > ? AND start_time < ? AND duration > ? AND duration < ? AND ` + "`type`" + `="span"
+GROUP BY trace_id
+ORDER BY MAX(start_time) DESC
 LIMIT ?`
 	queryIDsByDurationAndOperationName = `
-SELECT DISTINCT RAW trace_id
-FROM %s AS b
-WHERE process.service_name = ? AND operation_name = ? AND duration > ? AND duration < ? AND ` + "`type`" + `="span"
+SELECT RAW trace_id
+FROM %[1]s AS b
+WHERE %[2]s = ? AND operation_name = ? AND start_time > ? AND start_time < ? AND duration > ? AND duration < ? AND ` + "`type`" + `="span"
+GROUP BY trace_id
+ORDER BY MAX(start_time) DESC
 LIMIT ?`
 
-	queryTracesBySubQuery = `
-SELECT b.trace_id, b.span_id, b.operation_name, b.flags, b.start_time, b.duration, b.tags, b.logs, b.references, b.process
-FROM %s b
-WHERE b.trace_id IN (%s)
-ORDER BY b.trace_id, b.start_time`
-
 	// ErrServiceNameNotSet occurs when attempting to query with an empty service name
 	ErrServiceNameNotSet = errors.New("service Name must be set")
 
@@ -86,33 +110,172 @@ const (
 )
 
 type couchbaseSpanReader struct {
-	store Store
+	store           Store
+	maxResultBytes  int
+	maxTraces       int
+	keyStrategy     string
+	cache           *resultCache
+	readParallelism int
+	traceModel      bool
+	layout          string
+	tagWildcards    bool
+	tagOperators    bool
+	skipLogs        bool
+	skipProcessTags bool
+	adjuster        adjuster.Adjuster
+	partitions      *partitionManager
+	search          *tagSearch
+	kvIndex         *kvIndex
+	views           *viewIndex
+	processes       *processCache
+	errorField      *errorField
+	timeout         time.Duration
+	metrics         *readMetrics
+	logger          hclog.Logger
 }
 
 func (cs *couchbaseSpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
-	span, ctx := cs.startSpanForQuery(ctx, "readTrace", querySpanByTraceID)
+	ctx, cancel := cs.withTimeout(ctx)
+	defer cancel()
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "GetTrace")
+	defer span.Finish()
+	span.SetTag("jaeger.trace_id", traceID.String())
+
+	start := time.Now()
+	trace, err := cs.getTrace(withQueryName(ctx, "getTrace"), traceID)
+	cs.metrics.record("getTrace", start, err)
+	cs.logErrorToSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return cs.adjust(trace), nil
+}
+
+// getTrace fetches the trace from the store as it was written. Callers adjust it before returning it, so that
+// traces are adjusted alike however they're found.
+func (cs *couchbaseSpanReader) getTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+	if cs.partitions != nil {
+		return cs.getPartitionedTrace(ctx, traceID)
+	}
+
+	return cs.findTrace(ctx, traceID)
+}
+
+// adjust applies the configured adjustments to the trace. Adjusters still return the trace when they fail, with
+// whatever adjustments they could make.
+func (cs *couchbaseSpanReader) adjust(trace *model.Trace) *model.Trace {
+	if cs.adjuster == nil {
+		return trace
+	}
+
+	adjusted, err := cs.adjuster.Adjust(trace)
+	if err != nil {
+		cs.logger.Debug("failed to adjust trace", "error", err)
+	}
+	if adjusted == nil {
+		return trace
+	}
+
+	return adjusted
+}
+
+// findTrace fetches the trace with the ID, or with the other form of the ID if there's no trace with exactly that ID.
+func (cs *couchbaseSpanReader) findTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+	trace, err := cs.getTraceByID(ctx, traceID)
+	if err != spanstore.ErrTraceNotFound {
+		return trace, err
+	}
+
+	// IDs copied from systems that only show the low 64 bits of a 128 bit ID, or that show 64 bit IDs as 128 bit IDs,
+	// don't match the ID that the trace was written with so the trace is looked for under its other form.
+	otherID, ok, err := cs.otherTraceID(ctx, traceID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, spanstore.ErrTraceNotFound
+	}
+
+	return cs.getTraceByID(ctx, otherID)
+}
+
+// otherTraceID returns the other form of a trace ID. A 128 bit ID's other form is its low 64 bits. A 64 bit ID's
+// other form is the 128 bit ID whose low 64 bits match, if there is exactly one.
+func (cs *couchbaseSpanReader) otherTraceID(ctx context.Context, traceID model.TraceID) (model.TraceID, bool, error) {
+	if traceID.High != 0 {
+		return model.TraceID{Low: traceID.Low}, true, nil
+	}
+	// Finding the 128 bit form needs a query, which key-value only mode can't run.
+	if cs.kvIndex != nil {
+		return model.TraceID{}, false, nil
+	}
+
+	queryStmt := traceIDsByLowQuery(cs.layout, cs.spansKeyspace())
+	span, ctx := cs.startSpanForQuery(ctx, "findTraceIDByLow", queryStmt)
+	defer span.Finish()
+
+	traceIDs, err := cs.queryTraceIDs(ctx, span, queryStmt, lowTraceIDParams(cs.layout, traceID.Low))
+	if err != nil {
+		return model.TraceID{}, false, errors.Wrap(err, "Error reading traces from storage")
+	}
+	if len(traceIDs) != 1 || traceIDs[0].High == 0 {
+		return model.TraceID{}, false, nil
+	}
+
+	return traceIDToDomain(traceIDs[0]), true, nil
+}
+
+// getTraceByID fetches the trace with exactly the given ID.
+func (cs *couchbaseSpanReader) getTraceByID(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+	if cs.traceModel {
+		return cs.readTrace(ctx, traceID)
+	}
+	if cs.keyStrategy == deterministicKeyStrategy {
+		trace, err := cs.getTraceByKeys(ctx, traceID)
+		// Spans written before the key strategy was changed can only be found by querying.
+		if err != spanstore.ErrTraceNotFound {
+			return trace, err
+		}
+	}
+
+	queryStmt := spansByTraceIDQuery(cs.layout, cs.store.Keyspace(), cs.spanFields(""))
+	span, ctx := cs.startSpanForQuery(ctx, "readTrace", queryStmt)
 	defer span.Finish()
 	span.LogFields(otlog.String("event", "searching"), otlog.Object("trace_id", traceID))
 
-	dbTraceID := traceIDFromDomain(traceID)
-	result, err := cs.store.Query(querySpanByTraceID, []interface{}{dbTraceID.High, dbTraceID.Low})
+	result, err := cs.store.QueryPrepared(ctx, queryStmt, traceIDParams(cs.layout, traceIDFromDomain(traceID)))
 	if err != nil {
 		cs.logErrorToSpan(span, err)
 		return nil, err
 	}
 
 	var trace model.Trace
-	var traceSpan Span
-	for result.Next(&traceSpan) {
-		span, err := traceSpan.toDomain()
+	var split []*Span
+	spans := newSpanIterator(result, cs.maxResultBytes, cs.layout)
+	for dbSpan, ok := spans.Next(); ok; dbSpan, ok = spans.Next() {
+		// Spans stored with split storage are read once all of their bodies can be fetched together.
+		if dbSpan.Body != "" {
+			split = append(split, dbSpan)
+			continue
+		}
+		modelSpan, err := cs.toDomain(dbSpan)
 		if err != nil {
+			spans.Close()
 			return nil, err
 		}
-		trace.Spans = append(trace.Spans, span)
+		trace.Spans = append(trace.Spans, modelSpan)
 	}
 
-	err = result.Close()
+	err = spans.Close()
 	if err != nil {
+		cs.logErrorToSpan(span, err)
+		return nil, errors.Wrap(err, "Error reading traces from storage")
+	}
+	err = cs.appendSplitSpans(&trace, split)
+	if err != nil {
+		cs.logErrorToSpan(span, err)
 		return nil, errors.Wrap(err, "Error reading traces from storage")
 	}
 	if len(trace.Spans) == 0 {
@@ -122,8 +285,150 @@ func (cs *couchbaseSpanReader) GetTrace(ctx context.Context, traceID model.Trace
 	return &trace, err
 }
 
+// getTraceByKeys fetches a trace's spans with a bulk get when spans are keyed by their trace ID. Finding the keys is a
+// scan of the primary index, which holds the keys, so the spans themselves never go through the query service.
+func (cs *couchbaseSpanReader) getTraceByKeys(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+	queryStmt := fmt.Sprintf(querySpanKeysByTraceID, cs.store.Keyspace())
+	span, ctx := cs.startSpanForQuery(ctx, "readTraceByKeys", queryStmt)
+	defer span.Finish()
+
+	result, err := cs.store.QueryPrepared(ctx, queryStmt, []interface{}{traceKeyPrefix(traceID) + "%"})
+	if err != nil {
+		cs.logErrorToSpan(span, err)
+		return nil, err
+	}
+
+	var docs []Document
+	var key string
+	for result.Next(&key) {
+		if cs.layout == flatLayout {
+			docs = append(docs, Document{Key: key, Value: &FlatSpan{}})
+		} else {
+			docs = append(docs, Document{Key: key, Value: &Span{}})
+		}
+	}
+	err = result.Close()
+	if err != nil {
+		cs.logErrorToSpan(span, err)
+		return nil, errors.Wrap(err, "Error reading traces from storage")
+	}
+	if len(docs) == 0 {
+		return nil, spanstore.ErrTraceNotFound
+	}
+
+	var trace model.Trace
+	var split []*Span
+	for i, err := range cs.store.GetMulti(docs) {
+		if err == ErrDocumentNotFound {
+			// The span may have expired since its key was found.
+			continue
+		}
+		if err != nil {
+			cs.logErrorToSpan(span, err)
+			return nil, errors.Wrap(err, "Error reading traces from storage")
+		}
+
+		dbSpan, err := cs.documentSpan(docs[i].Value)
+		if err != nil {
+			return nil, err
+		}
+		if dbSpan.Body != "" {
+			split = append(split, dbSpan)
+			continue
+		}
+		if cs.skipLogs {
+			dbSpan.Logs = nil
+			dbSpan.Events = nil
+		}
+		if cs.skipProcessTags && dbSpan.Process != nil {
+			dbSpan.Process.Tags = nil
+		}
+
+		modelSpan, err := cs.toDomain(dbSpan)
+		if err != nil {
+			return nil, err
+		}
+		trace.Spans = append(trace.Spans, modelSpan)
+	}
+	err = cs.appendSplitSpans(&trace, split)
+	if err != nil {
+		cs.logErrorToSpan(span, err)
+		return nil, errors.Wrap(err, "Error reading traces from storage")
+	}
+	if len(trace.Spans) == 0 {
+		return nil, spanstore.ErrTraceNotFound
+	}
+
+	return &trace, nil
+}
+
+// readTrace fetches a trace from its trace document when the trace storage model is used.
+func (cs *couchbaseSpanReader) readTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "readTraceDocument")
+	defer span.Finish()
+
+	dbSpans, err := readTrace(cs.store, traceIDFromDomain(traceID))
+	if err == ErrDocumentNotFound {
+		return nil, spanstore.ErrTraceNotFound
+	}
+	if err != nil {
+		cs.logErrorToSpan(span, err)
+		return nil, errors.Wrap(err, "Error reading traces from storage")
+	}
+
+	var trace model.Trace
+	for _, dbSpan := range dbSpans {
+		// Trace documents are always fetched whole, so the projection is applied once they've been read.
+		if cs.skipLogs {
+			dbSpan.Logs = nil
+			dbSpan.Events = nil
+		}
+		if cs.skipProcessTags && dbSpan.Process != nil {
+			dbSpan.Process.Tags = nil
+		}
+
+		modelSpan, err := cs.toDomain(&dbSpan)
+		if err != nil {
+			return nil, err
+		}
+		trace.Spans = append(trace.Spans, modelSpan)
+	}
+	if len(trace.Spans) == 0 {
+		return nil, spanstore.ErrTraceNotFound
+	}
+
+	return &trace, nil
+}
+
 func (cs *couchbaseSpanReader) GetServices(ctx context.Context) ([]string, error) {
-	result, err := cs.store.Query(queryServiceNames, nil)
+	if services, ok := cs.cache.get("getServices", servicesCacheKey); ok {
+		return services.([]string), nil
+	}
+
+	ctx, cancel := cs.withTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+	services, err := cs.getServices(withQueryName(ctx, "getServices"))
+	cs.metrics.record("getServices", start, err)
+	if err == nil {
+		cs.cache.set(servicesCacheKey, services)
+	}
+
+	return services, err
+}
+
+func (cs *couchbaseSpanReader) getServices(ctx context.Context) ([]string, error) {
+	if cs.kvIndex != nil {
+		return cs.kvIndex.services()
+	}
+	if cs.views != nil {
+		return cs.views.services(ctx, cs.store)
+	}
+
+	// Lookups are listed with DISTINCT as a name containing a colon may also have a document under the unescaped key
+	// that earlier versions wrote.
+	result, err := cs.store.QueryPrepared(ctx, cs.lookupStatement(queryServiceNames), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -147,7 +452,33 @@ func (cs *couchbaseSpanReader) GetServices(ctx context.Context) ([]string, error
 }
 
 func (cs *couchbaseSpanReader) GetOperations(ctx context.Context, service string) ([]string, error) {
-	result, err := cs.store.Query(queryOperationNames, []interface{}{service})
+	key := operationsCacheKey(service) + "names"
+	if operations, ok := cs.cache.get("getOperations", key); ok {
+		return operations.([]string), nil
+	}
+
+	ctx, cancel := cs.withTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+	operations, err := cs.getOperations(withQueryName(ctx, "getOperations"), service)
+	cs.metrics.record("getOperations", start, err)
+	if err == nil {
+		cs.cache.set(key, operations)
+	}
+
+	return operations, err
+}
+
+func (cs *couchbaseSpanReader) getOperations(ctx context.Context, service string) ([]string, error) {
+	if cs.kvIndex != nil {
+		return cs.kvIndex.operationNames(service)
+	}
+	if cs.views != nil {
+		return cs.views.operationNames(ctx, cs.store, service)
+	}
+
+	result, err := cs.store.QueryPrepared(ctx, cs.lookupStatement(queryOperationNames), []interface{}{service})
 	if err != nil {
 		return nil, err
 	}
@@ -170,16 +501,82 @@ func (cs *couchbaseSpanReader) GetOperations(ctx context.Context, service string
 	return operationNames, nil
 }
 
+// GetOperationsWithKind returns the operations of a service along with their span kind, optionally filtered to a
+// single kind. This matches the GetOperations signature of newer Jaeger releases, which the Jaeger 1.12 plugin API
+// has no way to call.
+func (cs *couchbaseSpanReader) GetOperationsWithKind(ctx context.Context, query OperationQueryParameters) ([]Operation, error) {
+	key := operationsCacheKey(query.ServiceName) + "kind::" + query.SpanKind
+	if operations, ok := cs.cache.get("getOperationsWithKind", key); ok {
+		return operations.([]Operation), nil
+	}
+
+	ctx, cancel := cs.withTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+	operations, err := cs.getOperationsWithKind(withQueryName(ctx, "getOperationsWithKind"), query)
+	cs.metrics.record("getOperationsWithKind", start, err)
+	if err == nil {
+		cs.cache.set(key, operations)
+	}
+
+	return operations, err
+}
+
+func (cs *couchbaseSpanReader) getOperationsWithKind(ctx context.Context, query OperationQueryParameters) ([]Operation, error) {
+	if cs.kvIndex != nil {
+		return cs.kvIndex.operations(query.ServiceName, query.SpanKind)
+	}
+	if cs.views != nil {
+		return cs.views.operations(ctx, cs.store, query.ServiceName, query.SpanKind)
+	}
+
+	queryStmt := cs.lookupStatement(queryOperations)
+	params := []interface{}{query.ServiceName}
+	if query.SpanKind != "" {
+		queryStmt = cs.lookupStatement(queryOperationsByKind)
+		params = append(params, query.SpanKind)
+	}
+
+	result, err := cs.store.QueryPrepared(ctx, queryStmt, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var operations []Operation
+	var operation Operation
+	for result.Next(&operation) {
+		if operation.Name != "" {
+			operations = append(operations, operation)
+		}
+		operation = Operation{}
+	}
+
+	err = result.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return operations, nil
+}
+
 func (cs *couchbaseSpanReader) FindTraces(ctx context.Context, traceQuery *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
 	if err := cs.validateQuery(traceQuery); err != nil {
 		return nil, err
 	}
 
-	if traceQuery.NumTraces == 0 {
-		traceQuery.NumTraces = defaultNumTraces
-	}
+	ctx, cancel := cs.withTimeout(ctx)
+	defer cancel()
 
-	return cs.findTraces(ctx, traceQuery)
+	cs.limitNumTraces(traceQuery)
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "FindTraces")
+	defer span.Finish()
+	span.SetTag("jaeger.service", traceQuery.ServiceName)
+
+	traces, err := cs.findTraces(ctx, traceQuery)
+	cs.logErrorToSpan(span, err)
+	return traces, err
 }
 
 func (cs *couchbaseSpanReader) FindTraceIDs(ctx context.Context, traceQuery *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
@@ -187,17 +584,25 @@ func (cs *couchbaseSpanReader) FindTraceIDs(ctx context.Context, traceQuery *spa
 		return nil, err
 	}
 
-	if traceQuery.NumTraces == 0 {
-		traceQuery.NumTraces = defaultNumTraces
-	}
+	ctx, cancel := cs.withTimeout(ctx)
+	defer cancel()
+
+	cs.limitNumTraces(traceQuery)
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "FindTraceIDs")
+	defer span.Finish()
+	span.SetTag("jaeger.service", traceQuery.ServiceName)
 
+	// Only the IDs are needed so the spans of the traces are never read, and searches without tags or durations are
+	// answered from the index alone.
 	dbTraceIDs, err := cs.findTraceIDs(ctx, traceQuery)
 	if err != nil {
+		cs.logErrorToSpan(span, err)
 		return nil, err
 	}
 
 	var traceIDs []model.TraceID
-	for t := range dbTraceIDs {
+	for _, t := range dbTraceIDs {
 		if len(traceIDs) >= traceQuery.NumTraces {
 			break
 		}
@@ -206,47 +611,135 @@ func (cs *couchbaseSpanReader) FindTraceIDs(ctx context.Context, traceQuery *spa
 	return traceIDs, nil
 }
 
+// findTraces finds the IDs of the matching traces, limited to the number of traces requested, and then fetches the
+// spans of each trace. Fetching each trace separately means that the query for its spans can use the trace ID index,
+// and that no more traces than requested are ever read. Up to readParallelism traces are fetched at once, and each is
+// adjusted in the same way as by GetTrace so that search results show traces as the trace view does.
 func (cs *couchbaseSpanReader) findTraces(ctx context.Context, traceQuery *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
-	if traceQuery.DurationMin != 0 || traceQuery.DurationMax != 0 {
-		return cs.queryTracesByDuration(ctx, traceQuery)
+	traceIDs, matches, err := cs.matchTraceIDs(ctx, traceQuery)
+	if err != nil {
+		return nil, err
 	}
 
-	if traceQuery.OperationName != "" {
-		if len(traceQuery.Tags) > 0 {
-			return cs.queryTracesByServiceNameAndOperationAndTagsAndLogs(ctx, traceQuery)
+	// The first failure cancels the fetches that are still running.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parallelism := cs.readParallelism
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+
+	// Each trace has its own slot so that the traces stay in the order their IDs were found in.
+	results := make([]*model.Trace, len(traceIDs))
+	var errOnce sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallelism)
+	for i, traceID := range traceIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, traceID TraceID) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			trace, err := cs.getTrace(ctx, traceIDToDomain(traceID))
+			if err == spanstore.ErrTraceNotFound {
+				// The trace's spans may have expired since the query ran.
+				return
+			}
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			results[i] = cs.adjust(trace)
+		}(i, traceID)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	traces := make([]*model.Trace, 0, len(results))
+	for _, trace := range results {
+		if trace != nil {
+			traces = append(traces, trace)
 		}
+	}
+	matches.annotate(traces)
+
+	return traces, nil
+}
+
+func (cs *couchbaseSpanReader) findTraceIDs(ctx context.Context, traceQuery *spanstore.TraceQueryParameters) ([]TraceID, error) {
+	traceIDs, _, err := cs.matchTraceIDs(ctx, traceQuery)
+
+	return traceIDs, err
+}
 
-		return cs.queryTracesByServiceNameAndOperation(ctx, traceQuery)
+// matchTraceIDs finds the IDs of the traces matching the query, along with what matched in each span when the search
+// index found them. FindTraces and FindTraceIDs both find traces this way, so they always answer a query alike.
+func (cs *couchbaseSpanReader) matchTraceIDs(ctx context.Context, traceQuery *spanstore.TraceQueryParameters) ([]TraceID, spanMatches, error) {
+	traceQuery, err := cs.exemplarQuery(ctx, traceQuery)
+	if err != nil || traceQuery == nil {
+		return nil, nil, err
 	}
-	if len(traceQuery.Tags) > 0 {
-		return cs.queryTracesByTagsAndLogs(ctx, traceQuery)
+
+	var traceIDs []TraceID
+	switch {
+	case cs.kvIndex != nil:
+		traceIDs, err = cs.kvIndex.findTraceIDs(ctx, traceQuery)
+	case cs.views.usesViews(traceQuery):
+		traceIDs, err = cs.queryIDsByView(ctx, traceQuery)
+	case cs.partitions != nil:
+		traceIDs, err = cs.findPartitionedTraceIDs(ctx, traceQuery)
+	case traceQuery.DurationMin != 0 || traceQuery.DurationMax != 0:
+		traceIDs, err = cs.queryIDsByDuration(ctx, traceQuery)
+	case cs.usesTagSearch(traceQuery):
+		return cs.searchTraceIDs(ctx, traceQuery)
+	case isErrorSearch(traceQuery.Tags) && cs.errorField.indexes(traceQuery.StartTimeMin):
+		traceIDs, err = cs.queryIDsByError(ctx, traceQuery)
+	case traceQuery.OperationName != "" && len(traceQuery.Tags) > 0:
+		traceIDs, err = cs.queryIDsByServiceNameAndOperationAndTagsAndLogs(ctx, traceQuery)
+	case traceQuery.OperationName != "":
+		traceIDs, err = cs.queryIDsByServiceNameAndOperation(ctx, traceQuery)
+	case len(traceQuery.Tags) > 0:
+		traceIDs, err = cs.queryIDsByTagsAndLogs(ctx, traceQuery)
+	default:
+		traceIDs, err = cs.queryIDsByService(ctx, traceQuery)
 	}
-	return cs.queryTracesByService(ctx, traceQuery)
+
+	return traceIDs, nil, err
 }
 
-func (cs *couchbaseSpanReader) queryTracesByService(ctx context.Context, tq *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
-	queryStmt := fmt.Sprintf(queryTracesBySubQuery, cs.store.Name(), queryIDsByServiceName)
-	span, ctx := cs.startSpanForQuery(ctx, "queryTracesByService", queryStmt)
+// queryIDsByView finds the trace IDs with the views rather than N1QL.
+func (cs *couchbaseSpanReader) queryIDsByView(ctx context.Context, tq *spanstore.TraceQueryParameters) ([]TraceID, error) {
+	span, ctx := cs.startSpanForQuery(ctx, "queryIDsByView", cs.views.designDocument)
 	defer span.Finish()
 
-	params := []interface{}{
-		tq.ServiceName,
-		tq.StartTimeMin,
-		tq.StartTimeMax,
-		tq.NumTraces,
+	traceIDs, err := cs.views.traceIDs(ctx, cs.store, tq)
+	if err != nil {
+		cs.logErrorToSpan(span, err)
+		return nil, errors.Wrap(err, "Error reading trace IDs from views")
 	}
 
-	return cs.executeTraceQuery(span, queryStmt, params)
+	return traceIDs, nil
 }
 
-func (cs *couchbaseSpanReader) queryTracesByServiceNameAndOperationAndTagsAndLogs(ctx context.Context, tq *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
-	queryStmt := fmt.Sprintf(queryTracesBySubQuery, cs.store.Name(), queryIDsByServiceAndOperationNameAndTags)
+func (cs *couchbaseSpanReader) queryIDsByServiceNameAndOperationAndTagsAndLogs(ctx context.Context, tq *spanstore.TraceQueryParameters) ([]TraceID, error) {
+	queryStmt := cs.statement(queryIDsByServiceAndOperationNameAndTags)
 	span, ctx := cs.startSpanForQuery(ctx, "queryIDsByServiceAndOperationNameAndTags", queryStmt)
 	defer span.Finish()
 
-	var where []string
-	for k, v := range tq.Tags {
-		where = append(where, fmt.Sprintf("%s_%s", k, v))
+	where, patterns, err := cs.tagParams(tq.Tags)
+	if err != nil {
+		return nil, err
 	}
 
 	params := []interface{}{
@@ -255,20 +748,21 @@ func (cs *couchbaseSpanReader) queryTracesByServiceNameAndOperationAndTagsAndLog
 		tq.StartTimeMin,
 		tq.StartTimeMax,
 		where,
+		patterns,
 		tq.NumTraces,
 	}
 
-	return cs.executeTraceQuery(span, queryStmt, params)
+	return cs.executeIDQuery(ctx, span, "queryIDsByServiceAndOperationNameAndTags", queryStmt, params)
 }
 
-func (cs *couchbaseSpanReader) queryTracesByTagsAndLogs(ctx context.Context, tq *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
-	queryStmt := fmt.Sprintf(queryTracesBySubQuery, cs.store.Name(), queryIDsByTag)
+func (cs *couchbaseSpanReader) queryIDsByTagsAndLogs(ctx context.Context, tq *spanstore.TraceQueryParameters) ([]TraceID, error) {
+	queryStmt := cs.statement(queryIDsByTag)
 	span, ctx := cs.startSpanForQuery(ctx, "queryIDsByTagsAndLogs", queryStmt)
 	defer span.Finish()
 
-	var where []string
-	for k, v := range tq.Tags {
-		where = append(where, fmt.Sprintf("%s_%s", k, v))
+	where, patterns, err := cs.tagParams(tq.Tags)
+	if err != nil {
+		return nil, err
 	}
 
 	params := []interface{}{
@@ -276,52 +770,65 @@ func (cs *couchbaseSpanReader) queryTracesByTagsAndLogs(ctx context.Context, tq
 		tq.StartTimeMin,
 		tq.StartTimeMax,
 		where,
+		patterns,
 		tq.NumTraces,
 	}
 
-	return cs.executeTraceQuery(span, queryStmt, params)
+	return cs.executeIDQuery(ctx, span, "queryIDsByTagsAndLogs", queryStmt, params)
 }
 
-func (cs *couchbaseSpanReader) queryTracesByDuration(ctx context.Context, traceQuery *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+// queryIDsByError finds the traces with failed spans from the error indexes, which only hold failed spans.
+func (cs *couchbaseSpanReader) queryIDsByError(ctx context.Context, tq *spanstore.TraceQueryParameters) ([]TraceID, error) {
+	var queryStmt string
+	params := []interface{}{tq.ServiceName}
+	if tq.OperationName == "" {
+		queryStmt = cs.statement(queryIDsByError)
+	} else {
+		queryStmt = cs.statement(queryIDsByErrorAndOperationName)
+		params = append(params, tq.OperationName)
+	}
+	span, ctx := cs.startSpanForQuery(ctx, "queryIDsByError", queryStmt)
+	defer span.Finish()
+
+	params = append(params, tq.StartTimeMin, tq.StartTimeMax, tq.NumTraces)
+
+	return cs.executeIDQuery(ctx, span, "queryIDsByError", queryStmt, params)
+}
+
+func (cs *couchbaseSpanReader) queryIDsByDuration(ctx context.Context, traceQuery *spanstore.TraceQueryParameters) ([]TraceID, error) {
 	var queryStmt string
 	if traceQuery.OperationName == "" {
-		queryStmt = fmt.Sprintf(queryTracesBySubQuery, cs.store.Name(), queryIDsByDuration)
+		queryStmt = cs.statement(queryIDsByDuration)
 	} else {
-		queryStmt = fmt.Sprintf(queryTracesBySubQuery, cs.store.Name(), queryIDsByDurationAndOperationName)
+		queryStmt = cs.statement(queryIDsByDurationAndOperationName)
 	}
 	span, ctx := cs.startSpanForQuery(ctx, "queryIDsByDuration", queryStmt)
 	defer span.Finish()
 
-	minDuration := traceQuery.DurationMin.Nanoseconds()
-	maxDuration := (time.Hour * 24).Nanoseconds()
+	return cs.executeIDQuery(ctx, span, "queryIDsByDuration", queryStmt, durationParams(traceQuery))
+}
+
+// durationParams builds the parameters of the duration queries, which filter on the start time as well as the
+// duration so that they can use the service, start time and duration indexes rather than scanning every span of the
+// service.
+func durationParams(traceQuery *spanstore.TraceQueryParameters) []interface{} {
+	minDuration := traceQuery.DurationMin
+	maxDuration := time.Hour * 24
 	if traceQuery.DurationMax != 0 {
-		maxDuration = traceQuery.DurationMax.Nanoseconds()
+		maxDuration = traceQuery.DurationMax
 	}
 
-	var params []interface{}
-	if traceQuery.OperationName == "" {
-		params = []interface{}{
-			traceQuery.ServiceName,
-			minDuration,
-			maxDuration,
-			traceQuery.NumTraces,
-		}
-	} else {
-		params = []interface{}{
-			traceQuery.ServiceName,
-			traceQuery.OperationName,
-			minDuration,
-			maxDuration,
-			traceQuery.NumTraces,
-		}
+	params := []interface{}{traceQuery.ServiceName}
+	if traceQuery.OperationName != "" {
+		params = append(params, traceQuery.OperationName)
 	}
 
-	return cs.executeTraceQuery(span, queryStmt, params)
+	return append(params, traceQuery.StartTimeMin, traceQuery.StartTimeMax, minDuration, maxDuration, traceQuery.NumTraces)
 }
 
-func (cs *couchbaseSpanReader) queryTracesByServiceNameAndOperation(ctx context.Context, tq *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
-	queryStmt := fmt.Sprintf(queryTracesBySubQuery, cs.store.Name(), queryIDsByServiceAndOperationName)
-	span, ctx := cs.startSpanForQuery(ctx, "queryIDsByServiceAndOperationName", queryStmt)
+func (cs *couchbaseSpanReader) queryIDsByServiceNameAndOperation(ctx context.Context, tq *spanstore.TraceQueryParameters) ([]TraceID, error) {
+	queryStmt := cs.statement(queryIDsByServiceAndOperationName)
+	span, ctx := cs.startSpanForQuery(ctx, "queryIDsByServiceNameAndOperation", queryStmt)
 	defer span.Finish()
 
 	params := []interface{}{
@@ -331,33 +838,52 @@ func (cs *couchbaseSpanReader) queryTracesByServiceNameAndOperation(ctx context.
 		tq.StartTimeMax,
 		tq.NumTraces,
 	}
-	return cs.executeTraceQuery(span, queryStmt, params)
+	return cs.executeIDQuery(ctx, span, "queryIDsByServiceNameAndOperation", queryStmt, params)
+}
+
+func (cs *couchbaseSpanReader) queryIDsByService(ctx context.Context, tq *spanstore.TraceQueryParameters) ([]TraceID, error) {
+	queryStmt := cs.statement(queryIDsByServiceName)
+	span, ctx := cs.startSpanForQuery(ctx, "queryIDsByService", queryStmt)
+	defer span.Finish()
+
+	params := []interface{}{
+		tq.ServiceName,
+		tq.StartTimeMin,
+		tq.StartTimeMax,
+		tq.NumTraces,
+	}
+	return cs.executeIDQuery(ctx, span, "queryIDsByService", queryStmt, params)
 }
 
-func (cs *couchbaseSpanReader) executeTraceQuery(span opentracing.Span, query string, params []interface{}) ([]*model.Trace, error) {
-	result, err := cs.store.Query(query, params)
+func (cs *couchbaseSpanReader) executeIDQuery(ctx context.Context, span opentracing.Span, name, query string, params []interface{}) ([]TraceID, error) {
+	start := time.Now()
+	traceIDs, err := cs.queryTraceIDs(withQueryName(ctx, name), span, query, layoutParams(cs.layout, params))
+	cs.metrics.record(name, start, err)
 	if err != nil {
-		cs.logErrorToSpan(span, err)
-		return nil, err
+		cs.logger.Warn("trace ID query failed", "query", name, "error", err)
 	}
 
-	var traceSpan Span
-	var trace *model.Trace
-	var traces []*model.Trace
+	return traceIDs, err
+}
+
+func (cs *couchbaseSpanReader) queryTraceIDs(ctx context.Context, span opentracing.Span, query string, params []interface{}) ([]TraceID, error) {
 	var traceID TraceID
-	for result.Next(&traceSpan) {
-		if traceID != traceSpan.TraceID {
-			traceID = traceSpan.TraceID
-			trace = &model.Trace{}
-			traces = append(traces, trace)
-		}
+	var traceIDs []TraceID
+	seen := make(UniqueTraceIDs)
 
-		span, err := traceSpan.toDomain()
-		if err != nil {
-			return nil, err
-		}
+	result, err := cs.store.QueryPrepared(ctx, query, params)
+	if err != nil {
+		cs.logErrorToSpan(span, err)
+		return nil, err
+	}
 
-		trace.Spans = append(trace.Spans, span)
+	// Trace IDs are returned most recent first, which is the order the traces are shown in.
+	for result.Next(&traceID) {
+		if _, ok := seen[traceID]; ok {
+			continue
+		}
+		seen.Add(traceID)
+		traceIDs = append(traceIDs, traceID)
 	}
 
 	err = result.Close()
@@ -366,138 +892,142 @@ func (cs *couchbaseSpanReader) executeTraceQuery(span opentracing.Span, query st
 		return nil, err
 	}
 
-	return traces, nil
+	return traceIDs, nil
 }
 
-func (cs *couchbaseSpanReader) findTraceIDs(ctx context.Context, traceQuery *spanstore.TraceQueryParameters) (UniqueTraceIDs, error) {
-	if traceQuery.DurationMin != 0 || traceQuery.DurationMax != 0 {
-		return cs.queryIDsByDuration(ctx, traceQuery)
-	}
-
-	if traceQuery.OperationName != "" {
-		if len(traceQuery.Tags) > 0 {
-			return cs.queryIDsByServiceNameAndOperationAndTagsAndLogs(ctx, traceQuery)
-		}
-
-		return cs.queryIDsByServiceNameAndOperation(ctx, traceQuery)
+// limitNumTraces defaults the number of traces to find if it isn't set, and caps it at the maximum.
+func (cs *couchbaseSpanReader) limitNumTraces(traceQuery *spanstore.TraceQueryParameters) {
+	if traceQuery.NumTraces <= 0 {
+		traceQuery.NumTraces = defaultNumTraces
 	}
-	if len(traceQuery.Tags) > 0 {
-		return cs.queryIDsByTagsAndLogs(ctx, traceQuery)
+	if cs.maxTraces > 0 && traceQuery.NumTraces > cs.maxTraces {
+		traceQuery.NumTraces = cs.maxTraces
 	}
-	return cs.queryIDsByService(ctx, traceQuery)
 }
 
-func (cs *couchbaseSpanReader) queryIDsByServiceNameAndOperationAndTagsAndLogs(ctx context.Context, tq *spanstore.TraceQueryParameters) (UniqueTraceIDs, error) {
-	span, ctx := cs.startSpanForQuery(ctx, "queryIDsByServiceAndOperationNameAndTags", queryIDsByServiceAndOperationNameAndTags)
-	defer span.Finish()
-
-	var where []string
-	for k, v := range tq.Tags {
-		where = append(where, fmt.Sprintf("%s_%s", k, v))
+// withTimeout applies the read timeout to ctx, if one is configured.
+func (cs *couchbaseSpanReader) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cs.timeout <= 0 {
+		return ctx, func() {}
 	}
 
-	params := []interface{}{
-		tq.ServiceName,
-		tq.OperationName,
-		tq.StartTimeMin,
-		tq.StartTimeMax,
-		where,
-		tq.NumTraces,
-	}
-
-	return cs.executeIDQuery(span, queryIDsByServiceAndOperationNameAndTags, params)
+	return context.WithTimeout(ctx, cs.timeout)
 }
 
-func (cs *couchbaseSpanReader) queryIDsByTagsAndLogs(ctx context.Context, tq *spanstore.TraceQueryParameters) (UniqueTraceIDs, error) {
-	span, ctx := cs.startSpanForQuery(ctx, "queryIDsByTagsAndLogs", queryIDsByTag)
-	defer span.Finish()
+// statement fills the keyspace that spans are read from, and the fields of their layout, into a trace ID query
+// template.
+func (cs *couchbaseSpanReader) statement(query string) string {
+	return traceIDQuery(cs.layout, query, cs.spansKeyspace())
+}
 
-	var where []string
-	for k, v := range tq.Tags {
-		where = append(where, fmt.Sprintf("%s_%s", k, v))
+// spansKeyspace returns the keyspace that spans are read from, which unnests them from trace documents with the trace
+// storage model.
+func (cs *couchbaseSpanReader) spansKeyspace() string {
+	if cs.traceModel {
+		return fmt.Sprintf(spansKeyspaceTemplate, cs.store.Keyspace())
 	}
 
-	params := []interface{}{
-		tq.ServiceName,
-		tq.StartTimeMin,
-		tq.StartTimeMax,
-		where,
-		tq.NumTraces,
-	}
+	return cs.store.Keyspace()
+}
 
-	return cs.executeIDQuery(span, queryIDsByTag, params)
+// lookupStatement fills the keyspace holding the service and operation lookup documents into a query template.
+func (cs *couchbaseSpanReader) lookupStatement(query string) string {
+	return fmt.Sprintf(query, cs.store.Keyspace())
 }
 
-func (cs *couchbaseSpanReader) queryIDsByDuration(ctx context.Context, traceQuery *spanstore.TraceQueryParameters) (UniqueTraceIDs, error) {
-	span, ctx := cs.startSpanForQuery(ctx, "queryIDsByDuration", queryIDsByDuration)
-	defer span.Finish()
+// spanFields returns the projection used when reading spans, leaving out logs, events and process tags when they aren't
+// wanted so that they aren't sent over the network.
+func (cs *couchbaseSpanReader) spanFields(alias string) string {
+	prefix := ""
+	if alias != "" {
+		prefix = alias + "."
+	}
+	if cs.layout == flatLayout {
+		return flatSpanFields(prefix, cs.skipLogs, cs.skipProcessTags)
+	}
 
-	minDuration := traceQuery.DurationMin.Nanoseconds()
-	maxDuration := (time.Hour * 24).Nanoseconds()
-	if traceQuery.DurationMax != 0 {
-		maxDuration = traceQuery.DurationMax.Nanoseconds()
+	names := []string{"trace_id", "span_id", "operation_name", "flags", "start_time", "duration", "tags", "references", "encoding", "codec", "payload", "schema_version", "process_hash", "body"}
+	if !cs.skipLogs {
+		names = append(names, "logs", "events")
 	}
 
-	params := []interface{}{
-		traceQuery.ServiceName,
-		traceQuery.OperationName,
-		minDuration,
-		maxDuration,
-		traceQuery.NumTraces,
+	fields := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		fields = append(fields, prefix+name)
+	}
+	if cs.skipProcessTags {
+		fields = append(fields, fmt.Sprintf(`{"service_name": %sprocess.service_name} AS process`, prefix))
+	} else {
+		fields = append(fields, prefix+"process")
 	}
 
-	return cs.executeIDQuery(span, queryIDsByDuration, params)
+	return strings.Join(fields, ", ")
 }
 
-func (cs *couchbaseSpanReader) queryIDsByServiceNameAndOperation(ctx context.Context, tq *spanstore.TraceQueryParameters) (UniqueTraceIDs, error) {
-	span, ctx := cs.startSpanForQuery(ctx, "queryIDsByServiceNameAndOperation", queryIDsByServiceAndOperationName)
-	defer span.Finish()
-
-	params := []interface{}{
-		tq.ServiceName,
-		tq.OperationName,
-		tq.StartTimeMin,
-		tq.StartTimeMax,
-		tq.NumTraces,
+// documentSpan returns the span held by a document that has been read, converting it from the flat layout if needed.
+func (cs *couchbaseSpanReader) documentSpan(value interface{}) (*Span, error) {
+	if flat, ok := value.(*FlatSpan); ok {
+		return flat.toSpan()
 	}
-	return cs.executeIDQuery(span, queryIDsByServiceAndOperationName, params)
+
+	return value.(*Span), nil
 }
 
-func (cs *couchbaseSpanReader) queryIDsByService(ctx context.Context, tq *spanstore.TraceQueryParameters) (UniqueTraceIDs, error) {
-	span, ctx := cs.startSpanForQuery(ctx, "queryIDsByService", queryIDsByServiceName)
-	defer span.Finish()
+// toDomain converts the span, decoding or decompressing it first if needed. The projection can't leave the logs and
+// process tags of encoded or compressed spans out of queries so it's applied once they're decoded.
+func (cs *couchbaseSpanReader) toDomain(dbSpan *Span) (*model.Span, error) {
+	if dbSpan.Encoding == protobufEncoding {
+		span, err := dbSpan.decodeProto()
+		if err != nil {
+			return nil, err
+		}
+		if cs.skipLogs {
+			span.Logs = nil
+		}
+		if cs.skipProcessTags && span.Process != nil {
+			span.Process.Tags = nil
+		}
 
-	params := []interface{}{
-		tq.ServiceName,
-		tq.StartTimeMin,
-		tq.StartTimeMax,
-		tq.NumTraces,
+		return span, nil
 	}
-	return cs.executeIDQuery(span, queryIDsByServiceName, params)
-}
 
-func (cs *couchbaseSpanReader) executeIDQuery(span opentracing.Span, query string, params []interface{}) (UniqueTraceIDs, error) {
-	// start := time.Now()
-	var traceID TraceID
-	traceIDs := make(UniqueTraceIDs)
+	if dbSpan.Codec != "" {
+		err := dbSpan.decompress()
+		if err != nil {
+			return nil, err
+		}
+		if cs.skipLogs {
+			dbSpan.Logs = nil
+			dbSpan.Events = nil
+		}
+		if cs.skipProcessTags && dbSpan.Process != nil {
+			dbSpan.Process.Tags = nil
+		}
+	}
 
-	result, err := cs.store.Query(query, params)
+	if readSchema(dbSpan) {
+		cs.metrics.newerSchemaSpans.Inc(1)
+		cs.logger.Debug("read a span written by a newer version of the plugin", "schema_version", dbSpan.SchemaVersion)
+	}
+
+	span, err := dbSpan.toDomain()
 	if err != nil {
-		cs.logErrorToSpan(span, err)
 		return nil, err
 	}
+	cs.joinProcess(dbSpan, span)
 
-	for result.Next(&traceID) {
-		traceIDs.Add(traceID)
-	}
+	return span, nil
+}
 
-	err = result.Close()
+// tagParams returns the searchable tags and patterns that match the tags in a query.
+func (cs *couchbaseSpanReader) tagParams(tags map[string]string) ([][]string, [][]string, error) {
+	groups, err := tagGroups(tags, cs.tagOperators)
 	if err != nil {
-		cs.logErrorToSpan(span, err)
-		return nil, err
+		return nil, nil, err
 	}
+	predicates, patterns := tagPredicates(groups, cs.tagWildcards)
 
-	return traceIDs, nil
+	return predicates, patterns, nil
 }
 
 func (cs *couchbaseSpanReader) validateQuery(p *spanstore.TraceQueryParameters) error {
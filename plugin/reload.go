@@ -0,0 +1,103 @@
+package plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// oldClusterGracePeriod is how long a replaced cluster connection is kept open so that in flight requests can finish.
+const oldClusterGracePeriod = time.Minute
+
+// reconnect replaces the cluster connection and any open buckets, including the route buckets, with new
+// ones so that rotated certificates and credentials are picked up without restarting the plugin.
+func (cs *couchbaseStore) reconnect() error {
+	cluster, err := connectCluster(cs.connStr, cs.authenticator)
+	if err != nil {
+		return err
+	}
+
+	stores := cs.bucketStores()
+	buckets := make([]*gocb.Bucket, len(stores))
+	for i, store := range stores {
+		bucket := store.currentBucket()
+		if bucket == nil {
+			continue
+		}
+
+		buckets[i], err = store.openBucket(cluster, bucket.Name())
+		if err != nil {
+			cluster.Close()
+			return err
+		}
+	}
+
+	old := cs.cluster
+	for i, store := range stores {
+		store.mu.Lock()
+		store.cluster = cluster
+		if buckets[i] != nil {
+			store.bucket = buckets[i]
+		}
+		store.mu.Unlock()
+	}
+
+	time.AfterFunc(oldClusterGracePeriod, func() {
+		err := old.Close()
+		if err != nil {
+			cs.logger.Warn("failed to close old cluster connection", "error", err)
+		}
+	})
+
+	return nil
+}
+
+// watchFiles calls onChange whenever the contents of any of the files change, checking them every interval. Files
+// are compared by content rather than modification time as Kubernetes swaps mounted secrets using symlinks.
+func watchFiles(paths []string, interval time.Duration, onChange func() error, logger hclog.Logger) {
+	sums := make([][]byte, len(paths))
+	for i, path := range paths {
+		sums[i] = fileSum(path)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var changed bool
+		for i, path := range paths {
+			sum := fileSum(path)
+			if !bytes.Equal(sum, sums[i]) {
+				sums[i] = sum
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		logger.Info("watched files changed, reconnecting", "files", paths)
+		err := onChange()
+		if err != nil {
+			logger.Error("failed to reconnect", "error", err)
+		}
+	}
+}
+
+// fileSum returns a hash of the file, or nil if the file can't be read.
+func fileSum(path string) []byte {
+	if path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
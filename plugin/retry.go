@@ -0,0 +1,135 @@
+package plugin
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+	"github.com/uber/jaeger-lib/metrics"
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+var retriedOperations = []string{"insert", "upsert", "get", "insert_multi", "get_multi", "array_append", "increment", "query", "search", "view"}
+
+// retryer retries operations that fail with temporary errors, backing off exponentially with full jitter between
+// attempts so that retries from many writers don't arrive at the cluster together.
+type retryer struct {
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	retries        map[string]metrics.Counter
+	logger         hclog.Logger
+}
+
+func newRetryer(maxRetries int, initialBackoff, maxBackoff time.Duration, factory metrics.Factory, logger hclog.Logger) *retryer {
+	retries := make(map[string]metrics.Counter, len(retriedOperations))
+	for _, op := range retriedOperations {
+		retries[op] = factory.Counter(metrics.Options{
+			Name: "storage_retries_total",
+			Tags: map[string]string{"operation": op},
+			Help: "Number of storage operations retried after a temporary failure",
+		})
+	}
+
+	return &retryer{
+		maxRetries:     maxRetries,
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+		retries:        retries,
+		logger:         logger,
+	}
+}
+
+// do runs fn, retrying it whilst it fails with a temporary error until the retries are used up or ctx is done.
+func (r *retryer) do(ctx context.Context, op string, fn func() error) error {
+	err := fn()
+	for attempt := 0; attempt < r.maxRetries && isRetryable(err); attempt++ {
+		r.logger.Debug("retrying operation", "operation", op, "attempt", attempt+1, "error", err)
+		if !r.wait(ctx, attempt) {
+			return err
+		}
+
+		r.retries[op].Inc(1)
+		err = fn()
+	}
+
+	return err
+}
+
+// wait sleeps for the backoff of the given attempt, returning false if ctx is done first.
+func (r *retryer) wait(ctx context.Context, attempt int) bool {
+	timer := time.NewTimer(r.backoff(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (r *retryer) backoff(attempt int) time.Duration {
+	backoff := r.initialBackoff << uint(attempt)
+	if backoff > r.maxBackoff || backoff <= 0 {
+		backoff = r.maxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff))) + 1
+}
+
+// Query and analytics service error codes which mean that the request was turned away without being run. 1191 to
+// 1194 are the query service's rate limits, and 23000, 23003 and 23007 are analytics being temporarily unavailable,
+// rebalancing and having a full job queue.
+var retryableServiceCodes = map[uint32]bool{
+	1191:  true,
+	1192:  true,
+	1193:  true,
+	1194:  true,
+	23000: true,
+	23003: true,
+	23007: true,
+}
+
+// serviceError is implemented by the errors that gocb returns from the query and analytics services.
+type serviceError interface {
+	Code() uint32
+}
+
+// retryableError is implemented by the errors that gocb returns from the search service, which are retryable when it
+// rate limits the request.
+type retryableError interface {
+	Retryable() bool
+}
+
+// isRetryable reports whether an operation failed because the cluster was temporarily unable to handle it, in which
+// case the operation was not applied and is safe to retry.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	cause := errors.Cause(err)
+	switch cause {
+	case gocb.ErrTmpFail, gocb.ErrBusy, gocb.ErrOutOfMemory:
+		return true
+	}
+	// Key-value errors carry their status code along with any context the server gave.
+	if gocb.IsTmpFailError(cause) || gocb.IsStatusBusyError(cause) {
+		return true
+	}
+
+	switch e := cause.(type) {
+	case serviceError:
+		return retryableServiceCodes[e.Code()]
+	case retryableError:
+		return e.Retryable()
+	}
+
+	return false
+}
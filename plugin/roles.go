@@ -0,0 +1,161 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/httpclient"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// role is a role granted to a user, roles without a bucket apply to the whole cluster and roles without a scope or
+// collection to the whole bucket or scope.
+type role struct {
+	Role       string `json:"role"`
+	Bucket     string `json:"bucket_name"`
+	Scope      string `json:"scope_name"`
+	Collection string `json:"collection_name"`
+}
+
+// grants reports whether the role includes the named role on the bucket and scope, an empty scope means the whole
+// bucket. Full admins have every role and bucket_full_access includes reading and writing documents.
+func (r role) grants(name, bucket, scope string) bool {
+	if r.Role == "admin" {
+		return true
+	}
+	if r.Role != name && !(r.Role == "bucket_full_access" && (name == "data_reader" || name == "data_writer")) {
+		return false
+	}
+	if r.Bucket != "*" && r.Bucket != bucket {
+		return false
+	}
+	if r.Scope != "" && r.Scope != "*" && r.Scope != scope {
+		return false
+	}
+
+	return r.Collection == "" || r.Collection == "*"
+}
+
+// requiredRoles returns the roles that the plugin's options need on each bucket.
+func requiredRoles(opts options.Options) []string {
+	if opts.KVOnly {
+		return []string{"data_reader", "data_writer"}
+	}
+
+	roles := []string{"data_reader", "data_writer", "query_select", "query_insert"}
+	if opts.UseAnalytics {
+		roles = append(roles, "analytics_reader")
+	}
+	if opts.AutoCreateIndexes {
+		roles = append(roles, "query_manage_index")
+	}
+	if opts.FTSTagSearch {
+		roles = append(roles, "fts_searcher")
+	}
+	if opts.ViewsEnabled {
+		roles = append(roles, "views_admin")
+	}
+
+	return roles
+}
+
+// VerifyRoles checks that the user is defined in the configured domain and has the roles that the plugin needs,
+// returning the names of any that are missing so that the plugin fails at start up rather than with permission errors
+// later. Tenants each have their own scope, so with tenancy the roles are needed on the whole bucket. Users
+// authenticating with a certificate aren't checked as the management API isn't called with the certificate.
+func VerifyRoles(opts options.Options, httpClient httpclient.Client, conn string, logger hclog.Logger) error {
+	if !opts.VerifyRoles {
+		return nil
+	}
+	if opts.UseCertAuth {
+		logger.Debug("skipping role verification with certificate authentication")
+		return nil
+	}
+
+	user, domain, roles, err := whoami(opts, httpClient, conn)
+	if err != nil {
+		return errors.Wrap(err, "failed to read user's roles")
+	}
+	expected := opts.AuthDomain
+	if expected == "" {
+		expected = "local"
+	}
+	if domain != expected {
+		return errors.Errorf("user %q is in the %s domain rather than %s, set authDomain to %s", user, domain, expected, domain)
+	}
+
+	scope := opts.Scope
+	if opts.TenancyEnabled || scope == "_default" {
+		scope = ""
+	}
+	buckets := []string{opts.BucketName}
+
+	var missing []string
+	for _, bucket := range buckets {
+		for _, name := range requiredRoles(opts) {
+			granted := false
+			for _, r := range roles {
+				if r.grants(name, bucket, scope) {
+					granted = true
+					break
+				}
+			}
+			if !granted {
+				missing = append(missing, roleName(name, bucket, scope))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("user %q is missing roles %s", user, strings.Join(missing, ", "))
+	}
+
+	logger.Debug("verified user's roles", "user", user)
+	return nil
+}
+
+// roleName formats the role the way that the management API does, e.g. data_reader[jaeger:tenant:*].
+func roleName(name, bucket, scope string) string {
+	if scope == "" {
+		return fmt.Sprintf("%s[%s]", name, bucket)
+	}
+
+	return fmt.Sprintf("%s[%s:%s:*]", name, bucket, scope)
+}
+
+// whoami returns the user that the plugin authenticates as, the domain they're defined in and the roles they've been
+// granted, including those granted through groups.
+func whoami(opts options.Options, httpClient httpclient.Client, conn string) (string, string, []role, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:8091/whoami", conn), nil)
+	if err != nil {
+		return "", "", nil, err
+	}
+	req.SetBasicAuth(opts.Username, opts.Password)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", "", nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", "", nil, errors.Errorf("request failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	var user struct {
+		ID     string `json:"id"`
+		Domain string `json:"domain"`
+		Roles  []role `json:"roles"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&user)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return user.ID, user.Domain, user.Roles, nil
+}
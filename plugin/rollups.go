@@ -0,0 +1,231 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+const (
+	rollupDocumentType = "rollup"
+	hourlyRollup       = "hour"
+	dailyRollup        = "day"
+
+	// aggregateRollupsStmt counts the spans and errors of each service by latency bucket, %[2]s is the expression
+	// computing a span's latency bucket.
+	aggregateRollupsStmt = `
+SELECT process.service_name AS service_name, %[2]s AS bucket, COUNT(*) AS spans,
+SUM(CASE WHEN ANY t IN processed_tags SATISFIES t = "error_true" END THEN 1 ELSE 0 END) AS errors
+FROM %[1]s
+WHERE start_time >= ? AND start_time < ? AND ` + "`type`" + `="span"
+GROUP BY process.service_name, %[2]s`
+
+	queryRollupsStmt = `
+SELECT service_name, period, ` + "`start`" + `, spans, errors, p50_ms, p95_ms, p99_ms, latency_buckets
+FROM %s
+WHERE period = ? AND ` + "`start`" + ` >= ? AND ` + "`start`" + ` < ? AND ` + "`type`" + `="rollup"`
+	queryServiceRollupsStmt = queryRollupsStmt + ` AND service_name = ?`
+)
+
+// rollupDocument summarises the spans of a service over an hour or a day. Latencies are in milliseconds, the latency
+// buckets count spans by their index in latencyBucketBounds so that hourly rollups can be summed into daily ones.
+type rollupDocument struct {
+	Type           string  `json:"type,omitempty"`
+	ServiceName    string  `json:"service_name"`
+	Period         string  `json:"period"`
+	Start          int64   `json:"start"`
+	Spans          int64   `json:"spans"`
+	Errors         int64   `json:"errors"`
+	P50            float64 `json:"p50_ms"`
+	P95            float64 `json:"p95_ms"`
+	P99            float64 `json:"p99_ms"`
+	LatencyBuckets []int64 `json:"latency_buckets"`
+}
+
+// add counts spans in the rollup.
+func (d *rollupDocument) add(bucket int, spans, errors int64) {
+	if len(d.LatencyBuckets) == 0 {
+		d.LatencyBuckets = make([]int64, len(latencyBucketBounds)+1)
+	}
+	if bucket >= 0 && bucket < len(d.LatencyBuckets) {
+		d.LatencyBuckets[bucket] += spans
+	}
+	d.Spans += spans
+	d.Errors += errors
+}
+
+// merge adds the spans counted in another rollup to the rollup.
+func (d *rollupDocument) merge(other rollupDocument) {
+	for bucket, spans := range other.LatencyBuckets {
+		d.add(bucket, spans, 0)
+	}
+	d.Errors += other.Errors
+}
+
+// summarise computes the latency quantiles from the latency buckets.
+func (d *rollupDocument) summarise() {
+	d.P50 = quantile(d.LatencyBuckets, 0.5)
+	d.P95 = quantile(d.LatencyBuckets, 0.95)
+	d.P99 = quantile(d.LatencyBuckets, 0.99)
+}
+
+// RunRollups builds an hourly rollup of every service's spans at the end of each hour, and a daily rollup from the
+// hourly ones at the end of each day. Rewriting a rollup is harmless so several plugins can build them at once.
+func RunRollups(store Store, hourlyTTL, dailyTTL time.Duration, traceModel bool, logger hclog.Logger) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		end := now.UTC().Truncate(time.Hour)
+		start := end.Add(-time.Hour)
+
+		err := buildHourlyRollups(store, start, end, hourlyTTL, traceModel)
+		if err != nil {
+			logger.Error("failed to build hourly rollups", "start", start, "end", end, "error", err)
+			continue
+		}
+		logger.Debug("built hourly rollups", "start", start, "end", end)
+
+		if end.Hour() != 0 {
+			continue
+		}
+		day := end.AddDate(0, 0, -1)
+		err = buildDailyRollups(store, day, end, dailyTTL)
+		if err != nil {
+			logger.Error("failed to build daily rollups", "start", day, "end", end, "error", err)
+			continue
+		}
+		logger.Debug("built daily rollups", "start", day, "end", end)
+	}
+}
+
+// buildHourlyRollups builds the hourly rollups from the spans in each keyspace holding spans started in the hour.
+func buildHourlyRollups(store Store, start, end time.Time, ttl time.Duration, traceModel bool) error {
+	rollups := make(map[string]*rollupDocument)
+	for _, keyspace := range store.SpanKeyspaces(start, end) {
+		if traceModel {
+			keyspace = fmt.Sprintf(spansKeyspaceTemplate, keyspace)
+		}
+
+		result, err := store.Query(
+			context.Background(),
+			fmt.Sprintf(aggregateRollupsStmt, keyspace, latencyBucketExpression()),
+			[]interface{}{start.Format(dateLayout), end.Format(dateLayout)},
+		)
+		if err != nil {
+			return errors.Wrap(err, "failed to query spans")
+		}
+
+		var row struct {
+			ServiceName string `json:"service_name"`
+			Bucket      int    `json:"bucket"`
+			Spans       int64  `json:"spans"`
+			Errors      int64  `json:"errors"`
+		}
+		for result.Next(&row) {
+			rollup, ok := rollups[row.ServiceName]
+			if !ok {
+				rollup = &rollupDocument{
+					Type:        rollupDocumentType,
+					ServiceName: row.ServiceName,
+					Period:      hourlyRollup,
+					Start:       start.Unix(),
+				}
+				rollups[row.ServiceName] = rollup
+			}
+			rollup.add(row.Bucket, row.Spans, row.Errors)
+		}
+		err = result.Close()
+		if err != nil {
+			return errors.Wrap(err, "failed to query spans")
+		}
+	}
+
+	return writeRollups(store, rollups, ttl)
+}
+
+func buildDailyRollups(store Store, start, end time.Time, ttl time.Duration) error {
+	hourly, err := queryRollups(context.Background(), store, hourlyRollup, "", start, end)
+	if err != nil {
+		return err
+	}
+
+	rollups := make(map[string]*rollupDocument)
+	for _, hour := range hourly {
+		rollup, ok := rollups[hour.ServiceName]
+		if !ok {
+			rollup = &rollupDocument{
+				Type:        rollupDocumentType,
+				ServiceName: hour.ServiceName,
+				Period:      dailyRollup,
+				Start:       start.Unix(),
+			}
+			rollups[hour.ServiceName] = rollup
+		}
+		rollup.merge(hour)
+	}
+
+	return writeRollups(store, rollups, ttl)
+}
+
+// writeRollups upserts the rollups using N1QL, so that they can be written to named collections.
+func writeRollups(store Store, rollups map[string]*rollupDocument, ttl time.Duration) error {
+	for service, rollup := range rollups {
+		rollup.summarise()
+		key := fmt.Sprintf("rollup::%s::%s::%d", rollup.Period, keyComponent(service), rollup.Start)
+		err := store.Execute(fmt.Sprintf(upsertStmt, store.Keyspace()), []interface{}{key, rollup, expiryFromTTL(ttl)})
+		if err != nil {
+			return errors.Wrapf(err, "failed to write rollup for %s", service)
+		}
+	}
+
+	return nil
+}
+
+// queryRollups reads the rollups of a period that start between start and end, of every service if service is
+// empty.
+func queryRollups(ctx context.Context, store Store, period, service string, start, end time.Time) ([]rollupDocument, error) {
+	stmt := queryRollupsStmt
+	params := []interface{}{period, start.Unix(), end.Unix()}
+	if service != "" {
+		stmt = queryServiceRollupsStmt
+		params = append(params, service)
+	}
+
+	result, err := store.QueryPrepared(ctx, fmt.Sprintf(stmt, store.Keyspace()), params)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query rollups")
+	}
+
+	rollups := []rollupDocument{}
+	for {
+		var rollup rollupDocument
+		if !result.Next(&rollup) {
+			break
+		}
+		rollups = append(rollups, rollup)
+	}
+	err = result.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query rollups")
+	}
+
+	return rollups, nil
+}
+
+// latencyBucketExpression is a N1QL expression computing the index of a span's latency bucket from its duration,
+// which is stored in nanoseconds.
+func latencyBucketExpression() string {
+	var expr strings.Builder
+	expr.WriteString("CASE")
+	for i, bound := range latencyBucketBounds {
+		fmt.Fprintf(&expr, " WHEN duration <= %d THEN %d", int64(bound*float64(time.Millisecond)), i)
+	}
+	fmt.Fprintf(&expr, " ELSE %d END", len(latencyBucketBounds))
+
+	return expr.String()
+}
@@ -0,0 +1,331 @@
+package plugin
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// route is a bucket or collection that the spans of some services are written to.
+type route struct {
+	// bucket is empty when the route shares the plugin's bucket.
+	bucket     string
+	collection string
+	store      *couchbaseStore
+}
+
+// routes are the locations that services are routed to, services that aren't routed are stored as usual.
+type routes struct {
+	routes   []*route
+	services map[string]*route
+}
+
+func (cs *couchbaseStore) newRoutes(opts []options.Route) *routes {
+	if len(opts) == 0 {
+		return nil
+	}
+
+	r := &routes{services: make(map[string]*route)}
+	for _, opt := range opts {
+		rt := &route{
+			bucket:     opt.Bucket,
+			collection: opt.Collection,
+			store:      cs.forRoute(opt),
+		}
+		r.routes = append(r.routes, rt)
+		for _, service := range opt.Services {
+			r.services[service] = rt
+		}
+	}
+
+	return r
+}
+
+// storeFor returns the store that the service is routed to, or nil if it isn't routed.
+func (r *routes) storeFor(service string) *couchbaseStore {
+	if r == nil {
+		return nil
+	}
+
+	rt, ok := r.services[service]
+	if !ok {
+		return nil
+	}
+
+	return rt.store
+}
+
+// forRoute returns the store for a route. Routes to a collection share their parent's bucket, whereas routes to a
+// bucket open the bucket themselves. Routed writes aren't batched, and like tenants routes are always queried using
+// N1QL.
+func (cs *couchbaseStore) forRoute(opt options.Route) *couchbaseStore {
+	spanCollection := cs.spanCollection
+	if opt.Collection != "" {
+		spanCollection = opt.Collection
+	}
+
+	logger := cs.logger.With("route", strings.Join(opt.Services, ","))
+	store := cs.derive(logger)
+	store.spanCollection = spanCollection
+	store.cache = cs.cache.empty()
+	if opt.Bucket == "" {
+		store.parent = cs
+	} else if cs.mutations != nil {
+		// Mutation tokens are per bucket, so a route to its own bucket can't wait on its parent's.
+		store.mutations = newMutationTokens()
+	}
+
+	spanTTL := cs.writer.spanTTL
+	if opt.TTL > 0 {
+		spanTTL = opt.TTL
+	}
+	writer := &couchbaseSpanWriter{
+		store:          store,
+		spanTTL:        spanTTL,
+		serviceTTL:     cs.writer.serviceTTL,
+		keyStrategy:    cs.writer.keyStrategy,
+		compression:    cs.writer.compression,
+		encoding:       cs.writer.encoding,
+		layout:         cs.writer.layout,
+		splitStorage:   cs.writer.splitStorage,
+		maxSpanSize:    cs.writer.maxSpanSize,
+		oversizedSpans: cs.writer.oversizedSpans,
+		tags:           cs.writer.tags,
+		cache:          store.cache,
+		rollup:         cs.writer.rollup,
+		metrics:        cs.writer.metrics,
+		logger:         logger,
+	}
+	if cs.writer.lookups != nil {
+		writer.lookups = newLookupCache(cs.writer.lookups.size, cs.writer.lookups.ttl, 0)
+	}
+	store.errorField = newErrorField(store, logger)
+	writer.errorField = store.errorField
+	store.spanWriter = writer
+	store.writer = writer
+
+	return store
+}
+
+// hasCollectionRoutes reports whether any services are routed to a collection.
+func hasCollectionRoutes(opts options.Options) bool {
+	for _, route := range opts.Routes {
+		if route.Collection != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OpenRouteBuckets opens the buckets that services are routed to.
+func (cs *couchbaseStore) OpenRouteBuckets() error {
+	if cs.routes == nil {
+		return nil
+	}
+
+	for _, rt := range cs.routes.routes {
+		if rt.bucket == "" {
+			continue
+		}
+
+		err := OpenBucket(rt.store, rt.bucket, rt.store.logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RouteStores returns the stores of the buckets and collections that services are routed to.
+func (cs *couchbaseStore) RouteStores() []Store {
+	if cs.routes == nil {
+		return nil
+	}
+
+	stores := make([]Store, len(cs.routes.routes))
+	for i, rt := range cs.routes.routes {
+		stores[i] = rt.store
+	}
+
+	return stores
+}
+
+// bucketStores returns the stores that have opened a bucket of their own, rather than sharing their parent's.
+func (cs *couchbaseStore) bucketStores() []*couchbaseStore {
+	stores := []*couchbaseStore{cs}
+	if cs.routes != nil {
+		for _, rt := range cs.routes.routes {
+			if rt.bucket != "" {
+				stores = append(stores, rt.store)
+			}
+		}
+	}
+
+	return stores
+}
+
+// openBuckets returns every bucket that the plugin's stores write to, once each, whether a route has opened a bucket
+// of its own or shares its parent's.
+func (cs *couchbaseStore) openBuckets() []*gocb.Bucket {
+	stores := []*couchbaseStore{cs}
+	if cs.routes != nil {
+		for _, rt := range cs.routes.routes {
+			stores = append(stores, rt.store)
+		}
+	}
+
+	var buckets []*gocb.Bucket
+	seen := make(map[*gocb.Bucket]bool)
+	for _, store := range stores {
+		bucket := store.currentBucket()
+		if bucket == nil || seen[bucket] {
+			continue
+		}
+		seen[bucket] = true
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets
+}
+
+// routedSpanReader reads spans from wherever their services are routed to. Queries for a service go to the
+// service's location, everything else is read from every location and merged, as a trace's spans may be spread across
+// several of them.
+type routedSpanReader struct {
+	store *couchbaseStore
+}
+
+// readers returns the readers of the plugin's own location followed by each route's.
+func (r *routedSpanReader) readers() []*couchbaseSpanReader {
+	readers := []*couchbaseSpanReader{r.store.spanReader()}
+	for _, rt := range r.store.routes.routes {
+		readers = append(readers, rt.store.spanReader())
+	}
+
+	return readers
+}
+
+// readerFor returns the reader of the location that the service is routed to.
+func (r *routedSpanReader) readerFor(service string) *couchbaseSpanReader {
+	if store := r.store.routes.storeFor(service); store != nil {
+		return store.spanReader()
+	}
+
+	return r.store.spanReader()
+}
+
+// GetTrace reads the trace's spans from every location, adjusting the trace once they've been merged.
+func (r *routedSpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+	readers := r.readers()
+	ctx, cancel := readers[0].withTimeout(ctx)
+	defer cancel()
+
+	var merged *model.Trace
+	for _, reader := range readers {
+		trace, err := reader.findTrace(ctx, traceID)
+		if err == spanstore.ErrTraceNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if merged == nil {
+			merged = trace
+			continue
+		}
+		merged.Spans = append(merged.Spans, trace.Spans...)
+		merged.Warnings = append(merged.Warnings, trace.Warnings...)
+	}
+	if merged == nil {
+		return nil, spanstore.ErrTraceNotFound
+	}
+
+	return readers[0].adjust(merged), nil
+}
+
+func (r *routedSpanReader) GetServices(ctx context.Context) ([]string, error) {
+	seen := make(map[string]bool)
+	var services []string
+	for _, reader := range r.readers() {
+		found, err := reader.GetServices(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, service := range found {
+			if !seen[service] {
+				seen[service] = true
+				services = append(services, service)
+			}
+		}
+	}
+	sort.Strings(services)
+
+	return services, nil
+}
+
+func (r *routedSpanReader) GetOperations(ctx context.Context, service string) ([]string, error) {
+	return r.readerFor(service).GetOperations(ctx, service)
+}
+
+func (r *routedSpanReader) GetOperationsWithKind(ctx context.Context, query OperationQueryParameters) ([]Operation, error) {
+	return r.readerFor(query.ServiceName).GetOperationsWithKind(ctx, query)
+}
+
+// FindTraces finds the matching trace IDs and then reads each trace from every location, so that spans of routed
+// services appear in the traces that they're part of.
+func (r *routedSpanReader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+	traceIDs, err := r.FindTraceIDs(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var traces []*model.Trace
+	for _, traceID := range traceIDs {
+		trace, err := r.GetTrace(ctx, traceID)
+		if err == spanstore.ErrTraceNotFound {
+			// The trace's spans may have expired since the query ran.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		traces = append(traces, trace)
+	}
+
+	return traces, nil
+}
+
+// FindTraceIDs finds the matching trace IDs in the location of the query's service, or in every location when the
+// query has no service.
+func (r *routedSpanReader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
+	if query.ServiceName != "" {
+		return r.readerFor(query.ServiceName).FindTraceIDs(ctx, query)
+	}
+
+	seen := make(map[model.TraceID]bool)
+	var traceIDs []model.TraceID
+	for _, reader := range r.readers() {
+		found, err := reader.FindTraceIDs(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, traceID := range found {
+			if !seen[traceID] && (query.NumTraces <= 0 || len(traceIDs) < query.NumTraces) {
+				seen[traceID] = true
+				traceIDs = append(traceIDs, traceID)
+			}
+		}
+	}
+
+	return traceIDs, nil
+}
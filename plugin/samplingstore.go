@@ -0,0 +1,162 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jaegertracing/jaeger/cmd/collector/app/sampling/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	throughputKeyFormat          = "throughput::%d"
+	probabilitiesKey             = "probabilities"
+	probabilitiesAndQPSKeyFormat = "probabilitiesAndQPS::%d"
+)
+
+var (
+	queryThroughput          = `SELECT RAW throughput FROM %s WHERE ` + "`type`" + `="throughput" AND ts >= ? AND ts < ?`
+	queryProbabilitiesAndQPS = `SELECT hostname, probabilities, qps FROM %s WHERE ` + "`type`" + `="probabilitiesAndQPS" AND ts >= ? AND ts < ?`
+)
+
+// Throughput is a document holding the throughput recorded by a collector during a single calculation interval.
+type Throughput struct {
+	Type       string              `json:"type"`
+	Ts         string              `json:"ts"`
+	Throughput []*model.Throughput `json:"throughput"`
+}
+
+// Probabilities is a document holding the most recently calculated sampling probabilities.
+type Probabilities struct {
+	Type          string                              `json:"type"`
+	Ts            string                              `json:"ts"`
+	Hostname      string                              `json:"hostname"`
+	Probabilities model.ServiceOperationProbabilities `json:"probabilities"`
+	QPS           model.ServiceOperationQPS           `json:"qps"`
+}
+
+// couchbaseSamplingStore stores adaptive sampling throughput and probabilities. The latest probabilities are kept in a
+// single document, while a copy of each calculation is kept, for as long as throughput, to be read back by time range.
+// Jaeger 1.12's plugin API has no sampling store, so collectors can't reach it through the plugin.
+type couchbaseSamplingStore struct {
+	store         Store
+	throughputTTL time.Duration
+}
+
+func (cs *couchbaseSamplingStore) InsertThroughput(throughput []*model.Throughput) error {
+	now := time.Now().UTC()
+	doc := Throughput{
+		Type:       "throughput",
+		Ts:         now.Format(dateLayout),
+		Throughput: throughput,
+	}
+
+	err := cs.store.Insert(fmt.Sprintf(throughputKeyFormat, now.UnixNano()), doc, expiryFromTTL(cs.throughputTTL))
+	if err != nil {
+		return errors.Wrap(err, "Error writing throughput to storage")
+	}
+
+	return nil
+}
+
+func (cs *couchbaseSamplingStore) InsertProbabilitiesAndQPS(hostname string, probabilities model.ServiceOperationProbabilities, qps model.ServiceOperationQPS) error {
+	now := time.Now().UTC()
+	doc := Probabilities{
+		Type:          "probabilities",
+		Ts:            now.Format(dateLayout),
+		Hostname:      hostname,
+		Probabilities: probabilities,
+		QPS:           qps,
+	}
+
+	err := cs.store.Upsert(probabilitiesKey, doc, 0)
+	if err != nil {
+		return errors.Wrap(err, "Error writing probabilities to storage")
+	}
+
+	doc.Type = "probabilitiesAndQPS"
+	err = cs.store.Insert(fmt.Sprintf(probabilitiesAndQPSKeyFormat, now.UnixNano()), doc, expiryFromTTL(cs.throughputTTL))
+	if err != nil {
+		return errors.Wrap(err, "Error writing probabilities and qps to storage")
+	}
+
+	return nil
+}
+
+func (cs *couchbaseSamplingStore) GetThroughput(start, end time.Time) ([]*model.Throughput, error) {
+	result, err := cs.store.Query(
+		context.Background(),
+		fmt.Sprintf(queryThroughput, cs.store.Keyspace()),
+		[]interface{}{start.UTC().Format(dateLayout), end.UTC().Format(dateLayout)},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading throughput from storage")
+	}
+
+	var throughput []*model.Throughput
+	var interval []*model.Throughput
+	for result.Next(&interval) {
+		throughput = append(throughput, interval...)
+		interval = nil
+	}
+
+	if err = result.Close(); err != nil {
+		return nil, errors.Wrap(err, "Error reading throughput from storage")
+	}
+
+	return throughput, nil
+}
+
+func (cs *couchbaseSamplingStore) GetProbabilitiesAndQPS(start, end time.Time) (map[string][]model.ServiceOperationData, error) {
+	result, err := cs.store.Query(
+		context.Background(),
+		fmt.Sprintf(queryProbabilitiesAndQPS, cs.store.Keyspace()),
+		[]interface{}{start.UTC().Format(dateLayout), end.UTC().Format(dateLayout)},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading probabilities and qps from storage")
+	}
+
+	hosts := make(map[string][]model.ServiceOperationData)
+	var doc Probabilities
+	for result.Next(&doc) {
+		hosts[doc.Hostname] = append(hosts[doc.Hostname], serviceOperationData(doc.Probabilities, doc.QPS))
+		doc = Probabilities{}
+	}
+
+	if err = result.Close(); err != nil {
+		return nil, errors.Wrap(err, "Error reading probabilities and qps from storage")
+	}
+
+	return hosts, nil
+}
+
+// serviceOperationData pairs the probability of each operation with its qps, which is zero when it wasn't measured.
+func serviceOperationData(probabilities model.ServiceOperationProbabilities, qps model.ServiceOperationQPS) model.ServiceOperationData {
+	data := make(model.ServiceOperationData, len(probabilities))
+	for service, operations := range probabilities {
+		data[service] = make(map[string]*model.ProbabilityAndQPS, len(operations))
+		for operation, probability := range operations {
+			data[service][operation] = &model.ProbabilityAndQPS{
+				Probability: probability,
+				QPS:         qps[service][operation],
+			}
+		}
+	}
+
+	return data
+}
+
+func (cs *couchbaseSamplingStore) GetLatestProbabilities() (model.ServiceOperationProbabilities, error) {
+	var doc Probabilities
+	err := cs.store.Get(probabilitiesKey, &doc)
+	if err == ErrDocumentNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading probabilities from storage")
+	}
+
+	return doc.Probabilities, nil
+}
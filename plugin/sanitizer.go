@@ -0,0 +1,149 @@
+package plugin
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/pkg/errors"
+)
+
+// The names that jaeger-collector's sanitizers give to spans and tags that they replace.
+const (
+	nullProcessServiceName = "null-process-and-service-name"
+	emptyServiceName       = "empty-service-name"
+	invalidServiceName     = "invalid-service-name"
+	invalidOperationName   = "invalid-operation-name"
+	invalidTagKey          = "invalid-tag-key"
+)
+
+// The sanitizers that can be enabled, in the order that they're applied.
+const (
+	utf8Sanitizer             = "utf8"
+	emptyServiceNameSanitizer = "emptyServiceName"
+	negativeDurationSanitizer = "negativeDuration"
+	timestampSanitizer        = "timestamp"
+)
+
+var sanitizerOrder = []string{utf8Sanitizer, emptyServiceNameSanitizer, negativeDurationSanitizer, timestampSanitizer}
+
+// sanitizer fixes a problem with a span before it's written, modifying the span in place, so that malformed spans
+// can't break the indexes or queries.
+type sanitizer func(span *model.Span)
+
+// sanitizerChain applies each of its sanitizers in turn.
+type sanitizerChain []sanitizer
+
+// newSanitizerChain returns a chain of the named sanitizers, which are always applied in the same order whatever
+// order they're named in. The timestamp sanitizer allows start times up to maxClockSkew in the future.
+func newSanitizerChain(names []string, maxClockSkew time.Duration) (sanitizerChain, error) {
+	enabled := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !isValidSanitizer(name) {
+			return nil, errors.Errorf("unknown sanitizer %q", name)
+		}
+		enabled[name] = true
+	}
+
+	var chain sanitizerChain
+	for _, name := range sanitizerOrder {
+		if !enabled[name] {
+			continue
+		}
+		switch name {
+		case utf8Sanitizer:
+			chain = append(chain, sanitizeUTF8)
+		case emptyServiceNameSanitizer:
+			chain = append(chain, sanitizeEmptyServiceName)
+		case negativeDurationSanitizer:
+			chain = append(chain, sanitizeNegativeDuration)
+		case timestampSanitizer:
+			chain = append(chain, timestampSanitizerFor(maxClockSkew))
+		}
+	}
+
+	return chain, nil
+}
+
+func isValidSanitizer(name string) bool {
+	for _, valid := range sanitizerOrder {
+		if name == valid {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c sanitizerChain) sanitize(span *model.Span) {
+	for _, s := range c {
+		s(span)
+	}
+}
+
+// sanitizeUTF8 replaces invalid UTF-8 in the same way as jaeger-collector. Invalid service and operation names are
+// replaced and kept as binary tags, invalid tag keys are replaced and kept as the tag's binary value, and invalid
+// string values become binary values.
+func sanitizeUTF8(span *model.Span) {
+	if !utf8.ValidString(span.OperationName) {
+		span.Tags = append(span.Tags, model.Binary(invalidOperationName, []byte(span.OperationName)))
+		span.OperationName = invalidOperationName
+	}
+	if span.Process != nil {
+		if !utf8.ValidString(span.Process.ServiceName) {
+			span.Tags = append(span.Tags, model.Binary(invalidServiceName, []byte(span.Process.ServiceName)))
+			span.Process.ServiceName = invalidServiceName
+		}
+		sanitizeKeyValues(span.Process.Tags)
+	}
+	sanitizeKeyValues(span.Tags)
+	for _, log := range span.Logs {
+		sanitizeKeyValues(log.Fields)
+	}
+}
+
+func sanitizeKeyValues(kvs []model.KeyValue) {
+	for i, kv := range kvs {
+		if !utf8.ValidString(kv.Key) {
+			kvs[i] = model.Binary(invalidTagKey, []byte(kv.Key))
+		} else if kv.VType == model.StringType && !utf8.ValidString(kv.VStr) {
+			kvs[i] = model.Binary(kv.Key, []byte(kv.VStr))
+		}
+	}
+}
+
+// sanitizeEmptyServiceName names the services of spans without one in the same way as jaeger-collector, as spans
+// without a service can't be found.
+func sanitizeEmptyServiceName(span *model.Span) {
+	if span.Process == nil {
+		span.Process = model.NewProcess(nullProcessServiceName, nil)
+	} else if span.Process.ServiceName == "" {
+		span.Process.ServiceName = emptyServiceName
+	}
+}
+
+// sanitizeNegativeDuration sets negative durations to zero, which would otherwise match every duration search.
+func sanitizeNegativeDuration(span *model.Span) {
+	if span.Duration >= 0 {
+		return
+	}
+
+	span.Warnings = append(span.Warnings, fmt.Sprintf("negative duration %v replaced with 0", span.Duration))
+	span.Duration = 0
+}
+
+// timestampSanitizerFor returns a sanitizer replacing the start times of spans that started before the unix epoch,
+// or further in the future than the clock skew allows, with the time that they're written. Such start times would
+// put the spans outside every search and, with partitioning, into partitions that are never dropped.
+func timestampSanitizerFor(maxClockSkew time.Duration) sanitizer {
+	return func(span *model.Span) {
+		now := time.Now()
+		if span.StartTime.Unix() > 0 && !span.StartTime.After(now.Add(maxClockSkew)) {
+			return
+		}
+
+		span.Warnings = append(span.Warnings, fmt.Sprintf("invalid start time %s replaced with the time the span was written", span.StartTime.Format(time.RFC3339Nano)))
+		span.StartTime = now
+	}
+}
@@ -0,0 +1,325 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// Span documents are stamped with the version of their layout when written. Documents written before versioning have
+// no version and are version 0. When the layout changes the version is bumped and a migration is added that upgrades
+// spans of the version before it, both when they're read and in place with the migrate-schema subcommand, so that old
+// spans never have to be wiped.
+//
+// During a rolling upgrade collectors on the new version write spans that readers on the previous version still read,
+// so a new version must only add fields, and keep writing any that it replaces, until the version after it. That way
+// every reader can read spans of its own version, of the versions before it, and of the version after it.
+const currentSchemaVersion = 2
+
+const (
+	schemaSpanKeysStmt  = "SELECT RAW META(b).id FROM %s AS b WHERE b.`type`=\"span\" AND IFMISSING(b.schema_version, 0) < ?"
+	schemaTraceKeysStmt = "SELECT RAW META(t).id FROM %s AS t WHERE t.`type`=\"trace\" AND ANY s IN t.spans SATISFIES IFMISSING(s.schema_version, 0) < ? END"
+	schemaSpanStmt      = "UPDATE %s AS b USE KEYS ? SET %s, b.schema_version = ?"
+	// schemaTypeTracesStmt types the trace documents, and their overflow documents, written before chunks were typed.
+	schemaTypeTracesStmt = "UPDATE %s AS t SET t.`type` = \"trace\" WHERE t.`type` IS MISSING AND META(t).id LIKE \"trace::%%\" AND IS_ARRAY(t.spans)"
+	// schemaTraceStmt only upgrades the spans of a trace document that are older than the migration.
+	schemaTraceStmt = "UPDATE %s AS t USE KEYS ? SET %s FOR s IN t.spans WHEN IFMISSING(s.schema_version, 0) < ? END, " +
+		"s.schema_version = ? FOR s IN t.spans WHEN IFMISSING(s.schema_version, 0) < ? END"
+)
+
+// schemaMigration upgrades spans from the version before it to its version.
+type schemaMigration struct {
+	version     int
+	description string
+	// upgrade upgrades a span as it's read, it's nil for migrations of fields that reading spans doesn't use.
+	upgrade func(span *Span)
+	// set is the N1QL SET clause upgrading a stored span, with the span's alias in place of %[1]s.
+	set string
+}
+
+var schemaMigrations = []schemaMigration{
+	{
+		version:     1,
+		description: "sets span_kind from the span.kind tag of spans written before it was stored, for dependency aggregation",
+		// Spans read back take their kind from their tags, so only the stored field needs upgrading. Protobuf and
+		// compressed spans don't store their tags, so their searchable tags are checked instead, and they're left
+		// without a kind when span.kind wasn't one of them.
+		set: "%[1]s.span_kind = IFMISSINGORNULL(%[1]s.span_kind, " +
+			"FIRST tag.v_str FOR tag IN IFMISSINGORNULL(%[1]s.tags, []) WHEN tag.`key` = \"span.kind\" END, " +
+			"FIRST SUBSTR(tag, 10) FOR tag IN IFMISSINGORNULL(%[1]s.processed_tags, []) WHEN SUBSTR(tag, 0, 10) = \"span.kind_\" END)",
+	},
+	{
+		version:     2,
+		description: "sets error on failed spans written before it was stored, so that error searches find them",
+		upgrade: func(span *Span) {
+			span.Error = span.Error || hasErrorTag(span.Tags)
+		},
+		// Protobuf spans don't store their tags, so their searchable tags are checked too.
+		set: "%[1]s.error = (ANY tag IN IFMISSINGORNULL(%[1]s.tags, []) SATISFIES tag.`key` = \"error\" AND (tag.v_bool = true OR tag.v_str = \"true\") END " +
+			"OR \"error_true\" IN IFMISSINGORNULL(%[1]s.processed_tags, []))",
+	},
+}
+
+// readSchema prepares a span of any version to be read, reporting whether it was written by a newer version of the
+// plugin. Older spans are upgraded, while newer spans are read as they are since they still have the fields of this
+// version.
+func readSchema(span *Span) bool {
+	switch {
+	case span.SchemaVersion > currentSchemaVersion:
+		return true
+	case span.SchemaVersion < currentSchemaVersion:
+		upgradeSpan(span)
+	}
+
+	return false
+}
+
+// upgradeSpan applies the migrations that the span hasn't had yet, so that spans of every version read the same.
+func upgradeSpan(span *Span) {
+	for _, migration := range schemaMigrations {
+		if span.SchemaVersion < migration.version {
+			if migration.upgrade != nil {
+				migration.upgrade(span)
+			}
+			span.SchemaVersion = migration.version
+		}
+	}
+}
+
+// SchemaMigration describes the migration to a version of the span document layout.
+type SchemaMigration struct {
+	Version     int
+	Description string
+}
+
+// SchemaMigrations returns the migrations to each version of the span document layout, oldest first.
+func SchemaMigrations() []SchemaMigration {
+	migrations := make([]SchemaMigration, len(schemaMigrations))
+	for i, migration := range schemaMigrations {
+		migrations[i] = SchemaMigration{Version: migration.version, Description: migration.description}
+	}
+
+	return migrations
+}
+
+// MigrateSchema upgrades the stored spans to the current version of the document layout, a migration at a time, at no
+// more than rate documents per second and batchSize documents at a time, and returns the number of documents upgraded
+// by each migration. With the trace storage model each trace document holding an old span counts once. A dry run only
+// counts the documents that would be upgraded.
+func (cs *couchbaseStore) MigrateSchema(rate, batchSize int, dryRun bool) (map[int]int, error) {
+	if cs.kvIndex != nil {
+		return nil, errors.New("schema migrations need the query service, which isn't used in key-value only mode")
+	}
+	// Schema versions are versions of the model layout, spans in the flat layout aren't versioned.
+	if cs.layout == flatLayout {
+		return nil, errors.New("schema migrations only apply to the model document layout")
+	}
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	keyspaces := []string{cs.Keyspace()}
+	if cs.partitions != nil {
+		names, err := cs.partitions.list()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			keyspaces = append(keyspaces, cs.partitions.keyspace(name))
+		}
+	}
+
+	// Trace documents written before their chunks were typed are invisible to every query, including those finding the
+	// documents to migrate, so they're typed first.
+	if cs.traceModel && !dryRun {
+		for _, ks := range keyspaces {
+			err := cs.Execute(fmt.Sprintf(schemaTypeTracesStmt, ks), nil)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to type trace documents")
+			}
+		}
+	}
+
+	migrated := make(map[int]int)
+	for _, migration := range schemaMigrations {
+		for _, ks := range keyspaces {
+			n, err := cs.migrateKeyspace(ks, migration, rate, batchSize, dryRun)
+			migrated[migration.version] += n
+			if err != nil {
+				return migrated, errors.Wrapf(err, "failed to migrate to schema version %d", migration.version)
+			}
+		}
+	}
+
+	// Every span now has the error field, so error searches can use the error indexes whatever their time range.
+	if !dryRun {
+		err := cs.Upsert(errorFieldKey, errorFieldDocument{}, 0)
+		if err != nil {
+			return migrated, errors.Wrap(err, "failed to record that every span has the error field")
+		}
+	}
+
+	return migrated, nil
+}
+
+// migrateKeyspace finds the documents in the keyspace with spans older than the migration and upgrades them a batch
+// at a time, waiting between batches to stay under the rate.
+func (cs *couchbaseStore) migrateKeyspace(ks string, migration schemaMigration, rate, batchSize int, dryRun bool) (int, error) {
+	keysStmt := fmt.Sprintf(schemaSpanKeysStmt, ks)
+	updateStmt := fmt.Sprintf(schemaSpanStmt, ks, fmt.Sprintf(migration.set, "b"))
+	if cs.traceModel {
+		keysStmt = fmt.Sprintf(schemaTraceKeysStmt, ks)
+		updateStmt = fmt.Sprintf(schemaTraceStmt, ks, fmt.Sprintf(migration.set, "s"))
+	}
+
+	result, err := cs.Query(context.Background(), keysStmt, []interface{}{migration.version})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to query documents to migrate")
+	}
+
+	var migrated int
+	batch := make([]string, 0, batchSize)
+	upgrade := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		start := time.Now()
+		if !dryRun {
+			params := []interface{}{batch, migration.version}
+			if cs.traceModel {
+				params = []interface{}{batch, migration.version, migration.version, migration.version}
+			}
+			err := cs.Execute(updateStmt, params)
+			if err != nil {
+				return errors.Wrap(err, "failed to upgrade documents")
+			}
+		}
+		migrated += len(batch)
+		cs.logger.Debug("migrated documents", "keyspace", ks, "version", migration.version, "documents", len(batch), "dry_run", dryRun)
+		batch = batch[:0]
+
+		if rate > 0 && !dryRun {
+			wait := time.Duration(float64(batchSize)/float64(rate)*float64(time.Second)) - time.Since(start)
+			if wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		return nil
+	}
+
+	var key string
+	for result.Next(&key) {
+		batch = append(batch, key)
+		if len(batch) == batchSize {
+			err := upgrade()
+			if err != nil {
+				result.Close()
+				return migrated, err
+			}
+		}
+	}
+	err = upgrade()
+	if err != nil {
+		result.Close()
+		return migrated, err
+	}
+
+	err = result.Close()
+	if err != nil {
+		return migrated, errors.Wrap(err, "failed to query documents to migrate")
+	}
+
+	return migrated, nil
+}
+
+// errorFieldKey is the document recording since when every span has been written with the error field, which the
+// error indexes rely on. Writers record when they first wrote a span, and migrate-schema clears the time once it has
+// set the field on every older span.
+const errorFieldKey = "schema::error_field"
+
+// errorFieldRefresh is how often readers check whether the time in the error field document has moved.
+const errorFieldRefresh = time.Minute
+
+type errorFieldDocument struct {
+	// Since is when spans began to be written with the error field, or empty when every span has it.
+	Since string `json:"since,omitempty"`
+}
+
+// errorField tracks whether searches for errors can use the error indexes. Spans written before the error field was
+// stored aren't in those indexes until they're migrated, so searches reaching back before then match the error tag
+// against the searchable tags instead.
+type errorField struct {
+	store  Store
+	logger hclog.Logger
+
+	mu        sync.Mutex
+	recorded  bool
+	nextWrite time.Time
+	since     time.Time
+	known     bool
+	checked   time.Time
+}
+
+func newErrorField(store Store, logger hclog.Logger) *errorField {
+	return &errorField{store: store, logger: logger}
+}
+
+// recordWrite records when spans began to be written with the error field, unless a writer already has. Failures are
+// retried at most every errorFieldRefresh, and only mean that error searches keep matching tags.
+func (f *errorField) recordWrite() {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.recorded || now.Before(f.nextWrite) {
+		return
+	}
+
+	err := f.store.Insert(errorFieldKey, errorFieldDocument{Since: now.UTC().Format(dateLayout)}, 0)
+	if err != nil && !isDocumentExists(err) {
+		f.nextWrite = now.Add(errorFieldRefresh)
+		f.logger.Warn("failed to record when spans began to be written with the error field", "error", err)
+		return
+	}
+	f.recorded = true
+}
+
+// indexes reports whether every span started after start has the error field, so is in the error indexes when failed.
+func (f *errorField) indexes(start time.Time) bool {
+	if f == nil {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now := time.Now(); now.Sub(f.checked) >= errorFieldRefresh {
+		f.checked = now
+		var doc errorFieldDocument
+		err := f.store.Get(errorFieldKey, &doc)
+		switch {
+		case err == ErrDocumentNotFound:
+			f.known = false
+		case err != nil:
+			f.logger.Debug("failed to read when spans began to be written with the error field", "error", err)
+		case doc.Since == "":
+			f.since, f.known = time.Time{}, true
+		default:
+			since, err := time.Parse(dateLayout, doc.Since)
+			if err != nil {
+				f.logger.Warn("invalid error field document", "since", doc.Since, "error", err)
+				break
+			}
+			f.since, f.known = since, true
+		}
+	}
+
+	return f.known && !start.Before(f.since)
+}
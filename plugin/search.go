@@ -0,0 +1,193 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"gopkg.in/couchbase/gocb.v1"
+	"gopkg.in/couchbase/gocb.v1/cbft"
+)
+
+// searchHitsPerTrace is how many matching spans are fetched from the search service for each trace that's wanted, as
+// hits are spans and several spans of a trace may match.
+const searchHitsPerTrace = 10
+
+// tagSearch finds spans by their tags using a search index, created by init-fts-index, rather than N1QL. Tag values
+// can be matched fuzzily, and the fields that matched can be added to the matching spans as warnings so that it's
+// clear why a trace was found.
+type tagSearch struct {
+	indexName     string
+	fuzziness     int
+	matchWarnings bool
+}
+
+// forTenant returns the search of the tenant's own index, which is named after the tenant.
+func (s *tagSearch) forTenant(tenant string) *tagSearch {
+	if s == nil {
+		return nil
+	}
+
+	search := *s
+	search.indexName = s.indexName + "-" + tenant
+	return &search
+}
+
+// spanMatch identifies a span found by a search.
+type spanMatch struct {
+	traceID TraceID
+	spanID  uint64
+}
+
+// spanMatches are the warnings describing what matched in each span found by a search.
+type spanMatches map[spanMatch][]string
+
+// annotate adds the warnings to the matching spans of the traces.
+func (m spanMatches) annotate(traces []*model.Trace) {
+	if len(m) == 0 {
+		return
+	}
+
+	for _, trace := range traces {
+		for _, span := range trace.Spans {
+			warnings, ok := m[spanMatch{traceID: traceIDFromDomain(span.TraceID), spanID: uint64(span.SpanID)}]
+			if ok {
+				span.Warnings = append(span.Warnings, warnings...)
+			}
+		}
+	}
+}
+
+// usesTagSearch reports whether the query is run against the search index.
+func (cs *couchbaseSpanReader) usesTagSearch(traceQuery *spanstore.TraceQueryParameters) bool {
+	return cs.search != nil && len(traceQuery.Tags) > 0
+}
+
+// searchTraceIDs finds the IDs of the traces with spans matching the query's service, operation, time range and tags,
+// most recent first, along with what matched in each span if match warnings are enabled.
+func (cs *couchbaseSpanReader) searchTraceIDs(ctx context.Context, traceQuery *spanstore.TraceQueryParameters) ([]TraceID, spanMatches, error) {
+	span, ctx := cs.startSpanForQuery(ctx, "searchIDsByTags", cs.search.indexName)
+	defer span.Finish()
+
+	start := time.Now()
+	traceIDs, matches, err := cs.searchSpans(ctx, traceQuery)
+	cs.metrics.record("searchIDsByTags", start, err)
+	if err != nil {
+		cs.logErrorToSpan(span, err)
+		cs.logger.Warn("trace ID search failed", "index", cs.search.indexName, "error", err)
+		return nil, nil, err
+	}
+
+	return traceIDs, matches, nil
+}
+
+func (cs *couchbaseSpanReader) searchSpans(ctx context.Context, traceQuery *spanstore.TraceQueryParameters) ([]TraceID, spanMatches, error) {
+	conjuncts := []cbft.FtsQuery{
+		cbft.NewTermQuery(traceQuery.ServiceName).Field("process.service_name"),
+		cbft.NewDateRangeQuery().
+			Start(traceQuery.StartTimeMin.UTC().Format(time.RFC3339Nano), false).
+			End(traceQuery.StartTimeMax.UTC().Format(time.RFC3339Nano), false).
+			Field("start_time"),
+	}
+	if traceQuery.OperationName != "" {
+		conjuncts = append(conjuncts, cbft.NewTermQuery(traceQuery.OperationName).Field("operation_name"))
+	}
+	// Each group of tags matches any of the forms that Jaeger stringifies their values with, or any of their patterns
+	// when they hold wildcards.
+	predicates, patterns, err := cs.tagParams(traceQuery.Tags)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, alternatives := range patterns {
+		var disjuncts []cbft.FtsQuery
+		for _, pattern := range alternatives {
+			disjuncts = append(disjuncts, cbft.NewRegexpQuery(pattern).Field("processed_tags"))
+		}
+		conjuncts = append(conjuncts, cbft.NewDisjunctionQuery(disjuncts...))
+	}
+	for _, alternatives := range predicates {
+		var disjuncts []cbft.FtsQuery
+		for _, tag := range alternatives {
+			disjuncts = append(disjuncts, cbft.NewTermQuery(tag).Field("processed_tags").Fuzziness(cs.search.fuzziness))
+		}
+		conjuncts = append(conjuncts, cbft.NewDisjunctionQuery(disjuncts...))
+	}
+
+	query := gocb.NewSearchQuery(cs.search.indexName, cbft.NewConjunctionQuery(conjuncts...)).
+		Limit(traceQuery.NumTraces * searchHitsPerTrace).
+		Sort("-start_time")
+	if cs.search.matchWarnings {
+		query.Highlight(gocb.DefaultHighlightStyle, "processed_tags")
+	}
+
+	results, err := cs.store.Search(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Hits only identify span documents, so the documents are read to find their traces.
+	hits := results.Hits()
+	docs := make([]Document, len(hits))
+	found := make([]spanMatch, len(hits))
+	for i, hit := range hits {
+		docs[i] = Document{Key: hit.Id, Value: &struct {
+			TraceID *TraceID `json:"trace_id"`
+			SpanID  *uint64  `json:"span_id"`
+		}{&found[i].traceID, &found[i].spanID}}
+	}
+	errs := cs.store.GetMulti(docs)
+
+	var traceIDs []TraceID
+	seen := make(UniqueTraceIDs)
+	var matches spanMatches
+	if cs.search.matchWarnings {
+		matches = make(spanMatches)
+	}
+	for i, hit := range hits {
+		// The span may have expired since it was indexed.
+		if errs[i] != nil {
+			continue
+		}
+		if matches != nil {
+			matches[found[i]] = matchWarnings(hit)
+		}
+		if _, ok := seen[found[i].traceID]; ok || len(traceIDs) >= traceQuery.NumTraces {
+			continue
+		}
+		seen.Add(found[i].traceID)
+		traceIDs = append(traceIDs, found[i].traceID)
+	}
+
+	return traceIDs, matches, nil
+}
+
+// matchWarnings describes the terms that matched in each of the hit's fields, with the highlighted fragments of the
+// field when there are any.
+func matchWarnings(hit gocb.SearchResultHit) []string {
+	var fields []string
+	for field := range hit.Locations {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var warnings []string
+	for _, field := range fields {
+		var terms []string
+		for term := range hit.Locations[field] {
+			terms = append(terms, term)
+		}
+		sort.Strings(terms)
+
+		for _, term := range terms {
+			warnings = append(warnings, fmt.Sprintf("search matched %q in %s", term, field))
+		}
+		for _, fragment := range hit.Fragments[field] {
+			warnings = append(warnings, fmt.Sprintf("search matched %s: %s", field, fragment))
+		}
+	}
+
+	return warnings
+}
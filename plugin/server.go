@@ -0,0 +1,51 @@
+package plugin
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+// Serve runs the store as a standalone remote storage server on address, serving the same span reader and writer
+// services that Jaeger uses to talk to the plugin alongside the gRPC health and reflection services. It blocks until
+// the server stops, which it does gracefully on SIGINT or SIGTERM.
+func Serve(address string, store shared.StoragePlugin, logger hclog.Logger) error {
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen")
+	}
+
+	server := grpc.NewServer()
+
+	// The broker is only used by go-plugin to multiplex connections, the storage services don't need it.
+	err = (&shared.StorageGRPCPlugin{Impl: store}).GRPCServer(nil, server)
+	if err != nil {
+		return errors.Wrap(err, "failed to register storage services")
+	}
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	reflection.Register(server)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		logger.Info("shutting down remote storage server")
+		healthServer.Shutdown()
+		server.GracefulStop()
+	}()
+
+	logger.Info("serving remote storage", "address", lis.Addr().String())
+	return server.Serve(lis)
+}
@@ -0,0 +1,71 @@
+package plugin
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A latency sketch counts latencies in buckets whose bounds grow geometrically, so that every quantile is accurate to
+// within sketchRelativeAccuracy of the latency whatever the latencies are. Bucket i holds the latencies, in
+// microseconds, in (gamma^(i-1), gamma^i]. Sketches are merged by adding their counts, so they're kept as sub-document
+// counters that any number of writers can add to, and only hold the buckets that latencies fell in.
+const sketchRelativeAccuracy = 0.01
+
+// sketchGamma is the ratio between the bounds of consecutive sketch buckets.
+var sketchGamma = (1 + sketchRelativeAccuracy) / (1 - sketchRelativeAccuracy)
+
+// sketchIndex returns the index of the sketch bucket that the duration falls in. Durations under a microsecond are
+// counted as a microsecond.
+func sketchIndex(duration time.Duration) int {
+	micros := float64(duration) / float64(time.Microsecond)
+	if micros <= 1 {
+		return 0
+	}
+
+	return int(math.Ceil(math.Log(micros) / math.Log(sketchGamma)))
+}
+
+// sketchValue returns the latency, in milliseconds, that stands for the latencies counted in the bucket.
+func sketchValue(index int) float64 {
+	micros := 2 * math.Pow(sketchGamma, float64(index)) / (sketchGamma + 1)
+
+	return micros / 1000
+}
+
+// addSketch adds the counts of a sketch read from a rollup document, keyed by bucket index, to the sketch.
+func addSketch(sketch map[int]int64, counts map[string]int64) {
+	for bucket, n := range counts {
+		i, err := strconv.Atoi(bucket)
+		if err != nil || i < 0 {
+			continue
+		}
+		sketch[i] += n
+	}
+}
+
+// sketchQuantile returns the q quantile, in milliseconds, of the latencies counted in the sketch.
+func sketchQuantile(sketch map[int]int64, q float64) float64 {
+	indexes := make([]int, 0, len(sketch))
+	var total int64
+	for i, n := range sketch {
+		indexes = append(indexes, i)
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	sort.Ints(indexes)
+
+	rank := q * float64(total-1)
+	var cumulative int64
+	for _, i := range indexes {
+		cumulative += sketch[i]
+		if float64(cumulative) > rank {
+			return sketchValue(i)
+		}
+	}
+
+	return sketchValue(indexes[len(indexes)-1])
+}
@@ -0,0 +1,43 @@
+package plugin
+
+import (
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// slowQueryResult logs the query once the result is closed if it took longer than the threshold. Couchbase only
+// sends the query metrics once all of the rows have been read so they aren't available any earlier.
+type slowQueryResult struct {
+	Result
+	// raw is the result from the SDK, which has the query metrics.
+	raw       Result
+	statement string
+	params    interface{}
+	start     time.Time
+	threshold time.Duration
+	logger    hclog.Logger
+}
+
+func (r *slowQueryResult) Close() error {
+	err := r.Result.Close()
+	logSlowQuery(r.logger, r.threshold, r.statement, r.params, r.start, r.raw)
+
+	return err
+}
+
+// logSlowQuery logs the statement if it took longer than the threshold, a threshold of zero disables logging.
+func logSlowQuery(logger hclog.Logger, threshold time.Duration, statement string, params interface{}, start time.Time,
+	result interface{}) {
+	elapsed := time.Since(start)
+	if threshold <= 0 || elapsed < threshold {
+		return
+	}
+
+	args := []interface{}{"statement", statement, "params", params, "elapsed", elapsed}
+	if stats, ok := resultStats(result); ok {
+		args = append(args, "service", stats.service, "execution_time", stats.executionTime, "result_count", stats.resultCount)
+	}
+
+	logger.Warn("slow query", args...)
+}
@@ -0,0 +1,190 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/pkg/errors"
+)
+
+// The policies for spans whose documents are larger than the maximum span size.
+const (
+	truncateLogsPolicy = "truncateLogs"
+	dropTagsPolicy     = "dropTags"
+	rejectPolicy       = "reject"
+)
+
+func isValidOversizedPolicy(policy string) bool {
+	switch policy {
+	case truncateLogsPolicy, dropTagsPolicy, rejectPolicy:
+		return true
+	}
+
+	return false
+}
+
+// fitDocument checks that the span's document is no larger than the maximum span size, cutting the span down
+// according to the oversized spans policy if it is. The largest logs or tags are removed until the document fits and
+// a warning saying how many were removed is added to the span. Spans that can't be cut down enough are rejected.
+func (cs *couchbaseSpanWriter) fitDocument(span *model.Span, dbSpan Span, doc Document) (Span, Document, error) {
+	// Measuring a document means encoding it again, so only spans that could be too large are measured.
+	if cs.maxSpanSize <= 0 || spanSizeBound(span) <= cs.maxSpanSize {
+		return dbSpan, doc, nil
+	}
+
+	size, err := documentSize(doc)
+	if err != nil {
+		return Span{}, Document{}, err
+	}
+	if size <= cs.maxSpanSize {
+		return dbSpan, doc, nil
+	}
+
+	original := size
+	cut := *span
+	cut.Logs = append([]model.Log(nil), span.Logs...)
+	cut.Tags = append([]model.KeyValue(nil), span.Tags...)
+	cut.Warnings = append([]string(nil), span.Warnings...)
+	removed := 0
+	for size > cs.maxSpanSize {
+		n := cs.cutSpan(&cut, size-cs.maxSpanSize)
+		if n == 0 {
+			cs.metrics.oversized.Inc(1)
+			return Span{}, Document{}, errors.Errorf("span document of %d bytes is larger than the maximum span size of %d bytes", original, cs.maxSpanSize)
+		}
+		removed += n
+
+		dbSpan, doc, err = cs.encodeDocument(&cut)
+		if err != nil {
+			return Span{}, Document{}, err
+		}
+		size, err = documentSize(doc)
+		if err != nil {
+			return Span{}, Document{}, err
+		}
+	}
+
+	cs.metrics.truncated.Inc(1)
+	cs.logger.Debug("cut down oversized span", "trace_id", span.TraceID.String(), "span_id", span.SpanID.String(), "size", original, "removed", removed)
+
+	return dbSpan, doc, nil
+}
+
+// cutSpan removes the span's largest logs or tags, depending on the policy, until at least excess bytes have gone,
+// returning how many were removed. Nothing is removed when the policy is to reject oversized spans.
+func (cs *couchbaseSpanWriter) cutSpan(span *model.Span, excess int) int {
+	switch cs.oversizedSpans {
+	case truncateLogsPolicy:
+		sizes := make([]int, len(span.Logs))
+		for i, log := range span.Logs {
+			sizes[i] = encodedSize(log)
+		}
+		removed := largest(sizes, excess)
+		if len(removed) == 0 {
+			return 0
+		}
+
+		logs := span.Logs[:0]
+		for i, log := range span.Logs {
+			if !removed[i] {
+				logs = append(logs, log)
+			}
+		}
+		span.Logs = logs
+		span.Warnings = append(span.Warnings, fmt.Sprintf("%d logs removed to fit the maximum span size", len(removed)))
+
+		return len(removed)
+	case dropTagsPolicy:
+		sizes := make([]int, len(span.Tags))
+		for i, tag := range span.Tags {
+			sizes[i] = encodedSize(tag)
+		}
+		removed := largest(sizes, excess)
+		if len(removed) == 0 {
+			return 0
+		}
+
+		tags := span.Tags[:0]
+		for i, tag := range span.Tags {
+			if !removed[i] {
+				tags = append(tags, tag)
+			}
+		}
+		span.Tags = tags
+		span.Warnings = append(span.Warnings, fmt.Sprintf("%d tags removed to fit the maximum span size", len(removed)))
+
+		return len(removed)
+	}
+
+	return 0
+}
+
+// largest returns the indexes of the largest sizes that add up to at least excess, or all of them if they don't.
+func largest(sizes []int, excess int) map[int]bool {
+	order := make([]int, len(sizes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return sizes[order[i]] > sizes[order[j]]
+	})
+
+	removed := make(map[int]bool)
+	for _, i := range order {
+		if excess <= 0 {
+			break
+		}
+		removed[i] = true
+		excess -= sizes[i]
+	}
+
+	return removed
+}
+
+// documentSize returns the size of the document once encoded as JSON, as it's written to Couchbase.
+func documentSize(doc Document) (int, error) {
+	data, err := json.Marshal(doc.Value)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to marshal span")
+	}
+
+	return len(data), nil
+}
+
+func encodedSize(v interface{}) int {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+
+	return len(data)
+}
+
+// spanSizeBound is an upper bound on the size of the span's document. Every byte of a string could need escaping as
+// \u00XX in JSON, and tags and log fields are stored twice as they're also searchable tags.
+func spanSizeBound(span *model.Span) int {
+	size := 1024 + 6*len(span.OperationName) + 128*len(span.References)
+	size += 2 * keyValuesBound(span.Tags)
+	for _, log := range span.Logs {
+		size += 64 + 2*keyValuesBound(log.Fields)
+	}
+	for _, warning := range span.Warnings {
+		size += 8 + 6*len(warning)
+	}
+	if span.Process != nil {
+		size += 6*len(span.Process.ServiceName) + 2*keyValuesBound(span.Process.Tags)
+	}
+
+	return size
+}
+
+func keyValuesBound(kvs []model.KeyValue) int {
+	var size int
+	for _, kv := range kvs {
+		size += 64 + 6*(len(kv.Key)+len(kv.VStr)) + 2*len(kv.VBinary)
+	}
+
+	return size
+}
@@ -0,0 +1,356 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/pkg/errors"
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+const (
+	spillSegmentSuffix = ".spill"
+
+	// maximumSpillSegmentBytes is the size at which a new segment file is started, segments are read into memory
+	// whole when they are replayed.
+	maximumSpillSegmentBytes = 16 << 20
+)
+
+// spillBuffer is a spanstore.Writer that buffers spans in segment files on disk whilst Couchbase is unreachable, and
+// replays them in the background once it's reachable again. Each segment is a sequence of length prefixed protobuf
+// encoded spans.
+//
+// Once a write fails because the cluster can't be reached all spans are spilled to disk, rather than each waiting on
+// a timeout, until the buffered spans have been replayed.
+type spillBuffer struct {
+	writer   spanstore.Writer
+	dir      string
+	maxBytes int64
+	metrics  *writeMetrics
+	logger   hclog.Logger
+
+	mu           sync.Mutex
+	spilling     bool
+	size         int64
+	seq          uint64
+	segment      *os.File
+	segmentBytes int64
+}
+
+func newSpillBuffer(writer spanstore.Writer, dir string, maxBytes int, replayInterval time.Duration, metrics *writeMetrics, logger hclog.Logger) (*spillBuffer, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create spill directory")
+	}
+
+	b := &spillBuffer{
+		writer:   writer,
+		dir:      dir,
+		maxBytes: int64(maxBytes),
+		metrics:  metrics,
+		logger:   logger,
+	}
+
+	// Spans spilled before a restart are replayed along with any spilled from now on.
+	segments, err := b.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		info, err := os.Stat(segment.path)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read spill segment")
+		}
+		b.size += info.Size()
+		b.seq = segment.seq
+	}
+	if len(segments) > 0 {
+		logger.Info("found spans spilled to disk, they will be replayed", "segments", len(segments), "bytes", b.size)
+	}
+
+	go b.replayEvery(replayInterval)
+
+	return b, nil
+}
+
+// WriteSpan writes the span to Couchbase, or spills it to disk if Couchbase is unreachable.
+func (b *spillBuffer) WriteSpan(span *model.Span) error {
+	b.mu.Lock()
+	spilling := b.spilling
+	b.mu.Unlock()
+
+	if !spilling {
+		err := b.writer.WriteSpan(span)
+		if !isUnreachable(err) {
+			return err
+		}
+
+		b.mu.Lock()
+		if !b.spilling {
+			b.logger.Warn("couchbase is unreachable, spilling spans to disk", "dir", b.dir, "error", err)
+			b.spilling = true
+		}
+		b.mu.Unlock()
+	}
+
+	return b.spill(span)
+}
+
+func (b *spillBuffer) spill(span *model.Span) error {
+	data, err := span.Marshal()
+	if err != nil {
+		return errors.Wrap(err, "failed to encode span")
+	}
+
+	entry := make([]byte, binary.MaxVarintLen64+len(data))
+	n := binary.PutUvarint(entry, uint64(len(data)))
+	entry = append(entry[:n], data...)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.size+int64(len(entry)) > b.maxBytes {
+		b.metrics.spillDropped.Inc(1)
+		return errors.New("spill buffer is full")
+	}
+
+	if b.segment == nil {
+		b.seq++
+		b.segment, err = os.OpenFile(b.segmentPath(b.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			b.segment = nil
+			return errors.Wrap(err, "failed to create spill segment")
+		}
+		b.segmentBytes = 0
+	}
+
+	_, err = b.segment.Write(entry)
+	if err != nil {
+		return errors.Wrap(err, "failed to write spill segment")
+	}
+	b.size += int64(len(entry))
+	b.segmentBytes += int64(len(entry))
+	b.metrics.spilled.Inc(1)
+
+	if b.segmentBytes >= maximumSpillSegmentBytes {
+		b.closeSegment()
+	}
+
+	return nil
+}
+
+// closeSegment closes the segment being spilled to so that it can be replayed, the next spilled span starts a new
+// segment. b.mu must be held.
+func (b *spillBuffer) closeSegment() {
+	if b.segment == nil {
+		return
+	}
+
+	err := b.segment.Close()
+	if err != nil {
+		b.logger.Warn("failed to close spill segment", "error", err)
+	}
+	b.segment = nil
+}
+
+// Close closes the segment being spilled to, so that its spans are replayed when the plugin next starts, and then closes
+// the writer.
+func (b *spillBuffer) Close() error {
+	b.mu.Lock()
+	b.closeSegment()
+	b.mu.Unlock()
+
+	return closeWriter(b.writer)
+}
+
+func (b *spillBuffer) replayEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		b.replay()
+	}
+}
+
+// replay writes the spilled segments to Couchbase oldest first, stopping at the first segment that can't be written
+// because Couchbase is still unreachable.
+func (b *spillBuffer) replay() {
+	b.mu.Lock()
+	if b.size == 0 {
+		b.spilling = false
+		b.mu.Unlock()
+		return
+	}
+	b.closeSegment()
+	b.mu.Unlock()
+
+	segments, err := b.segments()
+	if err != nil {
+		b.logger.Warn("failed to list spill segments", "error", err)
+		return
+	}
+
+	for _, segment := range segments {
+		err := b.replaySegment(segment.path)
+		if err != nil {
+			b.logger.Debug("failed to replay spilled spans", "segment", segment.path, "error", err)
+			return
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Spans spilled whilst replaying are left for the next replay.
+	if b.segment == nil {
+		b.logger.Info("replayed spans spilled to disk, writing to couchbase")
+		b.spilling = false
+	}
+}
+
+// replaySegment writes the spans in the segment to Couchbase and removes it. If Couchbase is unreachable then the
+// spans that haven't been written are left in the segment.
+func (b *spillBuffer) replaySegment(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read spill segment")
+	}
+
+	r := bytes.NewReader(data)
+	var offset int64
+	for {
+		length, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			b.logger.Warn("spill segment is corrupt, dropping the rest of it", "segment", path, "error", err)
+			break
+		}
+
+		entry := make([]byte, length)
+		_, err = io.ReadFull(r, entry)
+		if err != nil {
+			b.logger.Warn("spill segment is corrupt, dropping the rest of it", "segment", path, "error", err)
+			break
+		}
+
+		var span model.Span
+		err = span.Unmarshal(entry)
+		if err != nil {
+			b.logger.Warn("failed to decode spilled span, dropping it", "segment", path, "error", err)
+		} else {
+			err = b.writer.WriteSpan(&span)
+			if isUnreachable(err) {
+				return b.truncateSegment(path, data, offset, err)
+			}
+			if err != nil {
+				b.logger.Warn("failed to replay spilled span, dropping it", "trace_id", span.TraceID.String(), "error", err)
+			} else {
+				b.metrics.replayed.Inc(1)
+			}
+		}
+
+		offset = int64(len(data) - r.Len())
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove spill segment")
+	}
+	b.release(int64(len(data)))
+
+	return nil
+}
+
+// truncateSegment rewrites the segment without the spans before offset, which have been replayed, and returns cause.
+func (b *spillBuffer) truncateSegment(path string, data []byte, offset int64, cause error) error {
+	if offset == 0 {
+		return cause
+	}
+
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, data[offset:], 0600)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		// The replayed spans will be written again, which is better than losing those that weren't.
+		b.logger.Warn("failed to truncate spill segment", "segment", path, "error", err)
+		return cause
+	}
+	b.release(offset)
+
+	return cause
+}
+
+func (b *spillBuffer) release(bytes int64) {
+	b.mu.Lock()
+	b.size -= bytes
+	b.mu.Unlock()
+}
+
+type spillSegment struct {
+	seq  uint64
+	path string
+}
+
+// segments returns the segments that aren't being spilled to, oldest first.
+func (b *spillBuffer) segments() ([]spillSegment, error) {
+	paths, err := filepath.Glob(filepath.Join(b.dir, "*"+spillSegmentSuffix))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list spill segments")
+	}
+
+	b.mu.Lock()
+	current := b.segment
+	b.mu.Unlock()
+
+	var segments []spillSegment
+	for _, path := range paths {
+		var seq uint64
+		_, err := fmt.Sscanf(filepath.Base(path), "%d"+spillSegmentSuffix, &seq)
+		if err != nil {
+			continue
+		}
+		if current != nil && path == current.Name() {
+			continue
+		}
+		segments = append(segments, spillSegment{seq: seq, path: path})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].seq < segments[j].seq
+	})
+
+	return segments, nil
+}
+
+func (b *spillBuffer) segmentPath(seq uint64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%020d%s", seq, spillSegmentSuffix))
+}
+
+// isUnreachable reports whether an operation failed because the cluster couldn't be reached or couldn't keep up,
+// rather than because of a problem with the operation itself.
+func isUnreachable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch errors.Cause(err) {
+	case gocb.ErrTimeout, gocb.ErrNetwork, gocb.ErrOverload, gocb.ErrShutdown:
+		return true
+	}
+
+	return isRetryable(err)
+}
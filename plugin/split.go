@@ -0,0 +1,106 @@
+package plugin
+
+import (
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/pkg/errors"
+)
+
+// With split storage each span is stored as a small span document holding only the fields that searches use, so that
+// the span indexes only cover small documents, and a body document holding the whole span as compressed protobuf.
+// Traces are read by finding their span documents and then fetching the bodies with a bulk get. The span document
+// refers to its body by key, so spans are read whole whether or not split storage is still in use.
+const spanBodyDocumentType = "span_body"
+
+// spanBody holds the whole of a span apart from its span document.
+type spanBody struct {
+	Codec   string `json:"codec,omitempty"`
+	Payload []byte `json:"payload"`
+	Type    string `json:"type"`
+}
+
+// bodyKey returns the key of the body of the span document with the key. Bodies don't share the prefix of span keys,
+// so that they aren't found when looking up a trace's span documents by key.
+func bodyKey(spanKey string) string {
+	return "body::" + spanKey
+}
+
+// withBodyKeys returns the keys along with the keys of the bodies of their spans.
+func withBodyKeys(keys []string) []string {
+	all := make([]string, 0, 2*len(keys))
+	all = append(all, keys...)
+	for _, key := range keys {
+		all = append(all, bodyKey(key))
+	}
+
+	return all
+}
+
+// bodyCodec returns the codec that bodies are compressed with, which is snappy unless another compression is set.
+func bodyCodec(compression string) string {
+	if compression == "" || compression == noCompression {
+		return snappyCompression
+	}
+
+	return compression
+}
+
+// writeBody writes the whole span to its body document, and cuts the span document down to the fields used by
+// searches along with the key of the body.
+func (cs *couchbaseSpanWriter) writeBody(span *model.Span, dbSpan *Span, doc *Document) error {
+	err := dbSpan.encodeProto(span, bodyCodec(cs.compression))
+	if err != nil {
+		return err
+	}
+	body := spanBody{
+		Codec:   dbSpan.Codec,
+		Payload: dbSpan.Payload,
+		Type:    spanBodyDocumentType,
+	}
+	dbSpan.Encoding = ""
+	dbSpan.Codec = ""
+	dbSpan.Payload = nil
+	dbSpan.Body = bodyKey(doc.Key)
+
+	err = cs.store.Upsert(dbSpan.Body, body, doc.Expiry)
+	if err != nil {
+		return errors.Wrap(err, "failed to write span body")
+	}
+	doc.Value = *dbSpan
+
+	return nil
+}
+
+// appendSplitSpans fetches the bodies of spans stored with split storage in one bulk get and adds the spans to the
+// trace. A span whose body can't be found, which may have expired just before its span document, is added with only
+// the fields used by searches and a warning.
+func (cs *couchbaseSpanReader) appendSplitSpans(trace *model.Trace, dbSpans []*Span) error {
+	if len(dbSpans) == 0 {
+		return nil
+	}
+
+	docs := make([]Document, len(dbSpans))
+	for i, dbSpan := range dbSpans {
+		docs[i] = Document{Key: dbSpan.Body, Value: &spanBody{}}
+	}
+	for i, err := range cs.store.GetMulti(docs) {
+		dbSpan := dbSpans[i]
+		if err == ErrDocumentNotFound {
+			dbSpan.Warnings = append(dbSpan.Warnings, "the span's body could not be found, only its searchable fields were read")
+		} else if err != nil {
+			return errors.Wrap(err, "failed to read span bodies")
+		} else {
+			body := docs[i].Value.(*spanBody)
+			dbSpan.Encoding = protobufEncoding
+			dbSpan.Codec = body.Codec
+			dbSpan.Payload = body.Payload
+		}
+
+		span, err := cs.toDomain(dbSpan)
+		if err != nil {
+			return err
+		}
+		trace.Spans = append(trace.Spans, span)
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package plugin
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const spmDocumentType = "spm"
+
+// latencyBucketBounds are the upper bounds, in milliseconds, of the latency histogram kept for each operation. Spans
+// slower than the last bound are counted in a final unbounded bucket.
+var latencyBucketBounds = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// spmKey identifies the rollup of an operation's spans for a minute.
+type spmKey struct {
+	service   string
+	operation string
+	spanKind  string
+	minute    int64
+}
+
+// spmCounts are the calls, errors and latencies of an operation's spans that haven't been written yet.
+type spmCounts struct {
+	calls   int64
+	errors  int64
+	buckets map[int]int64
+	sketch  map[int]int64
+}
+
+// spmDocument is a rollup of the calls, errors and latencies of an operation's spans for a minute, which the metrics
+// reader serves service performance monitoring from. Latency buckets are keyed by their index in
+// latencyBucketBounds, and the buckets of the latency sketch, when sketches are kept, by their sketch index.
+type spmDocument struct {
+	ServiceName    string           `json:"service_name"`
+	OperationName  string           `json:"operation_name"`
+	SpanKind       string           `json:"span_kind"`
+	Minute         int64            `json:"minute"`
+	Calls          int64            `json:"calls"`
+	Errors         int64            `json:"errors"`
+	LatencyBuckets map[string]int64 `json:"latency_buckets"`
+	LatencySketch  map[string]int64 `json:"latency_sketch,omitempty"`
+}
+
+// spmRollup counts the calls, errors and latencies of spans as they're written and periodically adds the counts to
+// per minute rollup documents. Counters are added to rather than overwritten so several plugins can write rollups.
+type spmRollup struct {
+	store    Store
+	ttl      time.Duration
+	sketches bool
+	logger   hclog.Logger
+
+	mu     sync.Mutex
+	counts map[spmKey]*spmCounts
+}
+
+// newSPMRollup creates a rollup that flushes every flushInterval, keeping latency sketches as well as histograms when
+// sketches is set.
+func newSPMRollup(store Store, ttl, flushInterval time.Duration, sketches bool, logger hclog.Logger) *spmRollup {
+	r := &spmRollup{
+		store:    store,
+		ttl:      ttl,
+		sketches: sketches,
+		logger:   logger,
+		counts:   make(map[spmKey]*spmCounts),
+	}
+	go r.flushEvery(flushInterval)
+
+	return r
+}
+
+// record counts the span in the rollup of its operation for the minute that it started in.
+func (r *spmRollup) record(span *model.Span) {
+	var spanKind string
+	if kind, ok := model.KeyValues(span.Tags).FindByKey(string(ext.SpanKind)); ok {
+		spanKind = kind.AsString()
+	}
+	key := spmKey{
+		service:   span.Process.ServiceName,
+		operation: span.OperationName,
+		spanKind:  spanKind,
+		minute:    span.StartTime.Truncate(time.Minute).Unix(),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	counts, ok := r.counts[key]
+	if !ok {
+		counts = &spmCounts{
+			buckets: make(map[int]int64),
+			sketch:  make(map[int]int64),
+		}
+		r.counts[key] = counts
+	}
+	counts.calls++
+	if isErrorSpan(span) {
+		counts.errors++
+	}
+	counts.buckets[latencyBucket(span.Duration)]++
+	if r.sketches {
+		counts.sketch[sketchIndex(span.Duration)]++
+	}
+}
+
+func (r *spmRollup) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.flush()
+	}
+}
+
+// flush adds the counts to the rollup documents. Counts that fail to be written are dropped rather than retried, as
+// adding them again could count them twice.
+func (r *spmRollup) flush() {
+	r.mu.Lock()
+	counts := r.counts
+	r.counts = make(map[spmKey]*spmCounts)
+	r.mu.Unlock()
+
+	var failed int
+	for key, c := range counts {
+		fields := map[string]interface{}{
+			"type":           spmDocumentType,
+			"service_name":   key.service,
+			"operation_name": key.operation,
+			"span_kind":      key.spanKind,
+			"minute":         key.minute,
+		}
+		deltas := map[string]int64{
+			"calls": c.calls,
+		}
+		if c.errors > 0 {
+			deltas["errors"] = c.errors
+		}
+		for bucket, n := range c.buckets {
+			deltas["latency_buckets."+strconv.Itoa(bucket)] = n
+		}
+		for bucket, n := range c.sketch {
+			deltas["latency_sketch."+strconv.Itoa(bucket)] = n
+		}
+
+		err := r.store.AddCounters(spmKeyString(key), fields, deltas, expiryFromTTL(r.ttl))
+		if err != nil {
+			failed++
+			r.logger.Debug("failed to write rollup", "service", key.service, "operation", key.operation, "error", err)
+		}
+	}
+
+	if failed > 0 {
+		r.logger.Warn("failed to write service performance rollups", "failed", failed, "total", len(counts))
+	}
+}
+
+func spmKeyString(key spmKey) string {
+	return fmt.Sprintf("spm::%s::%s::%s::%d", keyComponent(key.service), keyComponent(key.operation), keyComponent(key.spanKind), key.minute)
+}
+
+// latencyBucket returns the index of the latency histogram bucket that the duration falls in.
+func latencyBucket(duration time.Duration) int {
+	ms := float64(duration) / float64(time.Millisecond)
+	for i, bound := range latencyBucketBounds {
+		if ms <= bound {
+			return i
+		}
+	}
+
+	return len(latencyBucketBounds)
+}
+
+// isErrorSpan reports whether the span is tagged as an error, whatever the type of the tag's value.
+func isErrorSpan(span *model.Span) bool {
+	return hasErrorTag(span.Tags)
+}
+
+func hasErrorTag(tags []model.KeyValue) bool {
+	tag, ok := model.KeyValues(tags).FindByKey(string(ext.Error))
+	if !ok {
+		return false
+	}
+
+	return tag.AsString() == "true"
+}
@@ -1,63 +1,634 @@
 package plugin
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
 	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model/adjuster"
 	"github.com/jaegertracing/jaeger/storage/dependencystore"
+	"github.com/jaegertracing/jaeger/storage/samplingstore"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
 	"github.com/pkg/errors"
+	"github.com/uber/jaeger-lib/metrics"
 	"gopkg.in/couchbase/gocb.v1"
 )
 
+const (
+	defaultScope      = "_default"
+	defaultCollection = "_default"
+
+	insertStmt = `INSERT INTO %s (KEY, VALUE, OPTIONS) VALUES (?, ?, {"expiration": ?})`
+	upsertStmt = `UPSERT INTO %s (KEY, VALUE, OPTIONS) VALUES (?, ?, {"expiration": ?})`
+	getStmt    = "SELECT RAW d FROM %s AS d USE KEYS ?"
+
+	// maximumSubdocPaths is the largest number of paths that a single sub-document operation can use.
+	maximumSubdocPaths = 16
+)
+
+// ErrDocumentNotFound occurs when a document does not exist
+var ErrDocumentNotFound = errors.New("document not found")
+
+// ErrSubdocUnsupported occurs when a sub-document operation is used with a named collection, which gocb v1 can't do
+var ErrSubdocUnsupported = errors.New("sub-document operations are not supported on named collections")
+
 type Store interface {
 	UseAnalytics(use bool)
+	UsesAnalytics() bool
+	UseCollections(scope, spanCollection, dependencyCollection string)
 	Connect(bucketName string) error
-	Query(query string, params interface{}) (Result, error)
+	Query(ctx context.Context, query string, params interface{}) (Result, error)
+	QueryPrepared(ctx context.Context, query string, params interface{}) (Result, error)
+	Search(ctx context.Context, query *gocb.SearchQuery) (gocb.SearchResults, error)
+	ViewQuery(ctx context.Context, query *gocb.ViewQuery) (Result, error)
+	UpsertDesignDocument(ddoc *gocb.DesignDocument) error
+	UsesViews() bool
+	DocumentLayout() string
+	Execute(statement string, params interface{}) error
+	ExecuteAnalytics(statement string, params interface{}) error
+	Dataset(keyspace string) (string, string)
+	AnalyticsLink() string
 	Insert(key string, value interface{}, expiry int) error
+	InsertMulti(docs []Document) []error
+	GetMulti(docs []Document) []error
+	Upsert(key string, value interface{}, expiry int) error
+	Get(key string, valuePtr interface{}) error
+	ArrayAppend(key, path string, value interface{}, expiry int) error
+	ArrayAppendMulti(key, path string, values interface{}, fields map[string]interface{}, expiry int) error
+	Increment(key, path string, expiry int) (int64, error)
+	AddCounters(key string, fields map[string]interface{}, deltas map[string]int64, expiry int) error
+	GetField(key, path string, valuePtr interface{}) error
 	Name() string
+	Keyspace() string
+	SpanKeyspaces(start, end time.Time) []string
+	DependencyKeyspace() string
 	SpanReader() spanstore.Reader
 	SpanWriter() spanstore.Writer
+	NewSpanStream() SpanStream
 	DependencyReader() dependencystore.Reader
+	SamplingStore() samplingstore.Store
+	MetricsReader() MetricsReader
+	Ping() error
+	Activity() (lastRead, lastWrite time.Time)
+	TenantStore(tenant string) (Store, error)
+	ManagePartitions() error
+	PurgeSpans(query PurgeQuery, rate, batchSize int, dryRun bool) (int, error)
+	MigrateSchema(rate, batchSize int, dryRun bool) (map[int]int, error)
 }
 
 type Result interface {
 	Next(valuePtr interface{}) bool
+	NextBytes() []byte
 	Close() error
 }
 
+// Document is a single document to be written as part of a bulk operation.
+type Document struct {
+	Key    string
+	Value  interface{}
+	Expiry int
+}
+
 type couchbaseStore struct {
-	bucket       *gocb.Bucket
-	cluster      *gocb.Cluster
-	useAnalytics bool
-	logger       hclog.Logger
+	mu                    sync.RWMutex
+	parent                *couchbaseStore
+	bucket                *gocb.Bucket
+	cluster               *gocb.Cluster
+	connStr               string
+	authenticator         func() (gocb.Authenticator, error)
+	useAnalytics          bool
+	analytics             analyticsNames
+	n1qlFallback          bool
+	allowReplicaReads     bool
+	preparedStatements    bool
+	scope                 string
+	spanCollection        string
+	dependencyCollection  string
+	spanWriter            spanstore.Writer
+	writer                *couchbaseSpanWriter
+	traceModel            bool
+	layout                string
+	tagWildcards          bool
+	tagOperators          bool
+	skipLogs              bool
+	skipProcessTags       bool
+	adjuster              adjuster.Adjuster
+	throughputTTL         time.Duration
+	maxResultBytes        int
+	maxTraces             int
+	keyStrategy           string
+	durability            string
+	scanConsistency       string
+	mutations             *mutationTokens
+	cache                 *resultCache
+	readParallelism       int
+	queryLimiter          *queryLimiter
+	tunables              *tunables
+	dependencyTimeout     time.Duration
+	adhocDependencies     bool
+	spmEnabled            bool
+	maxDependencyLookback time.Duration
+	readMetrics           *readMetrics
+	retryer               *retryer
+	tenancy               bool
+	tenants               map[string]bool
+	tenantTag             string
+	defaultTenant         string
+	tenantsMu             sync.Mutex
+	tenantStores          map[string]*couchbaseStore
+	partitions            *partitionManager
+	routes                *routes
+	search                *tagSearch
+	kvIndex               *kvIndex
+	views                 *viewIndex
+	processes             *processCache
+	errorField            *errorField
+	logger                hclog.Logger
+}
+
+func NewCouchbaseStore(options options.Options, metricsFactory metrics.Factory, logger hclog.Logger) (*couchbaseStore, error) {
+	connStr, err := connectionString(options)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticator := func() (gocb.Authenticator, error) {
+		if options.UseCertAuth {
+			return gocb.CertificateAuthenticator{}, nil
+		}
+
+		err := options.ReadCredentialFiles()
+		if err != nil {
+			return nil, err
+		}
+
+		return gocb.PasswordAuthenticator{
+			Username: options.Username,
+			Password: options.Password,
+		}, nil
+	}
+
+	var traceModel bool
+	switch options.StorageModel {
+	case "span":
+	case "trace":
+		traceModel = true
+	default:
+		return nil, errors.Errorf("unknown storage model %q", options.StorageModel)
+	}
+	if !isValidKeyStrategy(options.KeyStrategy) {
+		return nil, errors.Errorf("unknown key strategy %q", options.KeyStrategy)
+	}
+	if !isValidCompression(options.Compression) {
+		return nil, errors.Errorf("unknown compression %q", options.Compression)
+	}
+	if !isValidEncoding(options.Encoding) {
+		return nil, errors.Errorf("unknown encoding %q", options.Encoding)
+	}
+	if !isValidLayout(options.DocumentLayout) {
+		return nil, errors.Errorf("unknown document layout %q", options.DocumentLayout)
+	}
+	if !isValidOversizedPolicy(options.OversizedSpans) {
+		return nil, errors.Errorf("unknown oversized spans policy %q", options.OversizedSpans)
+	}
+	sanitizers, err := newSanitizerChain(options.Sanitizers, options.SanitizersMaxClockSkew)
+	if err != nil {
+		return nil, err
+	}
+	if !isValidScanConsistency(options.ScanConsistency) {
+		return nil, errors.Errorf("unknown scan consistency %q", options.ScanConsistency)
+	}
+	// gocb v1 only returns mutation tokens for sub-document writes, which only the trace storage model uses.
+	if options.ScanConsistency == atPlusConsistency && !traceModel {
+		return nil, errors.Errorf("scan consistency %q is only supported by the trace storage model", options.ScanConsistency)
+	}
+	if options.DownsamplingRatio <= 0 || options.DownsamplingRatio > 1 {
+		return nil, errors.Errorf("downsampling ratio %v must be in (0, 1]", options.DownsamplingRatio)
+	}
+	if options.TailFilterEnabled {
+		if options.TailFilterRatio < 0 || options.TailFilterRatio > 1 {
+			return nil, errors.Errorf("tail filter ratio %v must be in [0, 1]", options.TailFilterRatio)
+		}
+		if options.TailFilterDecisionWait <= 0 {
+			return nil, errors.New("tail filter decision wait must be positive")
+		}
+		// Tenants' spans are written straight to their own writers, which the filter doesn't wrap.
+		if options.TenancyEnabled {
+			return nil, errors.New("tail filtering is not supported with tenancy")
+		}
+	}
+	if !isValidDurability(options.Durability) {
+		return nil, errors.Errorf("unknown durability %q", options.Durability)
+	}
+	// Rollups are written with sub-document counters, which gocb v1 can't use on named collections.
+	if options.SPMEnabled && (options.TenancyEnabled || !isDefaultCollection(options.Scope, options.SpanCollection)) {
+		return nil, errors.New("service performance monitoring is not supported with collections or tenancy")
+	}
+	// Spans are written to partitions through the query service, which trace documents and tenants don't use.
+	if options.PartitioningEnabled && (traceModel || options.TenancyEnabled) {
+		return nil, errors.New("partitioning is not supported by the trace storage model or with tenancy")
+	}
+	// Spans are appended to trace documents with sub-document operations, which gocb v1 can only use on the default
+	// collection.
+	if traceModel && (options.TenancyEnabled || !isDefaultCollection(options.Scope, options.SpanCollection)) {
+		return nil, errors.New("the trace storage model is not supported with collections or tenancy")
+	}
+	// Routes are written to and read from directly, without going through trace documents, tenants or partitions.
+	if len(options.Routes) > 0 && (traceModel || options.TenancyEnabled || options.PartitioningEnabled) {
+		return nil, errors.New("routing is not supported by the trace storage model or with tenancy or partitioning")
+	}
+	// Spans in trace documents aren't indexed by the search index, and partitions each have their own collection.
+	if options.FTSTagSearch && (traceModel || options.PartitioningEnabled) {
+		return nil, errors.New("tag search is not supported by the trace storage model or with partitioning")
+	}
+	// Key-value only mode finds spans through index documents kept alongside trace documents, written with sub-document
+	// operations that gocb v1 can only use on the default collection. Everything that needs a query is unavailable.
+	if options.KVOnly {
+		if !traceModel {
+			return nil, errors.New("key-value only mode requires the trace storage model")
+		}
+		if options.TenancyEnabled || !isDefaultCollection(options.Scope, options.SpanCollection) {
+			return nil, errors.New("key-value only mode is not supported with collections or tenancy")
+		}
+		if options.SPMEnabled || options.RollupsEnabled || options.AdhocDependencies || options.DependencyAggregationInterval > 0 {
+			return nil, errors.New("key-value only mode is not supported with service performance monitoring, rollups or dependencies")
+		}
+	}
+	// Views can only index the default collection, and key-value only mode has no views service to query.
+	if options.ViewsEnabled && (options.KVOnly || options.TenancyEnabled || options.PartitioningEnabled || len(options.Routes) > 0 || !isDefaultCollection(options.Scope, options.SpanCollection)) {
+		return nil, errors.New("views are not supported with collections, tenancy, partitioning, routing or key-value only mode")
+	}
+	// Only the span queries, and the indexes behind them, understand the flat layout. Everything else that reads spans
+	// directly expects the model layout, as do payloads, which hold the fields that the flat layout spells out.
+	if options.DocumentLayout == flatLayout {
+		if traceModel || options.KVOnly || options.ViewsEnabled || options.FTSTagSearch || options.PartitioningEnabled {
+			return nil, errors.New("the flat document layout is not supported by the trace storage model or with key-value only mode, views, tag search or partitioning")
+		}
+		if options.Encoding == protobufEncoding || (options.Compression != "" && options.Compression != noCompression) || options.NormalizeProcesses {
+			return nil, errors.New("the flat document layout is not supported with protobuf encoding, compression or normalizeProcesses")
+		}
+		if options.RollupsEnabled || options.AdhocDependencies || options.DependencyAggregationInterval > 0 {
+			return nil, errors.New("the flat document layout is not supported with rollups or dependencies")
+		}
+	}
+	// Views and key-value index documents are keyed on whole tags, so only queries and the search index can match part
+	// of a tag's value or any of several tags.
+	if (options.TagsWildcards || options.TagsOperators) && (options.KVOnly || options.ViewsEnabled) {
+		return nil, errors.New("tag wildcards and operators are not supported with key-value only mode or views")
+	}
+	// Bodies are written next to span documents, which trace documents and partitions don't allow for, and hold the
+	// whole span so neither the flat layout nor normalized processes would be of use.
+	if options.SplitStorage && (traceModel || options.PartitioningEnabled || options.DocumentLayout == flatLayout || options.NormalizeProcesses) {
+		return nil, errors.New("split storage is not supported by the trace storage model or with partitioning, the flat document layout or normalizeProcesses")
+	}
+	// Normalized processes are written alongside the spans, which protobuf payloads and partitions don't allow for.
+	if options.NormalizeProcesses && (options.Encoding == protobufEncoding || options.PartitioningEnabled) {
+		return nil, errors.New("normalizeProcesses is not supported with protobuf encoding or partitioning")
+	}
+	if options.Durability != noDurability {
+		// Spans appended to trace documents and writes through the query service can't observe durability.
+		if traceModel {
+			return nil, errors.Errorf("durability %q is not supported by the trace storage model", options.Durability)
+		}
+		if options.TenancyEnabled || options.PartitioningEnabled || !isDefaultCollection(options.Scope, options.SpanCollection) {
+			return nil, errors.Errorf("durability %q is not supported with collections", options.Durability)
+		}
+	}
+	var tenants map[string]bool
+	if len(options.Tenants) > 0 {
+		tenants = make(map[string]bool)
+		for _, tenant := range options.Tenants {
+			if !isValidTenant(tenant) {
+				return nil, errors.Errorf("invalid tenant %q", tenant)
+			}
+			tenants[tenant] = true
+		}
+	}
+	if options.TenancyEnabled && options.TenancyDefaultTenant != "" {
+		if !isValidTenant(options.TenancyDefaultTenant) || (tenants != nil && !tenants[options.TenancyDefaultTenant]) {
+			return nil, errors.Errorf("default tenant %q is not an allowed tenant", options.TenancyDefaultTenant)
+		}
+	}
+	rateLimited := options.WriteRateLimitSpans > 0 || options.WriteRateLimitBytes > 0
+	var dropWhenLimited bool
+	if rateLimited {
+		switch options.WriteRateLimitPolicy {
+		case "block":
+		case "drop":
+			dropWhenLimited = true
+		default:
+			return nil, errors.Errorf("unknown write rate limit policy %q", options.WriteRateLimitPolicy)
+		}
+	}
+	var dropWhenFull bool
+	if options.AsyncWrites {
+		switch options.WriteQueueFullPolicy {
+		case "block":
+		case "drop":
+			dropWhenFull = true
+		default:
+			return nil, errors.Errorf("unknown write queue full policy %q", options.WriteQueueFullPolicy)
+		}
+	}
+
+	// The options are all checked before connecting, so that a connection isn't left open when they're invalid.
+	cluster, err := connectCluster(connStr, authenticator)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &couchbaseStore{
+		cluster:               cluster,
+		traceModel:            traceModel,
+		layout:                options.DocumentLayout,
+		tagWildcards:          options.TagsWildcards,
+		tagOperators:          options.TagsOperators,
+		skipLogs:              options.SkipLogs,
+		skipProcessTags:       options.SkipProcessTags,
+		adjuster:              traceAdjuster(options),
+		connStr:               connStr,
+		authenticator:         authenticator,
+		n1qlFallback:          options.UseN1QLFallback,
+		allowReplicaReads:     options.AllowReplicaReads,
+		preparedStatements:    options.PreparedStatements,
+		throughputTTL:         options.SamplingThroughputTTL,
+		maxResultBytes:        options.MaxResultBytes,
+		maxTraces:             options.MaxTracesPerQuery,
+		keyStrategy:           options.KeyStrategy,
+		durability:            options.Durability,
+		scanConsistency:       options.ScanConsistency,
+		cache:                 newResultCache(options.QueryCacheTTL, metricsFactory),
+		readParallelism:       options.ReadParallelism,
+		queryLimiter:          newQueryLimiter(options.MaxConcurrentQueries, options.MaxQueuedQueries, options.QueryQueueTimeout),
+		tunables:              newTunables(options),
+		dependencyTimeout:     options.DependencyQueryTimeout,
+		adhocDependencies:     options.AdhocDependencies,
+		spmEnabled:            options.SPMEnabled,
+		maxDependencyLookback: options.MaxDependencyLookback,
+		readMetrics:           newReadMetrics(metricsFactory),
+		retryer:               newRetryer(options.MaxRetries, options.RetryInitialBackoff, options.RetryMaxBackoff, metricsFactory, logger),
+		tenancy:               options.TenancyEnabled,
+		tenantTag:             options.TenancyTag,
+		defaultTenant:         options.TenancyDefaultTenant,
+		tenants:               tenants,
+		tenantStores:          make(map[string]*couchbaseStore),
+		logger:                logger,
+	}
+	store.analytics = analyticsNames{
+		dataverse:         options.AnalyticsDataverse,
+		spanDataset:       options.AnalyticsDataset,
+		dependencyDataset: options.AnalyticsDependencyDataset,
+		link:              options.AnalyticsLink,
+	}
+	if options.ScanConsistency == atPlusConsistency {
+		store.mutations = newMutationTokens()
+	}
+	if options.ViewsEnabled {
+		store.views = &viewIndex{designDocument: options.ViewsDesignDocument}
+	}
+	if options.FTSTagSearch {
+		store.search = &tagSearch{
+			indexName:     options.FTSIndexName,
+			fuzziness:     options.FTSFuzziness,
+			matchWarnings: options.FTSMatchWarnings,
+		}
+	}
+
+	tags := newTagFilter(options.TagsIndexAll, options.TagsAllow, options.TagsDeny, options.TagsMaxValueLength)
+	writeMetrics := newWriteMetrics(metricsFactory)
+	writer := &couchbaseSpanWriter{
+		store:          store,
+		spanTTL:        options.SpanTTL,
+		serviceTTL:     options.ServiceTTL,
+		traceModel:     traceModel,
+		layout:         options.DocumentLayout,
+		splitStorage:   options.SplitStorage,
+		keyStrategy:    options.KeyStrategy,
+		compression:    options.Compression,
+		encoding:       options.Encoding,
+		maxSpanSize:    options.MaxSpanSize,
+		oversizedSpans: options.OversizedSpans,
+		tags:           tags,
+		cache:          store.cache,
+		lookups:        newLookupCache(options.LookupCacheSize, options.LookupCacheTTL, options.ServiceTTL),
+		sanitizers:     sanitizers,
+		downsampler:    newDownsampler(options.DownsamplingRatio, options.DownsamplingHashSalt),
+		metrics:        writeMetrics,
+		logger:         logger,
+	}
+	if options.PartitioningEnabled {
+		store.partitions = newPartitionManager(store, options.PartitioningRetention, logger.Named("partitions"))
+		writer.partitions = store.partitions
+	}
+	// Process documents are rewritten well before they expire, since spans can't be read in full without them.
+	if options.NormalizeProcesses {
+		writer.processes = newLookupCache(options.LookupCacheSize, options.LookupCacheTTL, options.SpanTTL)
+		store.processes = newProcessCache(options.LookupCacheSize)
+	}
+	if options.SelfTracing {
+		writer.selfService = options.SelfTracingServiceName
+	}
+	if options.SPMEnabled {
+		writer.rollup = newSPMRollup(store, options.SPMTTL, options.SPMFlushInterval, options.SPMSketches, logger.Named("spm"))
+	}
+	// Spans are inserted into their partitions one at a time so they can't be batched. Batches of spans in trace
+	// documents are coalesced into an append per trace.
+	if options.WriteBatchSize > 1 && !options.PartitioningEnabled {
+		writer.batcher = newBatcher(store, traceModel, options.WriteBatchSize, options.WriteFlushInterval, writeMetrics, logger)
+	}
+	store.errorField = newErrorField(store, logger)
+	writer.errorField = store.errorField
+	store.spanWriter = writer
+	store.writer = writer
+	store.routes = store.newRoutes(options.Routes)
+	writer.routes = store.routes
+	if options.KVOnly {
+		store.kvIndex = &kvIndex{
+			store:      store,
+			spanTTL:    options.SpanTTL,
+			serviceTTL: options.ServiceTTL,
+			lookups:    writer.lookups,
+			cache:      store.cache,
+			logger:     logger.Named("kv-index"),
+		}
+		writer.kvIndex = store.kvIndex
+	}
+
+	if options.SpillDir != "" {
+		store.spanWriter, err = newSpillBuffer(writer, options.SpillDir, options.SpillMaxBytes, options.SpillReplayInterval, writeMetrics, logger.Named("spill"))
+		if err != nil {
+			cluster.Close()
+			return nil, err
+		}
+	}
+
+	if options.TailFilterEnabled {
+		store.spanWriter = newTailFilter(store.spanWriter, options.TailFilterSlowThreshold, options.TailFilterRatio, options.TailFilterDecisionWait, options.TailFilterDecisionTTL, options.TailFilterMaxBufferedSpans, writeMetrics, logger.Named("tail-filter"))
+	}
+
+	if rateLimited {
+		store.spanWriter = newRateLimiter(store.spanWriter, options.WriteRateLimitSpans, options.WriteRateLimitBytes, dropWhenLimited, writeMetrics, logger)
+	}
+
+	if options.AsyncWrites {
+		store.spanWriter = newWriteQueue(store.spanWriter, options.WriteQueueSize, options.WriteWorkers, dropWhenFull, writeMetrics, logger)
+	}
+
+	var watched []string
+	if options.UseCertAuth {
+		watched = append(watched, options.CA, options.Cert, options.Key)
+	}
+	if options.UsernameFile != "" || options.PasswordFile != "" {
+		watched = append(watched, options.UsernameFile, options.PasswordFile)
+	}
+	if len(watched) > 0 && options.ReloadInterval > 0 {
+		go watchFiles(watched, options.ReloadInterval, store.reconnect, logger)
+	}
+
+	return store, nil
 }
 
-func NewCouchbaseStore(options options.Options, logger hclog.Logger) (*couchbaseStore, error) {
-	cluster, err := gocb.Connect(options.ConnStr)
+// connectCluster connects to the cluster, fetching the authenticator each time so that credentials read from files
+// are up to date.
+func connectCluster(connStr string, authenticator func() (gocb.Authenticator, error)) (*gocb.Cluster, error) {
+	auth, err := authenticator()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read credentials")
+	}
+
+	cluster, err := gocb.Connect(connStr)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create cluster")
 	}
 
-	err = cluster.Authenticate(gocb.PasswordAuthenticator{
-		Username: options.Username,
-		Password: options.Password,
-	})
+	err = cluster.Authenticate(auth)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to authenticate")
 	}
 
-	return &couchbaseStore{
-		cluster: cluster,
-		logger:  logger,
-	}, nil
+	return cluster, nil
 }
 
 func (cs *couchbaseStore) UseAnalytics(use bool) {
 	cs.useAnalytics = use
 }
 
+func (cs *couchbaseStore) UsesAnalytics() bool {
+	return cs.useAnalytics
+}
+
+// Dataset returns the dataverse and name of the analytics dataset that shadows the keyspace.
+func (cs *couchbaseStore) Dataset(keyspace string) (string, string) {
+	dataverse, name := datasetName(keyspace)
+	if cs.analytics.dataverse != "" {
+		dataverse = cs.analytics.dataverse
+	}
+	if keyspace == cs.Keyspace() && cs.analytics.spanDataset != "" {
+		name = cs.analytics.spanDataset
+	} else if keyspace == cs.DependencyKeyspace() && cs.analytics.dependencyDataset != "" {
+		name = cs.analytics.dependencyDataset
+	}
+
+	return dataverse, name
+}
+
+// AnalyticsLink returns the name of the link that the analytics datasets are populated through.
+func (cs *couchbaseStore) AnalyticsLink() string {
+	return cs.analytics.link
+}
+
+// analyticsStatement replaces the keyspaces in the statement with their datasets. The longer keyspace is replaced
+// first as the keyspace of a bucket is the start of the keyspaces of its collections.
+func (cs *couchbaseStore) analyticsStatement(statement string) string {
+	keyspaces := []string{cs.Keyspace(), cs.DependencyKeyspace()}
+	if len(keyspaces[1]) > len(keyspaces[0]) {
+		keyspaces[0], keyspaces[1] = keyspaces[1], keyspaces[0]
+	}
+
+	var replacements []string
+	for _, keyspace := range keyspaces {
+		replacements = append(replacements, keyspace, datasetReference(cs.Dataset(keyspace)))
+	}
+
+	return strings.NewReplacer(replacements...).Replace(statement)
+}
+
+// UseCollections sets the scope and collections that spans and dependencies are stored in, empty values
+// mean the default scope or collection.
+func (cs *couchbaseStore) UseCollections(scope, spanCollection, dependencyCollection string) {
+	cs.scope = scope
+	cs.spanCollection = spanCollection
+	cs.dependencyCollection = dependencyCollection
+	if cs.routes != nil {
+		for _, rt := range cs.routes.routes {
+			routeCollection := spanCollection
+			if rt.collection != "" {
+				routeCollection = rt.collection
+			}
+			rt.store.UseCollections(scope, routeCollection, dependencyCollection)
+		}
+	}
+}
+
+// Close finishes writing the spans that have been accepted but not yet written, such as those queued or held back by
+// the tail filter. It must only be called once spans are no longer being written.
+func (cs *couchbaseStore) Close() error {
+	return closeWriter(cs.spanWriter)
+}
+
+// derive returns a store with the store's settings, connection and metrics, for a tenant, route or partition to
+// build on by setting what differs, such as its collections, cache and parent. Every such store is built from here so
+// that settings added to the store reach them too. Analytics isn't set up for their collections, so they're always
+// queried using N1QL.
+func (cs *couchbaseStore) derive(logger hclog.Logger) *couchbaseStore {
+	return &couchbaseStore{
+		cluster:               cs.cluster,
+		scope:                 cs.scope,
+		spanCollection:        cs.spanCollection,
+		dependencyCollection:  cs.dependencyCollection,
+		allowReplicaReads:     cs.allowReplicaReads,
+		preparedStatements:    cs.preparedStatements,
+		traceModel:            cs.traceModel,
+		layout:                cs.layout,
+		tagWildcards:          cs.tagWildcards,
+		tagOperators:          cs.tagOperators,
+		skipLogs:              cs.skipLogs,
+		skipProcessTags:       cs.skipProcessTags,
+		adjuster:              cs.adjuster,
+		throughputTTL:         cs.throughputTTL,
+		maxResultBytes:        cs.maxResultBytes,
+		maxTraces:             cs.maxTraces,
+		keyStrategy:           cs.keyStrategy,
+		durability:            cs.durability,
+		scanConsistency:       cs.scanConsistency,
+		mutations:             cs.mutations,
+		cache:                 cs.cache,
+		readParallelism:       cs.readParallelism,
+		queryLimiter:          cs.queryLimiter,
+		tunables:              cs.tunables,
+		dependencyTimeout:     cs.dependencyTimeout,
+		adhocDependencies:     cs.adhocDependencies,
+		spmEnabled:            cs.spmEnabled,
+		maxDependencyLookback: cs.maxDependencyLookback,
+		readMetrics:           cs.readMetrics,
+		retryer:               cs.retryer,
+		logger:                logger,
+	}
+}
+
 func (cs *couchbaseStore) Connect(bucketName string) error {
-	bucket, err := cs.cluster.OpenBucket(bucketName, "")
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	bucket, err := cs.openBucket(cs.cluster, bucketName)
 	if err != nil {
 		return err
 	}
@@ -66,47 +637,799 @@ func (cs *couchbaseStore) Connect(bucketName string) error {
 	return nil
 }
 
-func (cs *couchbaseStore) Query(queryString string, params interface{}) (Result, error) {
-	var result Result
-	var err error
+// openBucket opens the bucket, applying the write timeout to its KV operations. Reads by key, such as getting trace
+// documents, share the timeout, whereas queries and searches are given the time left before their context's deadline.
+func (cs *couchbaseStore) openBucket(cluster *gocb.Cluster, bucketName string) (*gocb.Bucket, error) {
+	bucket, err := cluster.OpenBucket(bucketName, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout := cs.tunables.writeTimeout(); timeout > 0 {
+		bucket.SetOperationTimeout(timeout)
+		bucket.SetBulkOperationTimeout(timeout)
+	}
+
+	return bucket, nil
+}
+
+// currentBucket returns the open bucket, which is replaced whenever the store reconnects. Tenant stores use their
+// parent's bucket.
+func (cs *couchbaseStore) currentBucket() *gocb.Bucket {
+	if cs.parent != nil {
+		return cs.parent.currentBucket()
+	}
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	return cs.bucket
+}
+
+// Query runs the query, abandoning it if ctx is done before all of the rows have been read.
+func (cs *couchbaseStore) Query(ctx context.Context, queryString string, params interface{}) (Result, error) {
+	return cs.query(ctx, queryString, params, true)
+}
+
+// QueryPrepared runs the query as a prepared statement when using N1QL. gocb caches the prepared plan against the
+// statement, and each statement is a single query shape, so a query is only planned the first time that it's run.
+func (cs *couchbaseStore) QueryPrepared(ctx context.Context, queryString string, params interface{}) (Result, error) {
+	return cs.query(ctx, queryString, params, !cs.preparedStatements)
+}
+
+func (cs *couchbaseStore) query(ctx context.Context, queryString string, params interface{}, adhoc bool) (Result, error) {
+	// gocb v1 can't cancel a request that is in flight, so the best we can do is not start work for a context that
+	// is already done and have the server give up at the context's deadline.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	deadline, hasDeadline := ctx.Deadline()
+
+	release, err := cs.queryLimiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	component := "n1ql"
 	if cs.useAnalytics {
-		query := gocb.NewAnalyticsQuery(queryString)
-		result, err = cs.bucket.ExecuteAnalyticsQuery(query, params)
-	} else {
-		query := gocb.NewN1qlQuery(queryString)
-		result, err = cs.bucket.ExecuteN1qlQuery(query, params)
+		component = "analytics"
 	}
+	span, _ := opentracing.StartSpanFromContext(ctx, "query")
+	defer span.Finish()
+	ext.DBStatement.Set(span, queryString)
+	ext.DBType.Set(span, "couchbase")
+	ext.Component.Set(span, component)
+
+	start := time.Now()
+	var result Result
+	err = cs.retryer.do(ctx, "query", func() error {
+		var err error
+		if cs.useAnalytics {
+			query := cs.withAnalyticsConsistency(gocb.NewAnalyticsQuery(cs.analyticsStatement(queryString)))
+			if hasDeadline {
+				query.ServerSideTimeout(timeoutUntil(deadline))
+			}
+			result, err = cs.currentBucket().ExecuteAnalyticsQuery(query, params)
+			if err != nil && cs.n1qlFallback && isAnalyticsUnavailable(err) && ctx.Err() == nil {
+				cs.readMetrics.analyticsFallbacks.Inc(1)
+				cs.logger.Warn("analytics query failed, retrying with N1QL", "error", err)
+				result, err = cs.currentBucket().ExecuteN1qlQuery(cs.n1qlQuery(queryString, adhoc, deadline, hasDeadline), params)
+			}
+		} else {
+			result, err = cs.currentBucket().ExecuteN1qlQuery(cs.n1qlQuery(queryString, adhoc, deadline, hasDeadline), params)
+		}
+
+		return err
+	})
 	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogFields(otlog.Error(err))
+		release()
 		return nil, err
 	}
+	raw := result
+	result = &limitedResult{
+		Result: &statsResult{
+			Result:  result,
+			query:   queryName(ctx),
+			metrics: cs.readMetrics,
+		},
+		release: release,
+	}
+
+	if threshold := cs.tunables.slowQueryThreshold(); threshold > 0 {
+		result = &slowQueryResult{
+			Result:    result,
+			raw:       raw,
+			statement: queryString,
+			params:    params,
+			start:     start,
+			threshold: threshold,
+			logger:    cs.logger,
+		}
+	}
+
+	if ctx.Done() != nil {
+		result = &contextResult{
+			Result: result,
+			ctx:    ctx,
+		}
+	}
 
 	return result, nil
 }
 
+// Search runs the query against the search service, which gives up at the context's deadline.
+func (cs *couchbaseStore) Search(ctx context.Context, query *gocb.SearchQuery) (gocb.SearchResults, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		query.Timeout(timeoutUntil(deadline))
+	}
+
+	release, err := cs.queryLimiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var results gocb.SearchResults
+	err = cs.retryer.do(ctx, "search", func() error {
+		var err error
+		results, err = cs.currentBucket().ExecuteSearchQuery(query)
+		return err
+	})
+
+	return results, err
+}
+
+// ViewQuery runs the query against a view of the bucket, which gives up at the context's deadline.
+func (cs *couchbaseStore) ViewQuery(ctx context.Context, query *gocb.ViewQuery) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		query.Custom("connection_timeout", strconv.FormatInt(int64(timeoutUntil(deadline)/time.Millisecond), 10))
+	}
+
+	release, err := cs.queryLimiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var results gocb.ViewResults
+	err = cs.retryer.do(ctx, "view", func() error {
+		var err error
+		results, err = cs.currentBucket().ExecuteViewQuery(query)
+		return err
+	})
+
+	return results, err
+}
+
+// UpsertDesignDocument creates or replaces the design document. Design documents are managed over the views REST
+// API, which takes the same credentials as the bucket.
+func (cs *couchbaseStore) UpsertDesignDocument(ddoc *gocb.DesignDocument) error {
+	auth, err := cs.authenticator()
+	if err != nil {
+		return errors.Wrap(err, "failed to read credentials")
+	}
+
+	var username, password string
+	if creds, ok := auth.(gocb.PasswordAuthenticator); ok {
+		username, password = creds.Username, creds.Password
+	}
+
+	return cs.currentBucket().Manager(username, password).UpsertDesignDocument(ddoc)
+}
+
+// UsesViews reports whether services, operations and trace IDs are read from views.
+func (cs *couchbaseStore) UsesViews() bool {
+	return cs.views != nil
+}
+
+// DocumentLayout returns the layout that span documents are stored in.
+func (cs *couchbaseStore) DocumentLayout() string {
+	return cs.layout
+}
+
+func (cs *couchbaseStore) n1qlQuery(statement string, adhoc bool, deadline time.Time, hasDeadline bool) *gocb.N1qlQuery {
+	query := cs.withN1QLConsistency(gocb.NewN1qlQuery(statement).AdHoc(adhoc))
+	if hasDeadline {
+		query.Timeout(timeoutUntil(deadline))
+	}
+
+	return query
+}
+
 func (cs *couchbaseStore) Insert(key string, value interface{}, expiry int) error {
-	_, err := cs.bucket.Insert(key, value, 0)
+	return cs.retryer.do(context.Background(), "insert", func() error {
+		return cs.insert(key, value, expiry)
+	})
+}
+
+func (cs *couchbaseStore) insert(key string, value interface{}, expiry int) error {
+	// gocb v1 has no KV API for named collections so those inserts have to go through the query service.
+	if !isDefaultCollection(cs.scope, cs.spanCollection) {
+		return cs.execute(fmt.Sprintf(insertStmt, cs.Keyspace()), []interface{}{key, value, expiry}, cs.tunables.writeTimeout())
+	}
+
+	if cs.isDurable() {
+		replicateTo, persistTo := cs.durabilityRequirements()
+		_, err := cs.currentBucket().InsertDura(key, value, uint32(expiry), replicateTo, persistTo)
+
+		return err
+	}
+
+	_, err := cs.currentBucket().Insert(key, value, uint32(expiry))
+
+	return err
+}
+
+func (cs *couchbaseStore) Upsert(key string, value interface{}, expiry int) error {
+	return cs.retryer.do(context.Background(), "upsert", func() error {
+		return cs.upsert(key, value, expiry)
+	})
+}
+
+func (cs *couchbaseStore) upsert(key string, value interface{}, expiry int) error {
+	if !isDefaultCollection(cs.scope, cs.spanCollection) {
+		return cs.execute(fmt.Sprintf(upsertStmt, cs.Keyspace()), []interface{}{key, value, expiry}, cs.tunables.writeTimeout())
+	}
+
+	if cs.isDurable() {
+		replicateTo, persistTo := cs.durabilityRequirements()
+		_, err := cs.currentBucket().UpsertDura(key, value, uint32(expiry), replicateTo, persistTo)
+
+		return err
+	}
+
+	_, err := cs.currentBucket().Upsert(key, value, uint32(expiry))
+
+	return err
+}
+
+// Get fetches a document into valuePtr, returning ErrDocumentNotFound if the document does not exist.
+func (cs *couchbaseStore) Get(key string, valuePtr interface{}) error {
+	return cs.retryer.do(context.Background(), "get", func() error {
+		return cs.get(key, valuePtr)
+	})
+}
+
+func (cs *couchbaseStore) get(key string, valuePtr interface{}) error {
+	if !isDefaultCollection(cs.scope, cs.spanCollection) {
+		query := gocb.NewN1qlQuery(fmt.Sprintf(getStmt, cs.Keyspace()))
+		result, err := cs.currentBucket().ExecuteN1qlQuery(query, []interface{}{key})
+		if err != nil {
+			return err
+		}
+
+		found := result.Next(valuePtr)
+		if err = result.Close(); err != nil {
+			return err
+		}
+		if !found {
+			return ErrDocumentNotFound
+		}
+
+		return nil
+	}
+
+	_, err := cs.currentBucket().Get(key, valuePtr)
+	if cs.allowReplicaReads && isUnreachable(err) {
+		err = cs.getReplica(key, valuePtr, err)
+	}
+	if gocb.IsKeyNotFoundError(err) {
+		return ErrDocumentNotFound
+	}
+
+	return err
+}
+
+// getReplica fetches a document from the first replica that has it after the active node couldn't be reached,
+// returning activeErr if there are no replicas.
+func (cs *couchbaseStore) getReplica(key string, valuePtr interface{}, activeErr error) error {
+	bucket := cs.currentBucket()
+	replicas := bucket.IoRouter().NumReplicas()
+	if replicas == 0 {
+		return activeErr
+	}
+
+	// A replica that hasn't caught up with the active node may not have the document yet whilst another does.
+	var err error
+	for i := 1; i <= replicas; i++ {
+		_, err = bucket.GetReplica(key, valuePtr, i)
+		if err == nil {
+			cs.readMetrics.replicaReads.Inc(1)
+			return nil
+		}
+	}
+
+	return err
+}
+
+// ArrayAppend appends the value to the array at path within the document, creating the document and the array if
+// they don't exist.
+func (cs *couchbaseStore) ArrayAppend(key, path string, value interface{}, expiry int) error {
+	if !isDefaultCollection(cs.scope, cs.spanCollection) {
+		return ErrSubdocUnsupported
+	}
+
+	return cs.retryer.do(context.Background(), "array_append", func() error {
+		frag, err := cs.currentBucket().MutateInEx(key, gocb.SubdocDocFlagMkDoc, 0, uint32(expiry)).
+			ArrayAppendEx(path, value, gocb.SubdocFlagCreatePath).
+			Execute()
+		if err != nil {
+			return err
+		}
+		cs.recordMutation(frag)
+
+		return nil
+	})
+}
+
+// ArrayAppendMulti appends each of the values, which must be a slice, to the array at path within the document and
+// sets the fields in a single mutation, creating the document and the array if they don't exist.
+func (cs *couchbaseStore) ArrayAppendMulti(key, path string, values interface{}, fields map[string]interface{}, expiry int) error {
+	if !isDefaultCollection(cs.scope, cs.spanCollection) {
+		return ErrSubdocUnsupported
+	}
+
+	return cs.retryer.do(context.Background(), "array_append", func() error {
+		builder := cs.currentBucket().MutateInEx(key, gocb.SubdocDocFlagMkDoc, 0, uint32(expiry)).
+			ArrayAppendMultiEx(path, values, gocb.SubdocFlagCreatePath)
+		for field, value := range fields {
+			builder.UpsertEx(field, value, gocb.SubdocFlagNone)
+		}
+		frag, err := builder.Execute()
+		if err != nil {
+			return err
+		}
+		cs.recordMutation(frag)
+
+		return nil
+	})
+}
+
+// Increment adds one to the counter at path within the document, creating the document and the counter if they
+// don't exist, and returns the new value.
+func (cs *couchbaseStore) Increment(key, path string, expiry int) (int64, error) {
+	if !isDefaultCollection(cs.scope, cs.spanCollection) {
+		return 0, ErrSubdocUnsupported
+	}
+
+	var value int64
+	err := cs.retryer.do(context.Background(), "increment", func() error {
+		frag, err := cs.currentBucket().MutateInEx(key, gocb.SubdocDocFlagMkDoc, 0, uint32(expiry)).
+			CounterEx(path, 1, gocb.SubdocFlagCreatePath).
+			Execute()
+		if err != nil {
+			return err
+		}
+		cs.recordMutation(frag)
+
+		return frag.ContentByIndex(0, &value)
+	})
+
+	return value, err
+}
+
+// AddCounters sets the fields of the document and adds the deltas to the counters at their paths, creating the
+// document, the fields and the counters if they don't exist.
+func (cs *couchbaseStore) AddCounters(key string, fields map[string]interface{}, deltas map[string]int64, expiry int) error {
+	if !isDefaultCollection(cs.scope, cs.spanCollection) {
+		return ErrSubdocUnsupported
+	}
+
+	// A sub-document mutation can change at most 16 paths, so larger changes are split across several mutations.
+	var mutations [][]func(*gocb.MutateInBuilder)
+	var mutation []func(*gocb.MutateInBuilder)
+	add := func(op func(*gocb.MutateInBuilder)) {
+		if len(mutation) == maximumSubdocPaths {
+			mutations = append(mutations, mutation)
+			mutation = nil
+		}
+		mutation = append(mutation, op)
+	}
+	for path, value := range fields {
+		path, value := path, value
+		add(func(b *gocb.MutateInBuilder) {
+			b.UpsertEx(path, value, gocb.SubdocFlagCreatePath)
+		})
+	}
+	for path, delta := range deltas {
+		path, delta := path, delta
+		add(func(b *gocb.MutateInBuilder) {
+			b.CounterEx(path, delta, gocb.SubdocFlagCreatePath)
+		})
+	}
+	if len(mutation) > 0 {
+		mutations = append(mutations, mutation)
+	}
+
+	for _, ops := range mutations {
+		ops := ops
+		err := cs.retryer.do(context.Background(), "increment", func() error {
+			builder := cs.currentBucket().MutateInEx(key, gocb.SubdocDocFlagMkDoc, 0, uint32(expiry))
+			for _, op := range ops {
+				op(builder)
+			}
+
+			frag, err := builder.Execute()
+			if err != nil {
+				return err
+			}
+			cs.recordMutation(frag)
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetField fetches the value at path within the document into valuePtr, returning ErrDocumentNotFound if the
+// document does not exist.
+func (cs *couchbaseStore) GetField(key, path string, valuePtr interface{}) error {
+	if !isDefaultCollection(cs.scope, cs.spanCollection) {
+		return ErrSubdocUnsupported
+	}
+
+	return cs.retryer.do(context.Background(), "get", func() error {
+		frag, err := cs.currentBucket().LookupIn(key).Get(path).Execute()
+		if gocb.IsKeyNotFoundError(err) {
+			return ErrDocumentNotFound
+		}
+		// A failed lookup is reported as a multi path failure, the reason is returned by ContentByIndex.
+		if err != nil && errors.Cause(err) != gocb.ErrSubDocBadMulti {
+			return err
+		}
+
+		return frag.ContentByIndex(0, valuePtr)
+	})
+}
+
+// Execute runs a N1QL statement that returns no rows, regardless of whether analytics is in use.
+func (cs *couchbaseStore) Execute(statement string, params interface{}) error {
+	return cs.execute(statement, params, 0)
+}
+
+// execute runs a N1QL statement that returns no rows, a timeout of zero uses the SDK's default timeout.
+func (cs *couchbaseStore) execute(statement string, params interface{}, timeout time.Duration) error {
+	start := time.Now()
+	query := gocb.NewN1qlQuery(statement)
+	if timeout > 0 {
+		query.Timeout(timeout)
+	}
+	result, err := cs.currentBucket().ExecuteN1qlQuery(query, params)
+	if err != nil {
+		return err
+	}
+
+	err = result.Close()
+	if stats, ok := resultStats(result); ok {
+		stats.query = unnamedQuery
+		cs.readMetrics.recordStats(stats)
+	}
+	logSlowQuery(cs.logger, cs.tunables.slowQueryThreshold(), statement, params, start, result)
 
 	return err
 }
 
+// ExecuteAnalytics runs an analytics statement that returns no rows.
+func (cs *couchbaseStore) ExecuteAnalytics(statement string, params interface{}) error {
+	start := time.Now()
+	query := gocb.NewAnalyticsQuery(statement)
+	result, err := cs.currentBucket().ExecuteAnalyticsQuery(query, params)
+	if err != nil {
+		return err
+	}
+
+	err = result.Close()
+	if stats, ok := resultStats(result); ok {
+		stats.query = unnamedQuery
+		cs.readMetrics.recordStats(stats)
+	}
+	logSlowQuery(cs.logger, cs.tunables.slowQueryThreshold(), statement, params, start, result)
+
+	return err
+}
+
+// InsertMulti inserts the documents using a single bulk operation, returning an error for each document.
+func (cs *couchbaseStore) InsertMulti(docs []Document) []error {
+	return cs.retryMulti("insert_multi", docs, cs.insertMulti)
+}
+
+// GetMulti fetches the documents using a single bulk operation into the pointers held in their values, returning an
+// error for each document. Documents that don't exist fail with ErrDocumentNotFound.
+func (cs *couchbaseStore) GetMulti(docs []Document) []error {
+	return cs.retryMulti("get_multi", docs, cs.getMulti)
+}
+
+// retryMulti runs the bulk operation, retrying the documents which failed with a temporary error.
+func (cs *couchbaseStore) retryMulti(op string, docs []Document, fn func([]Document) []error) []error {
+	errs := fn(docs)
+	for attempt := 0; attempt < cs.retryer.maxRetries; attempt++ {
+		// Only the documents which failed with a temporary error are retried.
+		var retry []int
+		for i, err := range errs {
+			if isRetryable(err) {
+				retry = append(retry, i)
+			}
+		}
+		if len(retry) == 0 || !cs.retryer.wait(context.Background(), attempt) {
+			break
+		}
+
+		retryDocs := make([]Document, len(retry))
+		for j, i := range retry {
+			retryDocs[j] = docs[i]
+		}
+		cs.retryer.retries[op].Inc(int64(len(retry)))
+
+		retryErrs := fn(retryDocs)
+		for j, i := range retry {
+			errs[i] = retryErrs[j]
+		}
+	}
+
+	return errs
+}
+
+func (cs *couchbaseStore) insertMulti(docs []Document) []error {
+	errs := make([]error, len(docs))
+	// Bulk operations can't wait for durability, so durable writes are made one at a time.
+	if !isDefaultCollection(cs.scope, cs.spanCollection) || cs.isDurable() {
+		for i, doc := range docs {
+			errs[i] = cs.insert(doc.Key, doc.Value, doc.Expiry)
+		}
+
+		return errs
+	}
+
+	ops := make([]gocb.BulkOp, len(docs))
+	for i, doc := range docs {
+		ops[i] = &gocb.InsertOp{
+			Key:    doc.Key,
+			Value:  doc.Value,
+			Expiry: uint32(doc.Expiry),
+		}
+	}
+
+	err := cs.currentBucket().Do(ops)
+	for i, op := range ops {
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		errs[i] = op.(*gocb.InsertOp).Err
+	}
+
+	return errs
+}
+
+func (cs *couchbaseStore) getMulti(docs []Document) []error {
+	errs := make([]error, len(docs))
+	if !isDefaultCollection(cs.scope, cs.spanCollection) {
+		for i, doc := range docs {
+			errs[i] = cs.get(doc.Key, doc.Value)
+		}
+
+		return errs
+	}
+
+	ops := make([]gocb.BulkOp, len(docs))
+	for i, doc := range docs {
+		ops[i] = &gocb.GetOp{
+			Key:   doc.Key,
+			Value: doc.Value,
+		}
+	}
+
+	err := cs.currentBucket().Do(ops)
+	for i, op := range ops {
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		errs[i] = op.(*gocb.GetOp).Err
+		if cs.allowReplicaReads && isUnreachable(errs[i]) {
+			errs[i] = cs.getReplica(docs[i].Key, docs[i].Value, errs[i])
+		}
+		if gocb.IsKeyNotFoundError(errs[i]) {
+			errs[i] = ErrDocumentNotFound
+		}
+	}
+
+	return errs
+}
+
 func (cs *couchbaseStore) Name() string {
-	return cs.bucket.Name()
+	return cs.currentBucket().Name()
+}
+
+// Keyspace returns the keyspace used for span queries.
+func (cs *couchbaseStore) Keyspace() string {
+	return keyspace(cs.currentBucket().Name(), cs.scope, cs.spanCollection)
+}
+
+// DependencyKeyspace returns the keyspace used for dependency queries.
+func (cs *couchbaseStore) DependencyKeyspace() string {
+	return keyspace(cs.currentBucket().Name(), cs.scope, cs.dependencyCollection)
 }
 
 func (cs *couchbaseStore) SpanReader() spanstore.Reader {
+	if cs.tenancy {
+		return &tenantSpanReader{store: cs}
+	}
+	if cs.routes != nil {
+		return &routedSpanReader{store: cs}
+	}
+
+	return cs.spanReader()
+}
+
+func (cs *couchbaseStore) spanReader() *couchbaseSpanReader {
 	return &couchbaseSpanReader{
-		store: cs,
+		store:           cs,
+		maxResultBytes:  cs.maxResultBytes,
+		maxTraces:       cs.maxTraces,
+		keyStrategy:     cs.keyStrategy,
+		cache:           cs.cache,
+		readParallelism: cs.readParallelism,
+		traceModel:      cs.traceModel,
+		layout:          cs.layout,
+		tagWildcards:    cs.tagWildcards,
+		tagOperators:    cs.tagOperators,
+		skipLogs:        cs.skipLogs,
+		skipProcessTags: cs.skipProcessTags,
+		adjuster:        cs.adjuster,
+		partitions:      cs.partitions,
+		search:          cs.search,
+		kvIndex:         cs.kvIndex,
+		views:           cs.views,
+		processes:       cs.processes,
+		errorField:      cs.errorField,
+		timeout:         cs.tunables.readTimeout(),
+		metrics:         cs.readMetrics,
+		logger:          cs.logger,
 	}
 }
 
 func (cs *couchbaseStore) SpanWriter() spanstore.Writer {
-	return &couchbaseSpanWriter{
-		store: cs,
+	if cs.tenancy {
+		return &tenantSpanWriter{store: cs}
+	}
+
+	return cs.spanWriter
+}
+
+// NewSpanStream returns a stream for writing the spans received over a single streaming write call. Streams bypass
+// the async write queue so that their results can be reported when the stream is closed. Streams have no way to
+// carry a tenant so they reject every span when tenancy is enabled.
+func (cs *couchbaseStore) NewSpanStream() SpanStream {
+	if cs.tenancy {
+		return &spanStream{}
+	}
+
+	return &spanStream{
+		writer: cs.writer,
+	}
+}
+
+func (cs *couchbaseStore) SamplingStore() samplingstore.Store {
+	return &couchbaseSamplingStore{
+		store:         cs,
+		throughputTTL: cs.throughputTTL,
+	}
+}
+
+// MetricsReader returns the reader for service performance monitoring, or nil if rollups aren't kept.
+func (cs *couchbaseStore) MetricsReader() MetricsReader {
+	if !cs.spmEnabled {
+		return nil
+	}
+
+	return &couchbaseMetricsReader{
+		store:   cs,
+		timeout: cs.tunables.readTimeout(),
+		metrics: cs.readMetrics,
+		logger:  cs.logger,
 	}
 }
 
 func (cs *couchbaseStore) DependencyReader() dependencystore.Reader {
+	if cs.tenancy {
+		return &tenantDependencyReader{store: cs}
+	}
+
+	return cs.dependencyReader()
+}
+
+func (cs *couchbaseStore) dependencyReader() *couchbaseDependencyReader {
 	return &couchbaseDependencyReader{
-		store: cs,
+		store:       cs,
+		timeout:     cs.dependencyTimeout,
+		adhoc:       cs.adhocDependencies,
+		maxLookback: cs.maxDependencyLookback,
+		traceModel:  cs.traceModel,
+		kvOnly:      cs.kvIndex != nil,
+		cache:       cs.cache,
+		metrics:     cs.readMetrics,
+		logger:      cs.logger,
+	}
+}
+
+// isAnalyticsUnavailable reports whether an analytics query failed because the service timed out or could not be
+// reached, rather than because of a problem with the query itself.
+func isAnalyticsUnavailable(err error) bool {
+	if errors.Cause(err) == gocb.ErrTimeout {
+		return true
+	}
+
+	// gocb doesn't expose analytics error codes so we have to fall back to matching on the message.
+	msg := strings.ToLower(err.Error())
+	for _, reason := range []string{"timeout", "timed out", "unavailable", "connection refused", "no available"} {
+		if strings.Contains(msg, reason) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isDefaultCollection(scope, collection string) bool {
+	return (scope == "" || scope == defaultScope) && (collection == "" || collection == defaultCollection)
+}
+
+// keyspace builds a query keyspace for the given collection, falling back to the bucket itself for
+// the default collection so that queries still work against clusters without collections support.
+func keyspace(bucketName, scope, collection string) string {
+	if isDefaultCollection(scope, collection) {
+		return QuoteIdentifier(bucketName)
+	}
+	if scope == "" {
+		scope = defaultScope
 	}
+	if collection == "" {
+		collection = defaultCollection
+	}
+
+	return QuoteIdentifier(bucketName) + "." + QuoteIdentifier(scope) + "." + QuoteIdentifier(collection)
+}
+
+// QuoteIdentifier escapes a name for use as an identifier in N1QL and analytics statements. Names come from the
+// configuration and the cluster rather than from requests, but are still escaped so that a name containing a
+// backtick can't change the statement. Values are always passed as parameters instead.
+func QuoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// splitKeyspace returns the unescaped names making up a keyspace built by keyspace.
+func splitKeyspace(keyspace string) []string {
+	var names []string
+	var name strings.Builder
+	quoted := false
+	for i := 0; i < len(keyspace); i++ {
+		c := keyspace[i]
+		switch {
+		case c == '`' && quoted && i+1 < len(keyspace) && keyspace[i+1] == '`':
+			name.WriteByte('`')
+			i++
+		case c == '`':
+			quoted = !quoted
+		case c == '.' && !quoted:
+			names = append(names, name.String())
+			name.Reset()
+		default:
+			name.WriteByte(c)
+		}
+	}
+
+	return append(names, name.String())
 }
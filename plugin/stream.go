@@ -0,0 +1,97 @@
+package plugin
+
+import (
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/pkg/errors"
+)
+
+// SpanStream writes a run of spans in batches, the results of the writes are only known once the stream is closed.
+// Jaeger 1.12 collectors can't stream spans to the plugin, so streams are used by the subcommands that write spans in
+// bulk.
+type SpanStream interface {
+	WriteSpan(span *model.Span) error
+	Close() error
+}
+
+// pendingSpan is a span in a stream which is waiting for its batch to be flushed.
+type pendingSpan struct {
+	span  Span
+	start time.Time
+	errCh <-chan error
+}
+
+// spanStream adds each span in the stream to the writer's batcher without waiting for it to be written, closing the
+// stream flushes the batch and waits for all of the stream's spans. Without a batcher spans are written as they
+// arrive.
+type spanStream struct {
+	writer  *couchbaseSpanWriter
+	pending []pendingSpan
+}
+
+func (s *spanStream) WriteSpan(span *model.Span) error {
+	if s.writer == nil {
+		return ErrMissingTenant
+	}
+	s.writer.sanitizers.sanitize(span)
+	if !s.writer.keep(span) {
+		return nil
+	}
+	// Routed spans aren't batched, and spans indexed for key-value only mode are indexed as they're written.
+	if s.writer.batcher == nil || s.writer.kvIndex != nil || s.writer.routes.storeFor(span.Process.ServiceName) != nil {
+		return s.writer.WriteSpan(span)
+	}
+
+	dbSpan, doc, err := s.writer.toDocument(span)
+	if err != nil {
+		return err
+	}
+	err = s.writer.writeReferenced(span, &dbSpan, &doc)
+	if err != nil {
+		return err
+	}
+	s.pending = append(s.pending, pendingSpan{
+		span:  dbSpan,
+		start: time.Now(),
+		errCh: s.writer.batcher.enqueue(doc),
+	})
+
+	return nil
+}
+
+// Close flushes the stream's spans and waits for them to be written, returning an error if any of them failed.
+func (s *spanStream) Close() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	s.writer.batcher.Flush()
+
+	var failed int
+	var firstErr error
+	for _, pending := range s.pending {
+		err := <-pending.errCh
+		if err != nil && s.writer.isDuplicate(err) {
+			err = nil
+		}
+		if err == nil {
+			err = s.writer.writeLookups(pending.span)
+		}
+		s.writer.metrics.record(pending.start, err)
+		if err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	total := len(s.pending)
+	s.pending = nil
+
+	if failed > 0 {
+		s.writer.logger.Warn("failed to write spans in stream", "failed", failed, "size", total)
+		return errors.Wrapf(firstErr, "failed to write %d of %d spans", failed, total)
+	}
+
+	return nil
+}
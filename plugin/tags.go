@@ -0,0 +1,204 @@
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// tagFilter decides which tags are written to a span's searchable tags, all tags are always kept in the span itself.
+type tagFilter struct {
+	indexAll       bool
+	allow          map[string]bool
+	deny           map[string]bool
+	maxValueLength int
+}
+
+// newTagFilter creates a filter that indexes every tag not in deny when indexAll is set, or only the tags in allow
+// otherwise. Tags with values longer than maxValueLength are never indexed.
+func newTagFilter(indexAll bool, allow, deny []string, maxValueLength int) *tagFilter {
+	return &tagFilter{
+		indexAll:       indexAll,
+		allow:          toSet(allow),
+		deny:           toSet(deny),
+		maxValueLength: maxValueLength,
+	}
+}
+
+// indexed reports whether the tag should be searchable.
+func (f *tagFilter) indexed(tag TagInsertion) bool {
+	if f.maxValueLength > 0 && len(tag.TagValue) > f.maxValueLength {
+		return false
+	}
+	if f.deny[tag.TagKey] {
+		return false
+	}
+
+	return f.indexAll || f.allow[tag.TagKey]
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+
+	return set
+}
+
+// isErrorSearch reports whether a search is only for failed spans, which the error queries answer from the small
+// indexes over failed spans rather than matching searchable tags.
+func isErrorSearch(tags map[string]string) bool {
+	if len(tags) != 1 {
+		return false
+	}
+	value, ok := tags["error"]
+
+	return ok && strings.EqualFold(value, "true")
+}
+
+// orTagKey is the tag that holds an explicit OR group in a query when tag operators are enabled.
+const orTagKey = "__or__"
+
+// tagTerm is a tag that a span can have to match a query.
+type tagTerm struct {
+	key   string
+	value string
+}
+
+// tagGroups splits the tags in a query into groups, a span matching when it has any of the tags in every group.
+// Without operators each tag is a group of its own. With operators a value holding | matches any of the values that it
+// separates, e.g. http.status_code=500|503, and the __or__ tag holds space separated key=value pairs that match when
+// any of them does, e.g. __or__="error=true http.status_code=500".
+func tagGroups(tags map[string]string, operators bool) ([][]tagTerm, error) {
+	groups := make([][]tagTerm, 0, len(tags))
+	for key, value := range tags {
+		if !operators {
+			groups = append(groups, []tagTerm{{key: key, value: value}})
+			continue
+		}
+		if key != orTagKey {
+			groups = append(groups, orTerms(key, value))
+			continue
+		}
+
+		var group []tagTerm
+		for _, pair := range strings.Fields(value) {
+			i := strings.Index(pair, "=")
+			if i <= 0 {
+				return nil, errors.Errorf("the %s tag must hold key=value pairs, %q is not one", orTagKey, pair)
+			}
+			group = append(group, orTerms(pair[:i], pair[i+1:])...)
+		}
+		if len(group) == 0 {
+			return nil, errors.Errorf("the %s tag must hold at least one key=value pair", orTagKey)
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
+// orTerms returns a term for each of the values separated by | in the value.
+func orTerms(key, value string) []tagTerm {
+	values := strings.Split(value, "|")
+	terms := make([]tagTerm, len(values))
+	for i, v := range values {
+		terms[i] = tagTerm{key: key, value: v}
+	}
+
+	return terms
+}
+
+// tagPredicates builds the searchable tags that match each group of tags in a query. Searchable tags hold the string
+// form of the tag's value whatever its type, so as well as the value as given each tag matches the canonical string
+// forms of the number or boolean that the value parses as, e.g. http.status_code=500.0 matches the integer tag 500.
+// When wildcards are enabled, groups holding a value with a * are returned as patterns instead, see pattern. Neither
+// list is ever nil so that queries always have an array to test against.
+func tagPredicates(groups [][]tagTerm, wildcards bool) ([][]string, [][]string) {
+	predicates := make([][]string, 0, len(groups))
+	patterns := [][]string{}
+	for _, group := range groups {
+		var alternatives []string
+		if wildcards && hasWildcard(group) {
+			for _, term := range group {
+				alternatives = append(alternatives, term.pattern())
+			}
+			patterns = append(patterns, alternatives)
+			continue
+		}
+
+		for _, term := range group {
+			for _, v := range tagValueForms(term.value) {
+				alternatives = append(alternatives, fmt.Sprintf("%s_%s", term.key, v))
+			}
+		}
+		predicates = append(predicates, alternatives)
+	}
+
+	return predicates, patterns
+}
+
+func hasWildcard(group []tagTerm) bool {
+	for _, term := range group {
+		if strings.Contains(term.value, "*") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pattern returns a regular expression matching the term's searchable tag, which must match as a whole. A * in the
+// value matches any run of characters, so http.url=/checkout* is a prefix search and http.url=*checkout* a substring
+// search. Values without a * match any of their forms, as they do in predicates.
+func (t tagTerm) pattern() string {
+	var value string
+	if strings.Contains(t.value, "*") {
+		parts := strings.Split(t.value, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		value = strings.Join(parts, ".*")
+	} else {
+		forms := tagValueForms(t.value)
+		for i, form := range forms {
+			forms[i] = regexp.QuoteMeta(form)
+		}
+		value = "(" + strings.Join(forms, "|") + ")"
+	}
+
+	return regexp.QuoteMeta(t.key+"_") + value
+}
+
+// tagValueForms returns the value along with the forms that Jaeger stringifies typed tags with.
+func tagValueForms(value string) []string {
+	forms := []string{value}
+	add := func(form string) {
+		for _, f := range forms {
+			if f == form {
+				return
+			}
+		}
+		forms = append(forms, form)
+	}
+
+	// Only true and false are treated as booleans, so that 1 and 0 don't match boolean tags.
+	if strings.EqualFold(value, "true") || strings.EqualFold(value, "false") {
+		add(strings.ToLower(value))
+	}
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		add(strconv.FormatInt(i, 10))
+		add(strconv.FormatFloat(float64(i), 'g', 10, 64))
+	} else if f, err := strconv.ParseFloat(value, 64); err == nil {
+		add(strconv.FormatFloat(f, 'g', 10, 64))
+		if f == float64(int64(f)) {
+			add(strconv.FormatInt(int64(f), 10))
+		}
+	}
+
+	return forms
+}
@@ -0,0 +1,202 @@
+package plugin
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// tailFilter holds back the spans of each trace until the trace is known to be worth keeping, giving tail based
+// sampling at the storage layer. A trace is kept as soon as one of its spans is tagged as an error or takes at least
+// the slow threshold, at which point its held spans are written. Traces that are still undecided once the decision
+// wait has passed are kept in proportion to the ratio and their held spans written or dropped. Decisions are
+// remembered for the decision TTL so that late spans follow their trace. Spans still held when the filter is closed were
+// already reported as written, so they're all written then.
+type tailFilter struct {
+	writer        spanstore.Writer
+	slowThreshold time.Duration
+	sampler       *downsampler
+	decisionWait  time.Duration
+	decisionTTL   time.Duration
+	maxBuffered   int
+	metrics       *writeMetrics
+	logger        hclog.Logger
+	done          chan struct{}
+
+	mu       sync.Mutex
+	traces   map[model.TraceID]*traceState
+	buffered int
+}
+
+// traceState is what the filter knows about a trace, the spans held back whilst it is undecided and whether it's
+// kept once decided.
+type traceState struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+	decided   bool
+	keep      bool
+	spans     []*model.Span
+}
+
+func newTailFilter(writer spanstore.Writer, slowThreshold time.Duration, ratio float64, decisionWait, decisionTTL time.Duration, maxBuffered int, metrics *writeMetrics, logger hclog.Logger) *tailFilter {
+	f := &tailFilter{
+		writer:        writer,
+		slowThreshold: slowThreshold,
+		sampler:       newDownsampler(ratio, ""),
+		decisionWait:  decisionWait,
+		decisionTTL:   decisionTTL,
+		maxBuffered:   maxBuffered,
+		metrics:       metrics,
+		logger:        logger,
+		traces:        make(map[model.TraceID]*traceState),
+		done:          make(chan struct{}),
+	}
+	go f.decideEvery(decisionWait / 10)
+
+	return f
+}
+
+func (f *tailFilter) WriteSpan(span *model.Span) error {
+	interesting := isErrorSpan(span) || (f.slowThreshold > 0 && span.Duration >= f.slowThreshold)
+	now := time.Now()
+
+	f.mu.Lock()
+	state, ok := f.traces[span.TraceID]
+	if !ok {
+		state = &traceState{firstSeen: now}
+		f.traces[span.TraceID] = state
+	}
+	state.lastSeen = now
+
+	if state.decided {
+		// A trace which was dropped is kept from its first interesting span onwards.
+		if interesting {
+			state.keep = true
+		}
+		keep := state.keep
+		f.mu.Unlock()
+
+		return f.writeOrDrop(span, keep)
+	}
+
+	if interesting {
+		held := f.decide(state, true)
+		f.mu.Unlock()
+
+		f.writeHeld(held)
+		return f.writer.WriteSpan(span)
+	}
+
+	// Once the buffer is full new spans are decided straight away rather than held.
+	if f.buffered >= f.maxBuffered {
+		f.mu.Unlock()
+		return f.writeOrDrop(span, f.sampler.keep(span))
+	}
+
+	state.spans = append(state.spans, span)
+	f.buffered++
+	f.mu.Unlock()
+
+	return nil
+}
+
+// decide records the decision for the trace and returns its held spans if it's kept, the lock must be held.
+func (f *tailFilter) decide(state *traceState, keep bool) []*model.Span {
+	state.decided = true
+	state.keep = keep
+	held := state.spans
+	state.spans = nil
+	f.buffered -= len(held)
+
+	if !keep {
+		f.metrics.tailDropped.Inc(int64(len(held)))
+		return nil
+	}
+
+	return held
+}
+
+func (f *tailFilter) writeOrDrop(span *model.Span, keep bool) error {
+	if !keep {
+		f.metrics.tailDropped.Inc(1)
+		return nil
+	}
+
+	return f.writer.WriteSpan(span)
+}
+
+// writeHeld writes spans which were held back. Their writes were already reported as successful so failures can only
+// be logged.
+func (f *tailFilter) writeHeld(spans []*model.Span) {
+	for _, span := range spans {
+		err := f.writer.WriteSpan(span)
+		if err != nil {
+			f.logger.Debug("failed to write held span", "trace_id", span.TraceID.String(), "span_id", span.SpanID.String(), "error", err)
+		}
+	}
+}
+
+func (f *tailFilter) decideEvery(interval time.Duration) {
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			f.decideExpired(now)
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// Close writes every span still held back, keeping their traces whatever they would have been decided, and then
+// closes the writer. Spans mustn't be written once it's called.
+func (f *tailFilter) Close() error {
+	close(f.done)
+
+	var held []*model.Span
+	f.mu.Lock()
+	for _, state := range f.traces {
+		if !state.decided {
+			held = append(held, f.decide(state, true)...)
+		}
+	}
+	f.mu.Unlock()
+
+	f.writeHeld(held)
+	f.logger.Debug("wrote held spans on close", "spans", len(held))
+
+	return closeWriter(f.writer)
+}
+
+// decideExpired decides the traces which have waited long enough, and forgets decisions which have outlived the
+// decision TTL.
+func (f *tailFilter) decideExpired(now time.Time) {
+	var held []*model.Span
+
+	f.mu.Lock()
+	for traceID, state := range f.traces {
+		if state.decided {
+			if now.Sub(state.lastSeen) > f.decisionTTL {
+				delete(f.traces, traceID)
+			}
+			continue
+		}
+		if now.Sub(state.firstSeen) < f.decisionWait {
+			continue
+		}
+
+		keep := len(state.spans) > 0 && f.sampler.keep(state.spans[0])
+		held = append(held, f.decide(state, keep)...)
+	}
+	f.mu.Unlock()
+
+	f.writeHeld(held)
+}
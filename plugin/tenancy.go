@@ -0,0 +1,288 @@
+package plugin
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/metadata"
+)
+
+// tenantHeader is the gRPC header that Jaeger sends the tenant in.
+const tenantHeader = "x-tenant"
+
+// ErrMissingTenant occurs when tenancy is enabled and a request doesn't say which tenant it's for
+var ErrMissingTenant = errors.New("missing tenant")
+
+// ErrUnknownTenant occurs when a request is for a tenant that isn't allowed
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// validTenant matches the tenants that can be used as scope names.
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9-][A-Za-z0-9_%-]{0,250}$`)
+
+func isValidTenant(tenant string) bool {
+	return validTenant.MatchString(tenant)
+}
+
+// tenantFromContext returns the tenant from the request's gRPC headers.
+func tenantFromContext(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", ErrMissingTenant
+	}
+
+	tenants := md.Get(tenantHeader)
+	if len(tenants) != 1 || tenants[0] == "" {
+		return "", ErrMissingTenant
+	}
+
+	return tenants[0], nil
+}
+
+// TenantStore returns the store for the tenant's scope, which holds the tenant's spans, services and dependencies
+// in the configured collections.
+func (cs *couchbaseStore) TenantStore(tenant string) (Store, error) {
+	return cs.forTenant(tenant)
+}
+
+// storeForContext returns the store for the tenant that the request is for, or the default tenant's store if the
+// request doesn't say.
+func (cs *couchbaseStore) storeForContext(ctx context.Context) (*couchbaseStore, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err == ErrMissingTenant && cs.defaultTenant != "" {
+		return cs.forTenant(cs.defaultTenant)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return cs.forTenant(tenant)
+}
+
+// storeForSpan returns the store for the tenant in the span's tenant tag, or in its process's tags, or the default
+// tenant's store if neither has one.
+func (cs *couchbaseStore) storeForSpan(span *model.Span) (*couchbaseStore, error) {
+	tenant, ok := model.KeyValues(span.Tags).FindByKey(cs.tenantTag)
+	if !ok && span.Process != nil {
+		tenant, ok = model.KeyValues(span.Process.Tags).FindByKey(cs.tenantTag)
+	}
+	if ok && tenant.AsString() != "" {
+		return cs.forTenant(tenant.AsString())
+	}
+	if cs.defaultTenant == "" {
+		return nil, ErrMissingTenant
+	}
+
+	return cs.forTenant(cs.defaultTenant)
+}
+
+// defaultStore returns the default tenant's store, for requests that have no context to read the tenant from.
+func (cs *couchbaseStore) defaultStore() (*couchbaseStore, error) {
+	if cs.defaultTenant == "" {
+		return nil, ErrMissingTenant
+	}
+
+	return cs.forTenant(cs.defaultTenant)
+}
+
+func (cs *couchbaseStore) forTenant(tenant string) (*couchbaseStore, error) {
+	if !isValidTenant(tenant) || (cs.tenants != nil && !cs.tenants[tenant]) {
+		return nil, errors.Wrapf(ErrUnknownTenant, "tenant %q", tenant)
+	}
+
+	cs.tenantsMu.Lock()
+	defer cs.tenantsMu.Unlock()
+
+	if store, ok := cs.tenantStores[tenant]; ok {
+		return store, nil
+	}
+
+	// Tenant stores share their parent's bucket and metrics, but analytics datasets are only set up for the
+	// parent's collections so tenants are always queried using N1QL.
+	logger := cs.logger.With("tenant", tenant)
+	store := cs.derive(logger)
+	store.parent = cs
+	store.scope = tenant
+	store.cache = cs.cache.empty()
+	store.search = cs.search.forTenant(tenant)
+	store.processes = cs.processes.empty()
+
+	// Each tenant has its own lookup documents so needs its own cache of them. Writes in named collections go
+	// through the query service, so tenant writes aren't batched.
+	writer := &couchbaseSpanWriter{
+		store:          store,
+		spanTTL:        cs.writer.spanTTL,
+		serviceTTL:     cs.writer.serviceTTL,
+		traceModel:     cs.traceModel,
+		layout:         cs.writer.layout,
+		splitStorage:   cs.writer.splitStorage,
+		keyStrategy:    cs.writer.keyStrategy,
+		compression:    cs.writer.compression,
+		encoding:       cs.writer.encoding,
+		maxSpanSize:    cs.writer.maxSpanSize,
+		oversizedSpans: cs.writer.oversizedSpans,
+		tags:           cs.writer.tags,
+		sanitizers:     cs.writer.sanitizers,
+		downsampler:    cs.writer.downsampler,
+		selfService:    cs.writer.selfService,
+		cache:          store.cache,
+		metrics:        cs.writer.metrics,
+		logger:         logger,
+	}
+	if cs.writer.lookups != nil {
+		writer.lookups = newLookupCache(cs.writer.lookups.size, cs.writer.lookups.ttl, 0)
+	}
+	if cs.writer.processes != nil {
+		writer.processes = newLookupCache(cs.writer.processes.size, cs.writer.processes.ttl, 0)
+	}
+	store.errorField = newErrorField(store, logger)
+	writer.errorField = store.errorField
+	store.spanWriter = writer
+	store.writer = writer
+
+	cs.tenantStores[tenant] = store
+	return store, nil
+}
+
+// tenantSpanReader reads spans from the scope of the tenant that each request is for.
+type tenantSpanReader struct {
+	store *couchbaseStore
+}
+
+func (r *tenantSpanReader) reader(ctx context.Context) (*couchbaseSpanReader, error) {
+	store, err := r.store.storeForContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.spanReader(), nil
+}
+
+func (r *tenantSpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+	reader, err := r.reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return reader.GetTrace(ctx, traceID)
+}
+
+func (r *tenantSpanReader) GetServices(ctx context.Context) ([]string, error) {
+	reader, err := r.reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return reader.GetServices(ctx)
+}
+
+func (r *tenantSpanReader) GetOperations(ctx context.Context, service string) ([]string, error) {
+	reader, err := r.reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return reader.GetOperations(ctx, service)
+}
+
+func (r *tenantSpanReader) GetOperationsWithKind(ctx context.Context, query OperationQueryParameters) ([]Operation, error) {
+	reader, err := r.reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return reader.GetOperationsWithKind(ctx, query)
+}
+
+func (r *tenantSpanReader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+	reader, err := r.reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return reader.FindTraces(ctx, query)
+}
+
+func (r *tenantSpanReader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
+	reader, err := r.reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return reader.FindTraceIDs(ctx, query)
+}
+
+// tenantSpanWriter writes spans to the scope of the tenant that each request is for. WriteSpan has no context to
+// read the tenant from so takes it from the span's tags.
+type tenantSpanWriter struct {
+	store *couchbaseStore
+}
+
+// WriteSpan writes the span to the scope of the tenant in its tenant tag, or the default tenant's scope.
+func (w *tenantSpanWriter) WriteSpan(span *model.Span) error {
+	store, err := w.store.storeForSpan(span)
+	if err != nil {
+		return err
+	}
+
+	return store.writer.WriteSpan(span)
+}
+
+// WriteSpanContext writes the span to the scope of the tenant that the request is for.
+func (w *tenantSpanWriter) WriteSpanContext(ctx context.Context, span *model.Span) error {
+	store, err := w.store.storeForContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	return store.writer.WriteSpan(span)
+}
+
+// tenantDependencyReader reads dependencies from the scope of the tenant that each request is for.
+// GetDependencies has no context to read the tenant from so reads the default tenant's dependencies.
+type tenantDependencyReader struct {
+	store *couchbaseStore
+}
+
+// GetDependencies reads the default tenant's dependencies.
+func (r *tenantDependencyReader) GetDependencies(endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	store, err := r.store.defaultStore()
+	if err != nil {
+		return nil, err
+	}
+
+	return store.dependencyReader().GetDependencies(endTs, lookback)
+}
+
+// GetDependenciesContext reads the dependencies of the tenant that the request is for.
+func (r *tenantDependencyReader) GetDependenciesContext(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	store, err := r.store.storeForContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.dependencyReader().GetDependenciesContext(ctx, endTs, lookback)
+}
+
+// GetDeepDependencies reads the deep dependencies of the tenant that the request is for.
+func (r *tenantDependencyReader) GetDeepDependencies(ctx context.Context, service, operation string, endTs time.Time, lookback time.Duration) ([]DeepDependencyPath, error) {
+	store, err := r.store.storeForContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.dependencyReader().GetDeepDependencies(ctx, service, operation, endTs, lookback)
+}
+
+// GetDependencyEdges reads the dependency edges of the tenant that the request is for.
+func (r *tenantDependencyReader) GetDependencyEdges(ctx context.Context, endTs time.Time, lookback time.Duration) ([]DependencyEdge, error) {
+	store, err := r.store.storeForContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.dependencyReader().GetDependencyEdges(ctx, endTs, lookback)
+}
@@ -0,0 +1,45 @@
+package plugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/pkg/errors"
+)
+
+// TLSConfig builds the TLS configuration for connecting to the cluster from the CA, certificate and key options,
+// returning nil if none of them are set.
+func TLSConfig(opts options.Options) (*tls.Config, error) {
+	if opts.CA == "" && opts.Cert == "" && opts.Key == "" && !opts.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+
+	if opts.CA != "" {
+		ca, err := ioutil.ReadFile(opts.CA)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read CA certificate")
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.Errorf("no certificates found in %s", opts.CA)
+		}
+		config.RootCAs = pool
+	}
+
+	if opts.Cert != "" || opts.Key != "" {
+		cert, err := tls.LoadX509KeyPair(opts.Cert, opts.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
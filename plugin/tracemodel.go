@@ -0,0 +1,166 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// When the trace storage model is used spans are appended to a single document per trace, so that a trace can be
+// fetched with KV gets rather than a query. Couchbase limits documents to 20MB so once a trace document is full its
+// spans continue in overflow documents, the trace document's overflow field counts how many there are. The trace
+// document and its overflow documents are the chunks of the trace, and are all typed as traces so that searches and
+// purges see the spans in every chunk.
+const (
+	traceDocumentType = "trace"
+	traceSpansPath    = "spans"
+	traceOverflowPath = "overflow"
+
+	// spansKeyspaceTemplate exposes the spans of every trace document as if they were span documents so that the
+	// span queries can be reused, it is substituted into the queries in place of the keyspace.
+	spansKeyspaceTemplate = "(SELECT RAW s FROM %s AS t UNNEST t.spans AS s WHERE t.`type`=\"trace\")"
+)
+
+// traceDocument holds the spans of a trace, or of one of its overflow documents.
+type traceDocument struct {
+	Spans    []Span `json:"spans"`
+	Overflow int    `json:"overflow,omitempty"`
+	Type     string `json:"type,omitempty"`
+}
+
+// traceFields are set on every chunk of a trace as spans are appended to it.
+var traceFields = map[string]interface{}{"type": traceDocumentType}
+
+func traceKey(traceID TraceID) string {
+	return fmt.Sprintf("trace::%016x%016x", traceID.High, traceID.Low)
+}
+
+func overflowKey(traceID TraceID, overflow int64) string {
+	return fmt.Sprintf("%s::%d", traceKey(traceID), overflow)
+}
+
+// appendSpan appends the span to its trace document, moving on to an overflow document when the trace document is
+// full. Whichever chunk the span lands in is typed as a trace by the same mutation.
+func appendSpan(store Store, span Span, expiry int) error {
+	return appendSpans(store, span.TraceID, []Span{span}, expiry)
+}
+
+// appendSpans appends spans of the same trace to its trace document with a single mutation, moving on to an overflow
+// document when the trace document is full. Spans that don't fit together are appended one at a time, so that each
+// document is filled before moving on to the next.
+func appendSpans(store Store, traceID TraceID, spans []Span, expiry int) error {
+	key := traceKey(traceID)
+	err := store.ArrayAppendMulti(key, traceSpansPath, spans, traceFields, expiry)
+	if !isDocumentTooBig(err) {
+		return err
+	}
+	if len(spans) > 1 {
+		for _, span := range spans {
+			err := appendSpans(store, traceID, []Span{span}, expiry)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	var overflow int64
+	err = store.GetField(key, traceOverflowPath, &overflow)
+	if err != nil && !isPathNotFound(err) {
+		return err
+	}
+
+	if overflow > 0 {
+		err = store.ArrayAppendMulti(overflowKey(traceID, overflow), traceSpansPath, spans, traceFields, expiry)
+		if !isDocumentTooBig(err) {
+			return err
+		}
+	}
+
+	// Either there is no overflow document yet or the latest one is full too.
+	overflow, err = store.Increment(key, traceOverflowPath, expiry)
+	if err != nil {
+		return errors.Wrap(err, "failed to create overflow document")
+	}
+
+	return store.ArrayAppendMulti(overflowKey(traceID, overflow), traceSpansPath, spans, traceFields, expiry)
+}
+
+// readTrace fetches the spans of a trace from its trace document, and from any overflow documents with a single bulk
+// get, merging the chunks in the order that they were filled.
+func readTrace(store Store, traceID TraceID) ([]Span, error) {
+	var doc traceDocument
+	err := store.Get(traceKey(traceID), &doc)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Overflow == 0 {
+		return mergeChunks(doc.Spans), nil
+	}
+
+	chunks := make([]Document, doc.Overflow)
+	for i := range chunks {
+		chunks[i] = Document{Key: overflowKey(traceID, int64(i+1)), Value: &traceDocument{}}
+	}
+	spans := doc.Spans
+	for i, err := range store.GetMulti(chunks) {
+		if err == ErrDocumentNotFound {
+			// Overflow documents are numbered before they are written so a writer may not have created it yet.
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read overflow document %d", i+1)
+		}
+
+		spans = append(spans, chunks[i].Value.(*traceDocument).Spans...)
+	}
+
+	return mergeChunks(spans), nil
+}
+
+// chunkSpanKey identifies a span within a trace. Zipkin style client and server spans share their span ID, so the
+// service and kind are part of the key.
+type chunkSpanKey struct {
+	spanID    uint64
+	startTime string
+	operation string
+	service   string
+	kind      string
+}
+
+// mergeChunks drops the spans which appear more than once in a trace's chunks, which happens when an append that
+// timed out had reached the server and was retried, either into the same chunk or into the next chunk once the first
+// was full.
+func mergeChunks(spans []Span) []Span {
+	seen := make(map[chunkSpanKey]bool, len(spans))
+	merged := spans[:0]
+	for _, span := range spans {
+		key := chunkSpanKey{
+			spanID:    span.SpanID,
+			startTime: span.StartTime,
+			operation: span.OperationName,
+			kind:      span.SpanKind,
+		}
+		if span.Process != nil {
+			key.service = span.Process.ServiceName
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, span)
+	}
+
+	return merged
+}
+
+func isDocumentTooBig(err error) bool {
+	return err != nil && errors.Cause(err) == gocb.ErrTooBig
+}
+
+func isPathNotFound(err error) bool {
+	return err != nil && (errors.Cause(err) == gocb.ErrSubDocPathNotFound || strings.Contains(err.Error(), "path not found"))
+}
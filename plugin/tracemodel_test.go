@@ -0,0 +1,227 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// chunkStore holds trace chunks in memory, each of which fits at most capacity spans.
+type chunkStore struct {
+	Store
+	capacity int
+	docs     map[string]*traceDocument
+}
+
+func newChunkStore(capacity int) *chunkStore {
+	return &chunkStore{capacity: capacity, docs: make(map[string]*traceDocument)}
+}
+
+func (s *chunkStore) ArrayAppendMulti(key, path string, values interface{}, fields map[string]interface{}, expiry int) error {
+	spans := values.([]Span)
+	doc, ok := s.docs[key]
+	if !ok {
+		doc = &traceDocument{}
+	}
+	if len(doc.Spans)+len(spans) > s.capacity {
+		return gocb.ErrTooBig
+	}
+	doc.Spans = append(doc.Spans, spans...)
+	doc.Type, _ = fields["type"].(string)
+	s.docs[key] = doc
+
+	return nil
+}
+
+func (s *chunkStore) GetField(key, path string, valuePtr interface{}) error {
+	doc, ok := s.docs[key]
+	if !ok {
+		return ErrDocumentNotFound
+	}
+	if doc.Overflow == 0 {
+		return gocb.ErrSubDocPathNotFound
+	}
+	*valuePtr.(*int64) = int64(doc.Overflow)
+
+	return nil
+}
+
+func (s *chunkStore) Increment(key, path string, expiry int) (int64, error) {
+	doc, ok := s.docs[key]
+	if !ok {
+		doc = &traceDocument{}
+		s.docs[key] = doc
+	}
+	doc.Overflow++
+
+	return int64(doc.Overflow), nil
+}
+
+func (s *chunkStore) Get(key string, valuePtr interface{}) error {
+	doc, ok := s.docs[key]
+	if !ok {
+		return ErrDocumentNotFound
+	}
+	*valuePtr.(*traceDocument) = traceDocument{
+		Spans:    append([]Span(nil), doc.Spans...),
+		Overflow: doc.Overflow,
+		Type:     doc.Type,
+	}
+
+	return nil
+}
+
+func (s *chunkStore) GetMulti(docs []Document) []error {
+	errs := make([]error, len(docs))
+	for i, doc := range docs {
+		errs[i] = s.Get(doc.Key, doc.Value)
+	}
+
+	return errs
+}
+
+func chunkSpan(spanID uint64, service, kind string) Span {
+	return Span{
+		TraceID:       TraceID{Low: 1},
+		SpanID:        spanID,
+		StartTime:     "2019-06-01T00:00:00Z",
+		OperationName: "op",
+		SpanKind:      kind,
+		Process:       &model.Process{ServiceName: service},
+	}
+}
+
+func spanIDs(spans []Span) []uint64 {
+	ids := make([]uint64, len(spans))
+	for i, span := range spans {
+		ids[i] = span.SpanID
+	}
+
+	return ids
+}
+
+func TestMergeChunks(t *testing.T) {
+	tests := []struct {
+		name  string
+		spans []Span
+		want  []Span
+	}{
+		{
+			name: "no spans",
+		},
+		{
+			name:  "distinct spans",
+			spans: []Span{chunkSpan(1, "a", "server"), chunkSpan(2, "a", "client")},
+			want:  []Span{chunkSpan(1, "a", "server"), chunkSpan(2, "a", "client")},
+		},
+		{
+			name:  "retried append",
+			spans: []Span{chunkSpan(1, "a", "server"), chunkSpan(2, "a", "client"), chunkSpan(1, "a", "server")},
+			want:  []Span{chunkSpan(1, "a", "server"), chunkSpan(2, "a", "client")},
+		},
+		{
+			name:  "zipkin shared span ID",
+			spans: []Span{chunkSpan(1, "a", "client"), chunkSpan(1, "b", "server")},
+			want:  []Span{chunkSpan(1, "a", "client"), chunkSpan(1, "b", "server")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, spanIDs(test.want), spanIDs(mergeChunks(test.spans)))
+		})
+	}
+}
+
+func TestReadTraceWithoutOverflowDropsDuplicates(t *testing.T) {
+	store := newChunkStore(10)
+	traceID := TraceID{Low: 1}
+	store.docs[traceKey(traceID)] = &traceDocument{
+		Spans: []Span{chunkSpan(1, "a", "server"), chunkSpan(1, "a", "server")},
+		Type:  traceDocumentType,
+	}
+
+	spans, err := readTrace(store, traceID)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1}, spanIDs(spans))
+}
+
+func TestReadTraceMissingOverflowChunk(t *testing.T) {
+	store := newChunkStore(10)
+	traceID := TraceID{Low: 1}
+	store.docs[traceKey(traceID)] = &traceDocument{Spans: []Span{chunkSpan(1, "a", "server")}, Overflow: 2}
+	store.docs[overflowKey(traceID, 1)] = &traceDocument{Spans: []Span{chunkSpan(2, "a", "client")}}
+
+	spans, err := readTrace(store, traceID)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2}, spanIDs(spans))
+}
+
+func TestAppendSpans(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		batches  [][]uint64
+		want     map[string][]uint64
+	}{
+		{
+			name:     "fits",
+			capacity: 3,
+			batches:  [][]uint64{{1, 2}, {3}},
+			want:     map[string][]uint64{"": {1, 2, 3}},
+		},
+		{
+			name:     "fills the document exactly",
+			capacity: 2,
+			batches:  [][]uint64{{1, 2}},
+			want:     map[string][]uint64{"": {1, 2}},
+		},
+		{
+			name:     "starts an overflow chunk once the document is full",
+			capacity: 2,
+			batches:  [][]uint64{{1, 2}, {3}},
+			want:     map[string][]uint64{"": {1, 2}, "::1": {3}},
+		},
+		{
+			name:     "splits a batch that's too big",
+			capacity: 3,
+			batches:  [][]uint64{{1, 2}, {3, 4}},
+			want:     map[string][]uint64{"": {1, 2, 3}, "::1": {4}},
+		},
+		{
+			name:     "fills overflow chunks in turn",
+			capacity: 2,
+			batches:  [][]uint64{{1, 2, 3, 4, 5}},
+			want:     map[string][]uint64{"": {1, 2}, "::1": {3, 4}, "::2": {5}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newChunkStore(test.capacity)
+			traceID := TraceID{Low: 1}
+			for _, batch := range test.batches {
+				spans := make([]Span, len(batch))
+				for i, spanID := range batch {
+					spans[i] = chunkSpan(spanID, "a", "server")
+				}
+				require.NoError(t, appendSpans(store, traceID, spans, 0))
+			}
+
+			require.Len(t, store.docs, len(test.want))
+			var written int
+			for suffix, want := range test.want {
+				written += len(want)
+				doc, ok := store.docs[traceKey(traceID)+suffix]
+				require.True(t, ok, "chunk %q", suffix)
+				assert.Equal(t, want, spanIDs(doc.Spans), "chunk %q", suffix)
+				assert.Equal(t, traceDocumentType, doc.Type, "chunk %q", suffix)
+			}
+
+			spans, err := readTrace(store, traceID)
+			require.NoError(t, err)
+			assert.Len(t, spans, written)
+		})
+	}
+}
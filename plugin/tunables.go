@@ -0,0 +1,58 @@
+package plugin
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+)
+
+// tunables are the settings that can be changed whilst the plugin is running. They're shared by a store and the
+// stores derived from it, so they're read atomically as they may be changed at any time.
+type tunables struct {
+	slowQueryThresholdNanos int64
+	readTimeoutNanos        int64
+	writeTimeoutNanos       int64
+}
+
+func newTunables(opts options.Options) *tunables {
+	t := &tunables{}
+	t.set(opts)
+
+	return t
+}
+
+func (t *tunables) set(opts options.Options) {
+	atomic.StoreInt64(&t.slowQueryThresholdNanos, int64(opts.SlowQueryThreshold))
+	atomic.StoreInt64(&t.readTimeoutNanos, int64(opts.ReadTimeout))
+	atomic.StoreInt64(&t.writeTimeoutNanos, int64(opts.WriteTimeout))
+}
+
+func (t *tunables) slowQueryThreshold() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.slowQueryThresholdNanos))
+}
+
+func (t *tunables) readTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.readTimeoutNanos))
+}
+
+func (t *tunables) writeTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.writeTimeoutNanos))
+}
+
+// Reload applies the settings that can be changed whilst the plugin is running: the write batch size and flush
+// interval, the read and write timeouts and the slow query threshold. Other settings only take effect on restart.
+func (cs *couchbaseStore) Reload(opts options.Options) {
+	cs.tunables.set(opts)
+
+	if opts.WriteTimeout > 0 {
+		for _, bucket := range cs.openBuckets() {
+			bucket.SetOperationTimeout(opts.WriteTimeout)
+			bucket.SetBulkOperationTimeout(opts.WriteTimeout)
+		}
+	}
+
+	if cs.writer != nil && cs.writer.batcher != nil {
+		cs.writer.batcher.resize(opts.WriteBatchSize, opts.WriteFlushInterval)
+	}
+}
@@ -0,0 +1,199 @@
+package plugin
+
+import (
+	"context"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/pkg/errors"
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// The views read the spans of span documents and of trace documents, so that they work with either storage model.
+// They're a cheaper alternative to the secondary indexes on clusters where index memory is scarce, e.g. Community
+// Edition clusters, at the cost of results that may be a little behind the latest writes.
+const (
+	viewServices            = "services"
+	viewOperations          = "operations"
+	viewTraceIDs            = "trace_ids"
+	viewTraceIDsByOperation = "trace_ids_by_operation"
+
+	// viewSpans is the start of every map function, setting spans to the spans in the document.
+	viewSpans = `function (doc, meta) {
+  var spans = doc.type == "span" ? [doc] : (meta.id.indexOf("trace::") == 0 && doc.spans) || [];
+  for (var i = 0; i < spans.length; i++) {
+    var span = spans[i];
+    if (!span.process || !span.process.service_name) continue;
+`
+
+	// viewRowsPerTrace is how many rows are read for each trace that's wanted, as rows are spans and a trace usually
+	// has several spans of the same service.
+	viewRowsPerTrace = 10
+)
+
+// viewMaps are the map functions of each view, each emitting a row per span.
+var viewMaps = map[string]string{
+	viewServices:            viewSpans + "    emit(span.process.service_name, null);\n  }\n}",
+	viewOperations:          viewSpans + "    emit([span.process.service_name, span.operation_name, span.span_kind || \"\"], null);\n  }\n}",
+	viewTraceIDs:            viewSpans + "    emit([span.process.service_name, span.start_time], span.trace_id);\n  }\n}",
+	viewTraceIDsByOperation: viewSpans + "    emit([span.process.service_name, span.operation_name, span.start_time], span.trace_id);\n  }\n}",
+}
+
+// viewIndex reads services, operations and trace IDs from the views of the plugin's design document.
+type viewIndex struct {
+	designDocument string
+}
+
+// designDocument returns the design document holding the plugin's views. The services and operations views are
+// reduced with a count so that they can be grouped into distinct rows.
+func designDocument(name string) *gocb.DesignDocument {
+	ddoc := &gocb.DesignDocument{Name: name, Views: make(map[string]gocb.View)}
+	for view, mapFn := range viewMaps {
+		v := gocb.View{Map: mapFn}
+		if view == viewServices || view == viewOperations {
+			v.Reduce = "_count"
+		}
+		ddoc.Views[view] = v
+	}
+
+	return ddoc
+}
+
+// CreateViews creates or updates the design document holding the plugin's views, when views are in use.
+func CreateViews(store Store, designDocumentName string, logger hclog.Logger) error {
+	if !store.UsesViews() {
+		return nil
+	}
+
+	err := store.UpsertDesignDocument(designDocument(designDocumentName))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create design document %s", designDocumentName)
+	}
+
+	logger.Debug("created design document", "name", designDocumentName)
+	return nil
+}
+
+// usesViews reports whether the query can be answered from the views, which can't search by tag or duration.
+func (v *viewIndex) usesViews(traceQuery *spanstore.TraceQueryParameters) bool {
+	return v != nil && len(traceQuery.Tags) == 0 && traceQuery.DurationMin == 0 && traceQuery.DurationMax == 0
+}
+
+func (v *viewIndex) services(ctx context.Context, store Store) ([]string, error) {
+	result, err := store.ViewQuery(ctx, gocb.NewViewQuery(v.designDocument, viewServices).Group(true))
+	if err != nil {
+		return nil, err
+	}
+
+	var row struct {
+		Key string `json:"key"`
+	}
+	var services []string
+	for result.Next(&row) {
+		services = append(services, row.Key)
+	}
+
+	err = result.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
+
+// operations returns the operations of the service, optionally filtered to a single kind.
+func (v *viewIndex) operations(ctx context.Context, store Store, service, kind string) ([]Operation, error) {
+	query := gocb.NewViewQuery(v.designDocument, viewOperations).
+		Range([]interface{}{service}, []interface{}{service, map[string]interface{}{}}, true).
+		GroupLevel(3)
+	result, err := store.ViewQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var row struct {
+		Key []string `json:"key"`
+	}
+	var operations []Operation
+	for result.Next(&row) {
+		if len(row.Key) == 3 && row.Key[1] != "" && (kind == "" || row.Key[2] == kind) {
+			operations = append(operations, Operation{Name: row.Key[1], SpanKind: row.Key[2]})
+		}
+	}
+
+	err = result.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return operations, nil
+}
+
+func (v *viewIndex) operationNames(ctx context.Context, store Store, service string) ([]string, error) {
+	operations, err := v.operations(ctx, store, service, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows are sorted by operation and then kind, so an operation's kinds are next to each other.
+	var names []string
+	for i, operation := range operations {
+		if i == 0 || operations[i-1].Name != operation.Name {
+			names = append(names, operation.Name)
+		}
+	}
+
+	return names, nil
+}
+
+// traceIDs finds the IDs of the traces with spans of the query's service, and operation if it has one, in its time
+// range, most recent first. Rows are read a page at a time until enough distinct traces have been found.
+func (v *viewIndex) traceIDs(ctx context.Context, store Store, traceQuery *spanstore.TraceQueryParameters) ([]TraceID, error) {
+	view := viewTraceIDs
+	prefix := []interface{}{traceQuery.ServiceName}
+	if traceQuery.OperationName != "" {
+		view = viewTraceIDsByOperation
+		prefix = append(prefix, traceQuery.OperationName)
+	}
+	// The view is read in descending order so the range starts at the end of the time range.
+	start := append(append([]interface{}{}, prefix...), traceQuery.StartTimeMax.UTC().Format(dateLayout))
+	end := append(append([]interface{}{}, prefix...), traceQuery.StartTimeMin.UTC().Format(dateLayout))
+	pageSize := traceQuery.NumTraces * viewRowsPerTrace
+
+	var traceIDs []TraceID
+	seen := make(UniqueTraceIDs)
+	for skip := 0; len(traceIDs) < traceQuery.NumTraces; skip += pageSize {
+		query := gocb.NewViewQuery(v.designDocument, view).
+			Range(start, end, true).
+			Order(gocb.Descending).
+			Skip(uint(skip)).
+			Limit(uint(pageSize))
+		result, err := store.ViewQuery(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+
+		var row struct {
+			Value TraceID `json:"value"`
+		}
+		rows := 0
+		for result.Next(&row) {
+			rows++
+			if _, ok := seen[row.Value]; ok || len(traceIDs) >= traceQuery.NumTraces {
+				continue
+			}
+			seen.Add(row.Value)
+			traceIDs = append(traceIDs, row.Value)
+		}
+
+		err = result.Close()
+		if err != nil {
+			return nil, err
+		}
+		if rows < pageSize {
+			break
+		}
+	}
+
+	return traceIDs, nil
+}
@@ -2,23 +2,204 @@ package plugin
 
 import (
 	"encoding/json"
-	"fmt"
+	"io"
 	"strings"
+	"time"
 	"unicode/utf8"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
 )
 
 const (
 	maximumTagKeyOrValueSize = 256
 	dateLayout               = "2006-01-02T15:04:05.000Z"
+
+	// maximumRelativeExpiry is the largest expiry that Couchbase treats as relative, anything larger is
+	// taken to be an absolute unix timestamp.
+	maximumRelativeExpiry = 30 * 24 * time.Hour
 )
 
+// closeWriter closes the writer if it holds spans, or goroutines, that must be finished with before the plugin exits.
+// Writers that wrap another close it in turn.
+func closeWriter(writer spanstore.Writer) error {
+	closer, ok := writer.(io.Closer)
+	if !ok {
+		return nil
+	}
+
+	return closer.Close()
+}
+
 type couchbaseSpanWriter struct {
-	store Store
+	store          Store
+	batcher        *batcher
+	spanTTL        time.Duration
+	serviceTTL     time.Duration
+	traceModel     bool
+	keyStrategy    string
+	compression    string
+	encoding       string
+	layout         string
+	splitStorage   bool
+	maxSpanSize    int
+	oversizedSpans string
+	tags           *tagFilter
+	cache          *resultCache
+	lookups        *lookupCache
+	processes      *lookupCache
+	kvIndex        *kvIndex
+	partitions     *partitionManager
+	routes         *routes
+	sanitizers     sanitizerChain
+	downsampler    *downsampler
+	rollup         *spmRollup
+	errorField     *errorField
+	selfService    string
+	metrics        *writeMetrics
+	logger         hclog.Logger
+}
+
+// Close writes the spans waiting to be batched and stops the batcher.
+func (cs *couchbaseSpanWriter) Close() error {
+	if cs.batcher == nil {
+		return nil
+	}
+
+	return cs.batcher.Close()
 }
 
 func (cs *couchbaseSpanWriter) WriteSpan(span *model.Span) error {
+	cs.sanitizers.sanitize(span)
+	if !cs.keep(span) {
+		return nil
+	}
+
+	otSpan := cs.startSpan(span)
+	defer otSpan.Finish()
+
+	start := time.Now()
+	err := cs.writeSpan(span)
+	cs.metrics.record(start, err)
+	if err != nil {
+		cs.logger.Warn("failed to write span", "trace_id", span.TraceID.String(), "span_id", span.SpanID.String(), "error", err)
+		ext.Error.Set(otSpan, true)
+		otSpan.LogFields(otlog.Error(err))
+	}
+
+	return err
+}
+
+// startSpan starts the plugin's own span for writing the span. Spans of the plugin's own service aren't traced, as
+// writing them would then create more spans to write.
+func (cs *couchbaseSpanWriter) startSpan(span *model.Span) opentracing.Span {
+	if cs.selfService != "" && span.Process.ServiceName == cs.selfService {
+		return opentracing.NoopTracer{}.StartSpan("WriteSpan")
+	}
+
+	otSpan := opentracing.StartSpan("WriteSpan")
+	otSpan.SetTag("jaeger.trace_id", span.TraceID.String())
+	otSpan.SetTag("jaeger.service", span.Process.ServiceName)
+	return otSpan
+}
+
+func (cs *couchbaseSpanWriter) writeSpan(span *model.Span) error {
+	if store := cs.routes.storeFor(span.Process.ServiceName); store != nil {
+		return store.writer.writeSpan(span)
+	}
+	cs.errorField.recordWrite()
+
+	dbSpan, doc, err := cs.toDocument(span)
+	if err != nil {
+		return err
+	}
+	err = cs.writeReferenced(span, &dbSpan, &doc)
+	if err != nil {
+		return err
+	}
+
+	if cs.batcher != nil {
+		err = cs.batcher.Write(doc)
+	} else if cs.traceModel {
+		err = appendSpan(cs.store, dbSpan, doc.Expiry)
+	} else if cs.partitions != nil {
+		err = cs.writePartitioned(span, doc)
+	} else {
+		err = cs.store.Insert(doc.Key, doc.Value, doc.Expiry)
+	}
+	if err != nil && !cs.isDuplicate(err) {
+		return err
+	}
+	// Spans written again are skipped so that they aren't counted twice.
+	if err == nil && cs.rollup != nil {
+		cs.rollup.record(span)
+	}
+	if cs.kvIndex != nil {
+		return cs.kvIndex.record(dbSpan, span.StartTime)
+	}
+
+	return cs.writeLookups(dbSpan)
+}
+
+// writeReferenced writes the documents that the span document refers to, its process and its body, before the span
+// document itself so that they can always be read for the span.
+func (cs *couchbaseSpanWriter) writeReferenced(span *model.Span, dbSpan *Span, doc *Document) error {
+	if dbSpan.ProcessHash != "" {
+		err := cs.writeProcess(span, dbSpan.ProcessHash)
+		if err != nil {
+			return err
+		}
+	}
+	if cs.splitStorage {
+		return cs.writeBody(span, dbSpan, doc)
+	}
+
+	return nil
+}
+
+// keep reports whether the span is stored, counting the spans that downsampling drops.
+func (cs *couchbaseSpanWriter) keep(span *model.Span) bool {
+	if cs.downsampler.keep(span) {
+		return true
+	}
+	cs.metrics.downsampled.Inc(1)
+
+	return false
+}
+
+// writePartitioned writes the span to the partition for the day that it started on. Lookup documents are still
+// written to the span collection.
+func (cs *couchbaseSpanWriter) writePartitioned(span *model.Span, doc Document) error {
+	store, err := cs.partitions.storeFor(span.StartTime)
+	if err != nil {
+		return err
+	}
+
+	return store.Insert(doc.Key, doc.Value, doc.Expiry)
+}
+
+// isDuplicate reports whether the write failed because the span has already been written, which with deterministic
+// keys means that the span was written again by a retry.
+func (cs *couchbaseSpanWriter) isDuplicate(err error) bool {
+	return cs.keyStrategy == deterministicKeyStrategy && !cs.traceModel && isDocumentExists(err)
+}
+
+// toDocument converts the span into the span stored in Couchbase and the document that it's written as, cut down to
+// the maximum span size if it's too large.
+func (cs *couchbaseSpanWriter) toDocument(span *model.Span) (Span, Document, error) {
+	dbSpan, doc, err := cs.encodeDocument(span)
+	if err != nil {
+		return Span{}, Document{}, err
+	}
+
+	return cs.fitDocument(span, dbSpan, doc)
+}
+
+func (cs *couchbaseSpanWriter) encodeDocument(span *model.Span) (Span, Document, error) {
 	dbSpan := Span{
 		TraceID:       traceIDFromDomain(span.TraceID),
 		SpanID:        uint64(span.SpanID),
@@ -39,12 +220,91 @@ func (cs *couchbaseSpanWriter) WriteSpan(span *model.Span) error {
 			RefType: int32(ref.RefType),
 		})
 	}
+	// OTel links and events are stored as fields of their own so that they round trip without being mistaken for
+	// tags and logs.
+	dbSpan.Tags = splitLinkAttributes(dbSpan.Tags, dbSpan.References)
+	dbSpan.Logs, dbSpan.Events = splitEvents(dbSpan.Logs)
 	dbSpan.ProcessedTags = cs.getTags(span)
+	if kind, ok := model.KeyValues(span.Tags).FindByKey(string(ext.SpanKind)); ok {
+		dbSpan.SpanKind = kind.AsString()
+	}
+	dbSpan.Error = isErrorSpan(span)
 
 	dbSpan.Type = "span"
-	err := cs.store.Insert(fmt.Sprintf("%d", dbSpan.SpanID), dbSpan, 0)
+	dbSpan.SchemaVersion = currentSchemaVersion
+	if cs.processes != nil {
+		err := dbSpan.normalizeProcess()
+		if err != nil {
+			return Span{}, Document{}, err
+		}
+	}
+	if cs.encoding == protobufEncoding {
+		err := dbSpan.encodeProto(span, cs.compression)
+		if err != nil {
+			return Span{}, Document{}, err
+		}
+	} else if cs.compression != "" && cs.compression != noCompression {
+		err := dbSpan.compress(cs.compression)
+		if err != nil {
+			return Span{}, Document{}, err
+		}
+	}
+	key, err := spanKey(cs.keyStrategy, span)
 	if err != nil {
-		return err
+		return Span{}, Document{}, err
+	}
+	doc := Document{
+		Key:    key,
+		Value:  dbSpan,
+		Expiry: expiryFromTTL(cs.spanTTL),
+	}
+	if cs.layout == flatLayout {
+		doc.Value = dbSpan.flatten(span.StartTime)
+	}
+
+	return dbSpan, doc, nil
+}
+
+// writeLookups upserts the service and operation lookup documents for the span, skipping any that have been written
+// recently.
+func (cs *couchbaseSpanWriter) writeLookups(span Span) error {
+	if cs.lookups == nil {
+		return nil
+	}
+
+	service := span.Process.ServiceName
+	docs := []Document{
+		{
+			Key: serviceKey(service),
+			Value: serviceDocument{
+				ServiceName: service,
+				Type:        "service",
+			},
+		},
+		{
+			Key: operationKey(service, span.OperationName, span.SpanKind),
+			Value: operationDocument{
+				ServiceName:   service,
+				OperationName: span.OperationName,
+				SpanKind:      span.SpanKind,
+				Type:          "operation",
+			},
+		},
+	}
+
+	for _, doc := range docs {
+		if !cs.lookups.needsWrite(doc.Key) {
+			continue
+		}
+
+		err := cs.store.Upsert(doc.Key, doc.Value, expiryFromTTL(cs.serviceTTL))
+		if err != nil {
+			return err
+		}
+		cs.lookups.markWritten(doc.Key)
+
+		// The service or operation may be new, so cached lists of them can't be trusted.
+		cs.cache.invalidate(servicesCacheKey, operationsCacheKey(service))
 	}
 
 	return nil
@@ -61,7 +321,7 @@ func (cs *couchbaseSpanWriter) getTags(span *model.Span) []string {
 	return tags
 }
 
-// shouldStoreTag checks to see if the tag is json or not, if it's UTF8 valid and it's not too large
+// shouldStoreTag checks to see if the tag is json or not, if it's UTF8 valid, not too large and not filtered out
 func (cs *couchbaseSpanWriter) shouldStoreTag(tag TagInsertion) bool {
 	isJSON := func(s string) bool {
 		var js map[string]interface{}
@@ -70,7 +330,7 @@ func (cs *couchbaseSpanWriter) shouldStoreTag(tag TagInsertion) bool {
 	}
 
 	return len(tag.TagKey) < maximumTagKeyOrValueSize &&
-		len(tag.TagValue) < maximumTagKeyOrValueSize &&
+		cs.tags.indexed(tag) &&
 		utf8.ValidString(tag.TagValue) &&
 		utf8.ValidString(tag.TagKey) &&
 		!isJSON(tag.TagValue)
@@ -98,3 +358,15 @@ func (cs *couchbaseSpanWriter) getAllUniqueTags(span *model.Span) []TagInsertion
 	}
 	return uniqueTags
 }
+
+// expiryFromTTL converts a TTL into a document expiry, a zero TTL means the document never expires.
+func expiryFromTTL(ttl time.Duration) int {
+	if ttl <= 0 {
+		return 0
+	}
+	if ttl > maximumRelativeExpiry {
+		return int(time.Now().Add(ttl).Unix())
+	}
+
+	return int(ttl.Seconds())
+}
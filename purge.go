@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"time"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/httpclient"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/plugin"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/pkg/errors"
+)
+
+// purge deletes the spans matching a service, a list of trace IDs or a time range and then returns, e.g. to remove
+// spans that captured personal data.
+func purge(opts options.Options, args []string, store plugin.Store, conn string, client httpclient.Client, logger hclog.Logger) error {
+	flags := flag.NewFlagSet("purge", flag.ContinueOnError)
+	service := flags.String("service", "", "The service whose spans are deleted")
+	traceIDs := flags.String("trace-ids", "", "A comma separated list of the traces whose spans are deleted")
+	start := flags.String("start", "", "Deletes spans that started at or after this time, in RFC3339 format")
+	end := flags.String("end", "", "Deletes spans that started before this time, in RFC3339 format")
+	rate := flags.Int("rate", 1000, "The most documents deleted per second, 0 means no limit")
+	batchSize := flags.Int("batch-size", 100, "The number of documents deleted by each statement")
+	dryRun := flags.Bool("dry-run", false, "Reports how many documents would be deleted without deleting them")
+	tenant := flags.String("tenant", "", "The tenant whose spans are deleted, when tenancy is enabled")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	query := plugin.PurgeQuery{
+		ServiceName: *service,
+	}
+	if *traceIDs != "" {
+		for _, id := range strings.Split(*traceIDs, ",") {
+			traceID, err := model.TraceIDFromString(strings.TrimSpace(id))
+			if err != nil {
+				return errors.Wrapf(err, "invalid trace ID %q", id)
+			}
+			query.TraceIDs = append(query.TraceIDs, plugin.TraceID{High: traceID.High, Low: traceID.Low})
+		}
+	}
+	if *start != "" {
+		query.StartTimeMin, err = time.Parse(time.RFC3339, *start)
+		if err != nil {
+			return errors.Wrap(err, "invalid start")
+		}
+	}
+	if *end != "" {
+		query.StartTimeMax, err = time.Parse(time.RFC3339, *end)
+		if err != nil {
+			return errors.Wrap(err, "invalid end")
+		}
+	}
+
+	store, err = openStore(opts, store, *tenant, conn, client, logger)
+	if err != nil {
+		return err
+	}
+
+	purged, err := store.PurgeSpans(query, *rate, *batchSize, *dryRun)
+	if *dryRun {
+		logger.Info("dry run, no documents were deleted", "documents", purged)
+	} else {
+		logger.Info("purged documents", "documents", purged)
+	}
+
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hashicorp/go-hclog"
+	"github.com/spf13/viper"
+)
+
+// reloader applies the options that can be changed whilst the plugin is running.
+type reloader interface {
+	Reload(opts options.Options)
+}
+
+// watchConfig re-reads the configuration file whenever it changes, applying the options that can be changed whilst
+// the plugin is running and warning about changes to those that only take effect on restart, such as the bucket and
+// connection string.
+func watchConfig(v *viper.Viper, current options.Options, store reloader, logger hclog.Logger) {
+	var mu sync.Mutex
+	v.OnConfigChange(func(event fsnotify.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var changed options.Options
+		changed.InitFromViper(v)
+		err := changed.ReadCredentialFiles()
+		if err == nil {
+			err = changed.ReadRoutingFile()
+		}
+		if err != nil {
+			logger.Warn("failed to reload configuration", "error", err)
+			return
+		}
+
+		level := hclog.LevelFromString(changed.LogLevel)
+		if level == hclog.NoLevel {
+			logger.Warn("invalid log level, keeping the current level", "level", changed.LogLevel)
+			changed.LogLevel = current.LogLevel
+			level = hclog.LevelFromString(current.LogLevel)
+		}
+
+		reloaded, restart := current.Changed(changed)
+		if len(restart) > 0 {
+			logger.Warn("configuration changes need a restart to take effect", "options", strings.Join(restart, ", "))
+		}
+		current = changed
+		if len(reloaded) == 0 {
+			return
+		}
+
+		logger.SetLevel(level)
+		store.Reload(changed)
+		logger.Info("reloaded configuration", "options", strings.Join(reloaded, ", "))
+	})
+	v.WatchConfig()
+}
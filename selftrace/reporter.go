@@ -0,0 +1,170 @@
+package selftrace
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/httpclient"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/traceio"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// queueSize is the most spans that wait to be sent, spans finished while the queue is full are dropped.
+	queueSize = 1000
+	// batchSize is the most spans sent in a single request.
+	batchSize = 100
+	// flushInterval is how often waiting spans are sent.
+	flushInterval = time.Second
+)
+
+// New returns a tracer reporting spans with the service name to the OTLP/HTTP endpoint, e.g.
+// http://collector:4318/v1/traces, or to the log at debug level if there's no endpoint.
+func New(serviceName, endpoint string, client httpclient.Client, logger hclog.Logger) *Tracer {
+	if endpoint == "" {
+		return newTracer(serviceName, &logReporter{logger: logger})
+	}
+
+	r := &otlpReporter{
+		endpoint: endpoint,
+		client:   client,
+		queue:    make(chan *model.Span, queueSize),
+		done:     make(chan struct{}),
+		logger:   logger,
+	}
+	r.wg.Add(1)
+	go r.run()
+
+	return newTracer(serviceName, r)
+}
+
+type reporter interface {
+	report(span *model.Span)
+	close() error
+}
+
+// logReporter logs each span as it finishes.
+type logReporter struct {
+	logger hclog.Logger
+}
+
+func (r *logReporter) report(span *model.Span) {
+	args := []interface{}{
+		"trace_id", span.TraceID.String(),
+		"span_id", span.SpanID.String(),
+		"parent_id", span.ParentSpanID().String(),
+		"operation", span.OperationName,
+		"duration", span.Duration,
+	}
+	for _, tag := range span.Tags {
+		args = append(args, "tag."+tag.Key, tag.AsString())
+	}
+
+	r.logger.Debug("span", args...)
+}
+
+func (r *logReporter) close() error {
+	return nil
+}
+
+// otlpReporter sends spans to an OTLP/HTTP endpoint in batches, in OTLP's JSON encoding.
+type otlpReporter struct {
+	endpoint string
+	client   httpclient.Client
+	queue    chan *model.Span
+	done     chan struct{}
+	wg       sync.WaitGroup
+	logger   hclog.Logger
+}
+
+func (r *otlpReporter) report(span *model.Span) {
+	select {
+	case r.queue <- span:
+	default:
+		r.logger.Debug("span queue is full, dropping span", "operation", span.OperationName)
+	}
+}
+
+func (r *otlpReporter) close() error {
+	close(r.done)
+	r.wg.Wait()
+
+	return nil
+}
+
+func (r *otlpReporter) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []*model.Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := r.send(batch)
+		if err != nil {
+			r.logger.Warn("failed to send spans", "endpoint", r.endpoint, "spans", len(batch), "error", err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case span := <-r.queue:
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-r.done:
+			for {
+				select {
+				case span := <-r.queue:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *otlpReporter) send(spans []*model.Span) error {
+	var body bytes.Buffer
+	writer, err := traceio.NewWriter(traceio.OTLPFormat, &body)
+	if err != nil {
+		return err
+	}
+	err = writer.Write(&model.Trace{Spans: spans})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", r.endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("request failed with status %d: %s", resp.StatusCode, msg)
+	}
+
+	return nil
+}
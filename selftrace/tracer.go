@@ -0,0 +1,252 @@
+// Package selftrace traces the plugin's own storage operations, reporting the spans to an OTLP/HTTP endpoint or to the
+// log. Spans are never written through the plugin itself, so tracing storage can't feed back into storage.
+package selftrace
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// Tracer is an OpenTracing tracer which reports finished spans as Jaeger spans. Spans aren't propagated to or from
+// other processes, so every trace starts in the plugin.
+type Tracer struct {
+	process  *model.Process
+	reporter reporter
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// newTracer returns a tracer that reports spans with the service name to the reporter.
+func newTracer(serviceName string, reporter reporter) *Tracer {
+	return &Tracer{
+		process:  model.NewProcess(serviceName, nil),
+		reporter: reporter,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Close reports any spans that haven't been reported yet.
+func (t *Tracer) Close() error {
+	return t.reporter.close()
+}
+
+func (t *Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	var options opentracing.StartSpanOptions
+	for _, opt := range opts {
+		opt.Apply(&options)
+	}
+
+	s := &span{
+		tracer:        t,
+		operationName: operationName,
+		start:         options.StartTime,
+	}
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+
+	for _, ref := range options.References {
+		parent, ok := ref.ReferencedContext.(spanContext)
+		if !ok {
+			continue
+		}
+		if s.context.traceID == (model.TraceID{}) {
+			s.context.traceID = parent.traceID
+		}
+		if ref.Type == opentracing.FollowsFromRef {
+			s.references = append(s.references, model.NewFollowsFromRef(parent.traceID, parent.spanID))
+		} else {
+			s.references = append(s.references, model.NewChildOfRef(parent.traceID, parent.spanID))
+		}
+	}
+
+	t.mu.Lock()
+	if s.context.traceID == (model.TraceID{}) {
+		s.context.traceID = model.NewTraceID(t.rand.Uint64(), t.rand.Uint64())
+	}
+	s.context.spanID = model.NewSpanID(t.rand.Uint64())
+	t.mu.Unlock()
+
+	for key, value := range options.Tags {
+		s.SetTag(key, value)
+	}
+
+	return s
+}
+
+func (t *Tracer) Inject(sm opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	return opentracing.ErrUnsupportedFormat
+}
+
+func (t *Tracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	return nil, opentracing.ErrSpanContextNotFound
+}
+
+type spanContext struct {
+	traceID model.TraceID
+	spanID  model.SpanID
+}
+
+// ForeachBaggageItem does nothing as baggage isn't supported.
+func (c spanContext) ForeachBaggageItem(handler func(k, v string) bool) {}
+
+type span struct {
+	tracer        *Tracer
+	context       spanContext
+	references    []model.SpanRef
+	start         time.Time
+	mu            sync.Mutex
+	operationName string
+	tags          []model.KeyValue
+	logs          []model.Log
+	finished      bool
+}
+
+func (s *span) Finish() {
+	s.FinishWithOptions(opentracing.FinishOptions{})
+}
+
+func (s *span) FinishWithOptions(opts opentracing.FinishOptions) {
+	finish := opts.FinishTime
+	if finish.IsZero() {
+		finish = time.Now()
+	}
+	for _, record := range opts.LogRecords {
+		s.log(record.Timestamp, record.Fields)
+	}
+	for _, data := range opts.BulkLogData {
+		record := data.ToLogRecord()
+		s.log(record.Timestamp, record.Fields)
+	}
+
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	reported := &model.Span{
+		TraceID:       s.context.traceID,
+		SpanID:        s.context.spanID,
+		OperationName: s.operationName,
+		References:    s.references,
+		Flags:         model.SampledFlag,
+		StartTime:     s.start,
+		Duration:      finish.Sub(s.start),
+		Tags:          s.tags,
+		Logs:          s.logs,
+		Process:       s.tracer.process,
+	}
+	s.mu.Unlock()
+
+	s.tracer.reporter.report(reported)
+}
+
+func (s *span) Context() opentracing.SpanContext {
+	return s.context
+}
+
+func (s *span) SetOperationName(operationName string) opentracing.Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.operationName = operationName
+	return s
+}
+
+func (s *span) SetTag(key string, value interface{}) opentracing.Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tags = append(s.tags, keyValue(key, value))
+	return s
+}
+
+func (s *span) LogFields(fields ...log.Field) {
+	s.log(time.Now(), fields)
+}
+
+func (s *span) LogKV(alternatingKeyValues ...interface{}) {
+	fields, err := log.InterleavedKVToFields(alternatingKeyValues...)
+	if err != nil {
+		fields = []log.Field{log.Error(err)}
+	}
+	s.log(time.Now(), fields)
+}
+
+func (s *span) log(timestamp time.Time, fields []log.Field) {
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	entry := model.Log{Timestamp: timestamp}
+	for _, field := range fields {
+		entry.Fields = append(entry.Fields, keyValue(field.Key(), field.Value()))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.logs = append(s.logs, entry)
+}
+
+// SetBaggageItem does nothing as baggage isn't supported.
+func (s *span) SetBaggageItem(restrictedKey, value string) opentracing.Span {
+	return s
+}
+
+func (s *span) BaggageItem(restrictedKey string) string {
+	return ""
+}
+
+func (s *span) Tracer() opentracing.Tracer {
+	return s.tracer
+}
+
+func (s *span) LogEvent(event string) {
+	s.Log(opentracing.LogData{Event: event})
+}
+
+func (s *span) LogEventWithPayload(event string, payload interface{}) {
+	s.Log(opentracing.LogData{Event: event, Payload: payload})
+}
+
+func (s *span) Log(data opentracing.LogData) {
+	record := data.ToLogRecord()
+	s.log(record.Timestamp, record.Fields)
+}
+
+// keyValue converts a tag or log field to a Jaeger key value, values of other types are formatted as strings.
+func keyValue(key string, value interface{}) model.KeyValue {
+	switch v := value.(type) {
+	case string:
+		return model.String(key, v)
+	case bool:
+		return model.Bool(key, v)
+	case int:
+		return model.Int64(key, int64(v))
+	case int32:
+		return model.Int64(key, int64(v))
+	case int64:
+		return model.Int64(key, v)
+	case uint16:
+		return model.Int64(key, int64(v))
+	case uint32:
+		return model.Int64(key, int64(v))
+	case float32:
+		return model.Float64(key, float64(v))
+	case float64:
+		return model.Float64(key, v)
+	case error:
+		return model.String(key, v.Error())
+	}
+
+	return model.String(key, fmt.Sprint(value))
+}
@@ -0,0 +1,210 @@
+package setup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/httpclient"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// ftsPort is the port that the search service's REST API listens on.
+const ftsPort = "8094"
+
+// FTSIndex describes a search index over span documents.
+type FTSIndex struct {
+	Name       string
+	Bucket     string
+	Scope      string
+	Collection string
+	Partitions int
+	Replicas   int
+}
+
+// FTSIndexFromOptions describes the search index implied by the plugin's configuration.
+func FTSIndexFromOptions(opts options.Options) FTSIndex {
+	return FTSIndex{
+		Name:       opts.FTSIndexName,
+		Bucket:     opts.BucketName,
+		Scope:      opts.Scope,
+		Collection: opts.SpanCollection,
+		Partitions: 1,
+	}
+}
+
+// Definition returns the index definition sent to the search service. Only span documents are indexed: tag keys,
+// string tag values, the searchable tags, service and operation names and span kinds are indexed whole with the
+// keyword analyzer so that they're matched exactly, start times as datetimes and durations as numbers. Searchable tags
+// are also stored with their term vectors so that searches can report what matched. Spans in a named collection are
+// mapped by collection, which needs Couchbase Server 7.0 or above, and spans in the default collection by their type
+// field.
+func (i FTSIndex) Definition() map[string]interface{} {
+	keyword := func() map[string]interface{} {
+		return field("text", map[string]interface{}{"analyzer": "keyword"})
+	}
+	keyValues := map[string]interface{}{
+		"enabled": true,
+		"dynamic": false,
+		"properties": map[string]interface{}{
+			"key":   keyword(),
+			"v_str": keyword(),
+		},
+	}
+	span := map[string]interface{}{
+		"enabled": true,
+		"dynamic": false,
+		"properties": map[string]interface{}{
+			"operation_name": keyword(),
+			"span_kind":      keyword(),
+			"processed_tags": field("text", map[string]interface{}{"analyzer": "keyword", "store": true, "include_term_vectors": true}),
+			"start_time":     field("datetime", nil),
+			"duration":       field("number", nil),
+			"tags":           keyValues,
+			"process": map[string]interface{}{
+				"enabled": true,
+				"dynamic": false,
+				"properties": map[string]interface{}{
+					"service_name": keyword(),
+					"tags":         keyValues,
+				},
+			},
+		},
+	}
+
+	sourceType := "couchbase"
+	docConfig := map[string]interface{}{"mode": "type_field", "type_field": "type"}
+	typeName := "span"
+	if !isDefaultCollection(i.Scope, i.Collection) {
+		sourceType = "gocbcore"
+		docConfig["mode"] = "scope.collection.type_field"
+		typeName = i.Scope + "." + i.Collection + ".span"
+	}
+
+	return map[string]interface{}{
+		"type":       "fulltext-index",
+		"name":       i.Name,
+		"sourceType": sourceType,
+		"sourceName": i.Bucket,
+		"planParams": map[string]interface{}{
+			"indexPartitions": i.Partitions,
+			"numReplicas":     i.Replicas,
+		},
+		"params": map[string]interface{}{
+			"doc_config": docConfig,
+			"mapping": map[string]interface{}{
+				"default_mapping":   map[string]interface{}{"enabled": false},
+				"default_analyzer":  "keyword",
+				"default_type":      "_default",
+				"index_dynamic":     false,
+				"store_dynamic":     false,
+				"docvalues_dynamic": false,
+				"types": map[string]interface{}{
+					typeName: span,
+				},
+			},
+			"store": map[string]interface{}{
+				"indexType": "scorch",
+			},
+		},
+	}
+}
+
+// field maps a single field of the given type, with any extra settings.
+func field(fieldType string, settings map[string]interface{}) map[string]interface{} {
+	f := map[string]interface{}{
+		"type":  fieldType,
+		"index": true,
+	}
+	for key, value := range settings {
+		f[key] = value
+	}
+
+	return map[string]interface{}{
+		"enabled": true,
+		"dynamic": false,
+		"fields":  []interface{}{f},
+	}
+}
+
+// CreateFTSIndex creates the search index through the search service's REST API, leaving an index that already
+// exists alone unless replace is set.
+func CreateFTSIndex(index FTSIndex, replace bool, opts options.Options, conn string, client httpclient.Client, logger hclog.Logger) error {
+	body, err := json.Marshal(index.Definition())
+	if err != nil {
+		return err
+	}
+
+	uri := fmt.Sprintf("http://%s:%s/api/index/%s", conn, ftsPort, url.PathEscape(index.Name))
+	if replace {
+		err := deleteFTSIndex(uri, opts, client)
+		if err != nil {
+			return errors.Wrapf(err, "failed to delete search index %s", index.Name)
+		}
+	}
+
+	req, err := http.NewRequest("PUT", uri, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("content-type", "application/json")
+	req.SetBasicAuth(opts.Username, opts.Password)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		logger.Info("created search index", "name", index.Name)
+		return nil
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.New("request failed, no error detail could be determined")
+	}
+	if strings.Contains(string(respBody), "already exists") {
+		logger.Debug("skipping creation, already exists", "uri", uri, "name", index.Name)
+		return nil
+	}
+
+	return errors.Errorf("failed to create search index %s: %s", index.Name, respBody)
+}
+
+// deleteFTSIndex deletes the search index, an index that doesn't exist is ignored.
+func deleteFTSIndex(uri string, opts options.Options, client httpclient.Client) error {
+	req, err := http.NewRequest("DELETE", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(opts.Username, opts.Password)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 || resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if strings.Contains(string(respBody), "not found") {
+		return nil
+	}
+
+	return errors.Errorf("request failed: %s", respBody)
+}
+
+func isDefaultCollection(scope, collection string) bool {
+	return (scope == "" || scope == "_default") && (collection == "" || collection == "_default")
+}
@@ -0,0 +1,226 @@
+package setup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/httpclient"
+	"github.com/chvck/couchbase-jaeger-storage-plugin/options"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const defaultBucketRAMQuotaMB = 512
+
+// Schema describes the buckets, scopes and collections that the plugin stores documents in.
+type Schema struct {
+	Buckets []BucketSchema `mapstructure:"buckets"`
+}
+
+// BucketSchema describes a bucket and the scopes within it.
+type BucketSchema struct {
+	Name       string        `mapstructure:"name"`
+	RAMQuotaMB int           `mapstructure:"ramQuotaMB"`
+	Replicas   int           `mapstructure:"replicas"`
+	Scopes     []ScopeSchema `mapstructure:"scopes"`
+}
+
+// ScopeSchema describes a scope and the collections within it.
+type ScopeSchema struct {
+	Name        string   `mapstructure:"name"`
+	Collections []string `mapstructure:"collections"`
+}
+
+// LoadSchema reads a schema definition from a YAML or JSON file.
+func LoadSchema(path string) (Schema, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+
+	var schema Schema
+	err := v.ReadInConfig()
+	if err != nil {
+		return schema, errors.Wrap(err, "failed to read schema file")
+	}
+
+	err = v.Unmarshal(&schema)
+	if err != nil {
+		return schema, errors.Wrap(err, "failed to parse schema file")
+	}
+
+	return schema, nil
+}
+
+// SchemaFromOptions builds the schema implied by the plugin's configuration.
+func SchemaFromOptions(opts options.Options) Schema {
+	bucket := BucketSchema{
+		Name:       opts.BucketName,
+		RAMQuotaMB: defaultBucketRAMQuotaMB,
+	}
+	if opts.Scope != "" {
+		collections := []string{opts.SpanCollection}
+		if opts.DependencyCollection != opts.SpanCollection {
+			collections = append(collections, opts.DependencyCollection)
+		}
+		bucket.Scopes = []ScopeSchema{{Name: opts.Scope, Collections: collections}}
+	}
+
+	schema := Schema{
+		Buckets: []BucketSchema{bucket},
+	}
+
+	// Routed services are stored in their own bucket, which has the same scope and collections as the plugin's bucket,
+	// or in their own collection, or both.
+	for _, route := range opts.Routes {
+		name := opts.BucketName
+		if route.Bucket != "" {
+			name = route.Bucket
+		}
+		b := schema.bucket(name)
+		if route.Bucket != "" && b.Scopes == nil {
+			for _, scope := range bucket.Scopes {
+				for _, collection := range scope.Collections {
+					b.addCollection(scope.Name, collection)
+				}
+			}
+		}
+		if route.Collection != "" {
+			b.addCollection(opts.Scope, route.Collection)
+		}
+	}
+
+	return schema
+}
+
+// bucket returns the schema of the named bucket, adding it if it isn't in the schema.
+func (s *Schema) bucket(name string) *BucketSchema {
+	for i := range s.Buckets {
+		if s.Buckets[i].Name == name {
+			return &s.Buckets[i]
+		}
+	}
+
+	s.Buckets = append(s.Buckets, BucketSchema{Name: name, RAMQuotaMB: defaultBucketRAMQuotaMB})
+	return &s.Buckets[len(s.Buckets)-1]
+}
+
+// addCollection adds the collection to the scope, adding the scope if it isn't in the bucket. An empty scope means
+// the default scope.
+func (b *BucketSchema) addCollection(scope, collection string) {
+	if scope == "" {
+		scope = "_default"
+	}
+
+	for i := range b.Scopes {
+		if b.Scopes[i].Name != scope {
+			continue
+		}
+		for _, c := range b.Scopes[i].Collections {
+			if c == collection {
+				return
+			}
+		}
+		b.Scopes[i].Collections = append(b.Scopes[i].Collections, collection)
+		return
+	}
+
+	b.Scopes = append(b.Scopes, ScopeSchema{Name: scope, Collections: []string{collection}})
+}
+
+// ApplySchema creates any buckets, scopes and collections in the schema that do not already exist.
+func ApplySchema(schema Schema, opts options.Options, conn string, client httpclient.Client, logger hclog.Logger) error {
+	for _, bucket := range schema.Buckets {
+		ramQuota := bucket.RAMQuotaMB
+		if ramQuota == 0 {
+			ramQuota = defaultBucketRAMQuotaMB
+		}
+
+		form := url.Values{}
+		form.Set("name", bucket.Name)
+		form.Set("ramQuotaMB", strconv.Itoa(ramQuota))
+		form.Set("replicaNumber", strconv.Itoa(bucket.Replicas))
+		form.Set("bucketType", "couchbase")
+		err := createIfNotExists(
+			client,
+			fmt.Sprintf("http://%s:8091/pools/default/buckets", conn),
+			opts,
+			form,
+			logger,
+		)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create bucket %s", bucket.Name)
+		}
+
+		for _, scope := range bucket.Scopes {
+			form := url.Values{}
+			form.Set("name", scope.Name)
+			err := createIfNotExists(
+				client,
+				fmt.Sprintf("http://%s:8091/pools/default/buckets/%s/scopes", conn, url.PathEscape(bucket.Name)),
+				opts,
+				form,
+				logger,
+			)
+			if err != nil {
+				return errors.Wrapf(err, "failed to create scope %s", scope.Name)
+			}
+
+			for _, collection := range scope.Collections {
+				form := url.Values{}
+				form.Set("name", collection)
+				err := createIfNotExists(
+					client,
+					fmt.Sprintf(
+						"http://%s:8091/pools/default/buckets/%s/scopes/%s/collections",
+						conn,
+						url.PathEscape(bucket.Name),
+						url.PathEscape(scope.Name),
+					),
+					opts,
+					form,
+					logger,
+				)
+				if err != nil {
+					return errors.Wrapf(err, "failed to create collection %s", collection)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// createIfNotExists posts the form to the management API, treating an "already exists" response as success.
+func createIfNotExists(client httpclient.Client, uri string, opts options.Options, form url.Values, logger hclog.Logger) error {
+	req, err := http.NewRequest("POST", uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("content-type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(opts.Username, opts.Password)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.New("request failed, no error detail could be determined")
+	}
+	if strings.Contains(string(body), "already exists") {
+		logger.Debug("skipping creation, already exists", "uri", uri, "name", form.Get("name"))
+		return nil
+	}
+
+	return fmt.Errorf("request failed: %s", body)
+}
@@ -86,11 +86,23 @@ func Run(opts options.Options, conn string, client httpclient.Client, logger hcl
 
 	time.Sleep(1 * time.Second)
 
+	// The dataset is created in the configured dataverse, which is created first if it isn't the default.
+	dataverse := "Default"
+	statement := ""
+	if opts.AnalyticsDataverse != "" {
+		dataverse = opts.AnalyticsDataverse
+		statement = fmt.Sprintf("CREATE DATAVERSE %s IF NOT EXISTS; ", plugin.QuoteIdentifier(dataverse))
+	}
+	dataset := opts.BucketName
+	if opts.AnalyticsDataset != "" {
+		dataset = opts.AnalyticsDataset
+	}
+
 	analyticsQuery := struct {
 		Statement string `json:"statement"`
 		Timeout   string `json:"timeout"`
 	}{
-		Statement: fmt.Sprintf("CREATE DATASET `%s` ON `%s`", opts.BucketName, opts.BucketName),
+		Statement: statement + fmt.Sprintf("CREATE DATASET %s.%s ON %s", plugin.QuoteIdentifier(dataverse), plugin.QuoteIdentifier(dataset), plugin.QuoteIdentifier(opts.BucketName)),
 		Timeout:   (500 * time.Millisecond).String(),
 	}
 
@@ -115,7 +127,7 @@ func Run(opts options.Options, conn string, client httpclient.Client, logger hcl
 	linkQuery := struct {
 		Statement string `json:"statement"`
 	}{
-		"CONNECT LINK Local",
+		fmt.Sprintf("CONNECT LINK %s.%s", plugin.QuoteIdentifier(dataverse), plugin.QuoteIdentifier(opts.AnalyticsLink)),
 	}
 
 	body, err = json.Marshal(linkQuery)
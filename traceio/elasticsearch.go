@@ -0,0 +1,59 @@
+package traceio
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+	"github.com/pkg/errors"
+)
+
+// defaultTagDotReplacement is the character that Jaeger's Elasticsearch storage replaces dots in tag keys with by
+// default, when tags are stored as fields.
+const defaultTagDotReplacement = "@"
+
+// NewElasticsearchReader returns a reader of the span documents of Jaeger's Elasticsearch storage, one document per
+// line, either bare or as search hits with the document in _source, as tools such as elasticdump export them. Each
+// span is read as a trace of its own.
+func NewElasticsearchReader(r io.Reader, tagDotReplacement string) Reader {
+	return &elasticsearchReader{
+		lines:    newLineReader(r),
+		toDomain: dbmodel.NewToDomain(tagDotReplacement),
+	}
+}
+
+type elasticsearchReader struct {
+	lines    *lineReader
+	toDomain dbmodel.ToDomain
+}
+
+func (r *elasticsearchReader) Read() (*model.Trace, error) {
+	var hit struct {
+		Source json.RawMessage `json:"_source"`
+	}
+	line, err := r.lines.next()
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(line, &hit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid span on line %d", r.lines.line)
+	}
+	if len(hit.Source) > 0 {
+		line = hit.Source
+	}
+
+	var span dbmodel.Span
+	err = json.Unmarshal(line, &span)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid span on line %d", r.lines.line)
+	}
+
+	domainSpan, err := r.toDomain.SpanToDomain(&span)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid span on line %d", r.lines.line)
+	}
+
+	return &model.Trace{Spans: []*model.Span{domainSpan}}, nil
+}
@@ -0,0 +1,204 @@
+package traceio
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/jaegertracing/jaeger/model"
+	uiconv "github.com/jaegertracing/jaeger/model/converter/json"
+	ui "github.com/jaegertracing/jaeger/model/json"
+	"github.com/pkg/errors"
+)
+
+type jaegerWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *jaegerWriter) Write(trace *model.Trace) error {
+	return w.encoder.Encode(uiconv.FromDomain(trace))
+}
+
+type jaegerReader struct {
+	lines *lineReader
+}
+
+func (r *jaegerReader) Read() (*model.Trace, error) {
+	var trace ui.Trace
+	err := r.lines.decode(&trace)
+	if err != nil {
+		return nil, err
+	}
+
+	return jaegerToDomain(&trace)
+}
+
+// DecodeQueryResponse reads the traces in a response from jaeger-query's HTTP API, which holds the traces in the same
+// format that the Jaeger UI downloads them in.
+func DecodeQueryResponse(r io.Reader) ([]*model.Trace, error) {
+	var response struct {
+		Data []ui.Trace `json:"data"`
+	}
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	err := decoder.Decode(&response)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid response")
+	}
+
+	traces := make([]*model.Trace, 0, len(response.Data))
+	for i := range response.Data {
+		trace, err := jaegerToDomain(&response.Data[i])
+		if err != nil {
+			return nil, err
+		}
+		traces = append(traces, trace)
+	}
+
+	return traces, nil
+}
+
+// jaegerToDomain converts a trace from the Jaeger UI's format, which Jaeger can only convert to.
+func jaegerToDomain(trace *ui.Trace) (*model.Trace, error) {
+	processes := make(map[ui.ProcessID]*model.Process, len(trace.Processes))
+	for id, process := range trace.Processes {
+		tags, err := jaegerTagsToDomain(process.Tags)
+		if err != nil {
+			return nil, err
+		}
+		processes[id] = model.NewProcess(process.ServiceName, tags)
+	}
+
+	spans := make([]*model.Span, 0, len(trace.Spans))
+	for _, s := range trace.Spans {
+		traceID, err := model.TraceIDFromString(string(s.TraceID))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trace ID %q", s.TraceID)
+		}
+		spanID, err := model.SpanIDFromString(string(s.SpanID))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid span ID %q", s.SpanID)
+		}
+
+		span := &model.Span{
+			TraceID:       traceID,
+			SpanID:        spanID,
+			OperationName: s.OperationName,
+			Flags:         model.Flags(s.Flags),
+			StartTime:     model.EpochMicrosecondsAsTime(s.StartTime),
+			Duration:      model.MicrosecondsAsDuration(s.Duration),
+			ProcessID:     string(s.ProcessID),
+			Warnings:      s.Warnings,
+		}
+
+		for _, ref := range s.References {
+			refTraceID, err := model.TraceIDFromString(string(ref.TraceID))
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid trace ID %q", ref.TraceID)
+			}
+			refSpanID, err := model.SpanIDFromString(string(ref.SpanID))
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid span ID %q", ref.SpanID)
+			}
+			refType := model.ChildOf
+			if ref.RefType == ui.FollowsFrom {
+				refType = model.FollowsFrom
+			}
+			span.References = append(span.References, model.SpanRef{
+				TraceID: refTraceID,
+				SpanID:  refSpanID,
+				RefType: refType,
+			})
+		}
+
+		span.Tags, err = jaegerTagsToDomain(s.Tags)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range s.Logs {
+			fields, err := jaegerTagsToDomain(l.Fields)
+			if err != nil {
+				return nil, err
+			}
+			span.Logs = append(span.Logs, model.Log{
+				Timestamp: model.EpochMicrosecondsAsTime(l.Timestamp),
+				Fields:    fields,
+			})
+		}
+
+		span.Process = processes[s.ProcessID]
+		if s.Process != nil {
+			tags, err := jaegerTagsToDomain(s.Process.Tags)
+			if err != nil {
+				return nil, err
+			}
+			span.Process = model.NewProcess(s.Process.ServiceName, tags)
+		}
+		if span.Process == nil {
+			return nil, errors.Errorf("span %s has no process", s.SpanID)
+		}
+
+		spans = append(spans, span)
+	}
+
+	return &model.Trace{Spans: spans, Warnings: trace.Warnings}, nil
+}
+
+func jaegerTagsToDomain(tags []ui.KeyValue) ([]model.KeyValue, error) {
+	kvs := make([]model.KeyValue, 0, len(tags))
+	for _, tag := range tags {
+		kv, err := jaegerTagToDomain(tag)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid tag %q", tag.Key)
+		}
+		kvs = append(kvs, kv)
+	}
+
+	return kvs, nil
+}
+
+func jaegerTagToDomain(tag ui.KeyValue) (model.KeyValue, error) {
+	switch tag.Type {
+	case ui.StringType:
+		return model.String(tag.Key, fmt.Sprint(tag.Value)), nil
+	case ui.BoolType:
+		value, ok := tag.Value.(bool)
+		if !ok {
+			return model.KeyValue{}, errors.Errorf("%v is not a bool", tag.Value)
+		}
+		return model.Bool(tag.Key, value), nil
+	case ui.Int64Type:
+		number, ok := tag.Value.(json.Number)
+		if !ok {
+			return model.KeyValue{}, errors.Errorf("%v is not a number", tag.Value)
+		}
+		value, err := number.Int64()
+		if err != nil {
+			return model.KeyValue{}, err
+		}
+		return model.Int64(tag.Key, value), nil
+	case ui.Float64Type:
+		number, ok := tag.Value.(json.Number)
+		if !ok {
+			return model.KeyValue{}, errors.Errorf("%v is not a number", tag.Value)
+		}
+		value, err := number.Float64()
+		if err != nil {
+			return model.KeyValue{}, err
+		}
+		return model.Float64(tag.Key, value), nil
+	case ui.BinaryType:
+		encoded, ok := tag.Value.(string)
+		if !ok {
+			return model.KeyValue{}, errors.Errorf("%v is not base64", tag.Value)
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return model.KeyValue{}, err
+		}
+		return model.Binary(tag.Key, value), nil
+	}
+
+	return model.KeyValue{}, errors.Errorf("unknown tag type %q", tag.Type)
+}
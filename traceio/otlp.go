@@ -0,0 +1,531 @@
+package traceio
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chvck/couchbase-jaeger-storage-plugin/plugin"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/pkg/errors"
+)
+
+// The OTLP span kinds and status codes, OTLP's JSON encoding allows enums to be written as their numbers.
+const (
+	otlpSpanKindUnspecified = 0
+	otlpSpanKindInternal    = 1
+	otlpSpanKindServer      = 2
+	otlpSpanKindClient      = 3
+	otlpSpanKindProducer    = 4
+	otlpSpanKindConsumer    = 5
+
+	otlpStatusOK    = 1
+	otlpStatusError = 2
+
+	otlpServiceNameKey = "service.name"
+	otlpLogEventName   = "log"
+
+	// The tags that the translation of OTLP spans to Jaeger spans records the parts of spans that Jaeger has no
+	// fields for in.
+	otelStatusCodeKey        = "otel.status_code"
+	otelStatusDescriptionKey = "otel.status_description"
+	otelScopeNameKey         = "otel.scope.name"
+	otelScopeVersionKey      = "otel.scope.version"
+	traceStateKey            = "w3c.tracestate"
+)
+
+// otlpStatusCodes are the values of the otel.status_code tag.
+var otlpStatusCodes = map[int]string{
+	otlpStatusOK:    "OK",
+	otlpStatusError: "ERROR",
+}
+
+// otlpKinds maps Jaeger's span.kind tag values to OTLP span kinds.
+var otlpKinds = map[string]int{
+	string(ext.SpanKindRPCServerEnum): otlpSpanKindServer,
+	string(ext.SpanKindRPCClientEnum): otlpSpanKindClient,
+	string(ext.SpanKindProducerEnum):  otlpSpanKindProducer,
+	string(ext.SpanKindConsumerEnum):  otlpSpanKindConsumer,
+	"internal":                        otlpSpanKindInternal,
+}
+
+// The types below are the parts of OTLP's ExportTraceServiceRequest that Jaeger spans map to, following OTLP's JSON
+// encoding. 64 bit integers are encoded as strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	TraceState        string         `json:"traceState,omitempty"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind,omitempty"`
+	StartTimeUnixNano otlpUint64     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   otlpUint64     `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano otlpUint64     `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID    string         `json:"traceId"`
+	SpanID     string         `json:"spanId"`
+	TraceState string         `json:"traceState,omitempty"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string    `json:"stringValue,omitempty"`
+	BoolValue   *bool      `json:"boolValue,omitempty"`
+	IntValue    *otlpInt64 `json:"intValue,omitempty"`
+	DoubleValue *float64   `json:"doubleValue,omitempty"`
+	BytesValue  []byte     `json:"bytesValue,omitempty"`
+}
+
+// otlpInt64 is encoded as a string, as OTLP's JSON encoding requires, but can be decoded from a string or a number.
+type otlpInt64 int64
+
+func (i otlpInt64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(i), 10))
+}
+
+func (i *otlpInt64) UnmarshalJSON(data []byte) error {
+	n, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = otlpInt64(n)
+
+	return nil
+}
+
+// otlpUint64 is encoded as a string, as OTLP's JSON encoding requires, but can be decoded from a string or a number.
+type otlpUint64 uint64
+
+func (i otlpUint64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatUint(uint64(i), 10))
+}
+
+func (i *otlpUint64) UnmarshalJSON(data []byte) error {
+	n, err := strconv.ParseUint(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = otlpUint64(n)
+
+	return nil
+}
+
+type otlpWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *otlpWriter) Write(trace *model.Trace) error {
+	return w.encoder.Encode(otlpFromDomain(trace))
+}
+
+type otlpReader struct {
+	lines *lineReader
+}
+
+func (r *otlpReader) Read() (*model.Trace, error) {
+	var request otlpRequest
+	err := r.lines.decode(&request)
+	if err != nil {
+		return nil, err
+	}
+
+	return otlpToDomain(&request)
+}
+
+// otlpFromDomain converts a trace to an export request, with a resource for each of the trace's processes and a
+// scope for each instrumentation scope within it.
+func otlpFromDomain(trace *model.Trace) *otlpRequest {
+	resources := make(map[string]int)
+	scopes := make(map[string]map[otlpScope]int)
+	request := &otlpRequest{}
+	for _, span := range trace.Spans {
+		process := span.Process
+		if process == nil {
+			process = model.NewProcess("", nil)
+		}
+
+		key := processKey(process)
+		i, ok := resources[key]
+		if !ok {
+			attributes := []otlpKeyValue{otlpString(otlpServiceNameKey, process.ServiceName)}
+			request.ResourceSpans = append(request.ResourceSpans, otlpResourceSpans{
+				Resource: otlpResource{
+					Attributes: append(attributes, otlpAttributes(process.Tags)...),
+				},
+			})
+			i = len(request.ResourceSpans) - 1
+			resources[key] = i
+			scopes[key] = make(map[otlpScope]int)
+		}
+
+		s, scope := otlpSpanFromDomain(span)
+		resource := &request.ResourceSpans[i]
+		j, ok := scopes[key][scope]
+		if !ok {
+			resource.ScopeSpans = append(resource.ScopeSpans, otlpScopeSpans{Scope: scope})
+			j = len(resource.ScopeSpans) - 1
+			scopes[key][scope] = j
+		}
+		resource.ScopeSpans[j].Spans = append(resource.ScopeSpans[j].Spans, s)
+	}
+
+	return request
+}
+
+// processKey identifies a process by its service name and tags.
+func processKey(process *model.Process) string {
+	tags := make([]string, len(process.Tags))
+	for i, tag := range process.Tags {
+		tags[i] = tag.Key + "=" + tag.AsString()
+	}
+	sort.Strings(tags)
+
+	return process.ServiceName + "\x00" + strings.Join(tags, "\x00")
+}
+
+// otlpSpanFromDomain converts a span, returning it along with its instrumentation scope. The tags that carry parts of
+// OTel spans which Jaeger has no fields for are returned to those parts.
+func otlpSpanFromDomain(span *model.Span) (otlpSpan, otlpScope) {
+	s := otlpSpan{
+		TraceID:           otlpTraceID(span.TraceID),
+		SpanID:            otlpSpanID(span.SpanID),
+		Name:              span.OperationName,
+		StartTimeUnixNano: otlpUint64(span.StartTime.UnixNano()),
+		EndTimeUnixNano:   otlpUint64(span.StartTime.Add(span.Duration).UnixNano()),
+	}
+	var scope otlpScope
+
+	// The first parent in the same trace becomes the span's parent and any other references become links, which take
+	// the attributes carried for their reference.
+	links := make(map[int]int)
+	for i, ref := range span.References {
+		if s.ParentSpanID == "" && ref.RefType == model.ChildOf && ref.TraceID == span.TraceID {
+			s.ParentSpanID = otlpSpanID(ref.SpanID)
+			continue
+		}
+		links[i] = len(s.Links)
+		s.Links = append(s.Links, otlpLink{
+			TraceID: otlpTraceID(ref.TraceID),
+			SpanID:  otlpSpanID(ref.SpanID),
+		})
+	}
+
+	var tags []model.KeyValue
+	for _, tag := range span.Tags {
+		if i, key, ok := plugin.ParseLinkAttribute(tag.Key); ok {
+			if l, ok := links[i]; ok {
+				link := &s.Links[l]
+				if key == traceStateKey {
+					link.TraceState = tag.AsString()
+				} else {
+					tag.Key = key
+					link.Attributes = append(link.Attributes, otlpAttributes([]model.KeyValue{tag})...)
+				}
+				continue
+			}
+		}
+
+		switch tag.Key {
+		case string(ext.SpanKind):
+			s.Kind = otlpKinds[tag.AsString()]
+			continue
+		case string(ext.Error):
+			if tag.AsString() == "true" {
+				s.status().Code = otlpStatusError
+				continue
+			}
+		case otelStatusCodeKey:
+			for code, name := range otlpStatusCodes {
+				if tag.AsString() == name {
+					s.status().Code = code
+				}
+			}
+			continue
+		case otelStatusDescriptionKey:
+			s.status().Message = tag.AsString()
+			continue
+		case otelScopeNameKey:
+			scope.Name = tag.AsString()
+			continue
+		case otelScopeVersionKey:
+			scope.Version = tag.AsString()
+			continue
+		case traceStateKey:
+			s.TraceState = tag.AsString()
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	s.Attributes = otlpAttributes(tags)
+
+	for _, log := range span.Logs {
+		event := otlpEvent{
+			TimeUnixNano: otlpUint64(log.Timestamp.UnixNano()),
+			Name:         otlpLogEventName,
+		}
+		var fields []model.KeyValue
+		for _, field := range log.Fields {
+			if field.Key == plugin.EventNameField {
+				event.Name = field.AsString()
+				continue
+			}
+			if field.Key == plugin.EventMarkerField {
+				continue
+			}
+			fields = append(fields, field)
+		}
+		event.Attributes = otlpAttributes(fields)
+		s.Events = append(s.Events, event)
+	}
+
+	return s, scope
+}
+
+// status returns the span's status, adding one if it has none.
+func (s *otlpSpan) status() *otlpStatus {
+	if s.Status == nil {
+		s.Status = &otlpStatus{}
+	}
+
+	return s.Status
+}
+
+func otlpAttributes(tags []model.KeyValue) []otlpKeyValue {
+	attributes := make([]otlpKeyValue, 0, len(tags))
+	for _, tag := range tags {
+		var value otlpAnyValue
+		switch tag.VType {
+		case model.StringType:
+			str := tag.VStr
+			value.StringValue = &str
+		case model.BoolType:
+			b := tag.Bool()
+			value.BoolValue = &b
+		case model.Int64Type:
+			i := otlpInt64(tag.Int64())
+			value.IntValue = &i
+		case model.Float64Type:
+			f := tag.Float64()
+			value.DoubleValue = &f
+		case model.BinaryType:
+			value.BytesValue = tag.Binary()
+		}
+		attributes = append(attributes, otlpKeyValue{Key: tag.Key, Value: value})
+	}
+
+	return attributes
+}
+
+func otlpString(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+func otlpTraceID(traceID model.TraceID) string {
+	return fmt.Sprintf("%016x%016x", traceID.High, traceID.Low)
+}
+
+func otlpSpanID(spanID model.SpanID) string {
+	return fmt.Sprintf("%016x", uint64(spanID))
+}
+
+// otlpToDomain converts an export request to a trace, the request's spans must all belong to the same trace.
+func otlpToDomain(request *otlpRequest) (*model.Trace, error) {
+	trace := &model.Trace{}
+	for _, resourceSpans := range request.ResourceSpans {
+		process := &model.Process{}
+		for _, attribute := range resourceSpans.Resource.Attributes {
+			if attribute.Key == otlpServiceNameKey && attribute.Value.StringValue != nil {
+				process.ServiceName = *attribute.Value.StringValue
+				continue
+			}
+			process.Tags = append(process.Tags, otlpTagToDomain(attribute))
+		}
+
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			for _, s := range scopeSpans.Spans {
+				span, err := otlpSpanToDomain(s)
+				if err != nil {
+					return nil, err
+				}
+				if scopeSpans.Scope.Name != "" {
+					span.Tags = append(span.Tags, model.String(otelScopeNameKey, scopeSpans.Scope.Name))
+				}
+				if scopeSpans.Scope.Version != "" {
+					span.Tags = append(span.Tags, model.String(otelScopeVersionKey, scopeSpans.Scope.Version))
+				}
+				span.Process = process
+				trace.Spans = append(trace.Spans, span)
+			}
+		}
+	}
+
+	return trace, nil
+}
+
+func otlpSpanToDomain(s otlpSpan) (*model.Span, error) {
+	traceID, err := otlpTraceIDToDomain(s.TraceID)
+	if err != nil {
+		return nil, err
+	}
+	spanID, err := otlpSpanIDToDomain(s.SpanID)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Unix(0, int64(s.StartTimeUnixNano)).UTC()
+	span := &model.Span{
+		TraceID:       traceID,
+		SpanID:        spanID,
+		OperationName: s.Name,
+		StartTime:     start,
+		Duration:      time.Unix(0, int64(s.EndTimeUnixNano)).Sub(start),
+	}
+
+	if s.ParentSpanID != "" {
+		parentID, err := otlpSpanIDToDomain(s.ParentSpanID)
+		if err != nil {
+			return nil, err
+		}
+		span.References = append(span.References, model.NewChildOfRef(traceID, parentID))
+	}
+	for _, link := range s.Links {
+		linkTraceID, err := otlpTraceIDToDomain(link.TraceID)
+		if err != nil {
+			return nil, err
+		}
+		linkSpanID, err := otlpSpanIDToDomain(link.SpanID)
+		if err != nil {
+			return nil, err
+		}
+		i := len(span.References)
+		span.References = append(span.References, model.NewFollowsFromRef(linkTraceID, linkSpanID))
+		if link.TraceState != "" {
+			span.Tags = append(span.Tags, model.String(plugin.LinkAttributeKey(i, traceStateKey), link.TraceState))
+		}
+		for _, attribute := range link.Attributes {
+			attribute.Key = plugin.LinkAttributeKey(i, attribute.Key)
+			span.Tags = append(span.Tags, otlpTagToDomain(attribute))
+		}
+	}
+
+	for kind, otlpKind := range otlpKinds {
+		if otlpKind == s.Kind && s.Kind != otlpSpanKindUnspecified {
+			span.Tags = append(span.Tags, model.String(string(ext.SpanKind), kind))
+		}
+	}
+	if s.Status != nil {
+		if s.Status.Code == otlpStatusError {
+			span.Tags = append(span.Tags, model.Bool(string(ext.Error), true))
+		}
+		if name, ok := otlpStatusCodes[s.Status.Code]; ok {
+			span.Tags = append(span.Tags, model.String(otelStatusCodeKey, name))
+		}
+		if s.Status.Message != "" {
+			span.Tags = append(span.Tags, model.String(otelStatusDescriptionKey, s.Status.Message))
+		}
+	}
+	if s.TraceState != "" {
+		span.Tags = append(span.Tags, model.String(traceStateKey, s.TraceState))
+	}
+	for _, attribute := range s.Attributes {
+		span.Tags = append(span.Tags, otlpTagToDomain(attribute))
+	}
+
+	for _, event := range s.Events {
+		attributes := make([]model.KeyValue, len(event.Attributes))
+		for i, attribute := range event.Attributes {
+			attributes[i] = otlpTagToDomain(attribute)
+		}
+		span.Logs = append(span.Logs, plugin.EventLog(event.Name, time.Unix(0, int64(event.TimeUnixNano)).UTC(), attributes))
+	}
+
+	return span, nil
+}
+
+// otlpTagToDomain converts an attribute to a tag, values with types that Jaeger doesn't have, such as arrays, become
+// empty strings.
+func otlpTagToDomain(attribute otlpKeyValue) model.KeyValue {
+	value := attribute.Value
+	switch {
+	case value.StringValue != nil:
+		return model.String(attribute.Key, *value.StringValue)
+	case value.BoolValue != nil:
+		return model.Bool(attribute.Key, *value.BoolValue)
+	case value.IntValue != nil:
+		return model.Int64(attribute.Key, int64(*value.IntValue))
+	case value.DoubleValue != nil:
+		return model.Float64(attribute.Key, *value.DoubleValue)
+	case value.BytesValue != nil:
+		return model.Binary(attribute.Key, value.BytesValue)
+	}
+
+	return model.String(attribute.Key, "")
+}
+
+func otlpTraceIDToDomain(id string) (model.TraceID, error) {
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != 16 {
+		return model.TraceID{}, errors.Errorf("invalid trace ID %q", id)
+	}
+
+	return model.TraceIDFromString(id)
+}
+
+func otlpSpanIDToDomain(id string) (model.SpanID, error) {
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != 8 {
+		return 0, errors.Errorf("invalid span ID %q", id)
+	}
+
+	return model.SpanIDFromString(id)
+}
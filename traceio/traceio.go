@@ -0,0 +1,109 @@
+// Package traceio reads and writes traces as newline delimited files, one trace per line, so that traces can be
+// moved between clusters.
+package traceio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// JaegerFormat is the JSON format that the Jaeger UI downloads and loads traces in.
+	JaegerFormat = "jaeger"
+	// OTLPFormat is the JSON encoding of OTLP trace export requests.
+	OTLPFormat = "otlp"
+	// ElasticsearchFormat is the span documents of Jaeger's Elasticsearch storage, which can only be read.
+	ElasticsearchFormat = "es"
+
+	// maximumLineSize is the largest trace that can be read, traces are held on a single line.
+	maximumLineSize = 64 * 1024 * 1024
+)
+
+// Writer writes traces to a file.
+type Writer interface {
+	Write(trace *model.Trace) error
+}
+
+// Reader reads traces from a file, returning io.EOF once every trace has been read.
+type Reader interface {
+	Read() (*model.Trace, error)
+}
+
+// NewWriter returns a writer of traces in the format.
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	encoder := json.NewEncoder(w)
+	switch format {
+	case JaegerFormat:
+		return &jaegerWriter{encoder: encoder}, nil
+	case OTLPFormat:
+		return &otlpWriter{encoder: encoder}, nil
+	}
+
+	return nil, errors.Errorf("unknown format %q", format)
+}
+
+// NewReader returns a reader of traces in the format.
+func NewReader(format string, r io.Reader) (Reader, error) {
+	switch format {
+	case JaegerFormat:
+		return &jaegerReader{lines: newLineReader(r)}, nil
+	case OTLPFormat:
+		return &otlpReader{lines: newLineReader(r)}, nil
+	case ElasticsearchFormat:
+		return NewElasticsearchReader(r, defaultTagDotReplacement), nil
+	}
+
+	return nil, errors.Errorf("unknown format %q", format)
+}
+
+// lineReader reads the lines of a file, skipping blank lines.
+type lineReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newLineReader(r io.Reader) *lineReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maximumLineSize)
+
+	return &lineReader{scanner: scanner}
+}
+
+// next returns the next line, or io.EOF at the end of the file.
+func (r *lineReader) next() ([]byte, error) {
+	for r.scanner.Scan() {
+		r.line++
+		if len(r.scanner.Bytes()) > 0 {
+			return r.scanner.Bytes(), nil
+		}
+	}
+	err := r.scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, io.EOF
+}
+
+// decode unmarshals the next line into v. Numbers are decoded as json.Number so that large integers don't lose
+// precision.
+func (r *lineReader) decode(v interface{}) error {
+	line, err := r.next()
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	err = decoder.Decode(v)
+	if err != nil {
+		return errors.Wrapf(err, "invalid trace on line %d", r.line)
+	}
+
+	return nil
+}